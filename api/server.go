@@ -1,9 +1,11 @@
 package api
 
 import (
+	"context"
 	"encoding/hex"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/LeiZhou-97/blockchain/core"
 	"github.com/LeiZhou-97/blockchain/types"
@@ -29,36 +31,151 @@ type Block struct {
 	Timestamp     int64
 	Validator     string
 	Signature string
+	// Commit is set for blocks decided by BFT consensus.
+	Commit *Commit
+	// Evidence holds the hashes of the evidence the block carries.
+	Evidence []string
 
 	TxResponse TxResponse
 }
 
+// Evidence is a validator that signed two blocks at Height, carried by the
+// block IncludedIn.
+type Evidence struct {
+	Hash      string
+	Validator string
+	Height    uint32
+	// Blocks are the hashes of the two blocks the validator signed.
+	Blocks         []string
+	IncludedIn     string
+	IncludedHeight uint32
+}
+
+// Checkpoint is the highest block of the node that can not be reverted
+// anymore. Another node can sync from it by pinning Height and Hash.
+type Checkpoint struct {
+	Height uint32
+	Hash   string
+	// Commit is set if the consensus engine signed the block.
+	Commit *Commit
+}
+
+type Commit struct {
+	Round uint32
+	// Signers are the addresses of the validators that precommitted the
+	// block.
+	Signers []string
+}
+
+type Validator struct {
+	Address   string
+	PublicKey string
+	Power     uint64
+}
+
+// ValidatorSet is the validator set that is active at Height.
+type ValidatorSet struct {
+	Height uint32
+	// Epoch is the epoch of Height, validator updates take effect after
+	// its last block.
+	Epoch      uint32
+	TotalPower uint64
+	Validators []Validator
+}
+
+type Peer struct {
+	ID         string
+	NodeID     string
+	Addr       string
+	ListenAddr string
+	Outgoing   bool
+	Score      int
+	// RTT is the round trip time to the peer, 0 if it is not known yet.
+	RTT time.Duration
+}
+
+type Ban struct {
+	Peer   string
+	Until  int64
+	Reason string
+}
+
+type SyncStatus struct {
+	Syncing       bool
+	CurrentHeight uint32
+	// TargetHeight is the highest height we know of in the network.
+	TargetHeight uint32
+	// Progress is CurrentHeight in percent of TargetHeight.
+	Progress float64
+	// Peers is the number of peers we currently download blocks from.
+	Peers int
+	// FinalizedHeight is the highest block that can not be reverted
+	// anymore.
+	FinalizedHeight uint32
+}
+
+// SyncReporter gives the api access to the chain synchronization.
+type SyncReporter interface {
+	SyncStatus() SyncStatus
+}
+
+// PeerLister gives the api access to the peers of the node.
+type PeerLister interface {
+	Peers() []Peer
+	Bans() []Ban
+}
+
 type ServerConfig struct {
 	Logger     log.Logger
 	ListenAddr string
+	// Peers is optional, without it the peer endpoints are not served.
+	Peers PeerLister
+	// Sync is optional, without it /sync is not served.
+	Sync SyncReporter
 }
 
 type Server struct {
 	ServerConfig
 	bc *core.BlockChain
+	e  *echo.Echo
 }
 
 func NewServer(cfg ServerConfig, bc *core.BlockChain) *Server {
 	return &Server{
 		ServerConfig: cfg,
 		bc:           bc,
+		e:            echo.New(),
 	}
 }
 
+// Start serves the api until Shutdown is called, it then returns
+// http.ErrServerClosed.
 func (s *Server) Start() error {
-	e := echo.New()
+	e := s.e
 
 	e.GET("/block/:hashorid", s.handleGetBlock)
 	e.GET("/tx/:hash", s.handleGetTx)
+	e.GET("/validators/:height", s.handleGetValidators)
+	e.GET("/evidence", s.handleGetAllEvidence)
+	e.GET("/evidence/:hash", s.handleGetEvidence)
+	e.GET("/checkpoint", s.handleGetCheckpoint)
+	if s.Peers != nil {
+		e.GET("/peers", s.handleGetPeers)
+		e.GET("/bans", s.handleGetBans)
+	}
+	if s.Sync != nil {
+		e.GET("/sync", s.handleGetSync)
+	}
 
 	return e.Start(s.ListenAddr)
 }
 
+// Shutdown stops the server and waits for the requests in progress to
+// finish until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.e.Shutdown(ctx)
+}
+
 func (s *Server) handleGetTx(c echo.Context) error {
 	hash := c.Param("hash")
 	b, err := hex.DecodeString(hash)
@@ -72,6 +189,92 @@ func (s *Server) handleGetTx(c echo.Context) error {
 	return c.JSON(http.StatusOK, tx)
 }
 
+func (s *Server) handleGetValidators(c echo.Context) error {
+	height, err := strconv.ParseUint(c.Param("height"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	vs, err := s.bc.ValidatorSet(uint32(height))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	resp := ValidatorSet{
+		Height:     uint32(height),
+		Epoch:      uint32(height) / s.bc.EpochLength(),
+		TotalPower: vs.TotalPower(),
+		Validators: []Validator{},
+	}
+	for _, v := range vs {
+		resp.Validators = append(resp.Validators, Validator{
+			Address:   v.Key.Address().String(),
+			PublicKey: hex.EncodeToString(v.Key),
+			Power:     v.Power,
+		})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleGetAllEvidence(c echo.Context) error {
+	resp := []Evidence{}
+	for _, b := range s.bc.Evidence() {
+		for _, ev := range b.Evidence {
+			resp = append(resp, intoJSONEvidence(ev, b))
+		}
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (s *Server) handleGetEvidence(c echo.Context) error {
+	b, err := hex.DecodeString(c.Param("hash"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	ev, block, err := s.bc.GetEvidence(types.HashFromBytes(b))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, intoJSONEvidence(ev, block))
+}
+
+func intoJSONEvidence(ev *core.Evidence, b *core.Block) Evidence {
+	return Evidence{
+		Hash:      ev.Hash().String(),
+		Validator: ev.Validator.Address().String(),
+		Height:    ev.Height(),
+		Blocks: []string{
+			core.BlockHasher{}.Hash(ev.First).String(),
+			core.BlockHasher{}.Hash(ev.Second).String(),
+		},
+		IncludedIn:     b.Hash(core.BlockHasher{}).String(),
+		IncludedHeight: b.Height,
+	}
+}
+
+func (s *Server) handleGetCheckpoint(c echo.Context) error {
+	cp, err := s.bc.LatestCheckpoint()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	return c.JSON(http.StatusOK, Checkpoint{
+		Height: cp.Header.Height,
+		Hash:   cp.Checkpoint().Hash.String(),
+		Commit: intoJSONCommit(cp.Commit),
+	})
+}
+
+func (s *Server) handleGetPeers(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Peers.Peers())
+}
+
+func (s *Server) handleGetBans(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Peers.Bans())
+}
+
+func (s *Server) handleGetSync(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Sync.SyncStatus())
+}
+
 func (s *Server) handleGetBlock(c echo.Context) error {
 	hashOrID := c.Param("hashorid")
 
@@ -103,6 +306,10 @@ func intoJSONBlock(block *core.Block) Block {
 	for i := 0; i < int(txResponse.TxCount); i++ {
 		txResponse.Hashes[i] = block.Transactions[i].Hash(core.TxHasher{}).String()
 	}
+	evidence := []string{}
+	for _, ev := range block.Evidence {
+		evidence = append(evidence, ev.Hash().String())
+	}
 	return Block{
 		Hash:          block.Hash(core.BlockHasher{}).String(),
 		Version:       block.Header.Version,
@@ -112,8 +319,19 @@ func intoJSONBlock(block *core.Block) Block {
 		Timestamp:     block.Header.Timestamp,
 		Validator:     block.Validator.Address().String(),
 		Signature:     block.Signature.String(),
+		Commit:        intoJSONCommit(block.Commit),
+		Evidence:      evidence,
 		TxResponse:    txResponse,
 	}
 }
 
-
+func intoJSONCommit(c *core.Commit) *Commit {
+	if c == nil {
+		return nil
+	}
+	commit := &Commit{Round: c.Round, Signers: []string{}}
+	for _, v := range c.Precommits {
+		commit.Signers = append(commit.Signers, v.Validator.Address().String())
+	}
+	return commit
+}
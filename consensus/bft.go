@@ -0,0 +1,280 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+var (
+	ErrNoCommit        = errors.New("block has no commit")
+	ErrInvalidCommit   = errors.New("block has an invalid commit")
+	ErrInvalidVote     = errors.New("invalid vote")
+	ErrInvalidProposal = errors.New("invalid proposal")
+)
+
+// BFT is Tendermint style byzantine fault tolerant consensus. For every
+// height the validators run rounds of three steps until a block is
+// decided. In a round the proposer of the round proposes a block, the
+// validators prevote for it or for nothing, and once a quorum prevoted for
+// the block they precommit it. A block with the precommits of a quorum is
+// decided and final, the precommits are stored with it as its commit.
+// Votes weigh with the voting power of their validator, a quorum is more
+// than two thirds of the power of the epoch, so validators with up to a
+// third of it may be faulty. BFTState runs the rounds, the engine holds
+// the rules.
+type BFT struct {
+	blockTime time.Duration
+	key       *crypto.PrivateKey
+	now       func() time.Time
+}
+
+// NewBFT creates the BFT engine for the validators of g.
+func NewBFT(g *core.Genesis, cfg Config) (*BFT, error) {
+	if len(g.Validators) == 0 {
+		return nil, errors.New("BFT needs at least one validator")
+	}
+	if g.BlockTime <= 0 {
+		return nil, errors.New("BFT needs the block time in the genesis")
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &BFT{
+		blockTime: g.BlockTime,
+		key:       cfg.Key,
+		now:       cfg.Now,
+	}, nil
+}
+
+// Proposer returns the validator of vs that proposes the block at height
+// in the given round, round robin by height and round.
+func (e *BFT) Proposer(vs core.ValidatorSet, height, round uint32) crypto.PublicKey {
+	n := uint64(len(vs))
+	if n == 0 {
+		return nil
+	}
+	return vs[(uint64(height)+uint64(round))%n].Key
+}
+
+// Timeout returns how long a validator waits in step of round before it
+// moves on without the messages it waits for. Later rounds wait longer,
+// so the validators eventually overlap in a round long enough to decide.
+func (e *BFT) Timeout(step TimeoutStep, round uint32) time.Duration {
+	grow := time.Duration(round) * e.blockTime / 2
+	switch step {
+	case TimeoutPropose:
+		return e.blockTime + grow
+	case TimeoutPrevote, TimeoutPrecommit:
+		return e.blockTime/2 + grow
+	}
+	return e.blockTime
+}
+
+// Key returns the key we vote with, nil if we only follow the chain.
+func (e *BFT) Key() *crypto.PrivateKey {
+	return e.key
+}
+
+// NextSeal never lets us seal a block on our own, BFTState proposes them.
+func (e *BFT) NextSeal(chain ChainReader, parent *core.Header, now time.Time) (time.Time, bool) {
+	return time.Time{}, false
+}
+
+// Prepare sets the timestamp, at least one nanosecond after the parent.
+func (e *BFT) Prepare(chain ChainReader, header *core.Header) error {
+	parent, err := chain.GetHeader(header.Height - 1)
+	if err != nil {
+		return err
+	}
+	header.Timestamp = e.now().UnixNano()
+	if header.Timestamp <= parent.Timestamp {
+		header.Timestamp = parent.Timestamp + 1
+	}
+	return nil
+}
+
+func (e *BFT) Seal(ctx context.Context, chain ChainReader, b *core.Block) error {
+	return sign(e.key, b)
+}
+
+// VerifyProposal checks the block of a proposal before we vote for it,
+// vs are the validators of its height.
+func (e *BFT) VerifyProposal(vs core.ValidatorSet, parent *core.Header, b *core.Block) error {
+	if err := checkTimestamp(b, e.now()); err != nil {
+		return err
+	}
+	return e.verifyHeader(vs, parent, b)
+}
+
+func (e *BFT) verifyHeader(vs core.ValidatorSet, parent *core.Header, b *core.Block) error {
+	if b.Timestamp <= parent.Timestamp {
+		return fmt.Errorf("%w: block %s is not after its parent", ErrInvalidProposal, b.Hash(core.BlockHasher{}))
+	}
+	if !vs.Contains(b.Validator) {
+		return fmt.Errorf("%w: %s", ErrNotValidator, b.Validator.Address())
+	}
+	return nil
+}
+
+// VerifySeal checks that b was signed by a validator and decided by a
+// quorum of them. The clock is not checked, a decided block is final no
+// matter when we see it.
+func (e *BFT) VerifySeal(chain ChainReader, parent *core.Header, b *core.Block) error {
+	vs, err := chain.ValidatorSet(b.Height)
+	if err != nil {
+		return err
+	}
+	if err := e.verifyHeader(vs, parent, b); err != nil {
+		return err
+	}
+	return e.VerifyCommit(vs, b)
+}
+
+// VerifyCommit checks that the commit of b holds valid precommits for b of
+// a quorum of vs, all from the same round.
+func (e *BFT) VerifyCommit(vs core.ValidatorSet, b *core.Block) error {
+	if b.Commit == nil {
+		return fmt.Errorf("%w: block %s", ErrNoCommit, b.Hash(core.BlockHasher{}))
+	}
+
+	hash := b.Hash(core.BlockHasher{})
+	signers := make(map[string]bool)
+	power := uint64(0)
+	for _, v := range b.Commit.Precommits {
+		if v.Type != core.VotePrecommit || v.Height != b.Height || v.Round != b.Commit.Round || v.BlockHash != hash {
+			return fmt.Errorf("%w: %s of %s for height %d round %d block %s", ErrInvalidCommit, v.Type, v.Validator.Address(), v.Height, v.Round, v.BlockHash)
+		}
+		if signers[string(v.Validator)] {
+			return fmt.Errorf("%w: two precommits of %s", ErrInvalidCommit, v.Validator.Address())
+		}
+		if err := e.VerifyVote(vs, v); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidCommit, err)
+		}
+		signers[string(v.Validator)] = true
+		power += vs.Power(v.Validator)
+	}
+
+	if quorum := vs.Quorum(); power < quorum {
+		return fmt.Errorf("%w: precommits of power %d for block %s, need %d", ErrInvalidCommit, power, hash, quorum)
+	}
+	return nil
+}
+
+// VerifyVote checks that v was signed by a validator of vs, the validators
+// of its height.
+func (e *BFT) VerifyVote(vs core.ValidatorSet, v *core.Vote) error {
+	if !vs.Contains(v.Validator) {
+		return fmt.Errorf("%w: %s of %s, not a validator", ErrInvalidVote, v.Type, v.Validator.Address())
+	}
+	if err := v.Verify(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidVote, err)
+	}
+	return nil
+}
+
+// VerifyProposalSignature checks that p was signed by the proposer of its
+// height and round among vs.
+func (e *BFT) VerifyProposalSignature(vs core.ValidatorSet, p *Proposal) error {
+	if p.Block == nil || p.Block.Height != p.Height {
+		return fmt.Errorf("%w: no block for height %d", ErrInvalidProposal, p.Height)
+	}
+	if proposer := e.Proposer(vs, p.Height, p.Round); !bytes.Equal(proposer, p.Proposer) {
+		return fmt.Errorf("%w: height %d round %d belongs to %s, not %s", ErrInvalidProposal, p.Height, p.Round, proposer.Address(), p.Proposer.Address())
+	}
+	if p.POLRound >= int32(p.Round) || p.POLRound < -1 {
+		return fmt.Errorf("%w: proof of lock round %d in round %d", ErrInvalidProposal, p.POLRound, p.Round)
+	}
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Finalized returns the tip, every block with a commit is final.
+func (e *BFT) Finalized(chain ChainReader) uint32 {
+	return chain.Height()
+}
+
+func (e *BFT) Work(h *core.Header) *big.Int {
+	return big.NewInt(1)
+}
+
+// Proposal is the block the proposer of a round proposes.
+type Proposal struct {
+	Height uint32
+	Round  uint32
+	// POLRound is the round in which a quorum prevoted for the block,
+	// the proof of lock that lets locked validators vote for it. It is -1
+	// for a new block.
+	POLRound  int32
+	Block     *core.Block
+	Proposer  crypto.PublicKey
+	Signature *crypto.Signature
+}
+
+// SignBytes returns what the proposer signs: the codec version followed by
+// the height, round, proof of lock round and block hash.
+func (p *Proposal) SignBytes() []byte {
+	buf := new(bytes.Buffer)
+	w := core.NewBinaryWriter(buf)
+	w.WriteUint8(core.CodecVersion)
+	w.WriteUint32(p.Height)
+	w.WriteUint32(p.Round)
+	w.WriteUint32(uint32(p.POLRound))
+	w.WriteHash(p.Block.Hash(core.BlockHasher{}))
+	return buf.Bytes()
+}
+
+func (p *Proposal) Sign(key crypto.PrivateKey) error {
+	hash := sha256.Sum256(p.SignBytes())
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+
+	p.Proposer = key.PublicKey()
+	p.Signature = sig
+	return nil
+}
+
+func (p *Proposal) Verify() error {
+	if p.Signature == nil {
+		return fmt.Errorf("%w: no signature", ErrInvalidProposal)
+	}
+	hash := sha256.Sum256(p.SignBytes())
+	if !p.Signature.Verify(p.Proposer, hash[:]) {
+		return fmt.Errorf("%w: invalid signature of %s", ErrInvalidProposal, p.Proposer.Address())
+	}
+	return nil
+}
+
+func (p *Proposal) EncodeBinary(w *core.BinaryWriter) {
+	if p.Block == nil {
+		w.Fail(errors.New("proposal has no block"))
+		return
+	}
+	w.WriteUint32(p.Height)
+	w.WriteUint32(p.Round)
+	w.WriteUint32(uint32(p.POLRound))
+	p.Block.EncodeBinary(w)
+	w.WriteBytes(p.Proposer)
+	core.WriteSignature(w, p.Signature)
+}
+
+func (p *Proposal) DecodeBinary(r *core.BinaryReader) {
+	p.Height = r.ReadUint32()
+	p.Round = r.ReadUint32()
+	p.POLRound = int32(r.ReadUint32())
+	p.Block = new(core.Block)
+	p.Block.DecodeBinary(r)
+	p.Proposer = r.ReadBytes()
+	p.Signature = core.ReadSignature(r)
+}
@@ -0,0 +1,602 @@
+package consensus
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/go-kit/log"
+)
+
+// TimeoutStep is what a BFT timeout is for.
+type TimeoutStep uint8
+
+const (
+	TimeoutPropose TimeoutStep = iota + 1
+	TimeoutPrevote
+	TimeoutPrecommit
+	// TimeoutNewHeight ends the pause after a decision that lets the
+	// transactions for the next block come in.
+	TimeoutNewHeight
+	// TimeoutRebroadcast sends our messages of the height again, for the
+	// validators that missed them, e.g. behind a partition.
+	TimeoutRebroadcast
+)
+
+// BFTTimeout is a timeout of a BFTState.
+type BFTTimeout struct {
+	Height uint32
+	Round  uint32
+	Step   TimeoutStep
+}
+
+// BFTDriver connects a BFTState to the node running it.
+type BFTDriver interface {
+	BroadcastProposal(p *Proposal)
+	BroadcastVote(v *core.Vote)
+	// Schedule calls HandleTimeout with t after d.
+	Schedule(d time.Duration, t BFTTimeout)
+	// Propose returns a new sealed block on top of the chain.
+	Propose() (*core.Block, error)
+	// Check checks a proposed block on top of the chain, like
+	// core.BlockChain.CheckBlock.
+	Check(b *core.Block) error
+	// Commit adds a decided block with its commit to the chain.
+	Commit(b *core.Block) error
+}
+
+// maxFutureMessages is the number of messages for the next height a
+// BFTState keeps until it gets there.
+var maxFutureMessages = 1000
+
+type roundStep uint8
+
+const (
+	stepNewHeight roundStep = iota
+	stepPropose
+	stepPrevote
+	stepPrecommit
+)
+
+type voteKey struct {
+	typ   core.VoteType
+	round uint32
+}
+
+// voteSet holds the votes of one type and round, at most one per
+// validator, and the voting power behind them.
+type voteSet struct {
+	votes map[string]*core.Vote
+	count map[types.Hash]uint64
+	power uint64
+}
+
+func newVoteSet() *voteSet {
+	return &voteSet{
+		votes: make(map[string]*core.Vote),
+		count: make(map[types.Hash]uint64),
+	}
+}
+
+// add adds v of a validator with the given power unless it already
+// voted. A second vote of a validator for another block is ignored, the
+// first one counts.
+func (vs *voteSet) add(v *core.Vote, power uint64) bool {
+	if _, ok := vs.votes[string(v.Validator)]; ok {
+		return false
+	}
+	vs.votes[string(v.Validator)] = v
+	vs.count[v.BlockHash] += power
+	vs.power += power
+	return true
+}
+
+func (vs *voteSet) total() uint64 {
+	return vs.power
+}
+
+// votesFor returns the votes for hash ordered by validator.
+func (vs *voteSet) votesFor(hash types.Hash) []*core.Vote {
+	votes := []*core.Vote{}
+	for _, v := range vs.votes {
+		if v.BlockHash == hash {
+			votes = append(votes, v)
+		}
+	}
+	sort.Slice(votes, func(i, j int) bool {
+		return bytes.Compare(votes[i].Validator, votes[j].Validator) < 0
+	})
+	return votes
+}
+
+// BFTState runs the rounds of the BFT engine for one node, following the
+// Tendermint algorithm (arXiv:1807.04938). It reacts to proposals, votes
+// and timeouts and talks to the network and the chain through its driver.
+// Nodes without a validator key follow the rounds without voting.
+type BFTState struct {
+	lock    sync.Mutex
+	engine  *BFT
+	chain   ChainReader
+	driver  BFTDriver
+	logger  log.Logger
+	started bool
+
+	height uint32
+	round  uint32
+	step   roundStep
+	// validators are the validators of the height.
+	validators core.ValidatorSet
+
+	// lockedBlock is the block we precommitted, we only prevote for
+	// another block with a proof of lock from a later round.
+	lockedBlock *core.Block
+	lockedRound int32
+	// validBlock is the last block a quorum prevoted for, we propose it
+	// again when it is our turn.
+	validBlock *core.Block
+	validRound int32
+	// proposed is the block we built at the height. We propose it again
+	// in later rounds, two signed blocks at one height are evidence of
+	// double signing.
+	proposed *core.Block
+
+	proposals map[uint32]*Proposal
+	blocks    map[types.Hash]*core.Block
+	votes     map[voteKey]*voteSet
+	// voters holds the validators we have votes of by round.
+	voters map[uint32]map[string]bool
+	// validity caches the result of checking the proposed blocks.
+	validity map[types.Hash]error
+	// the rules that fire only once per round.
+	prevoteTimeout   bool
+	precommitTimeout bool
+	polka            bool
+	// own holds our proposals and votes of the height.
+	own []any
+	// future holds the messages for the next height.
+	future []any
+}
+
+func NewBFTState(engine *BFT, chain ChainReader, driver BFTDriver, logger log.Logger) *BFTState {
+	return &BFTState{
+		engine: engine,
+		chain:  chain,
+		driver: driver,
+		logger: logger,
+	}
+}
+
+// Start starts the rounds for the block on top of the chain.
+func (s *BFTState) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.started = true
+	s.enterHeight(s.chain.Height() + 1)
+	s.check()
+}
+
+// Height returns the height we decide on.
+func (s *BFTState) Height() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.height
+}
+
+// Round returns the round we are in.
+func (s *BFTState) Round() uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.round
+}
+
+// NewTip moves on to the next height if the chain got the block we are
+// deciding on, e.g. from a peer during sync.
+func (s *BFTState) NewTip() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.started || s.chain.Height() < s.height {
+		return
+	}
+	s.enterHeight(s.chain.Height() + 1)
+	s.check()
+}
+
+// HandleProposal handles a proposal from the network. It returns an error
+// if p was not signed by its proposer, and whether p is new to us and
+// worth relaying. A proposal for the next height is checked once we get
+// there, the validators of the height may not be known yet.
+func (s *BFTState) HandleProposal(p *Proposal) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if p.Height == s.height+1 {
+		return false, s.keepFuture(p)
+	}
+	if p.Height != s.height {
+		return false, nil
+	}
+	if err := s.engine.VerifyProposalSignature(s.validators, p); err != nil {
+		return false, err
+	}
+	if s.proposals[p.Round] != nil {
+		return false, nil
+	}
+	s.addProposal(p)
+	s.check()
+	return true, nil
+}
+
+// HandleVote handles a vote from the network. It returns an error if v
+// was not signed by a validator, and whether v is new to us and worth
+// relaying. Like proposals, votes for the next height are checked once
+// we get there.
+func (s *BFTState) HandleVote(v *core.Vote) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if v.Height == s.height+1 {
+		return false, s.keepFuture(v)
+	}
+	if v.Height != s.height {
+		return false, nil
+	}
+	if err := s.engine.VerifyVote(s.validators, v); err != nil {
+		return false, err
+	}
+	if !s.addVote(v) {
+		return false, nil
+	}
+	s.check()
+	return true, nil
+}
+
+// HandleTimeout handles a timeout the driver scheduled.
+func (s *BFTState) HandleTimeout(t BFTTimeout) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t.Height != s.height {
+		return
+	}
+	switch t.Step {
+	case TimeoutPropose:
+		if t.Round == s.round && s.step == stepPropose {
+			s.vote(core.VotePrevote, types.Hash{})
+			s.step = stepPrevote
+		}
+	case TimeoutPrevote:
+		if t.Round == s.round && s.step == stepPrevote {
+			s.vote(core.VotePrecommit, types.Hash{})
+			s.step = stepPrecommit
+		}
+	case TimeoutPrecommit:
+		if t.Round == s.round && s.step != stepNewHeight {
+			s.startRound(s.round + 1)
+		}
+	case TimeoutNewHeight:
+		if s.step == stepNewHeight {
+			s.startRound(0)
+		}
+	case TimeoutRebroadcast:
+		for _, m := range s.own {
+			switch m := m.(type) {
+			case *Proposal:
+				s.driver.BroadcastProposal(m)
+			case *core.Vote:
+				s.driver.BroadcastVote(m)
+			}
+		}
+		s.driver.Schedule(s.engine.Timeout(TimeoutRebroadcast, 0), t)
+	}
+	s.check()
+}
+
+func (s *BFTState) keepFuture(m any) error {
+	if len(s.future) < maxFutureMessages {
+		s.future = append(s.future, m)
+	}
+	return nil
+}
+
+// enterHeight starts to decide on the block at height. The first round
+// starts after a pause, or as soon as other validators are in it.
+func (s *BFTState) enterHeight(height uint32) {
+	validators, err := s.chain.ValidatorSet(height)
+	if err != nil {
+		s.logger.Log("msg", "no validators for height", "height", height, "err", err)
+	}
+	s.validators = validators
+	s.height = height
+	s.round = 0
+	s.step = stepNewHeight
+	s.lockedBlock, s.lockedRound = nil, -1
+	s.validBlock, s.validRound = nil, -1
+	s.proposed = nil
+	s.proposals = make(map[uint32]*Proposal)
+	s.blocks = make(map[types.Hash]*core.Block)
+	s.votes = make(map[voteKey]*voteSet)
+	s.voters = make(map[uint32]map[string]bool)
+	s.validity = make(map[types.Hash]error)
+	s.own = nil
+	s.resetRound()
+
+	s.driver.Schedule(s.engine.Timeout(TimeoutNewHeight, 0), BFTTimeout{Height: height, Step: TimeoutNewHeight})
+	s.driver.Schedule(s.engine.Timeout(TimeoutRebroadcast, 0), BFTTimeout{Height: height, Step: TimeoutRebroadcast})
+
+	future := s.future
+	s.future = nil
+	for _, m := range future {
+		switch m := m.(type) {
+		case *Proposal:
+			if m.Height == height && s.proposals[m.Round] == nil && s.engine.VerifyProposalSignature(s.validators, m) == nil {
+				s.addProposal(m)
+			} else if m.Height == height+1 {
+				s.keepFuture(m)
+			}
+		case *core.Vote:
+			if m.Height == height && s.engine.VerifyVote(s.validators, m) == nil {
+				s.addVote(m)
+			} else if m.Height == height+1 {
+				s.keepFuture(m)
+			}
+		}
+	}
+}
+
+func (s *BFTState) resetRound() {
+	s.prevoteTimeout = false
+	s.precommitTimeout = false
+	s.polka = false
+}
+
+// startRound starts round, we propose a block if it is our turn.
+func (s *BFTState) startRound(round uint32) {
+	s.round = round
+	s.step = stepPropose
+	s.resetRound()
+	s.driver.Schedule(s.engine.Timeout(TimeoutPropose, round), BFTTimeout{Height: s.height, Round: round, Step: TimeoutPropose})
+
+	key := s.engine.Key()
+	if key == nil || !bytes.Equal(s.engine.Proposer(s.validators, s.height, round), key.PublicKey()) {
+		return
+	}
+
+	b := s.validBlock
+	if b == nil {
+		b = s.proposed
+	}
+	if b == nil {
+		var err error
+		if b, err = s.driver.Propose(); err != nil {
+			s.logger.Log("msg", "could not propose a block", "height", s.height, "round", round, "err", err)
+			return
+		}
+		s.proposed = b
+	}
+	p := &Proposal{Height: s.height, Round: round, POLRound: s.validRound, Block: b}
+	if err := p.Sign(*key); err != nil {
+		s.logger.Log("msg", "could not sign proposal", "err", err)
+		return
+	}
+	s.addProposal(p)
+	s.own = append(s.own, p)
+	s.driver.BroadcastProposal(p)
+}
+
+// vote votes for hash in the current round if we are a validator.
+func (s *BFTState) vote(typ core.VoteType, hash types.Hash) {
+	key := s.engine.Key()
+	if key == nil || !s.validators.Contains(key.PublicKey()) {
+		return
+	}
+
+	v := &core.Vote{Type: typ, Height: s.height, Round: s.round, BlockHash: hash}
+	if err := v.Sign(*key); err != nil {
+		s.logger.Log("msg", "could not sign vote", "err", err)
+		return
+	}
+	s.addVote(v)
+	s.own = append(s.own, v)
+	s.driver.BroadcastVote(v)
+}
+
+// lockedOn reports whether we are locked on the block with hash.
+func (s *BFTState) lockedOn(hash types.Hash) bool {
+	return s.lockedBlock != nil && s.lockedBlock.Hash(core.BlockHasher{}) == hash
+}
+
+func (s *BFTState) addProposal(p *Proposal) {
+	s.proposals[p.Round] = p
+	s.blocks[p.Block.Hash(core.BlockHasher{})] = p.Block
+}
+
+func (s *BFTState) addVote(v *core.Vote) bool {
+	if !s.voteSet(v.Type, v.Round).add(v, s.validators.Power(v.Validator)) {
+		return false
+	}
+	if s.voters[v.Round] == nil {
+		s.voters[v.Round] = make(map[string]bool)
+	}
+	s.voters[v.Round][string(v.Validator)] = true
+	return true
+}
+
+// power returns the voting power of voters.
+func (s *BFTState) power(voters map[string]bool) uint64 {
+	power := uint64(0)
+	for key := range voters {
+		power += s.validators.Power(crypto.PublicKey(key))
+	}
+	return power
+}
+
+func (s *BFTState) voteSet(typ core.VoteType, round uint32) *voteSet {
+	key := voteKey{typ: typ, round: round}
+	if s.votes[key] == nil {
+		s.votes[key] = newVoteSet()
+	}
+	return s.votes[key]
+}
+
+// valid checks a proposed block once per height.
+func (s *BFTState) valid(b *core.Block) bool {
+	hash := b.Hash(core.BlockHasher{})
+	if err, ok := s.validity[hash]; ok {
+		return err == nil
+	}
+
+	parent, err := s.chain.GetHeader(s.height - 1)
+	if err == nil {
+		err = s.engine.VerifyProposal(s.validators, parent, b)
+	}
+	if err == nil {
+		err = s.driver.Check(b)
+	}
+	if err != nil {
+		s.logger.Log("msg", "invalid proposal", "hash", hash, "height", s.height, "err", err)
+	}
+	s.validity[hash] = err
+	return err == nil
+}
+
+// check applies the rules of the algorithm until none fires anymore.
+func (s *BFTState) check() {
+	for s.apply() {
+	}
+}
+
+// apply applies the first rule that fires and reports whether one did.
+// The comments name the lines of the algorithm in the paper.
+func (s *BFTState) apply() bool {
+	quorum := s.validators.Quorum()
+
+	// line 49: a quorum precommitted a block in any round, decide it.
+	for key, set := range s.votes {
+		if key.typ != core.VotePrecommit {
+			continue
+		}
+		for hash, n := range set.count {
+			if hash.IsZero() || n < quorum {
+				continue
+			}
+			if b := s.blocks[hash]; b != nil && s.valid(b) {
+				s.decide(b, key.round)
+				return true
+			}
+		}
+	}
+
+	// line 55: validators with f+1 of the power are in a later round, at
+	// least one of them honest, catch up with them.
+	skip := s.validators.TotalPower() - quorum + 1
+	later, found := uint32(0), false
+	for round, voters := range s.voters {
+		ahead := round > s.round || (s.step == stepNewHeight && round == s.round)
+		if ahead && s.power(voters) >= skip && (!found || round > later) {
+			later, found = round, true
+		}
+	}
+	if found {
+		s.startRound(later)
+		return true
+	}
+
+	if s.step == stepNewHeight {
+		return false
+	}
+
+	var (
+		p          = s.proposals[s.round]
+		hash       types.Hash
+		prevotes   = s.voteSet(core.VotePrevote, s.round)
+		precommits = s.voteSet(core.VotePrecommit, s.round)
+	)
+	if p != nil {
+		hash = p.Block.Hash(core.BlockHasher{})
+	}
+
+	// line 22: a new proposal, prevote for it unless we are locked on
+	// another block.
+	if s.step == stepPropose && p != nil && p.POLRound == -1 {
+		if s.valid(p.Block) && (s.lockedRound == -1 || s.lockedOn(hash)) {
+			s.vote(core.VotePrevote, hash)
+		} else {
+			s.vote(core.VotePrevote, types.Hash{})
+		}
+		s.step = stepPrevote
+		return true
+	}
+
+	// line 28: a proposal again of a block a quorum prevoted for in an
+	// earlier round, that unlocks us if our lock is older.
+	if s.step == stepPropose && p != nil && p.POLRound >= 0 && s.voteSet(core.VotePrevote, uint32(p.POLRound)).count[hash] >= quorum {
+		if s.valid(p.Block) && (s.lockedRound <= p.POLRound || s.lockedOn(hash)) {
+			s.vote(core.VotePrevote, hash)
+		} else {
+			s.vote(core.VotePrevote, types.Hash{})
+		}
+		s.step = stepPrevote
+		return true
+	}
+
+	// line 34: a quorum prevoted, but not for the same block yet.
+	if s.step == stepPrevote && !s.prevoteTimeout && prevotes.total() >= quorum {
+		s.prevoteTimeout = true
+		s.driver.Schedule(s.engine.Timeout(TimeoutPrevote, s.round), BFTTimeout{Height: s.height, Round: s.round, Step: TimeoutPrevote})
+		return true
+	}
+
+	// line 36: a quorum prevoted for the proposal, lock on it and
+	// precommit it.
+	if s.step >= stepPrevote && !s.polka && p != nil && prevotes.count[hash] >= quorum && s.valid(p.Block) {
+		s.polka = true
+		if s.step == stepPrevote {
+			s.lockedBlock, s.lockedRound = p.Block, int32(s.round)
+			s.vote(core.VotePrecommit, hash)
+			s.step = stepPrecommit
+		}
+		s.validBlock, s.validRound = p.Block, int32(s.round)
+		return true
+	}
+
+	// line 44: a quorum prevoted for no block.
+	if s.step == stepPrevote && prevotes.count[types.Hash{}] >= quorum {
+		s.vote(core.VotePrecommit, types.Hash{})
+		s.step = stepPrecommit
+		return true
+	}
+
+	// line 47: a quorum precommitted, but not for the same block.
+	if !s.precommitTimeout && precommits.total() >= quorum {
+		s.precommitTimeout = true
+		s.driver.Schedule(s.engine.Timeout(TimeoutPrecommit, s.round), BFTTimeout{Height: s.height, Round: s.round, Step: TimeoutPrecommit})
+		return true
+	}
+
+	return false
+}
+
+// decide adds b with the precommits of round as its commit to the chain
+// and moves on to the next height.
+func (s *BFTState) decide(b *core.Block, round uint32) {
+	hash := b.Hash(core.BlockHasher{})
+	decided := *b
+	decided.Commit = &core.Commit{
+		Round:      round,
+		Precommits: s.voteSet(core.VotePrecommit, round).votesFor(hash),
+	}
+	if err := s.driver.Commit(&decided); err != nil {
+		s.logger.Log("msg", "could not commit decided block", "hash", hash, "height", s.height, "err", err)
+		s.validity[hash] = err
+		return
+	}
+
+	s.logger.Log("msg", "decided block", "hash", hash, "height", s.height, "round", round)
+	s.enterHeight(s.chain.Height() + 1)
+}
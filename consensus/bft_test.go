@@ -0,0 +1,398 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// bftNet runs BFTStates that talk through an in-memory queue. Timeouts
+// only fire when the test fires them.
+type bftNet struct {
+	genesis *core.Genesis
+	keys    []crypto.PrivateKey
+	engines []*BFT
+	nodes   []*bftNode
+	queue   []func()
+	// down holds the nodes whose messages are lost.
+	down map[int]bool
+}
+
+type bftNode struct {
+	net      *bftNet
+	i        int
+	chain    *headerChain
+	state    *BFTState
+	blocks   []*core.Block
+	timeouts []BFTTimeout
+}
+
+func newBFTNet(t *testing.T, n int) *bftNet {
+	powers := []uint64{}
+	for i := 0; i < n; i++ {
+		powers = append(powers, 1)
+	}
+	return newWeightedBFTNet(t, powers)
+}
+
+// newWeightedBFTNet returns a net of validators with the given voting
+// powers.
+func newWeightedBFTNet(t *testing.T, powers []uint64) *bftNet {
+	n := len(powers)
+	net := &bftNet{down: make(map[int]bool)}
+	validators := []crypto.PublicKey{}
+	for i := 0; i < n; i++ {
+		net.keys = append(net.keys, crypto.GeneratePrivateKey())
+		validators = append(validators, net.keys[i].PublicKey())
+	}
+	now := poaEpoch.Add(time.Minute)
+	g := &core.Genesis{Engine: EngineBFT, Timestamp: poaEpoch.UnixNano(), BlockTime: time.Second, Validators: validators, Powers: powers}
+	net.genesis = g
+
+	for i := 0; i < n; i++ {
+		engine, err := NewBFT(g, Config{Key: &net.keys[i], Now: func() time.Time { return now }})
+		assert.Nil(t, err)
+		node := &bftNode{net: net, i: i, chain: &headerChain{headers: []*core.Header{g.Block().Header}, validators: g.ValidatorSet()}}
+		node.state = NewBFTState(engine, node.chain, node, log.NewNopLogger())
+		net.engines = append(net.engines, engine)
+		net.nodes = append(net.nodes, node)
+	}
+	return net
+}
+
+// run delivers messages until there are none left.
+func (net *bftNet) run() {
+	for len(net.queue) > 0 {
+		f := net.queue[0]
+		net.queue = net.queue[1:]
+		f()
+	}
+}
+
+// fire fires the pending timeouts of step at every node that is up.
+func (net *bftNet) fire(step TimeoutStep) {
+	for _, node := range net.nodes {
+		if net.down[node.i] {
+			continue
+		}
+		pending := node.timeouts
+		node.timeouts = nil
+		for _, t := range pending {
+			if t.Step == step {
+				node.state.HandleTimeout(t)
+			} else {
+				node.timeouts = append(node.timeouts, t)
+			}
+		}
+	}
+	net.run()
+}
+
+func (net *bftNet) start() {
+	for _, node := range net.nodes {
+		if !net.down[node.i] {
+			node.state.Start()
+		}
+	}
+}
+
+func (n *bftNode) send(deliver func(*bftNode)) {
+	if n.net.down[n.i] {
+		return
+	}
+	for _, other := range n.net.nodes {
+		if other != n && !n.net.down[other.i] {
+			other := other
+			n.net.queue = append(n.net.queue, func() { deliver(other) })
+		}
+	}
+}
+
+func (n *bftNode) BroadcastProposal(p *Proposal) {
+	n.send(func(other *bftNode) { other.state.HandleProposal(p) })
+}
+
+func (n *bftNode) BroadcastVote(v *core.Vote) {
+	n.send(func(other *bftNode) { other.state.HandleVote(v) })
+}
+
+func (n *bftNode) Schedule(d time.Duration, t BFTTimeout) {
+	n.timeouts = append(n.timeouts, t)
+}
+
+func (n *bftNode) Propose() (*core.Block, error) {
+	parent, err := n.chain.GetHeader(n.chain.Height())
+	if err != nil {
+		return nil, err
+	}
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	if err != nil {
+		return nil, err
+	}
+	engine := n.net.engines[n.i]
+	if err := engine.Prepare(n.chain, b.Header); err != nil {
+		return nil, err
+	}
+	return b, engine.Seal(context.Background(), n.chain, b)
+}
+
+func (n *bftNode) Check(b *core.Block) error {
+	return b.Verify()
+}
+
+func (n *bftNode) Commit(b *core.Block) error {
+	parent, _ := n.chain.GetHeader(n.chain.Height())
+	if err := n.net.engines[n.i].VerifySeal(n.chain, parent, b); err != nil {
+		return err
+	}
+	n.chain.add(b.Header)
+	n.blocks = append(n.blocks, b)
+	return nil
+}
+
+func TestBFTQuorum(t *testing.T) {
+	for n, quorum := range map[int]uint64{1: 1, 3: 3, 4: 3, 6: 5, 7: 5, 10: 7} {
+		net := newBFTNet(t, n)
+		assert.Equal(t, quorum, net.nodes[0].chain.validators.Quorum(), "%d validators", n)
+	}
+}
+
+func TestBFTDecide(t *testing.T) {
+	net := newBFTNet(t, 4)
+	net.start()
+
+	for height := uint32(1); height <= 3; height++ {
+		net.fire(TimeoutNewHeight)
+
+		for _, node := range net.nodes {
+			assert.Equal(t, height, node.chain.Height())
+			assert.Equal(t, height+1, node.state.Height())
+			b := node.blocks[height-1]
+			assert.Equal(t, net.nodes[0].blocks[height-1].Hash(core.BlockHasher{}), b.Hash(core.BlockHasher{}))
+			assert.Equal(t, uint32(0), b.Commit.Round)
+			assert.GreaterOrEqual(t, len(b.Commit.Precommits), 3)
+			assert.Nil(t, net.engines[node.i].VerifyCommit(node.chain.validators, b))
+		}
+		// the proposer of the height proposed.
+		proposer := net.nodes[height%4]
+		assert.True(t, bytes.Equal(proposer.state.engine.Key().PublicKey(), net.nodes[0].blocks[height-1].Validator))
+	}
+}
+
+func TestBFTSilentProposer(t *testing.T) {
+	net := newBFTNet(t, 4)
+	// node 1 proposes the first block in round 0.
+	net.down[1] = true
+	net.start()
+
+	net.fire(TimeoutNewHeight)
+	for _, node := range net.nodes {
+		assert.Equal(t, uint32(0), node.chain.Height())
+	}
+
+	// nobody gets a proposal, the validators prevote and precommit for no
+	// block and move on to round 1.
+	net.fire(TimeoutPropose)
+	net.fire(TimeoutPrecommit)
+
+	for _, node := range net.nodes {
+		if net.down[node.i] {
+			continue
+		}
+		assert.Equal(t, uint32(1), node.chain.Height())
+		assert.Equal(t, uint32(1), node.blocks[0].Commit.Round)
+		assert.True(t, bytes.Equal(net.keys[2].PublicKey(), node.blocks[0].Validator))
+	}
+}
+
+func TestBFTNoQuorum(t *testing.T) {
+	net := newBFTNet(t, 4)
+	net.down[2] = true
+	net.down[3] = true
+	net.start()
+
+	for i := 0; i < 3; i++ {
+		net.fire(TimeoutNewHeight)
+		net.fire(TimeoutPropose)
+		net.fire(TimeoutPrevote)
+		net.fire(TimeoutPrecommit)
+	}
+	for _, node := range net.nodes {
+		assert.Equal(t, uint32(0), node.chain.Height())
+	}
+}
+
+func TestBFTLock(t *testing.T) {
+	net := newBFTNet(t, 4)
+	net.start()
+	net.fire(TimeoutNewHeight)
+	assert.Equal(t, uint32(1), net.nodes[0].chain.Height())
+
+	// a validator that precommitted a block in round 0 does not prevote
+	// for another block in round 1.
+	s := net.nodes[0].state
+	locked, err := net.nodes[1].Propose()
+	assert.Nil(t, err)
+	other, err := net.nodes[1].Propose()
+	assert.Nil(t, err)
+	other.Timestamp++
+	assert.Nil(t, other.Sign(net.keys[1]))
+
+	s.lock.Lock()
+	s.lockedBlock, s.lockedRound = locked, 0
+	s.step = stepPropose
+	s.round = 1
+	s.addProposal(&Proposal{Height: 2, Round: 1, POLRound: -1, Block: other})
+	s.check()
+	prevote := s.own[len(s.own)-1].(*core.Vote)
+	s.lock.Unlock()
+
+	assert.Equal(t, core.VotePrevote, prevote.Type)
+	assert.True(t, prevote.BlockHash.IsZero())
+}
+
+func TestBFTVerifyCommit(t *testing.T) {
+	net := newBFTNet(t, 4)
+	net.start()
+	net.fire(TimeoutNewHeight)
+	engine := net.engines[0]
+	vs := net.nodes[0].chain.validators
+	b := net.nodes[0].blocks[0]
+	assert.Nil(t, engine.VerifyCommit(vs, b))
+
+	commit := b.Commit
+	withCommit := func(c *core.Commit) *core.Block {
+		copied := *b
+		copied.Commit = c
+		return &copied
+	}
+	precommit := func(key crypto.PrivateKey, round uint32) *core.Vote {
+		v := &core.Vote{Type: core.VotePrecommit, Height: 1, Round: round, BlockHash: b.Hash(core.BlockHasher{})}
+		assert.Nil(t, v.Sign(key))
+		return v
+	}
+
+	err := engine.VerifyCommit(vs, withCommit(nil))
+	assert.True(t, errors.Is(err, ErrNoCommit))
+
+	cases := map[string][]*core.Vote{
+		"too few":       commit.Precommits[:2],
+		"duplicate":     {commit.Precommits[0], commit.Precommits[0], commit.Precommits[1]},
+		"wrong round":   {precommit(net.keys[0], 0), precommit(net.keys[1], 0), precommit(net.keys[2], 1)},
+		"not validator": {precommit(net.keys[0], 0), precommit(net.keys[1], 0), precommit(crypto.GeneratePrivateKey(), 0)},
+	}
+	for name, votes := range cases {
+		err := engine.VerifyCommit(vs, withCommit(&core.Commit{Round: 0, Precommits: votes}))
+		assert.True(t, errors.Is(err, ErrInvalidCommit), name)
+	}
+
+	// a precommit that claims another signer.
+	forged := precommit(net.keys[2], 0)
+	forged.Validator = net.keys[3].PublicKey()
+	err = engine.VerifyCommit(vs, withCommit(&core.Commit{Precommits: []*core.Vote{precommit(net.keys[0], 0), precommit(net.keys[1], 0), forged}}))
+	assert.True(t, errors.Is(err, ErrInvalidCommit))
+
+	assert.Nil(t, engine.VerifyCommit(vs, withCommit(&core.Commit{Precommits: []*core.Vote{precommit(net.keys[3], 0), precommit(net.keys[1], 0), precommit(net.keys[2], 0)}})))
+}
+
+// TestBFTSignedCheckpoint pins a decided block by its commit. A forged
+// commit or the commit of another block pins nothing.
+func TestBFTSignedCheckpoint(t *testing.T) {
+	net := newBFTNet(t, 4)
+	net.start()
+	net.fire(TimeoutNewHeight)
+	b := net.nodes[0].blocks[0]
+
+	bc, err := core.NewBlockChain(log.NewNopLogger(), net.genesis.Block())
+	assert.Nil(t, err)
+	bc.SetValidators(net.genesis.ValidatorSet(), net.genesis.EpochLength)
+	bc.SetConsensus(net.engines[0])
+
+	// precommits of keys that are no validators.
+	forged := &core.Commit{}
+	for i := 0; i < 3; i++ {
+		v := &core.Vote{Type: core.VotePrecommit, Height: b.Height, BlockHash: b.Hash(core.BlockHasher{})}
+		assert.Nil(t, v.Sign(crypto.GeneratePrivateKey()))
+		forged.Precommits = append(forged.Precommits, v)
+	}
+	err = bc.AddSignedCheckpoint(&core.SignedCheckpoint{Header: b.Header, Commit: forged})
+	assert.True(t, errors.Is(err, ErrInvalidCommit))
+
+	other := *b.Header
+	other.Timestamp++
+	err = bc.AddSignedCheckpoint(&core.SignedCheckpoint{Header: &other, Commit: b.Commit})
+	assert.True(t, errors.Is(err, ErrInvalidCommit))
+
+	assert.NotNil(t, bc.AddSignedCheckpoint(&core.SignedCheckpoint{Header: b.Header}))
+	assert.Empty(t, bc.Checkpoints())
+
+	cp := &core.SignedCheckpoint{Header: b.Header, Commit: b.Commit}
+	assert.Nil(t, bc.AddSignedCheckpoint(cp))
+	assert.Equal(t, []core.Checkpoint{cp.Checkpoint()}, bc.Checkpoints())
+}
+
+// TestBFTWeighted gives one of four validators 4 of a total power of 7,
+// a quorum is 5: the other three are no quorum without it.
+func TestBFTWeighted(t *testing.T) {
+	net := newWeightedBFTNet(t, []uint64{4, 1, 1, 1})
+	net.down[0] = true
+	net.start()
+
+	for i := 0; i < 3; i++ {
+		net.fire(TimeoutNewHeight)
+		net.fire(TimeoutPropose)
+		net.fire(TimeoutPrevote)
+		net.fire(TimeoutPrecommit)
+	}
+	for _, node := range net.nodes {
+		assert.Equal(t, uint32(0), node.chain.Height())
+	}
+
+	// it decides with any one of the others.
+	net = newWeightedBFTNet(t, []uint64{4, 1, 1, 1})
+	net.down[2] = true
+	net.down[3] = true
+	net.start()
+	net.fire(TimeoutNewHeight)
+	assert.Equal(t, uint32(1), net.nodes[0].chain.Height())
+	b := net.nodes[0].blocks[0]
+	assert.Equal(t, 2, len(b.Commit.Precommits))
+
+	vs := net.nodes[0].chain.validators
+	assert.Nil(t, net.engines[1].VerifyCommit(vs, b))
+	// the same precommits are no quorum if every validator has power 1.
+	even := core.ValidatorSet{}
+	for _, v := range vs {
+		even = append(even, core.ValidatorPower{Key: v.Key, Power: 1})
+	}
+	assert.True(t, errors.Is(net.engines[1].VerifyCommit(even, b), ErrInvalidCommit))
+}
+
+func TestProposalCodec(t *testing.T) {
+	net := newBFTNet(t, 4)
+	b, err := net.nodes[1].Propose()
+	assert.Nil(t, err)
+	p := &Proposal{Height: 1, Round: 0, POLRound: -1, Block: b}
+	assert.Nil(t, p.Sign(net.keys[1]))
+	assert.Nil(t, net.engines[0].VerifyProposalSignature(net.nodes[0].chain.validators, p))
+
+	data, err := core.MarshalBinary(p)
+	assert.Nil(t, err)
+	decoded := new(Proposal)
+	assert.Nil(t, core.UnmarshalBinary(data, decoded))
+	assert.Equal(t, int32(-1), decoded.POLRound)
+	assert.Equal(t, b.Hash(core.BlockHasher{}), decoded.Block.Hash(core.BlockHasher{}))
+	assert.Nil(t, net.engines[0].VerifyProposalSignature(net.nodes[0].chain.validators, decoded))
+
+	// only the proposer of the round may propose.
+	p.Round = 1
+	assert.Nil(t, p.Sign(net.keys[1]))
+	assert.True(t, errors.Is(net.engines[0].VerifyProposalSignature(net.nodes[0].chain.validators, p), ErrInvalidProposal))
+}
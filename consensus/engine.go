@@ -0,0 +1,110 @@
+// Package consensus holds the rules that decide who produces blocks and
+// which chain the nodes agree on. Every chain picks one Engine in its
+// genesis.
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+// The engines a genesis can name.
+const (
+	// EngineSingle accepts blocks from any signer. It is the default for
+	// development chains.
+	EngineSingle = "single"
+	// EnginePoA lets the validators take turns.
+	EnginePoA = "poa"
+	// EnginePoW lets anyone mine blocks by finding a nonce.
+	EnginePoW = "pow"
+	// EngineBFT lets the validators vote on every block, a decided block
+	// is final.
+	EngineBFT = "bft"
+)
+
+// ErrBlockInFuture is the error of the chain for blocks from the future,
+// the engines allow less clock drift than the chain.
+var ErrBlockInFuture = core.ErrBlockInFuture
+
+// maxClockDrift is how far the timestamp of a block may be ahead of our
+// clock before we reject it.
+var maxClockDrift = time.Second
+
+// ChainReader is the part of the chain the engines look at.
+type ChainReader = core.ChainReader
+
+// Engine is a consensus algorithm.
+type Engine interface {
+	// NextSeal returns the earliest time at or after now at which we may
+	// seal the block on top of parent, the tip of chain. It returns false
+	// if we never may, e.g. because we have no key.
+	NextSeal(chain ChainReader, parent *core.Header, now time.Time) (time.Time, bool)
+	// Prepare sets the consensus fields of a new header on top of the
+	// chain, like its timestamp.
+	Prepare(chain ChainReader, header *core.Header) error
+	// Seal makes b valid under the rules of the engine, e.g. signs it. It
+	// gives up when ctx is done.
+	Seal(ctx context.Context, chain ChainReader, b *core.Block) error
+	// Consensus verifies seals, weighs blocks for the fork choice and
+	// finalizes them.
+	core.Consensus
+}
+
+// Config holds what an engine needs to know about the node running it.
+type Config struct {
+	// Key seals our blocks. Without it the engine only verifies.
+	Key *crypto.PrivateKey
+	// Now is the clock of the node.
+	Now func() time.Time
+	// BlockTime is used by engines whose genesis does not set one.
+	BlockTime time.Duration
+	// Threads is the number of goroutines that mine, the default is one
+	// per CPU.
+	Threads int
+}
+
+// New creates the engine the genesis names.
+func New(g *core.Genesis, cfg Config) (Engine, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if g.BlockTime > 0 {
+		cfg.BlockTime = g.BlockTime
+	}
+
+	switch g.Engine {
+	case "", EngineSingle:
+		return NewSingle(cfg), nil
+	case EnginePoA:
+		return NewPoA(g, cfg)
+	case EnginePoW:
+		return NewPoW(g, cfg)
+	case EngineBFT:
+		return NewBFT(g, cfg)
+	}
+	return nil, fmt.Errorf("unknown consensus engine %q", g.Engine)
+}
+
+// checkTimestamp rejects blocks from the future.
+func checkTimestamp(b *core.Block, now time.Time) error {
+	if limit := now.Add(maxClockDrift); b.Timestamp > limit.UnixNano() {
+		return fmt.Errorf("%w: block %s at %s", ErrBlockInFuture, b.Hash(core.BlockHasher{}), time.Unix(0, b.Timestamp).UTC())
+	}
+	return nil
+}
+
+// sign signs b with key.
+func sign(key *crypto.PrivateKey, b *core.Block) error {
+	if key == nil {
+		return errors.New("no key to seal blocks with")
+	}
+	return b.Sign(*key)
+}
@@ -0,0 +1,75 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEngine(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+
+	engine, err := New(&core.Genesis{}, Config{BlockTime: time.Second})
+	assert.Nil(t, err)
+	assert.IsType(t, &Single{}, engine)
+
+	engine, err = New(&core.Genesis{Engine: EnginePoA, Validators: []crypto.PublicKey{key.PublicKey()}, BlockTime: time.Second}, Config{})
+	assert.Nil(t, err)
+	assert.IsType(t, &PoA{}, engine)
+
+	// PoA needs validators and a block time.
+	_, err = New(&core.Genesis{Engine: EnginePoA, BlockTime: time.Second}, Config{})
+	assert.NotNil(t, err)
+	_, err = New(&core.Genesis{Engine: EnginePoA, Validators: []crypto.PublicKey{key.PublicKey()}}, Config{})
+	assert.NotNil(t, err)
+
+	engine, err = New(&core.Genesis{Engine: EnginePoW, BlockTime: time.Second, Difficulty: TestDifficulty}, Config{})
+	assert.Nil(t, err)
+	assert.IsType(t, &PoW{}, engine)
+
+	// PoW needs a difficulty.
+	_, err = New(&core.Genesis{Engine: EnginePoW, BlockTime: time.Second}, Config{})
+	assert.NotNil(t, err)
+
+	engine, err = New(&core.Genesis{Engine: EngineBFT, Validators: []crypto.PublicKey{key.PublicKey()}, BlockTime: time.Second}, Config{})
+	assert.Nil(t, err)
+	assert.IsType(t, &BFT{}, engine)
+
+	// BFT needs validators.
+	_, err = New(&core.Genesis{Engine: EngineBFT, BlockTime: time.Second}, Config{})
+	assert.NotNil(t, err)
+
+	_, err = New(&core.Genesis{Engine: "magic"}, Config{})
+	assert.NotNil(t, err)
+}
+
+func TestSingle(t *testing.T) {
+	now := poaEpoch.Add(time.Minute)
+	key := crypto.GeneratePrivateKey()
+	engine := NewSingle(Config{Key: &key, Now: func() time.Time { return now }, BlockTime: time.Second})
+	parent := &core.Header{Height: 4, Timestamp: now.Add(-300 * time.Millisecond).UnixNano()}
+
+	at, ok := engine.NextSeal(nil, parent, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(700*time.Millisecond).UnixNano(), at.UnixNano())
+	at, _ = engine.NextSeal(nil, parent, now.Add(time.Hour))
+	assert.Equal(t, now.Add(time.Hour).UnixNano(), at.UnixNano())
+
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.Prepare(nil, b.Header))
+	assert.Equal(t, now.UnixNano(), b.Timestamp)
+	assert.Nil(t, engine.Seal(context.Background(), nil, b))
+	assert.Nil(t, b.Verify())
+	assert.Nil(t, engine.VerifySeal(nil, parent, b))
+
+	assert.Equal(t, int64(1), engine.Work(b.Header).Int64())
+
+	// without a key the engine only verifies.
+	_, ok = NewSingle(Config{BlockTime: time.Second}).NextSeal(nil, parent, now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,159 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+var (
+	ErrNotValidator = errors.New("block signed by a key that is not a validator")
+	ErrWrongSlot    = errors.New("block signed outside the slot of its validator")
+)
+
+// PoA is proof of authority consensus. The validators take turns: time
+// after a block is divided into slots of one block time each, and every
+// slot has a single validator that may sign the next block. Slot 0 starts
+// one block time after the parent and belongs to the validator scheduled
+// for the height, round robin by height. If it misses its slot the next
+// validator in line takes over, and so on. Every validator of the epoch
+// gets the same turns no matter its voting power. PoA has no finality,
+// the longest chain wins.
+type PoA struct {
+	blockTime time.Duration
+	key       *crypto.PrivateKey
+	now       func() time.Time
+}
+
+// NewPoA creates the PoA engine for the validators of g.
+func NewPoA(g *core.Genesis, cfg Config) (*PoA, error) {
+	if len(g.Validators) == 0 {
+		return nil, errors.New("PoA needs at least one validator")
+	}
+	if g.BlockTime <= 0 {
+		return nil, errors.New("PoA needs the block time in the genesis")
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &PoA{
+		blockTime: g.BlockTime,
+		key:       cfg.Key,
+		now:       cfg.Now,
+	}, nil
+}
+
+// Leader returns the validator of vs that may sign the block at height in
+// the given slot.
+func (p *PoA) Leader(vs core.ValidatorSet, height uint32, slot uint64) crypto.PublicKey {
+	n := uint64(len(vs))
+	return vs[(uint64(height)%n+slot%n)%n].Key
+}
+
+// Slot returns the slot a block with the given timestamp on top of parent
+// falls into.
+func (p *PoA) Slot(parent *core.Header, timestamp int64) (uint64, error) {
+	elapsed := timestamp - parent.Timestamp
+	if elapsed < int64(p.blockTime) {
+		return 0, fmt.Errorf("%w: block only %s after its parent", ErrWrongSlot, time.Duration(elapsed))
+	}
+	return uint64(elapsed/int64(p.blockTime)) - 1, nil
+}
+
+// NextSlot returns the earliest time at or after now at which key may sign
+// the block on top of parent, vs are the validators of the block. It
+// returns false if key is not one of them.
+func (p *PoA) NextSlot(vs core.ValidatorSet, parent *core.Header, key crypto.PublicKey, now time.Time) (time.Time, bool) {
+	i := vs.Index(key)
+	if i < 0 {
+		return time.Time{}, false
+	}
+
+	var (
+		n         = uint64(len(vs))
+		blockTime = int64(p.blockTime)
+		height    = uint64(parent.Height) + 1
+		// slot is the first slot of key for this height, its later slots
+		// follow every n slots.
+		slot  = (uint64(i) + n - height%n) % n
+		start = func(slot uint64) int64 {
+			return parent.Timestamp + int64(slot+1)*blockTime
+		}
+		at = now.UnixNano()
+	)
+	if at >= start(slot)+blockTime {
+		missed := uint64((at-start(slot))/blockTime) / n
+		slot += missed * n
+		if at >= start(slot)+blockTime {
+			slot += n
+		}
+	}
+	if start(slot) > at {
+		at = start(slot)
+	}
+	return time.Unix(0, at), true
+}
+
+// NextSeal returns our next slot. While we are no validator we look again
+// after a block time, an epoch may make us one.
+func (p *PoA) NextSeal(chain ChainReader, parent *core.Header, now time.Time) (time.Time, bool) {
+	if p.key == nil {
+		return time.Time{}, false
+	}
+	vs, err := chain.ValidatorSet(parent.Height + 1)
+	if err != nil {
+		return now.Add(p.blockTime), true
+	}
+	if at, ok := p.NextSlot(vs, parent, p.key.PublicKey(), now); ok {
+		return at, true
+	}
+	return now.Add(p.blockTime), true
+}
+
+// Prepare sets the timestamp, which decides the slot of the block.
+func (p *PoA) Prepare(chain ChainReader, header *core.Header) error {
+	header.Timestamp = p.now().UnixNano()
+	return nil
+}
+
+func (p *PoA) Seal(ctx context.Context, chain ChainReader, b *core.Block) error {
+	return sign(p.key, b)
+}
+
+// VerifySeal checks that b was signed by the validator of its slot.
+func (p *PoA) VerifySeal(chain ChainReader, parent *core.Header, b *core.Block) error {
+	if err := checkTimestamp(b, p.now()); err != nil {
+		return err
+	}
+	vs, err := chain.ValidatorSet(b.Height)
+	if err != nil {
+		return err
+	}
+	if !vs.Contains(b.Validator) {
+		return fmt.Errorf("%w: %s", ErrNotValidator, b.Validator.Address())
+	}
+
+	slot, err := p.Slot(parent, b.Timestamp)
+	if err != nil {
+		return err
+	}
+	if leader := p.Leader(vs, b.Height, slot); !bytes.Equal(leader, b.Validator) {
+		return fmt.Errorf("%w: slot %d of height %d belongs to %s, not %s", ErrWrongSlot, slot, b.Height, leader.Address(), b.Validator.Address())
+	}
+	return nil
+}
+
+func (p *PoA) Finalized(chain ChainReader) uint32 {
+	return 0
+}
+
+// Work makes the longest chain win.
+func (p *PoA) Work(h *core.Header) *big.Int {
+	return big.NewInt(1)
+}
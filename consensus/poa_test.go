@@ -0,0 +1,130 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+var poaEpoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestPoA(t *testing.T, n int, now func() time.Time) (*PoA, []crypto.PrivateKey, *headerChain) {
+	keys := []crypto.PrivateKey{}
+	g := &core.Genesis{Engine: EnginePoA, Timestamp: poaEpoch.UnixNano(), BlockTime: time.Second}
+	for i := 0; i < n; i++ {
+		key := crypto.GeneratePrivateKey()
+		keys = append(keys, key)
+		g.Validators = append(g.Validators, key.PublicKey())
+	}
+	poa, err := NewPoA(g, Config{Now: now})
+	assert.Nil(t, err)
+	return poa, keys, &headerChain{headers: []*core.Header{g.Block().Header}, validators: g.ValidatorSet()}
+}
+
+// poaBlock returns a block on top of parent, signed by key at the given
+// time after the parent.
+func poaBlock(t *testing.T, parent *core.Header, key crypto.PrivateKey, after time.Duration) *core.Block {
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Timestamp = parent.Timestamp + int64(after)
+	assert.Nil(t, b.Sign(key))
+	return b
+}
+
+func TestPoALeader(t *testing.T) {
+	poa, keys, chain := newTestPoA(t, 3, time.Now)
+	vs := chain.validators
+
+	assert.Equal(t, keys[1].PublicKey(), poa.Leader(vs, 1, 0))
+	assert.Equal(t, keys[2].PublicKey(), poa.Leader(vs, 2, 0))
+	assert.Equal(t, keys[0].PublicKey(), poa.Leader(vs, 3, 0))
+	// fallbacks
+	assert.Equal(t, keys[2].PublicKey(), poa.Leader(vs, 1, 1))
+	assert.Equal(t, keys[0].PublicKey(), poa.Leader(vs, 1, 2))
+	assert.Equal(t, keys[1].PublicKey(), poa.Leader(vs, 1, 3))
+}
+
+func TestPoANextSlot(t *testing.T) {
+	poa, keys, chain := newTestPoA(t, 3, time.Now)
+	vs := chain.validators
+	parent := &core.Header{Height: 0, Timestamp: poaEpoch.UnixNano()}
+	at := func(d time.Duration) time.Time { return poaEpoch.Add(d) }
+	unix := func(d time.Duration) int64 { return at(d).UnixNano() }
+
+	// keys[1] is the leader of height 1, its slot starts one block time
+	// after the parent.
+	next, ok := poa.NextSlot(vs, parent, keys[1].PublicKey(), at(0))
+	assert.True(t, ok)
+	assert.Equal(t, unix(time.Second), next.UnixNano())
+
+	// within the slot it may sign right away.
+	next, _ = poa.NextSlot(vs, parent, keys[1].PublicKey(), at(1500*time.Millisecond))
+	assert.Equal(t, unix(1500*time.Millisecond), next.UnixNano())
+
+	// keys[2] is the first fallback, keys[0] the second.
+	next, _ = poa.NextSlot(vs, parent, keys[2].PublicKey(), at(0))
+	assert.Equal(t, unix(2*time.Second), next.UnixNano())
+	next, _ = poa.NextSlot(vs, parent, keys[0].PublicKey(), at(0))
+	assert.Equal(t, unix(3*time.Second), next.UnixNano())
+
+	// once its slot passed a validator waits for its turn in the next
+	// round.
+	next, _ = poa.NextSlot(vs, parent, keys[1].PublicKey(), at(2*time.Second))
+	assert.Equal(t, unix(4*time.Second), next.UnixNano())
+	next, _ = poa.NextSlot(vs, parent, keys[1].PublicKey(), at(8*time.Second))
+	assert.Equal(t, unix(10*time.Second), next.UnixNano())
+
+	_, ok = poa.NextSlot(vs, parent, crypto.GeneratePrivateKey().PublicKey(), at(0))
+	assert.False(t, ok)
+}
+
+func TestPoAVerifyBlock(t *testing.T) {
+	now := poaEpoch.Add(time.Minute)
+	poa, keys, chain := newTestPoA(t, 3, func() time.Time { return now })
+	parent := &core.Header{Height: 0, Timestamp: poaEpoch.UnixNano()}
+
+	// the leader in its slot
+	assert.Nil(t, poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[1], time.Second)))
+	assert.Nil(t, poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[1], 1999*time.Millisecond)))
+
+	// the fallback after the leader missed its slot
+	assert.Nil(t, poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[2], 2*time.Second)))
+
+	// before the first slot
+	err := poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[1], 999*time.Millisecond))
+	assert.True(t, errors.Is(err, ErrWrongSlot))
+
+	// a validator in the slot of another
+	err = poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[2], time.Second))
+	assert.True(t, errors.Is(err, ErrWrongSlot))
+	err = poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[0], 2*time.Second))
+	assert.True(t, errors.Is(err, ErrWrongSlot))
+
+	// not a validator
+	err = poa.VerifySeal(chain, parent, poaBlock(t, parent, crypto.GeneratePrivateKey(), time.Second))
+	assert.True(t, errors.Is(err, ErrNotValidator))
+
+	// a timestamp in the future cannot claim a later slot
+	err = poa.VerifySeal(chain, parent, poaBlock(t, parent, keys[0], 3*time.Minute))
+	assert.True(t, errors.Is(err, ErrBlockInFuture))
+}
+
+func TestPoAValidator(t *testing.T) {
+	poa, keys, _ := newTestPoA(t, 2, time.Now)
+	genesis := &core.Genesis{Engine: EnginePoA, Timestamp: poaEpoch.UnixNano(), Validators: []crypto.PublicKey{keys[0].PublicKey(), keys[1].PublicKey()}, BlockTime: time.Second}
+	bc, err := core.NewBlockChain(log.NewNopLogger(), genesis.Block())
+	assert.Nil(t, err)
+	bc.SetValidators(genesis.ValidatorSet(), genesis.EpochLength)
+	bc.SetConsensus(poa)
+
+	parent, err := bc.GetHeader(0)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(bc.AddBlock(poaBlock(t, parent, keys[0], time.Second)), ErrWrongSlot))
+	assert.Nil(t, bc.AddBlock(poaBlock(t, parent, keys[1], time.Second)))
+	assert.Equal(t, uint32(1), bc.Height())
+}
@@ -0,0 +1,253 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+var (
+	ErrWrongDifficulty = errors.New("block has the wrong difficulty")
+	ErrInvalidPoW      = errors.New("block hash does not meet its difficulty")
+	// ErrNewTip is returned by a miner that stopped because the chain got
+	// a new tip, its block would be stale.
+	ErrNewTip = errors.New("chain got a new tip while mining")
+)
+
+// TestDifficulty lets a test chain mine a block in a handful of hashes.
+const TestDifficulty = 4
+
+var (
+	// retargetWindow is the number of blocks after which the difficulty
+	// is adjusted to the time they took.
+	retargetWindow uint32 = 16
+	// maxRetarget bounds the factor by which one adjustment changes the
+	// difficulty.
+	maxRetarget int64 = 4
+	// tipCheckInterval is the number of nonces a miner tries between two
+	// looks at the tip of the chain.
+	tipCheckInterval uint64 = 1 << 12
+)
+
+// PoW is proof of work consensus. Anyone may mine a block by finding a
+// Nonce that makes the block hash at most 2^256 / Difficulty. Every
+// retarget window the difficulty is scaled so that blocks come one block
+// time apart. The branch with the most work, the sum of the difficulties
+// of its blocks, is the chain. Nothing is final.
+type PoW struct {
+	blockTime time.Duration
+	key       *crypto.PrivateKey
+	now       func() time.Time
+	threads   int
+}
+
+// NewPoW creates the PoW engine. The difficulty of the first blocks is the
+// one of the genesis header.
+func NewPoW(g *core.Genesis, cfg Config) (*PoW, error) {
+	if g.Difficulty == 0 {
+		return nil, errors.New("PoW needs the difficulty in the genesis")
+	}
+	if g.BlockTime <= 0 {
+		return nil, errors.New("PoW needs the block time in the genesis")
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	if cfg.Threads <= 0 {
+		cfg.Threads = runtime.NumCPU()
+	}
+	return &PoW{
+		blockTime: g.BlockTime,
+		key:       cfg.Key,
+		now:       cfg.Now,
+		threads:   cfg.Threads,
+	}, nil
+}
+
+// Target returns the highest block hash that meets difficulty.
+func Target(difficulty uint64) *big.Int {
+	if difficulty == 0 {
+		difficulty = 1
+	}
+	target := new(big.Int).Lsh(big.NewInt(1), 256)
+	return target.Div(target, new(big.Int).SetUint64(difficulty))
+}
+
+func meetsTarget(hash types.Hash, target *big.Int) bool {
+	return new(big.Int).SetBytes(hash.ToSlice()).Cmp(target) <= 0
+}
+
+// Difficulty returns the difficulty of the block on top of parent, chain
+// ends in parent.
+func (p *PoW) Difficulty(chain ChainReader, parent *core.Header) (uint64, error) {
+	height := parent.Height + 1
+	if height%retargetWindow != 0 || height == retargetWindow {
+		// the timestamp of the genesis says nothing about how fast the
+		// first blocks were mined.
+		return parent.Difficulty, nil
+	}
+
+	first, err := chain.GetHeader(height - retargetWindow)
+	if err != nil {
+		return 0, err
+	}
+	expected := int64(retargetWindow-1) * int64(p.blockTime)
+	actual := parent.Timestamp - first.Timestamp
+	if actual < expected/maxRetarget {
+		actual = expected / maxRetarget
+	}
+	if actual > expected*maxRetarget {
+		actual = expected * maxRetarget
+	}
+
+	d := new(big.Int).SetUint64(parent.Difficulty)
+	d.Mul(d, big.NewInt(expected))
+	d.Div(d, big.NewInt(actual))
+	if !d.IsUint64() {
+		return math.MaxUint64, nil
+	}
+	if d.Uint64() == 0 {
+		return 1, nil
+	}
+	return d.Uint64(), nil
+}
+
+// NextSeal lets a node with a key mine all the time.
+func (p *PoW) NextSeal(chain ChainReader, parent *core.Header, now time.Time) (time.Time, bool) {
+	if p.key == nil {
+		return time.Time{}, false
+	}
+	return now, true
+}
+
+// Prepare sets the timestamp and the difficulty.
+func (p *PoW) Prepare(chain ChainReader, header *core.Header) error {
+	parent, err := chain.GetHeader(header.Height - 1)
+	if err != nil {
+		return err
+	}
+	difficulty, err := p.Difficulty(chain, parent)
+	if err != nil {
+		return err
+	}
+
+	header.Timestamp = p.now().UnixNano()
+	header.Difficulty = difficulty
+	return nil
+}
+
+// Seal searches a nonce that meets the difficulty of b and signs b. The
+// miners stop when ctx is done or the chain gets a new tip.
+func (p *PoW) Seal(ctx context.Context, chain ChainReader, b *core.Block) error {
+	if p.key == nil {
+		return errors.New("no key to seal blocks with")
+	}
+
+	tip := func() types.Hash {
+		h, err := chain.GetHeader(chain.Height())
+		if err != nil {
+			return types.Hash{}
+		}
+		return core.BlockHasher{}.Hash(h)
+	}
+	parent := b.PrevBlockHash
+	if tip() != parent {
+		return ErrNewTip
+	}
+
+	var (
+		target = Target(b.Difficulty)
+		found  = make(chan uint64, 1)
+		wg     sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < p.threads; i++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+
+			h := *b.Header
+			for tries := uint64(0); ; tries++ {
+				if tries%tipCheckInterval == 0 && (ctx.Err() != nil || tip() != parent) {
+					return
+				}
+				h.Nonce = nonce
+				if meetsTarget(core.BlockHasher{}.Hash(&h), target) {
+					select {
+					case found <- nonce:
+					default:
+					}
+					return
+				}
+				nonce += uint64(p.threads)
+			}
+		}(uint64(i))
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case nonce := <-found:
+		cancel()
+		<-stopped
+		b.Nonce = nonce
+		return sign(p.key, b)
+	case <-stopped:
+		select {
+		case nonce := <-found:
+			b.Nonce = nonce
+			return sign(p.key, b)
+		default:
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return ErrNewTip
+	}
+}
+
+// VerifySeal checks the difficulty of b and that its hash meets it.
+func (p *PoW) VerifySeal(chain ChainReader, parent *core.Header, b *core.Block) error {
+	if err := checkTimestamp(b, p.now()); err != nil {
+		return err
+	}
+
+	difficulty, err := p.Difficulty(chain, parent)
+	if err != nil {
+		return err
+	}
+	if b.Difficulty != difficulty {
+		return fmt.Errorf("%w: %d, expected %d", ErrWrongDifficulty, b.Difficulty, difficulty)
+	}
+
+	hash := core.BlockHasher{}.Hash(b.Header)
+	if !meetsTarget(hash, Target(b.Difficulty)) {
+		return fmt.Errorf("%w: block %s with difficulty %d", ErrInvalidPoW, hash, b.Difficulty)
+	}
+	return nil
+}
+
+func (p *PoW) Finalized(chain ChainReader) uint32 {
+	return 0
+}
+
+// Work is the difficulty of the block, the expected number of hashes it
+// took.
+func (p *PoW) Work(h *core.Header) *big.Int {
+	return new(big.Int).SetUint64(h.Difficulty)
+}
@@ -0,0 +1,156 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// headerChain is a ChainReader over a slice of headers with the same
+// validators at every height.
+type headerChain struct {
+	lock       sync.Mutex
+	headers    []*core.Header
+	validators core.ValidatorSet
+}
+
+func (c *headerChain) Height() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return uint32(len(c.headers) - 1)
+}
+
+func (c *headerChain) GetHeader(height uint32) (*core.Header, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.headers[height], nil
+}
+
+func (c *headerChain) ValidatorSet(height uint32) (core.ValidatorSet, error) {
+	return c.validators, nil
+}
+
+func (c *headerChain) add(h *core.Header) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.headers = append(c.headers, h)
+}
+
+func newTestPoW(t *testing.T, difficulty uint64) (*PoW, *core.Genesis) {
+	key := crypto.GeneratePrivateKey()
+	g := &core.Genesis{Engine: EnginePoW, Timestamp: poaEpoch.UnixNano(), BlockTime: time.Second, Difficulty: difficulty}
+	pow, err := NewPoW(g, Config{Key: &key, Threads: 4})
+	assert.Nil(t, err)
+	return pow, g
+}
+
+func TestPoWMine(t *testing.T) {
+	pow, g := newTestPoW(t, TestDifficulty)
+	bc, err := core.NewBlockChain(log.NewNopLogger(), g.Block())
+	assert.Nil(t, err)
+	bc.SetConsensus(pow)
+
+	for i := 0; i < 5; i++ {
+		parent, err := bc.GetHeader(bc.Height())
+		assert.Nil(t, err)
+		b, err := core.NewBlockFromPrevHeader(parent, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, pow.Prepare(bc, b.Header))
+		assert.Equal(t, uint64(TestDifficulty), b.Difficulty)
+		assert.Nil(t, pow.Seal(context.Background(), bc, b))
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, uint32(5), bc.Height())
+	assert.Equal(t, int64(5*TestDifficulty), bc.Work().Int64())
+}
+
+func TestPoWVerifySeal(t *testing.T) {
+	pow, g := newTestPoW(t, 1<<40)
+	parent := g.Block().Header
+	chain := &headerChain{headers: []*core.Header{parent}}
+
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Difficulty = 1 << 40
+	err = pow.VerifySeal(chain, parent, b)
+	assert.True(t, errors.Is(err, ErrInvalidPoW))
+
+	b.Difficulty = TestDifficulty
+	err = pow.VerifySeal(chain, parent, b)
+	assert.True(t, errors.Is(err, ErrWrongDifficulty))
+
+	// difficulty 1 accepts every hash.
+	pow, g = newTestPoW(t, 1)
+	parent = g.Block().Header
+	b, err = core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Difficulty = 1
+	assert.Nil(t, pow.VerifySeal(&headerChain{headers: []*core.Header{parent}}, parent, b))
+}
+
+func TestPoWRetarget(t *testing.T) {
+	pow, g := newTestPoW(t, 1000)
+	chain := &headerChain{headers: []*core.Header{g.Block().Header}}
+	// mine 2 windows at the given time per block.
+	build := func(blockTime time.Duration) {
+		chain.headers = chain.headers[:1]
+		for h := uint32(1); h < 2*retargetWindow; h++ {
+			parent := chain.headers[h-1]
+			chain.add(&core.Header{Height: h, Timestamp: parent.Timestamp + int64(blockTime), Difficulty: 1000})
+		}
+	}
+
+	build(time.Second)
+	d, err := pow.Difficulty(chain, chain.headers[retargetWindow-1])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), d)
+	d, err = pow.Difficulty(chain, chain.headers[retargetWindow])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), d)
+	d, err = pow.Difficulty(chain, chain.headers[2*retargetWindow-1])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1000), d)
+
+	// blocks twice as fast double the difficulty.
+	build(time.Second / 2)
+	d, err = pow.Difficulty(chain, chain.headers[2*retargetWindow-1])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2000), d)
+
+	// a single adjustment is bounded.
+	build(time.Minute)
+	d, err = pow.Difficulty(chain, chain.headers[2*retargetWindow-1])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(250), d)
+	build(0)
+	d, err = pow.Difficulty(chain, chain.headers[2*retargetWindow-1])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4000), d)
+}
+
+func TestPoWSealStops(t *testing.T) {
+	pow, g := newTestPoW(t, 1<<62)
+	parent := g.Block().Header
+	chain := &headerChain{headers: []*core.Header{parent}}
+
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, pow.Prepare(chain, b.Header))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.Is(pow.Seal(ctx, chain, b), context.DeadlineExceeded))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		chain.add(&core.Header{Height: 1})
+	}()
+	assert.Equal(t, ErrNewTip, pow.Seal(context.Background(), chain, b))
+}
@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+// Single is the consensus of a development chain: a node with a key seals
+// a block every block time, and every correctly signed block is accepted,
+// whoever signed it. Nothing is final and the longest chain wins.
+type Single struct {
+	key       *crypto.PrivateKey
+	now       func() time.Time
+	blockTime time.Duration
+}
+
+func NewSingle(cfg Config) *Single {
+	return &Single{
+		key:       cfg.Key,
+		now:       cfg.Now,
+		blockTime: cfg.BlockTime,
+	}
+}
+
+func (e *Single) NextSeal(chain ChainReader, parent *core.Header, now time.Time) (time.Time, bool) {
+	if e.key == nil {
+		return time.Time{}, false
+	}
+	at := time.Unix(0, parent.Timestamp).Add(e.blockTime)
+	if at.Before(now) {
+		return now, true
+	}
+	return at, true
+}
+
+func (e *Single) Prepare(chain ChainReader, header *core.Header) error {
+	header.Timestamp = e.now().UnixNano()
+	return nil
+}
+
+func (e *Single) Seal(ctx context.Context, chain ChainReader, b *core.Block) error {
+	return sign(e.key, b)
+}
+
+// VerifySeal accepts every block, its signature is checked with the block.
+func (e *Single) VerifySeal(chain ChainReader, parent *core.Header, b *core.Block) error {
+	return nil
+}
+
+func (e *Single) Finalized(chain ChainReader) uint32 {
+	return 0
+}
+
+// Work makes the longest chain win.
+func (e *Single) Work(h *core.Header) *big.Int {
+	return big.NewInt(1)
+}
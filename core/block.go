@@ -3,7 +3,7 @@ package core
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
 	"fmt"
 	"time"
 
@@ -18,20 +18,55 @@ type Header struct {
 	Timestamp     int64
 	Height        uint32
 	Nonce         uint64
+	// Difficulty is the expected number of hashes needed to find a Nonce
+	// that seals the block, for engines with proof of work. The others
+	// leave it at 0.
+	Difficulty uint64
 }
 
+// HeaderSize is the size of the canonical header encoding.
+const HeaderSize = 1 + 4 + 32 + 32 + 8 + 4 + 8 + 8
+
+// Bytes returns the canonical encoding of the header: the codec version
+// followed by the fields at fixed offsets, see docs/encoding.md. The block
+// hash is the hash of these bytes.
 func (h *Header) Bytes() []byte {
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	enc.Encode(h)
-	return buf.Bytes()
+	b := make([]byte, HeaderSize)
+	b[0] = CodecVersion
+	binary.BigEndian.PutUint32(b[1:5], h.Version)
+	copy(b[5:37], h.DataHash[:])
+	copy(b[37:69], h.PrevBlockHash[:])
+	binary.BigEndian.PutUint64(b[69:77], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(b[77:81], h.Height)
+	binary.BigEndian.PutUint64(b[81:89], h.Nonce)
+	binary.BigEndian.PutUint64(b[89:97], h.Difficulty)
+	return b
+}
+
+// Verify checks that sig is the signature of validator over the hash of
+// the header, so none of its fields changed after signing.
+func (h *Header) Verify(validator crypto.PublicKey, sig *crypto.Signature) error {
+	if sig == nil {
+		return fmt.Errorf("block has no sign")
+	}
+
+	hash := BlockHasher{}.Hash(h)
+	if !sig.Verify(validator, hash.ToSlice()) {
+		return fmt.Errorf("block %s has invalid sign", hash)
+	}
+	return nil
 }
 
 type Block struct {
 	*Header
 	Transactions []*Transaction
-	Validator    crypto.PublicKey
-	Signature    *crypto.Signature
+	// Evidence of double signing by validators, covered by the DataHash.
+	Evidence  []*Evidence
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+	// Commit proves that the block was decided by BFT consensus. It is
+	// nil for the other engines and not covered by the block hash.
+	Commit *Commit
 	// cached version of the header hash
 	hash types.Hash
 }
@@ -49,7 +84,7 @@ func NewBlockFromPrevHeader(prevHeader *Header, txx []*Transaction) (*Block, err
 		return nil, err
 	}
 	header := &Header{
-		Version:       1,
+		Version:       BlockVersion,
 		Height:        prevHeader.Height + 1,
 		DataHash:      dataHash,
 		PrevBlockHash: BlockHasher{}.Hash(prevHeader),
@@ -61,8 +96,24 @@ func (b *Block) AddTransaction(tx *Transaction) {
 	b.Transactions = append(b.Transactions, tx)
 }
 
+// SetEvidence sets the evidence the block carries and updates its
+// DataHash. The block has to be signed again afterwards.
+func (b *Block) SetEvidence(evidence []*Evidence) error {
+	dataHash, err := CalculateDataHash(b.Transactions, evidence...)
+	if err != nil {
+		return err
+	}
+	b.Evidence = evidence
+	b.DataHash = dataHash
+	b.hash = types.Hash{}
+	return nil
+}
+
+// Sign signs the hash of the header. Signing the header bytes themselves
+// would only cover their first 32 bytes, ECDSA truncates longer input.
 func (b *Block) Sign(privKey crypto.PrivateKey) error {
-	sig, err := privKey.Sign(b.Header.Bytes())
+	hash := BlockHasher{}.Hash(b.Header)
+	sig, err := privKey.Sign(hash.ToSlice())
 	if err != nil {
 		panic(err)
 	}
@@ -73,12 +124,12 @@ func (b *Block) Sign(privKey crypto.PrivateKey) error {
 }
 
 func (b *Block) Verify() error {
-	if b.Signature == nil {
-		return fmt.Errorf("block has no sign")
+	if !b.hash.IsZero() && b.hash != (BlockHasher{}).Hash(b.Header) {
+		return fmt.Errorf("block %s changed after it was hashed", b.hash)
 	}
 
-	if !b.Signature.Verify(b.Validator, b.Header.Bytes()) {
-		return fmt.Errorf("block has invalid sign")
+	if err := b.Header.Verify(b.Validator, b.Signature); err != nil {
+		return err
 	}
 
 	for _, tx := range b.Transactions {
@@ -87,7 +138,7 @@ func (b *Block) Verify() error {
 		}
 	}
 
-	dataHash, err := CalculateDataHash(b.Transactions)
+	dataHash, err := CalculateDataHash(b.Transactions, b.Evidence...)
 	if err != nil {
 		return err
 	}
@@ -113,11 +164,18 @@ func (b *Block) Hash(hasher Hasher[*Header]) types.Hash {
 	return b.hash
 }
 
-func CalculateDataHash(txx []*Transaction) (hash types.Hash, err error) {
+// CalculateDataHash returns the hash of the transactions of a block
+// followed by its evidence.
+func CalculateDataHash(txx []*Transaction, evidence ...*Evidence) (hash types.Hash, err error) {
 	buf := &bytes.Buffer{}
 
 	for _, tx := range txx {
-		if err := tx.Encode(NewGobTxEncoder(buf)); err != nil {
+		if err := tx.Encode(NewBinaryTxEncoder(buf)); err != nil {
+			return types.Hash{}, err
+		}
+	}
+	for _, ev := range evidence {
+		if err := WriteBinary(buf, ev); err != nil {
 			return types.Hash{}, err
 		}
 	}
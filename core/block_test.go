@@ -2,6 +2,9 @@ package core
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -26,10 +29,102 @@ func TestVerifyBlock(t *testing.T) {
 	assert.Nil(t, b.Sign(privkey))
 	assert.Nil(t, b.Verify())
 
-	//TODO
 	// edit header
-	// b.Height = 100
-	// assert.NotNil(t, b.Verify())
+	b.Height = 100
+	assert.NotNil(t, b.Verify())
+}
+
+func TestVerifyBlockEveryHeaderField(t *testing.T) {
+	edits := map[string]func(h *Header){
+		"Version":       func(h *Header) { h.Version++ },
+		"DataHash":      func(h *Header) { h.DataHash[31]++ },
+		"PrevBlockHash": func(h *Header) { h.PrevBlockHash[31]++ },
+		"Timestamp":     func(h *Header) { h.Timestamp++ },
+		"Height":        func(h *Header) { h.Height++ },
+		"Nonce":         func(h *Header) { h.Nonce++ },
+		"Difficulty":    func(h *Header) { h.Difficulty++ },
+	}
+	for field, edit := range edits {
+		b := randomBlock(t, 1, types.Hash{})
+		edit(b.Header)
+		assert.NotNil(t, b.Header.Verify(b.Validator, b.Signature), field)
+		assert.NotNil(t, b.Verify(), field)
+	}
+}
+
+func TestVerifyBlockChangedAfterHashing(t *testing.T) {
+	b := randomBlock(t, 1, types.Hash{})
+	hash := b.Hash(BlockHasher{})
+
+	// a block that was hashed keeps its hash, even if the header changes
+	// afterwards.
+	b.Height++
+	assert.Equal(t, hash, b.Hash(BlockHasher{}))
+	assert.NotNil(t, b.Verify())
+}
+
+func TestHeaderBytesVectors(t *testing.T) {
+	vectors := []struct {
+		header *Header
+		bytes  string
+		hash   string
+	}{
+		{
+			header: &Header{},
+			bytes:  "07" + strings.Repeat("00", 96),
+			hash:   "59482d394ef6a0658778158e865604a268fa3c735b1f8267388d9e9445f54b3f",
+		},
+		{
+			header: &Header{
+				Version:       1,
+				DataHash:      types.Hash{0x01, 0x02},
+				PrevBlockHash: types.Hash{31: 0xff},
+				Timestamp:     1700000000000000000,
+				Height:        42,
+				Nonce:         7,
+				Difficulty:    1024,
+			},
+			bytes: "07" + "00000001" +
+				"0102" + strings.Repeat("00", 30) +
+				strings.Repeat("00", 31) + "ff" +
+				"17979cfe362a0000" + "0000002a" + "0000000000000007" +
+				"0000000000000400",
+			hash: "5aa5ca1471e165e0c0660f4a065f2e979364f3f8573821f5ae818f8b82a0f362",
+		},
+		{
+			header: &Header{
+				Version:    0xffffffff,
+				Timestamp:  -1,
+				Height:     0xffffffff,
+				Nonce:      0xffffffffffffffff,
+				Difficulty: 0xffffffffffffffff,
+			},
+			bytes: "07" + "ffffffff" + strings.Repeat("00", 64) +
+				"ffffffffffffffff" + "ffffffff" + "ffffffffffffffff" +
+				"ffffffffffffffff",
+			hash: "ab668b2b7615e66825be5bcbd1a978ac413181a2dacda4e661450999855bd788",
+		},
+	}
+
+	for _, v := range vectors {
+		assert.Equal(t, v.bytes, hex.EncodeToString(v.header.Bytes()))
+		assert.Len(t, v.header.Bytes(), HeaderSize)
+		assert.Equal(t, v.hash, BlockHasher{}.Hash(v.header).String())
+
+		// the codec writes the same bytes.
+		b, err := MarshalBinary(v.header)
+		assert.Nil(t, err)
+		assert.Equal(t, v.header.Bytes(), b)
+
+		decoded := new(Header)
+		assert.Nil(t, UnmarshalBinary(b, decoded))
+		assert.Equal(t, v.header, decoded)
+	}
+
+	// the zero header of version 1, before the difficulty, is refused.
+	v1, err := hex.DecodeString("01" + strings.Repeat("00", 88))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(UnmarshalBinary(v1, new(Header)), ErrUnknownCodecVersion))
 }
 
 func TestDecodeEncode(t *testing.T) {
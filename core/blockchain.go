@@ -2,23 +2,68 @@ package core
 
 import (
 	"fmt"
+	"math/big"
 	"sync"
+	"time"
 
+	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/types"
 	"github.com/go-kit/log"
 )
 
+// stateInterval is how many blocks of the main chain apart we keep a copy
+// of the state. A reorg runs the blocks from the copy at or below the
+// block it forks off from.
+var stateInterval uint32 = 32
+
 type BlockChain struct {
 	logger    log.Logger
 	store     Storage
 	lock      sync.RWMutex
+	// addLock makes sure only one block at a time is validated and added.
+	addLock   sync.Mutex
+	// headers and blocks are the main chain, the branch with the most
+	// work.
 	headers   []*Header
 	blocks    []*Block
 	txStore map[types.Hash]*Transaction
+	// evidenceStore holds the block of the main chain that carries each
+	// evidence.
+	evidenceStore map[types.Hash]*Block
+	// blockStore holds every valid block we know, on the main chain or on
+	// another branch.
 	blockStore map[types.Hash]*Block
+	// work is the total work of the branch ending in each block of
+	// blockStore.
+	work map[types.Hash]*big.Int
 	validator Validator
+	// consensus is nil if the chain was not given one, every block then
+	// weighs the same.
+	consensus Consensus
 	// TODO make this an interface
 	contractState *State
+	// states holds a copy of the state after every stateInterval-th
+	// block of the main chain by height, down to the last one at or
+	// below the finalized height.
+	states map[uint32]*State
+	// pruned is the finalized height up to which we dropped what can
+	// not be part of the chain anymore.
+	pruned uint32
+	// validators is the validator set of the first epoch, the later ones
+	// follow from the validator updates in the blocks.
+	validators  ValidatorSet
+	epochLength uint32
+	setLock     sync.Mutex
+	// validatorSets caches the set of every epoch by the hash of the last
+	// block before it.
+	validatorSets map[types.Hash]ValidatorSet
+	// now is the clock blocks from the future are checked against.
+	now func() time.Time
+	// checkpoints pin the blocks at their heights, lowest first.
+	checkpoints []Checkpoint
+	// trusted holds the hashes of the headers below a checkpoint we
+	// synced from by height.
+	trusted map[uint32]types.Hash
 }
 
 func NewBlockChain(l log.Logger, genesis *Block) (*BlockChain, error) {
@@ -27,8 +72,15 @@ func NewBlockChain(l log.Logger, genesis *Block) (*BlockChain, error) {
 		store:   NewMemStore(),
 		logger: l,
 		contractState: NewState(),
+		states: map[uint32]*State{0: NewState()},
 		blockStore: make(map[types.Hash]*Block),
 		txStore: make(map[types.Hash]*Transaction),
+		evidenceStore: make(map[types.Hash]*Block),
+		work: make(map[types.Hash]*big.Int),
+		epochLength: DefaultEpochLength,
+		validatorSets: make(map[types.Hash]ValidatorSet),
+		now: time.Now,
+		trusted: make(map[uint32]types.Hash),
 	}
 
 	bc.validator = NewBlockValidator(bc)
@@ -42,23 +94,393 @@ func (bc *BlockChain) SGetValidator(v Validator) {
 	bc.validator = v
 }
 
+// SetConsensus makes c decide which blocks are valid and which branch is
+// the chain.
+func (bc *BlockChain) SetConsensus(c Consensus) {
+	bc.consensus = c
+	bc.validator = NewSealValidator(bc, c)
+}
+
+// AddBlock adds b on top of the chain or, if its parent is another block
+// we know, to a branch. A branch that gets more work than the chain
+// becomes the chain.
 func (bc *BlockChain) AddBlock(b *Block) error {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
 	// validate before adding to chain
 	if err := bc.validator.ValidateBlock(b); err != nil {
 		return err
 	}
+
+	if b.PrevBlockHash != bc.tipHash() {
+		if err := bc.addBranchBlock(b); err != nil {
+			return err
+		}
+		bc.prune()
+		return nil
+	}
+
+	if err := bc.executeBlock(bc.contractState, b); err != nil {
+		return err
+	}
+	if err := bc.addBlockWithoutValidation(b); err != nil {
+		return err
+	}
+	if b.Height%stateInterval == 0 {
+		bc.lock.Lock()
+		bc.states[b.Height] = bc.contractState.Copy()
+		bc.lock.Unlock()
+	}
+	bc.prune()
+	return nil
+}
+
+// CheckBlock checks that b is a valid next block for the tip of the chain
+// without its seal and without adding it. Transactions run on a copy of
+// the state. BFT validators check proposals with it before they vote.
+func (bc *BlockChain) CheckBlock(b *Block) error {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
+	hash := b.Hash(BlockHasher{})
+	if b.PrevBlockHash != bc.tipHash() {
+		return fmt.Errorf("%w: block (%s) is not on top of the tip", ErrUnknownParent, hash)
+	}
+	if b.Height != bc.Height()+1 {
+		return fmt.Errorf("block (%s) with height (%d) on top of height (%d)", hash, b.Height, bc.Height())
+	}
+	parent, err := bc.GetBlockByHash(b.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+	if _, err := bc.checkCheckpoint(b); err != nil {
+		return err
+	}
+	if err := bc.checkHeader(parent.Header, b); err != nil {
+		return err
+	}
+	if err := b.Verify(); err != nil {
+		return err
+	}
+	if err := bc.verifyBlockEvidence(parent.Header, b); err != nil {
+		return err
+	}
+	return bc.executeBlock(bc.contractState.Copy(), b)
+}
+
+// executeBlock runs the transactions of b on state. Their nonces are
+// checked first and count only if all transactions ran.
+func (bc *BlockChain) executeBlock(state *State, b *Block) error {
+	nonces, err := state.nextNonces(b.Transactions)
+	if err != nil {
+		return err
+	}
 	for _, tx := range b.Transactions {
+		// validator updates are counted at the end of their epoch.
+		if tx.Type != TxTypeContract {
+			continue
+		}
 		bc.logger.Log("msg", "executing code", "hash", tx.Hash(&TxHasher{}))
-		vm := NewVM(tx.Data, bc.contractState)
+		vm := NewVM(tx.Data, state)
 		if err := vm.Run(); err != nil {
 			return err
 		}
-		
+
 		result := vm.stack.Pop()
 
 		bc.logger.Log("vm result", result)
 	}
-	return bc.addBlockWithoutValidation(b)
+	state.setNonces(nonces)
+	return nil
+}
+
+// Nonce returns the nonce the next transaction of from needs on top of the
+// chain.
+func (bc *BlockChain) Nonce(from crypto.PublicKey) uint64 {
+	bc.lock.RLock()
+	state := bc.contractState
+	bc.lock.RUnlock()
+
+	return state.Nonce(from)
+}
+
+// addBranchBlock keeps b, whose parent is not the tip of the chain, and
+// switches to its branch if that has more work.
+func (bc *BlockChain) addBranchBlock(b *Block) error {
+	hash := b.Hash(BlockHasher{})
+
+	bc.lock.Lock()
+	bc.blockStore[hash] = b
+	bc.work[hash] = new(big.Int).Add(bc.work[b.PrevBlockHash], bc.blockWork(b.Header))
+	heavier := bc.work[hash].Cmp(bc.work[bc.tipHashLocked()]) > 0
+	bc.lock.Unlock()
+
+	if !heavier {
+		bc.logger.Log("msg", "adding block to a branch", "hash", hash, "height", b.Height)
+		return nil
+	}
+	return bc.reorg(b)
+}
+
+// reorg makes the branch that ends in tip the chain.
+func (bc *BlockChain) reorg(tip *Block) error {
+	bc.lock.RLock()
+	branch := []*Block{}
+	for b := tip; !bc.onChainLocked(b); b = bc.blockStore[b.PrevBlockHash] {
+		branch = append([]*Block{b}, branch...)
+	}
+	fork := branch[0].Height - 1
+	base, state := bc.stateLocked(fork)
+	common := append([]*Block{}, bc.blocks[base+1:fork+1]...)
+	oldHeight := uint32(len(bc.headers) - 1)
+	bc.lock.RUnlock()
+
+	if fork < bc.Finalized() {
+		return fmt.Errorf("%w: branch of block (%s) forks at height (%d)", ErrFinalized, tip.Hash(BlockHasher{}), fork)
+	}
+
+	// the branch runs on a copy of the state saved at or below the fork,
+	// so the state of the chain stays untouched if a block of the branch
+	// fails.
+	for _, b := range common {
+		if err := bc.executeBlock(state, b); err != nil {
+			return err
+		}
+	}
+	states := make(map[uint32]*State)
+	for i, b := range branch {
+		if err := bc.executeBlock(state, b); err != nil {
+			bc.lock.Lock()
+			for _, bad := range branch[i:] {
+				delete(bc.blockStore, bad.Hash(BlockHasher{}))
+				delete(bc.work, bad.Hash(BlockHasher{}))
+			}
+			bc.lock.Unlock()
+			return err
+		}
+		if b.Height%stateInterval == 0 {
+			states[b.Height] = state.Copy()
+		}
+	}
+
+	bc.lock.Lock()
+	for _, old := range bc.blocks[fork+1:] {
+		for _, tx := range old.Transactions {
+			delete(bc.txStore, tx.Hash(TxHasher{}))
+		}
+		for _, ev := range old.Evidence {
+			delete(bc.evidenceStore, ev.Hash())
+		}
+	}
+	bc.headers = bc.headers[:fork+1]
+	bc.blocks = bc.blocks[:fork+1]
+	for _, b := range branch {
+		bc.headers = append(bc.headers, b.Header)
+		bc.blocks = append(bc.blocks, b)
+		for _, tx := range b.Transactions {
+			bc.txStore[tx.Hash(TxHasher{})] = tx
+		}
+		for _, ev := range b.Evidence {
+			bc.evidenceStore[ev.Hash()] = b
+		}
+	}
+	bc.contractState = state
+	for height := range bc.states {
+		if height > fork {
+			delete(bc.states, height)
+		}
+	}
+	for height, state := range states {
+		bc.states[height] = state
+	}
+	bc.lock.Unlock()
+
+	bc.logger.Log(
+		"msg", "switched to a branch with more work",
+		"hash", tip.Hash(BlockHasher{}),
+		"fork", fork,
+		"oldHeight", oldHeight,
+		"height", tip.Height,
+	)
+
+	for _, b := range branch {
+		if err := bc.store.Put(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateLocked returns the highest height at or below height we saved the
+// state at and a copy of that state. bc.lock must be held.
+func (bc *BlockChain) stateLocked(height uint32) (uint32, *State) {
+	base := bc.savedHeightLocked(height)
+	return base, bc.states[base].Copy()
+}
+
+// savedHeightLocked returns the highest height at or below height we saved
+// the state at. bc.lock must be held.
+func (bc *BlockChain) savedHeightLocked(height uint32) uint32 {
+	base := uint32(0)
+	for h := range bc.states {
+		if h <= height && h > base {
+			base = h
+		}
+	}
+	return base
+}
+
+// prune drops what can not become part of the chain anymore once the
+// finalized height moved on: the branches that fork off below it and the
+// states saved below the last one at or below it.
+func (bc *BlockChain) prune() {
+	finalized := bc.Finalized()
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if finalized <= bc.pruned {
+		return
+	}
+	bc.pruned = finalized
+
+	// forks holds the height at which the branch of a block forks off
+	// the chain.
+	forks := make(map[types.Hash]uint32)
+	var forkOf func(b *Block) uint32
+	forkOf = func(b *Block) uint32 {
+		if bc.onChainLocked(b) {
+			return b.Height
+		}
+		hash := b.Hash(BlockHasher{})
+		if fork, ok := forks[hash]; ok {
+			return fork
+		}
+		fork := uint32(0)
+		if parent, ok := bc.blockStore[b.PrevBlockHash]; ok {
+			fork = forkOf(parent)
+		}
+		forks[hash] = fork
+		return fork
+	}
+	dead := []types.Hash{}
+	for hash, b := range bc.blockStore {
+		if !bc.onChainLocked(b) && forkOf(b) < finalized {
+			dead = append(dead, hash)
+		}
+	}
+	bc.setLock.Lock()
+	for _, hash := range dead {
+		delete(bc.blockStore, hash)
+		delete(bc.work, hash)
+		delete(bc.validatorSets, hash)
+	}
+	bc.setLock.Unlock()
+	if len(dead) > 0 {
+		bc.logger.Log("msg", "pruned branches below the finalized height", "finalized", finalized, "blocks", len(dead))
+	}
+
+	// a reorg starts from the state at or below the finalized height at
+	// the earliest.
+	base := bc.savedHeightLocked(finalized)
+	for height := range bc.states {
+		if height < base {
+			delete(bc.states, height)
+		}
+	}
+}
+
+// Finalized returns the height of the highest block that can not be
+// reverted anymore, because the engine finalized it or a checkpoint pins
+// it.
+func (bc *BlockChain) Finalized() uint32 {
+	finalized := bc.finalizedCheckpoint()
+	if bc.consensus == nil {
+		return finalized
+	}
+	if height := bc.consensus.Finalized(bc); height > finalized {
+		return height
+	}
+	return finalized
+}
+
+// Work returns the total work of the blocks on top of the genesis.
+func (bc *BlockChain) Work() *big.Int {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return new(big.Int).Set(bc.work[bc.tipHashLocked()])
+}
+
+// HeadersWork returns the total work of the chain that ends in headers, a
+// chain of headers on top of a block we have. It is what the chain would
+// have if it switched to the blocks of headers.
+func (bc *BlockChain) HeadersWork(headers []*Header) (*big.Int, error) {
+	if len(headers) == 0 {
+		return bc.Work(), nil
+	}
+
+	bc.lock.RLock()
+	base, ok := bc.work[headers[0].PrevBlockHash]
+	bc.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("block with hash (%s) not exist", headers[0].PrevBlockHash)
+	}
+	work := new(big.Int).Set(base)
+	for _, h := range headers {
+		work.Add(work, bc.blockWork(h))
+	}
+	return work, nil
+}
+
+func (bc *BlockChain) blockWork(h *Header) *big.Int {
+	if bc.consensus == nil {
+		return big.NewInt(1)
+	}
+	return bc.consensus.Work(h)
+}
+
+func (bc *BlockChain) tipHash() types.Hash {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return bc.tipHashLocked()
+}
+
+func (bc *BlockChain) tipHashLocked() types.Hash {
+	return bc.blocks[len(bc.blocks)-1].Hash(BlockHasher{})
+}
+
+// onChainLocked reports whether b is on the main chain.
+func (bc *BlockChain) onChainLocked(b *Block) bool {
+	return int(b.Height) < len(bc.blocks) && bc.blocks[b.Height].Hash(BlockHasher{}) == b.Hash(BlockHasher{})
+}
+
+// branch returns the chain that ends in tip, which may be on another
+// branch than the main chain.
+func (bc *BlockChain) branch(tip *Header) ChainReader {
+	return &branchReader{bc: bc, tip: tip}
+}
+
+type branchReader struct {
+	bc  *BlockChain
+	tip *Header
+}
+
+func (r *branchReader) Height() uint32 {
+	return r.tip.Height
+}
+
+func (r *branchReader) GetHeader(height uint32) (*Header, error) {
+	r.bc.lock.RLock()
+	defer r.bc.lock.RUnlock()
+
+	b, err := r.bc.ancestorLocked(r.tip, height)
+	if err != nil {
+		return nil, err
+	}
+	return b.Header, nil
 }
 
 func (bc *BlockChain) GetHeader(height uint32) (*Header, error) {
@@ -73,6 +495,8 @@ func (bc *BlockChain) GetHeader(height uint32) (*Header, error) {
 
 
 func (bc *BlockChain) GetBlockByHash(hash types.Hash) (*Block, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
 	block, ok := bc.blockStore[hash]
 	if !ok {
 		return nil, fmt.Errorf("block with hash (%s) not exist", hash)
@@ -111,16 +535,32 @@ func (bc *BlockChain) Height() uint32 {
 	return uint32(len(bc.headers) - 1)
 }
 
+// Close waits for the block that is being added and closes the storage.
+func (bc *BlockChain) Close() error {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
+	return bc.store.Close()
+}
+
 func (bc *BlockChain) addBlockWithoutValidation(b *Block) error {
 	bc.lock.Lock()
 	bc.headers = append(bc.headers, b.Header)
 	bc.blocks = append(bc.blocks, b)
 	bc.blockStore[b.Hash(BlockHasher{})] = b
-	bc.lock.Unlock()
-
+	// every chain shares the genesis, its work does not count.
+	work := new(big.Int)
+	if b.Height > 0 {
+		work.Add(bc.work[b.PrevBlockHash], bc.blockWork(b.Header))
+	}
+	bc.work[b.Hash(BlockHasher{})] = work
 	for _, tx := range b.Transactions {
 		bc.txStore[tx.Hash(TxHasher{})] = tx
 	}
+	for _, ev := range b.Evidence {
+		bc.evidenceStore[ev.Hash()] = b
+	}
+	bc.lock.Unlock()
 
 	bc.logger.Log(
 		"msg", "adding new block",
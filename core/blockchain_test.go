@@ -1,9 +1,12 @@
 package core
 
 import (
+	"errors"
+	"math/big"
 	"os"
 	"testing"
 
+	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/types"
 	"github.com/go-kit/log"
 	"github.com/stretchr/testify/assert"
@@ -83,3 +86,204 @@ func getPrevBlockHash(t *testing.T, bc *BlockChain, height uint32) types.Hash {
 	return BlockHasher{}.Hash(prevHeader)
 }
 
+
+// weightConsensus weighs a block by its difficulty plus one.
+type weightConsensus struct {
+	finalized uint32
+}
+
+func (c *weightConsensus) VerifySeal(chain ChainReader, parent *Header, b *Block) error {
+	return nil
+}
+
+func (c *weightConsensus) Work(h *Header) *big.Int {
+	return new(big.Int).SetUint64(h.Difficulty + 1)
+}
+
+func (c *weightConsensus) Finalized(chain ChainReader) uint32 {
+	return c.finalized
+}
+
+func childBlock(t *testing.T, parent *Block, difficulty uint64) *Block {
+	b := randomBlock(t, parent.Height+1, parent.Hash(BlockHasher{}))
+	b.Difficulty = difficulty
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	return b
+}
+
+// addChain adds n blocks on top of parent and returns them.
+func addChain(t *testing.T, bc *BlockChain, parent *Block, n int, difficulty uint64) []*Block {
+	blocks := []*Block{}
+	for i := 0; i < n; i++ {
+		b := childBlock(t, parent, difficulty)
+		assert.Nil(t, bc.AddBlock(b))
+		blocks = append(blocks, b)
+		parent = b
+	}
+	return blocks
+}
+
+func TestAddBlockReorg(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	main := addChain(t, bc, genesis, 3, 0)
+	assert.Equal(t, uint32(3), bc.Height())
+	assert.Equal(t, int64(3), bc.Work().Int64())
+
+	// a branch as long as the chain does not replace it.
+	branch := addChain(t, bc, main[0], 2, 0)
+	assert.Equal(t, uint32(3), bc.Height())
+	b, err := bc.GetBlock(3)
+	assert.Nil(t, err)
+	assert.Equal(t, main[2], b)
+	assert.Equal(t, ErrBlockKnown, bc.AddBlock(branch[1]))
+
+	// a longer one does.
+	branch = append(branch, addChain(t, bc, branch[1], 1, 0)...)
+	assert.Equal(t, uint32(4), bc.Height())
+	for i, want := range append([]*Block{main[0]}, branch...) {
+		b, err := bc.GetBlock(uint32(i + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, want, b)
+	}
+
+	// the old chain stays known and can win again.
+	addChain(t, bc, main[2], 2, 0)
+	assert.Equal(t, uint32(5), bc.Height())
+	b, err = bc.GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, main[1], b)
+}
+
+func TestAddBlockMostWork(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	bc.SetConsensus(&weightConsensus{})
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	addChain(t, bc, genesis, 4, 0)
+	heavy := addChain(t, bc, genesis, 2, 2)
+	assert.Equal(t, uint32(2), bc.Height())
+	assert.Equal(t, int64(6), bc.Work().Int64())
+	tip, err := bc.GetBlock(2)
+	assert.Nil(t, err)
+	assert.Equal(t, heavy[1], tip)
+
+	_, err = bc.branch(heavy[0].Header).GetHeader(0)
+	assert.Nil(t, err)
+}
+
+func TestAddBlockFinalized(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	c := &weightConsensus{}
+	bc.SetConsensus(c)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	main := addChain(t, bc, genesis, 3, 0)
+	branch := addChain(t, bc, main[0], 2, 0)
+
+	c.finalized = 2
+	assert.True(t, errors.Is(bc.AddBlock(childBlock(t, main[0], 0)), ErrFinalized))
+	assert.True(t, errors.Is(bc.AddBlock(childBlock(t, branch[1], 0)), ErrFinalized))
+	assert.Equal(t, uint32(3), bc.Height())
+	b, err := bc.GetBlock(3)
+	assert.Nil(t, err)
+	assert.Equal(t, main[2], b)
+}
+
+// nonceTx returns a transaction of key with nonce.
+func nonceTx(t *testing.T, key crypto.PrivateKey, nonce uint64) *Transaction {
+	tx := NewTransaction([]byte("foo"))
+	tx.Nonce = nonce
+	assert.Nil(t, tx.Sign(key))
+	return tx
+}
+
+func TestAddBlockReorgState(t *testing.T) {
+	defer func(n uint32) { stateInterval = n }(stateInterval)
+	stateInterval = 2
+
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	key := crypto.GeneratePrivateKey()
+
+	main := []*Block{genesis}
+	for i := 0; i < 5; i++ {
+		b := blockWithTxs(t, main[i], nonceTx(t, key, uint64(i)))
+		assert.Nil(t, bc.AddBlock(b))
+		main = append(main, b)
+	}
+	assert.Equal(t, uint64(5), bc.Nonce(key.PublicKey()))
+
+	// blocks below the state saved at the fork are not run again, one
+	// that would fail now does not stop the reorg.
+	main[1].Transactions[0].Nonce = 7
+
+	other := crypto.GeneratePrivateKey()
+	branch := []*Block{main[3]}
+	for i := 0; i < 3; i++ {
+		b := blockWithTxs(t, branch[i], nonceTx(t, key, uint64(3+i)), nonceTx(t, other, uint64(i)))
+		assert.Nil(t, bc.AddBlock(b))
+		branch = append(branch, b)
+	}
+	assert.Equal(t, uint32(6), bc.Height())
+	tip, err := bc.GetBlock(6)
+	assert.Nil(t, err)
+	assert.Equal(t, branch[3], tip)
+	assert.Equal(t, uint64(6), bc.Nonce(key.PublicKey()))
+	assert.Equal(t, uint64(3), bc.Nonce(other.PublicKey()))
+
+	// the states of the old chain above the fork are replaced.
+	assert.Len(t, bc.states, 4)
+	for _, height := range []uint32{0, 2, 4, 6} {
+		assert.NotNil(t, bc.states[height])
+	}
+	assert.Equal(t, uint64(1), bc.states[4].Nonce(other.PublicKey()))
+}
+
+func TestAddBlockPrunesBranches(t *testing.T) {
+	defer func(n uint32) { stateInterval = n }(stateInterval)
+	stateInterval = 2
+
+	bc := newBlockChainWithGenesis(t)
+	c := &weightConsensus{}
+	bc.SetConsensus(c)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	main := addChain(t, bc, genesis, 4, 0)
+	below := addChain(t, bc, main[0], 2, 0)
+	above := addChain(t, bc, main[2], 1, 0)
+
+	c.finalized = 3
+	main = append(main, addChain(t, bc, main[3], 1, 0)...)
+
+	// the branch that forks off below the finalized height is gone, the
+	// one that forks off at it stays.
+	for _, b := range below {
+		_, err := bc.GetBlockByHash(b.Hash(BlockHasher{}))
+		assert.NotNil(t, err)
+	}
+	_, err = bc.GetBlockByHash(above[0].Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	for _, b := range main {
+		_, err := bc.GetBlockByHash(b.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+	}
+
+	// so is the state a reorg can not start from anymore.
+	assert.Len(t, bc.states, 2)
+	assert.NotNil(t, bc.states[2])
+	assert.NotNil(t, bc.states[4])
+}
+
+func TestAddBlockUnknownParent(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+
+	assert.True(t, errors.Is(bc.AddBlock(randomBlock(t, 1, types.Hash{1})), ErrUnknownParent))
+	assert.True(t, errors.Is(bc.AddBlock(randomBlock(t, 2, types.Hash{1})), ErrBlockTooHigh))
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// ErrCheckpointMismatch is returned for a block or header at the height of
+// a checkpoint that is not the block the checkpoint pins.
+var ErrCheckpointMismatch = errors.New("block conflicts with a checkpoint")
+
+// Checkpoint pins the hash of the block at a height. The chain refuses
+// every other block at that height and never reverts the block.
+type Checkpoint struct {
+	Height uint32
+	Hash   types.Hash
+}
+
+// SignedCheckpoint is a block the consensus engine finalized and the
+// commit of the validators that finalized it. The commit is nil for
+// engines without one.
+type SignedCheckpoint struct {
+	Header *Header
+	Commit *Commit
+}
+
+// Checkpoint returns the checkpoint that pins the block of cp.
+func (cp *SignedCheckpoint) Checkpoint() Checkpoint {
+	return Checkpoint{Height: cp.Header.Height, Hash: BlockHasher{}.Hash(cp.Header)}
+}
+
+// AddCheckpoints pins the blocks of checkpoints. It fails if the chain or
+// a checkpoint we have disagrees with one of them.
+func (bc *BlockChain) AddCheckpoints(checkpoints ...Checkpoint) error {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	added := make(map[uint32]types.Hash)
+	for _, cp := range checkpoints {
+		if cp.Height == 0 {
+			return errors.New("checkpoint at height 0, the genesis is pinned by the chain")
+		}
+		hash, ok := bc.pinnedLocked(cp.Height)
+		if !ok {
+			hash, ok = added[cp.Height]
+		}
+		if !ok && int(cp.Height) < len(bc.blocks) {
+			hash, ok = bc.blocks[cp.Height].Hash(BlockHasher{}), true
+		}
+		if ok && hash != cp.Hash {
+			return fmt.Errorf("%w: (%s) at height (%d), have (%s)", ErrCheckpointMismatch, cp.Hash, cp.Height, hash)
+		}
+		added[cp.Height] = cp.Hash
+	}
+
+	fresh := []Checkpoint{}
+	for height, hash := range added {
+		if _, ok := bc.checkpointLocked(height); !ok {
+			fresh = append(fresh, Checkpoint{Height: height, Hash: hash})
+		}
+	}
+	bc.checkpoints = append(bc.checkpoints, fresh...)
+	sort.Slice(bc.checkpoints, func(i, j int) bool { return bc.checkpoints[i].Height < bc.checkpoints[j].Height })
+	return nil
+}
+
+// AddSignedCheckpoint pins the block of cp once its commit checks out
+// against the validators of its height. Only engines with commits sign
+// checkpoints, and the validators of a height are only known once the
+// chain has the epoch before it. Any other checkpoint has to be trusted
+// and pinned with AddCheckpoints.
+func (bc *BlockChain) AddSignedCheckpoint(cp *SignedCheckpoint) error {
+	if cp.Header == nil {
+		return errors.New("signed checkpoint without header")
+	}
+	verifier, ok := bc.consensus.(CommitVerifier)
+	if !ok || cp.Commit == nil {
+		return fmt.Errorf("checkpoint at height (%d) has no commit we can check", cp.Header.Height)
+	}
+	vs, err := bc.ValidatorSet(cp.Header.Height)
+	if err != nil {
+		return err
+	}
+	if err := verifier.VerifyCommit(vs, &Block{Header: cp.Header, Commit: cp.Commit}); err != nil {
+		return err
+	}
+	return bc.AddCheckpoints(cp.Checkpoint())
+}
+
+// Checkpoints returns the checkpoints of the chain, lowest first.
+func (bc *BlockChain) Checkpoints() []Checkpoint {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return append([]Checkpoint{}, bc.checkpoints...)
+}
+
+// LatestCheckpoint returns the highest block that can not be reverted
+// anymore, signed by the commit that finalized it if the engine has one.
+func (bc *BlockChain) LatestCheckpoint() (*SignedCheckpoint, error) {
+	height := bc.Finalized()
+	if height == 0 {
+		return nil, errors.New("no block finalized yet")
+	}
+	b, err := bc.GetBlock(height)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedCheckpoint{Header: b.Header, Commit: b.Commit}, nil
+}
+
+// PendingCheckpoint returns the highest checkpoint above the tip whose
+// headers are not trusted yet, the one sync should start from.
+func (bc *BlockChain) PendingCheckpoint() (Checkpoint, bool) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	if len(bc.checkpoints) == 0 {
+		return Checkpoint{}, false
+	}
+	cp := bc.checkpoints[len(bc.checkpoints)-1]
+	if int(cp.Height) < len(bc.headers) || bc.trusted[cp.Height] == cp.Hash {
+		return Checkpoint{}, false
+	}
+	return cp, true
+}
+
+// VerifyCheckpoints checks that none of headers conflicts with a
+// checkpoint or a trusted header.
+func (bc *BlockChain) VerifyCheckpoints(headers []*Header) error {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	for _, h := range headers {
+		hash, ok := bc.pinnedLocked(h.Height)
+		if ok && hash != (BlockHasher{}).Hash(h) {
+			return fmt.Errorf("%w: header (%s) at height (%d), pinned (%s)", ErrCheckpointMismatch, BlockHasher{}.Hash(h), h.Height, hash)
+		}
+	}
+	return nil
+}
+
+// TrustHeaders trusts headers, a chain of headers that ends in a
+// checkpoint. The checkpoint vouches for every block of the chain, they
+// are accepted without checking their seal and no other block at their
+// heights is. A node syncs from a checkpoint this way instead of checking
+// every block from the genesis on.
+func (bc *BlockChain) TrustHeaders(headers []*Header) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].Height != headers[i-1].Height+1 || headers[i].PrevBlockHash != (BlockHasher{}).Hash(headers[i-1]) {
+			return fmt.Errorf("header with height (%d) does not link to its previous header", headers[i].Height)
+		}
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	last := headers[len(headers)-1]
+	cp, ok := bc.checkpointLocked(last.Height)
+	if !ok || cp.Hash != (BlockHasher{}).Hash(last) {
+		return fmt.Errorf("%w: headers end in (%s) at height (%d)", ErrCheckpointMismatch, BlockHasher{}.Hash(last), last.Height)
+	}
+	for _, h := range headers {
+		hash, ok := bc.pinnedLocked(h.Height)
+		if ok && hash != (BlockHasher{}).Hash(h) {
+			return fmt.Errorf("%w: header (%s) at height (%d), pinned (%s)", ErrCheckpointMismatch, BlockHasher{}.Hash(h), h.Height, hash)
+		}
+	}
+	for _, h := range headers {
+		bc.trusted[h.Height] = BlockHasher{}.Hash(h)
+	}
+	return nil
+}
+
+// checkCheckpoint checks b against the block pinned at its height and
+// reports whether there is one. A pinned block needs no seal.
+func (bc *BlockChain) checkCheckpoint(b *Block) (bool, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	hash, ok := bc.pinnedLocked(b.Height)
+	if !ok {
+		return false, nil
+	}
+	if hash != b.Hash(BlockHasher{}) {
+		return false, fmt.Errorf("%w: block (%s) at height (%d), pinned (%s)", ErrCheckpointMismatch, b.Hash(BlockHasher{}), b.Height, hash)
+	}
+	return true, nil
+}
+
+// finalizedCheckpoint returns the height of the highest checkpoint the
+// chain reached, 0 if there is none.
+func (bc *BlockChain) finalizedCheckpoint() uint32 {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	for i := len(bc.checkpoints) - 1; i >= 0; i-- {
+		if int(bc.checkpoints[i].Height) < len(bc.headers) {
+			return bc.checkpoints[i].Height
+		}
+	}
+	return 0
+}
+
+// pinnedLocked returns the hash a checkpoint or a trusted header pins at
+// height. bc.lock must be held.
+func (bc *BlockChain) pinnedLocked(height uint32) (types.Hash, bool) {
+	if cp, ok := bc.checkpointLocked(height); ok {
+		return cp.Hash, true
+	}
+	hash, ok := bc.trusted[height]
+	return hash, ok
+}
+
+// checkpointLocked returns the checkpoint at height. bc.lock must be held.
+func (bc *BlockChain) checkpointLocked(height uint32) (Checkpoint, bool) {
+	i := sort.Search(len(bc.checkpoints), func(i int) bool { return bc.checkpoints[i].Height >= height })
+	if i < len(bc.checkpoints) && bc.checkpoints[i].Height == height {
+		return bc.checkpoints[i], true
+	}
+	return Checkpoint{}, false
+}
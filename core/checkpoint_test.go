@@ -0,0 +1,96 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errBadSeal = errors.New("bad seal")
+
+// sealConsensus rejects the seal of every block.
+type sealConsensus struct {
+	weightConsensus
+}
+
+func (c *sealConsensus) VerifySeal(chain ChainReader, parent *Header, b *Block) error {
+	return errBadSeal
+}
+
+func checkpointOf(b *Block) Checkpoint {
+	return Checkpoint{Height: b.Height, Hash: b.Hash(BlockHasher{})}
+}
+
+func TestCheckpoints(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	main := addChain(t, bc, genesis, 3, 0)
+
+	assert.NotNil(t, bc.AddCheckpoints(Checkpoint{Height: 0, Hash: checkpointOf(genesis).Hash}))
+	assert.True(t, errors.Is(bc.AddCheckpoints(Checkpoint{Height: 1, Hash: main[1].Hash(BlockHasher{})}), ErrCheckpointMismatch))
+	assert.True(t, errors.Is(bc.AddCheckpoints(checkpointOf(main[1]), Checkpoint{Height: 2}), ErrCheckpointMismatch))
+	assert.Empty(t, bc.Checkpoints())
+
+	_, err = bc.LatestCheckpoint()
+	assert.NotNil(t, err)
+	assert.Nil(t, bc.AddCheckpoints(checkpointOf(main[1])))
+	assert.Equal(t, []Checkpoint{checkpointOf(main[1])}, bc.Checkpoints())
+	assert.Equal(t, uint32(2), bc.Finalized())
+	cp, err := bc.LatestCheckpoint()
+	assert.Nil(t, err)
+	assert.Equal(t, checkpointOf(main[1]), cp.Checkpoint())
+	_, ok := bc.PendingCheckpoint()
+	assert.False(t, ok)
+
+	// no other block at the height and no branch below it.
+	assert.True(t, errors.Is(bc.AddBlock(childBlock(t, main[0], 0)), ErrCheckpointMismatch))
+	assert.True(t, errors.Is(bc.AddBlock(childBlock(t, genesis, 0)), ErrFinalized))
+	assert.Nil(t, bc.CheckBlock(childBlock(t, main[2], 0)))
+	assert.Nil(t, bc.AddBlock(childBlock(t, main[1], 0)))
+	assert.True(t, errors.Is(bc.VerifyCheckpoints([]*Header{childBlock(t, main[0], 0).Header}), ErrCheckpointMismatch))
+	assert.Nil(t, bc.VerifyCheckpoints([]*Header{main[1].Header, main[2].Header}))
+}
+
+func TestTrustHeaders(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	bc.SetConsensus(&sealConsensus{})
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	blocks := []*Block{}
+	headers := []*Header{}
+	parent := genesis
+	for i := 0; i < 4; i++ {
+		parent = childBlock(t, parent, 0)
+		blocks = append(blocks, parent)
+		headers = append(headers, parent.Header)
+	}
+	// the seal of every block is bad.
+	assert.True(t, errors.Is(bc.AddBlock(blocks[0]), errBadSeal))
+
+	assert.Nil(t, bc.AddCheckpoints(checkpointOf(blocks[2])))
+	cp, ok := bc.PendingCheckpoint()
+	assert.True(t, ok)
+	assert.Equal(t, checkpointOf(blocks[2]), cp)
+
+	// the headers have to end in the checkpoint.
+	assert.True(t, errors.Is(bc.TrustHeaders(headers[:2]), ErrCheckpointMismatch))
+	assert.NotNil(t, bc.TrustHeaders([]*Header{headers[0], headers[2]}))
+	other := childBlock(t, genesis, 0)
+	assert.True(t, errors.Is(bc.TrustHeaders([]*Header{other.Header}), ErrCheckpointMismatch))
+
+	assert.Nil(t, bc.TrustHeaders(headers[:3]))
+	_, ok = bc.PendingCheckpoint()
+	assert.False(t, ok)
+	assert.True(t, errors.Is(bc.AddBlock(other), ErrCheckpointMismatch))
+	assert.True(t, errors.Is(bc.VerifyCheckpoints([]*Header{other.Header}), ErrCheckpointMismatch))
+
+	// the checkpoint vouches for the blocks up to it, not above.
+	for _, b := range blocks[:3] {
+		assert.Nil(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, uint32(3), bc.Finalized())
+	assert.True(t, errors.Is(bc.AddBlock(blocks[3]), errBadSeal))
+}
@@ -0,0 +1,498 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// CodecVersion is the version of the binary encoding. It is the first byte
+// of every encoded value, see docs/encoding.md for the format. Bump it with
+// every change to the layout of a value.
+const CodecVersion byte = 7
+
+// maxBinaryLen bounds the length of byte strings and lists we decode, so a
+// corrupt length cannot make us allocate arbitrary amounts of memory.
+const maxBinaryLen = 32 << 20
+
+var (
+	ErrUnknownCodecVersion = errors.New("unknown codec version")
+	ErrNonCanonical        = errors.New("non-canonical encoding")
+)
+
+// BinaryCodec is implemented by the types that have a binary encoding.
+// EncodeBinary and DecodeBinary handle the fields only, the version byte is
+// written once for the outermost value.
+type BinaryCodec interface {
+	EncodeBinary(*BinaryWriter)
+	DecodeBinary(*BinaryReader)
+}
+
+// BinaryWriter writes the primitives of the binary encoding. The first
+// error sticks, later writes do nothing.
+type BinaryWriter struct {
+	w   io.Writer
+	buf [8]byte
+	err error
+}
+
+func NewBinaryWriter(w io.Writer) *BinaryWriter {
+	return &BinaryWriter{w: w}
+}
+
+func (w *BinaryWriter) Err() error {
+	return w.err
+}
+
+// Fail records err unless an earlier error is recorded already.
+func (w *BinaryWriter) Fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *BinaryWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+func (w *BinaryWriter) WriteUint8(v uint8) {
+	w.buf[0] = v
+	w.write(w.buf[:1])
+}
+
+func (w *BinaryWriter) WriteBool(v bool) {
+	if v {
+		w.WriteUint8(1)
+	} else {
+		w.WriteUint8(0)
+	}
+}
+
+func (w *BinaryWriter) WriteUint32(v uint32) {
+	binary.BigEndian.PutUint32(w.buf[:4], v)
+	w.write(w.buf[:4])
+}
+
+func (w *BinaryWriter) WriteUint64(v uint64) {
+	binary.BigEndian.PutUint64(w.buf[:8], v)
+	w.write(w.buf[:8])
+}
+
+func (w *BinaryWriter) WriteInt64(v int64) {
+	w.WriteUint64(uint64(v))
+}
+
+// WriteLen writes the length of a byte string or list.
+func (w *BinaryWriter) WriteLen(n int) {
+	if n > maxBinaryLen {
+		w.Fail(fmt.Errorf("length %d exceeds %d", n, maxBinaryLen))
+		return
+	}
+	w.WriteUint32(uint32(n))
+}
+
+func (w *BinaryWriter) WriteBytes(b []byte) {
+	w.WriteLen(len(b))
+	w.write(b)
+}
+
+func (w *BinaryWriter) WriteString(s string) {
+	w.WriteBytes([]byte(s))
+}
+
+func (w *BinaryWriter) WriteHash(h types.Hash) {
+	w.write(h[:])
+}
+
+// WriteFixed writes b without a length, the reader has to know it.
+func (w *BinaryWriter) WriteFixed(b []byte) {
+	w.write(b)
+}
+
+// BinaryReader reads the primitives of the binary encoding. The first error
+// sticks, later reads return zero values.
+type BinaryReader struct {
+	r   io.Reader
+	buf [8]byte
+	err error
+}
+
+func NewBinaryReader(r io.Reader) *BinaryReader {
+	return &BinaryReader{r: r}
+}
+
+func (r *BinaryReader) Err() error {
+	return r.err
+}
+
+// Fail records err unless an earlier error is recorded already.
+func (r *BinaryReader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *BinaryReader) read(b []byte) bool {
+	if r.err != nil {
+		return false
+	}
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.err = err
+		return false
+	}
+	return true
+}
+
+func (r *BinaryReader) ReadUint8() uint8 {
+	if !r.read(r.buf[:1]) {
+		return 0
+	}
+	return r.buf[0]
+}
+
+func (r *BinaryReader) ReadBool() bool {
+	switch r.ReadUint8() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+	r.Fail(fmt.Errorf("%w: bool is neither 0 nor 1", ErrNonCanonical))
+	return false
+}
+
+func (r *BinaryReader) ReadUint32() uint32 {
+	if !r.read(r.buf[:4]) {
+		return 0
+	}
+	return binary.BigEndian.Uint32(r.buf[:4])
+}
+
+func (r *BinaryReader) ReadUint64() uint64 {
+	if !r.read(r.buf[:8]) {
+		return 0
+	}
+	return binary.BigEndian.Uint64(r.buf[:8])
+}
+
+func (r *BinaryReader) ReadInt64() int64 {
+	return int64(r.ReadUint64())
+}
+
+// ReadLen reads the length of a byte string or list.
+func (r *BinaryReader) ReadLen() int {
+	n := r.ReadUint32()
+	if n > maxBinaryLen {
+		r.Fail(fmt.Errorf("length %d exceeds %d", n, maxBinaryLen))
+		return 0
+	}
+	return int(n)
+}
+
+// ReadBytes reads a byte string. The empty string is returned as nil.
+func (r *BinaryReader) ReadBytes() []byte {
+	n := r.ReadLen()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	// grow the buffer with the data that actually arrives instead of
+	// trusting the length.
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, r.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.Fail(err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func (r *BinaryReader) ReadString() string {
+	return string(r.ReadBytes())
+}
+
+func (r *BinaryReader) ReadHash() types.Hash {
+	var h types.Hash
+	r.read(h[:])
+	return h
+}
+
+// ReadFixed fills b.
+func (r *BinaryReader) ReadFixed(b []byte) {
+	r.read(b)
+}
+
+// WriteBinary writes the version byte and the encoding of v to w.
+func WriteBinary(w io.Writer, v BinaryCodec) error {
+	bw := NewBinaryWriter(w)
+	bw.WriteUint8(CodecVersion)
+	v.EncodeBinary(bw)
+	return bw.Err()
+}
+
+// ReadBinary reads a value written by WriteBinary from r into v.
+func ReadBinary(r io.Reader, v BinaryCodec) error {
+	br := NewBinaryReader(r)
+	if version := br.ReadUint8(); br.Err() == nil && version != CodecVersion {
+		return fmt.Errorf("%w %d", ErrUnknownCodecVersion, version)
+	}
+	v.DecodeBinary(br)
+	return br.Err()
+}
+
+// MarshalBinary returns the encoding of v.
+func MarshalBinary(v BinaryCodec) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := WriteBinary(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes b into v. Every byte of b has to be part of the
+// encoding.
+func UnmarshalBinary(b []byte, v BinaryCodec) error {
+	r := bytes.NewReader(b)
+	if err := ReadBinary(r, v); err != nil {
+		return err
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrNonCanonical, r.Len())
+	}
+	return nil
+}
+
+// BinaryEncoder is the Encoder of the binary encoding.
+type BinaryEncoder[T BinaryCodec] struct {
+	w io.Writer
+}
+
+func NewBinaryEncoder[T BinaryCodec](w io.Writer) *BinaryEncoder[T] {
+	return &BinaryEncoder[T]{w: w}
+}
+
+func (e *BinaryEncoder[T]) Encode(v T) error {
+	return WriteBinary(e.w, v)
+}
+
+// BinaryDecoder is the Decoder of the binary encoding.
+type BinaryDecoder[T BinaryCodec] struct {
+	r io.Reader
+}
+
+func NewBinaryDecoder[T BinaryCodec](r io.Reader) *BinaryDecoder[T] {
+	return &BinaryDecoder[T]{r: r}
+}
+
+func (d *BinaryDecoder[T]) Decode(v T) error {
+	return ReadBinary(d.r, v)
+}
+
+func NewBinaryTxEncoder(w io.Writer) *BinaryEncoder[*Transaction] {
+	return NewBinaryEncoder[*Transaction](w)
+}
+
+func NewBinaryTxDecoder(r io.Reader) *BinaryDecoder[*Transaction] {
+	return NewBinaryDecoder[*Transaction](r)
+}
+
+func NewBinaryBlockEncoder(w io.Writer) *BinaryEncoder[*Block] {
+	return NewBinaryEncoder[*Block](w)
+}
+
+func NewBinaryBlockDecoder(r io.Reader) *BinaryDecoder[*Block] {
+	return NewBinaryDecoder[*Block](r)
+}
+
+// EncodeBinary writes the canonical header encoding without its version
+// byte.
+func (h *Header) EncodeBinary(w *BinaryWriter) {
+	w.WriteFixed(h.Bytes()[1:])
+}
+
+func (h *Header) DecodeBinary(r *BinaryReader) {
+	h.Version = r.ReadUint32()
+	h.DataHash = r.ReadHash()
+	h.PrevBlockHash = r.ReadHash()
+	h.Timestamp = r.ReadInt64()
+	h.Height = r.ReadUint32()
+	h.Nonce = r.ReadUint64()
+	h.Difficulty = r.ReadUint64()
+}
+
+func (tx *Transaction) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint8(uint8(tx.Type))
+	w.WriteUint64(tx.Nonce)
+	w.WriteUint64(tx.Fee)
+	w.WriteBytes(tx.Data)
+	w.WriteBytes(tx.From)
+	WriteSignature(w, tx.Signature)
+}
+
+func (tx *Transaction) DecodeBinary(r *BinaryReader) {
+	tx.Type = TxType(r.ReadUint8())
+	tx.Nonce = r.ReadUint64()
+	tx.Fee = r.ReadUint64()
+	tx.Data = r.ReadBytes()
+	tx.From = r.ReadBytes()
+	tx.Signature = ReadSignature(r)
+	tx.hash = types.Hash{}
+}
+
+func (b *Block) EncodeBinary(w *BinaryWriter) {
+	if b.Header == nil {
+		w.Fail(errors.New("block has no header"))
+		return
+	}
+	b.Header.EncodeBinary(w)
+	w.WriteLen(len(b.Transactions))
+	for _, tx := range b.Transactions {
+		tx.EncodeBinary(w)
+	}
+	w.WriteLen(len(b.Evidence))
+	for _, ev := range b.Evidence {
+		ev.EncodeBinary(w)
+	}
+	w.WriteBytes(b.Validator)
+	WriteSignature(w, b.Signature)
+	w.WriteBool(b.Commit != nil)
+	if b.Commit != nil {
+		b.Commit.EncodeBinary(w)
+	}
+}
+
+func (b *Block) DecodeBinary(r *BinaryReader) {
+	b.Header = new(Header)
+	b.Header.DecodeBinary(r)
+	b.Transactions = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		tx := new(Transaction)
+		tx.DecodeBinary(r)
+		b.Transactions = append(b.Transactions, tx)
+	}
+	b.Evidence = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		ev := new(Evidence)
+		ev.DecodeBinary(r)
+		b.Evidence = append(b.Evidence, ev)
+	}
+	b.Validator = r.ReadBytes()
+	b.Signature = ReadSignature(r)
+	b.Commit = nil
+	if r.ReadBool() {
+		b.Commit = new(Commit)
+		b.Commit.DecodeBinary(r)
+	}
+	b.hash = types.Hash{}
+}
+
+func (s *Seal) EncodeBinary(w *BinaryWriter) {
+	w.WriteBytes(s.Validator)
+	WriteSignature(w, s.Signature)
+	w.WriteBool(s.Commit != nil)
+	if s.Commit != nil {
+		s.Commit.EncodeBinary(w)
+	}
+}
+
+func (s *Seal) DecodeBinary(r *BinaryReader) {
+	s.Validator = r.ReadBytes()
+	s.Signature = ReadSignature(r)
+	s.Commit = nil
+	if r.ReadBool() {
+		s.Commit = new(Commit)
+		s.Commit.DecodeBinary(r)
+	}
+}
+
+func (v *Vote) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint8(uint8(v.Type))
+	w.WriteUint32(v.Height)
+	w.WriteUint32(v.Round)
+	w.WriteHash(v.BlockHash)
+	w.WriteBytes(v.Validator)
+	WriteSignature(w, v.Signature)
+}
+
+func (v *Vote) DecodeBinary(r *BinaryReader) {
+	v.Type = VoteType(r.ReadUint8())
+	v.Height = r.ReadUint32()
+	v.Round = r.ReadUint32()
+	v.BlockHash = r.ReadHash()
+	v.Validator = r.ReadBytes()
+	v.Signature = ReadSignature(r)
+}
+
+func (c *Commit) EncodeBinary(w *BinaryWriter) {
+	w.WriteUint32(c.Round)
+	w.WriteLen(len(c.Precommits))
+	for _, v := range c.Precommits {
+		v.EncodeBinary(w)
+	}
+}
+
+func (c *Commit) DecodeBinary(r *BinaryReader) {
+	c.Round = r.ReadUint32()
+	c.Precommits = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		v := new(Vote)
+		v.DecodeBinary(r)
+		c.Precommits = append(c.Precommits, v)
+	}
+}
+
+func (u *ValidatorUpdate) EncodeBinary(w *BinaryWriter) {
+	w.WriteBytes(u.Key)
+	w.WriteUint64(u.Power)
+}
+
+func (u *ValidatorUpdate) DecodeBinary(r *BinaryReader) {
+	u.Key = r.ReadBytes()
+	u.Power = r.ReadUint64()
+}
+
+// WriteSignature writes an optional signature: a presence flag followed by
+// R and S as big-endian byte strings without leading zeros.
+func WriteSignature(w *BinaryWriter, sig *crypto.Signature) {
+	w.WriteBool(sig != nil)
+	if sig == nil {
+		return
+	}
+	if sig.R == nil || sig.S == nil || sig.R.Sign() < 0 || sig.S.Sign() < 0 {
+		w.Fail(errors.New("signature has no valid R and S"))
+		return
+	}
+	w.WriteBytes(sig.R.Bytes())
+	w.WriteBytes(sig.S.Bytes())
+}
+
+func ReadSignature(r *BinaryReader) *crypto.Signature {
+	if !r.ReadBool() {
+		return nil
+	}
+	return &crypto.Signature{
+		R: readBigInt(r),
+		S: readBigInt(r),
+	}
+}
+
+func readBigInt(r *BinaryReader) *big.Int {
+	b := r.ReadBytes()
+	if len(b) > 0 && b[0] == 0 {
+		r.Fail(fmt.Errorf("%w: integer with leading zero", ErrNonCanonical))
+	}
+	return new(big.Int).SetBytes(b)
+}
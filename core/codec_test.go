@@ -0,0 +1,96 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryTxEncodeDecode(t *testing.T) {
+	tx := randomTxWithSignature(t)
+	buf := &bytes.Buffer{}
+	assert.Nil(t, tx.Encode(NewBinaryTxEncoder(buf)))
+
+	txDecoded := new(Transaction)
+	assert.Nil(t, txDecoded.Decode(NewBinaryTxDecoder(buf)))
+	assert.Equal(t, tx, txDecoded)
+}
+
+func TestBinaryBlockEncodeDecode(t *testing.T) {
+	b := randomBlock(t, 1, types.Hash{})
+	buf := &bytes.Buffer{}
+	assert.Nil(t, b.Encode(NewBinaryBlockEncoder(buf)))
+
+	bDec := new(Block)
+	assert.Nil(t, bDec.Decode(NewBinaryBlockDecoder(buf)))
+	assert.Equal(t, b, bDec)
+	assert.Nil(t, bDec.Verify())
+}
+
+func TestBinaryBlockCommitEncodeDecode(t *testing.T) {
+	b := randomBlock(t, 1, types.Hash{})
+	hash := b.Hash(BlockHasher{})
+	b.Commit = &Commit{Round: 2}
+	for i := 0; i < 3; i++ {
+		v := &Vote{Type: VotePrecommit, Height: 1, Round: 2, BlockHash: hash}
+		assert.Nil(t, v.Sign(crypto.GeneratePrivateKey()))
+		b.Commit.Precommits = append(b.Commit.Precommits, v)
+	}
+
+	data, err := MarshalBinary(b)
+	assert.Nil(t, err)
+	bDec := new(Block)
+	assert.Nil(t, UnmarshalBinary(data, bDec))
+	assert.Equal(t, b.Commit, bDec.Commit)
+	// the commit is not part of the block hash.
+	assert.Equal(t, hash, bDec.Hash(BlockHasher{}))
+	for _, v := range bDec.Commit.Precommits {
+		assert.Nil(t, v.Verify())
+	}
+}
+
+func TestBinaryEncodingIsDeterministic(t *testing.T) {
+	b := randomBlock(t, 1, types.Hash{})
+
+	first, err := MarshalBinary(b)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		again, err := MarshalBinary(b)
+		assert.Nil(t, err)
+		assert.Equal(t, first, again)
+	}
+
+	// a decoded block encodes to the same bytes.
+	bDec := new(Block)
+	assert.Nil(t, UnmarshalBinary(first, bDec))
+	again, err := MarshalBinary(bDec)
+	assert.Nil(t, err)
+	assert.Equal(t, first, again)
+}
+
+func TestBinaryDecodeRejects(t *testing.T) {
+	tx := randomTxWithSignature(t)
+	b, err := MarshalBinary(tx)
+	assert.Nil(t, err)
+
+	// unknown version
+	unknown := append([]byte{CodecVersion + 1}, b[1:]...)
+	assert.True(t, errors.Is(UnmarshalBinary(unknown, new(Transaction)), ErrUnknownCodecVersion))
+
+	// trailing bytes
+	trailing := append(append([]byte{}, b...), 0)
+	assert.True(t, errors.Is(UnmarshalBinary(trailing, new(Transaction)), ErrNonCanonical))
+
+	// truncated
+	assert.NotNil(t, UnmarshalBinary(b[:len(b)-1], new(Transaction)))
+
+	// the signature flag is neither 0 nor 1
+	flag := 1 + 1 + 8 + 8 + 4 + len(tx.Data) + 4 + len(tx.From)
+	invalid := append([]byte{}, b...)
+	invalid[flag] = 2
+	assert.True(t, errors.Is(UnmarshalBinary(invalid, new(Transaction)), ErrNonCanonical))
+}
@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+var ErrInvalidEvidence = errors.New("invalid evidence")
+
+// MaxBlockEvidence is the most evidence a block may carry.
+var MaxBlockEvidence = 16
+
+// Evidence proves that a validator signed two different blocks at the same
+// height on the same parent. A block that carries it removes the validator
+// from the validator set of the next epoch.
+//
+// Blocks on different parents are no evidence: under the engines where the
+// chain with the most work wins, an honest validator signs at a height
+// again once it follows another branch.
+type Evidence struct {
+	Validator crypto.PublicKey
+	// First and Second are the two headers, ordered by their hash.
+	First           *Header
+	FirstSignature  *crypto.Signature
+	Second          *Header
+	SecondSignature *crypto.Signature
+}
+
+// NewEvidence returns the evidence of two blocks signed by the same
+// validator at the same height on the same parent, or nil if they do not
+// conflict.
+func NewEvidence(a, b *Block) *Evidence {
+	if a.Height != b.Height || a.PrevBlockHash != b.PrevBlockHash || !bytes.Equal(a.Validator, b.Validator) || a.Hash(BlockHasher{}) == b.Hash(BlockHasher{}) {
+		return nil
+	}
+	if bytes.Compare(a.Hash(BlockHasher{}).ToSlice(), b.Hash(BlockHasher{}).ToSlice()) > 0 {
+		a, b = b, a
+	}
+	return &Evidence{
+		Validator:       a.Validator,
+		First:           a.Header,
+		FirstSignature:  a.Signature,
+		Second:          b.Header,
+		SecondSignature: b.Signature,
+	}
+}
+
+// Height returns the height at which the validator signed twice.
+func (ev *Evidence) Height() uint32 {
+	return ev.First.Height
+}
+
+// Hash identifies the double signing by the validator and the height. All
+// evidence that a validator signed two blocks at a height is the same, a
+// validator is punished once per height.
+func (ev *Evidence) Hash() types.Hash {
+	buf := new(bytes.Buffer)
+	w := NewBinaryWriter(buf)
+	w.WriteBytes(ev.Validator)
+	w.WriteUint32(ev.Height())
+	return types.Hash(sha256.Sum256(buf.Bytes()))
+}
+
+// Verify checks that both headers are at the same height on the same
+// parent, differ and were signed by the validator. Whether it was a
+// validator at that height is up to the chain.
+func (ev *Evidence) Verify() error {
+	if ev.First == nil || ev.Second == nil {
+		return fmt.Errorf("%w: missing header", ErrInvalidEvidence)
+	}
+	if ev.First.Height != ev.Second.Height {
+		return fmt.Errorf("%w: headers at heights %d and %d", ErrInvalidEvidence, ev.First.Height, ev.Second.Height)
+	}
+	if ev.First.PrevBlockHash != ev.Second.PrevBlockHash {
+		return fmt.Errorf("%w: headers on parents %s and %s", ErrInvalidEvidence, ev.First.PrevBlockHash, ev.Second.PrevBlockHash)
+	}
+	first, second := BlockHasher{}.Hash(ev.First), BlockHasher{}.Hash(ev.Second)
+	if bytes.Compare(first.ToSlice(), second.ToSlice()) >= 0 {
+		return fmt.Errorf("%w: headers %s and %s not in order", ErrInvalidEvidence, first, second)
+	}
+	if err := ev.First.Verify(ev.Validator, ev.FirstSignature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvidence, err)
+	}
+	if err := ev.Second.Verify(ev.Validator, ev.SecondSignature); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvidence, err)
+	}
+	return nil
+}
+
+// VerifyEvidence checks ev on top of the chain: it must be valid and name a
+// validator of its height. The height may be above the tip as long as its
+// validators are known.
+func (bc *BlockChain) VerifyEvidence(ev *Evidence) error {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return bc.verifyEvidenceLocked(bc.headers[len(bc.headers)-1], ev)
+}
+
+// verifyEvidenceLocked checks ev on the branch that ends in tip. bc.lock
+// must be held.
+func (bc *BlockChain) verifyEvidenceLocked(tip *Header, ev *Evidence) error {
+	if err := ev.Verify(); err != nil {
+		return err
+	}
+	vs, err := bc.validatorSetLocked(tip, ev.Height())
+	if err != nil {
+		return err
+	}
+	if !vs.Contains(ev.Validator) {
+		return fmt.Errorf("%w: %s is no validator at height (%d)", ErrInvalidEvidence, ev.Validator.Address(), ev.Height())
+	}
+	return nil
+}
+
+// verifyBlockEvidence checks the evidence of b, whose parent is parent.
+// Evidence has to be of a height below the block and may be included only
+// once on a branch.
+func (bc *BlockChain) verifyBlockEvidence(parent *Header, b *Block) error {
+	if len(b.Evidence) > MaxBlockEvidence {
+		return fmt.Errorf("%w: block (%s) with %d pieces of evidence", ErrInvalidEvidence, b.Hash(BlockHasher{}), len(b.Evidence))
+	}
+
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	seen := make(map[types.Hash]bool)
+	for _, ev := range b.Evidence {
+		if err := bc.verifyEvidenceLocked(parent, ev); err != nil {
+			return err
+		}
+		if ev.Height() >= b.Height {
+			return fmt.Errorf("%w: double signing at height (%d) in block with height (%d)", ErrInvalidEvidence, ev.Height(), b.Height)
+		}
+		hash := ev.Hash()
+		if seen[hash] || bc.includedLocked(parent, hash) {
+			return fmt.Errorf("%w: evidence (%s) included twice", ErrInvalidEvidence, hash)
+		}
+		seen[hash] = true
+	}
+	return nil
+}
+
+// includedLocked reports whether the evidence with hash is in a block of
+// the main chain that is on the branch ending in tip. bc.lock must be
+// held.
+func (bc *BlockChain) includedLocked(tip *Header, hash types.Hash) bool {
+	b, ok := bc.evidenceStore[hash]
+	if !ok || b.Height > tip.Height {
+		return false
+	}
+	ancestor, err := bc.ancestorLocked(tip, b.Height)
+	return err == nil && ancestor == b
+}
+
+// IncludedEvidence reports whether the evidence with hash is on the chain.
+func (bc *BlockChain) IncludedEvidence(hash types.Hash) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	_, ok := bc.evidenceStore[hash]
+	return ok
+}
+
+// GetEvidence returns the evidence with hash on the chain and the block
+// that carries it.
+func (bc *BlockChain) GetEvidence(hash types.Hash) (*Evidence, *Block, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	b, ok := bc.evidenceStore[hash]
+	if !ok {
+		return nil, nil, fmt.Errorf("evidence with hash (%s) not exist", hash)
+	}
+	for _, ev := range b.Evidence {
+		if ev.Hash() == hash {
+			return ev, b, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("evidence with hash (%s) not exist", hash)
+}
+
+// Evidence returns the blocks of the chain that carry evidence.
+func (bc *BlockChain) Evidence() []*Block {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	blocks := []*Block{}
+	for _, b := range bc.blocks {
+		if len(b.Evidence) > 0 {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+func (ev *Evidence) EncodeBinary(w *BinaryWriter) {
+	if ev.First == nil || ev.Second == nil {
+		w.Fail(errors.New("evidence has no headers"))
+		return
+	}
+	w.WriteBytes(ev.Validator)
+	ev.First.EncodeBinary(w)
+	WriteSignature(w, ev.FirstSignature)
+	ev.Second.EncodeBinary(w)
+	WriteSignature(w, ev.SecondSignature)
+}
+
+func (ev *Evidence) DecodeBinary(r *BinaryReader) {
+	ev.Validator = r.ReadBytes()
+	ev.First = new(Header)
+	ev.First.DecodeBinary(r)
+	ev.FirstSignature = ReadSignature(r)
+	ev.Second = new(Header)
+	ev.Second.DecodeBinary(r)
+	ev.SecondSignature = ReadSignature(r)
+}
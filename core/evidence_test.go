@@ -0,0 +1,124 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// doubleSign returns two blocks at height signed by key.
+func doubleSign(t *testing.T, key crypto.PrivateKey, height uint32) (*Block, *Block) {
+	blocks := []*Block{}
+	for i := 0; i < 2; i++ {
+		b, err := NewBlock(&Header{Version: 1, Height: height, Timestamp: int64(i)}, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Sign(key))
+		blocks = append(blocks, b)
+	}
+	return blocks[0], blocks[1]
+}
+
+func TestEvidence(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+	a, b := doubleSign(t, key, 3)
+	ev := NewEvidence(a, b)
+	assert.NotNil(t, ev)
+	assert.Nil(t, ev.Verify())
+	assert.Equal(t, uint32(3), ev.Height())
+
+	// the order of the blocks does not matter.
+	assert.Equal(t, ev, NewEvidence(b, a))
+
+	data, err := MarshalBinary(ev)
+	assert.Nil(t, err)
+	decoded := new(Evidence)
+	assert.Nil(t, UnmarshalBinary(data, decoded))
+	assert.Nil(t, decoded.Verify())
+	assert.Equal(t, ev.Hash(), decoded.Hash())
+
+	// any two blocks of the validator at the height are the same evidence.
+	c, _ := doubleSign(t, key, 3)
+	c.Timestamp = 2
+	assert.Nil(t, c.Sign(key))
+	assert.Equal(t, ev.Hash(), NewEvidence(a, c).Hash())
+
+	// no conflict.
+	assert.Nil(t, NewEvidence(a, a))
+	other, _ := doubleSign(t, crypto.GeneratePrivateKey(), 3)
+	assert.Nil(t, NewEvidence(a, other))
+	higher, _ := doubleSign(t, key, 4)
+	assert.Nil(t, NewEvidence(a, higher))
+	// blocks on different parents, as an honest validator signs them after
+	// a reorg.
+	forked, _ := doubleSign(t, key, 3)
+	forked.PrevBlockHash = types.Hash{1}
+	assert.Nil(t, forked.Sign(key))
+	assert.Nil(t, NewEvidence(a, forked))
+
+	// a header the validator did not sign.
+	forged := *ev
+	forged.SecondSignature = forged.FirstSignature
+	assert.True(t, errors.Is(forged.Verify(), ErrInvalidEvidence))
+
+	// headers on different parents.
+	reorged := *ev
+	reorged.Second, reorged.SecondSignature = forked.Header, forked.Signature
+	assert.True(t, errors.Is(reorged.Verify(), ErrInvalidEvidence))
+
+	swapped := *ev
+	swapped.First, swapped.Second = ev.Second, ev.First
+	swapped.FirstSignature, swapped.SecondSignature = ev.SecondSignature, ev.FirstSignature
+	assert.True(t, errors.Is(swapped.Verify(), ErrInvalidEvidence))
+}
+
+func TestBlockChainEvidence(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	keys := []crypto.PrivateKey{}
+	vs := ValidatorSet{}
+	for i := 0; i < 4; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		vs = append(vs, ValidatorPower{Key: keys[i].PublicKey(), Power: 1})
+	}
+	bc.SetValidators(vs, 3)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	b1 := blockWithTxs(t, genesis)
+	assert.Nil(t, bc.AddBlock(b1))
+	ev := NewEvidence(doubleSign(t, keys[3], 1))
+
+	// the evidence has to be of a height below the block.
+	early := blockWithEvidence(t, genesis, ev)
+	assert.True(t, errors.Is(bc.AddBlock(early), ErrInvalidEvidence))
+
+	// only validators can double sign.
+	outsider := NewEvidence(doubleSign(t, crypto.GeneratePrivateKey(), 1))
+	assert.True(t, errors.Is(bc.AddBlock(blockWithEvidence(t, b1, outsider)), ErrInvalidEvidence))
+
+	b2 := blockWithEvidence(t, b1, ev)
+	assert.Nil(t, bc.CheckBlock(b2))
+	assert.Nil(t, bc.AddBlock(b2))
+	assert.True(t, bc.IncludedEvidence(ev.Hash()))
+	got, in, err := bc.GetEvidence(ev.Hash())
+	assert.Nil(t, err)
+	assert.Equal(t, ev, got)
+	assert.Equal(t, b2, in)
+
+	// evidence is included only once.
+	assert.True(t, errors.Is(bc.AddBlock(blockWithEvidence(t, b2, ev)), ErrInvalidEvidence))
+
+	// the offender is removed with the next epoch.
+	set, err := bc.ValidatorSet(3)
+	assert.Nil(t, err)
+	assert.Equal(t, vs[:3], set)
+}
+
+func blockWithEvidence(t *testing.T, parent *Block, evidence ...*Evidence) *Block {
+	b := blockWithTxs(t, parent)
+	assert.Nil(t, b.SetEvidence(evidence))
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	return b
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// Genesis describes the first block of a chain and the consensus rules
+// every node of the chain has to agree on.
+type Genesis struct {
+	Timestamp int64
+	// Engine names the consensus engine of the chain, see the consensus
+	// package. The default is a single signer.
+	Engine string
+	// Validators are the keys that take turns producing blocks, in the
+	// order of their turns. They are the validators of the first epoch,
+	// validator update transactions change them for the later ones.
+	Validators []crypto.PublicKey
+	// Powers are the voting powers of the validators, 1 each if empty.
+	Powers []uint64
+	// EpochLength is the number of blocks of an epoch, validator updates
+	// take effect at the start of the next epoch. The default is
+	// DefaultEpochLength.
+	EpochLength uint32
+	// BlockTime is the time between two blocks.
+	BlockTime time.Duration
+	// Difficulty is the difficulty of the first blocks of a proof of work
+	// chain.
+	Difficulty uint64
+	// Checkpoints pin blocks of the chain, see Checkpoint. They are not
+	// part of the genesis hash, so new releases can add checkpoints
+	// without forking the chain.
+	Checkpoints []Checkpoint
+}
+
+// Validate checks the parts of the genesis every engine relies on. The
+// engines check their own rules.
+func (g *Genesis) Validate() error {
+	if g.BlockTime < 0 {
+		return errors.New("genesis block time is negative")
+	}
+	if len(g.Powers) > 0 && len(g.Powers) != len(g.Validators) {
+		return fmt.Errorf("genesis has %d powers for %d validators", len(g.Powers), len(g.Validators))
+	}
+	for i, power := range g.Powers {
+		if power == 0 || power > maxValidatorPower {
+			return fmt.Errorf("genesis validator %d has invalid power %d", i, power)
+		}
+	}
+	for i, key := range g.Validators {
+		if len(key) != 33 {
+			return fmt.Errorf("genesis validator %d is not a compressed public key", i)
+		}
+		for _, other := range g.Validators[:i] {
+			if bytes.Equal(key, other) {
+				return fmt.Errorf("genesis validator %s is listed twice", key.Address())
+			}
+		}
+	}
+	for i, cp := range g.Checkpoints {
+		if cp.Height == 0 {
+			return fmt.Errorf("genesis checkpoint %d at height 0", i)
+		}
+		if i > 0 && cp.Height <= g.Checkpoints[i-1].Height {
+			return fmt.Errorf("genesis checkpoint %d at height %d not above the one before", i, cp.Height)
+		}
+	}
+	return nil
+}
+
+// ValidatorSet returns the validators of the first epoch.
+func (g *Genesis) ValidatorSet() ValidatorSet {
+	vs := ValidatorSet{}
+	for i, key := range g.Validators {
+		power := uint64(1)
+		if len(g.Powers) > 0 {
+			power = g.Powers[i]
+		}
+		vs = append(vs, ValidatorPower{Key: key, Power: power})
+	}
+	return vs
+}
+
+// Block returns the genesis block. Its DataHash commits to the consensus
+// rules, so chains with different rules do not share a genesis hash.
+func (g *Genesis) Block() *Block {
+	h := sha256.New()
+	NewBinaryWriter(h).WriteString(g.Engine)
+	for _, v := range g.ValidatorSet() {
+		h.Write(v.Key)
+		binary.Write(h, binary.BigEndian, v.Power)
+	}
+	binary.Write(h, binary.BigEndian, int64(g.BlockTime))
+	binary.Write(h, binary.BigEndian, g.Difficulty)
+	binary.Write(h, binary.BigEndian, g.EpochLength)
+
+	header := &Header{
+		Version:    1,
+		DataHash:   types.HashFromBytes(h.Sum(nil)),
+		Height:     0,
+		Timestamp:  g.Timestamp,
+		Difficulty: g.Difficulty,
+	}
+	b, _ := NewBlock(header, nil)
+	return b
+}
@@ -0,0 +1,45 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenesisValidate(t *testing.T) {
+	key := crypto.GeneratePrivateKey().PublicKey()
+
+	assert.Nil(t, (&Genesis{}).Validate())
+	assert.Nil(t, (&Genesis{Validators: []crypto.PublicKey{key}, BlockTime: time.Second}).Validate())
+	assert.NotNil(t, (&Genesis{BlockTime: -time.Second}).Validate())
+	assert.NotNil(t, (&Genesis{Validators: []crypto.PublicKey{key, key}, BlockTime: time.Second}).Validate())
+	assert.NotNil(t, (&Genesis{Validators: []crypto.PublicKey{key[1:]}, BlockTime: time.Second}).Validate())
+	assert.Nil(t, (&Genesis{Validators: []crypto.PublicKey{key}, Powers: []uint64{5}}).Validate())
+	assert.NotNil(t, (&Genesis{Validators: []crypto.PublicKey{key}, Powers: []uint64{5, 1}}).Validate())
+	assert.NotNil(t, (&Genesis{Validators: []crypto.PublicKey{key}, Powers: []uint64{0}}).Validate())
+	assert.Nil(t, (&Genesis{Checkpoints: []Checkpoint{{Height: 5}, {Height: 10}}}).Validate())
+	assert.NotNil(t, (&Genesis{Checkpoints: []Checkpoint{{Height: 0}}}).Validate())
+	assert.NotNil(t, (&Genesis{Checkpoints: []Checkpoint{{Height: 10}, {Height: 5}}}).Validate())
+
+	// the genesis hash depends on the consensus rules.
+	other := crypto.GeneratePrivateKey().PublicKey()
+	genesis := Genesis{Engine: "poa", Validators: []crypto.PublicKey{key}, BlockTime: time.Second}
+	hash := genesis.Block().Hash(BlockHasher{})
+	assert.Equal(t, hash, genesis.Block().Hash(BlockHasher{}))
+	for _, g := range []Genesis{
+		{Engine: "single", Validators: []crypto.PublicKey{key}, BlockTime: time.Second},
+		{Engine: "poa", Validators: []crypto.PublicKey{other}, BlockTime: time.Second},
+		{Engine: "poa", Validators: []crypto.PublicKey{key}, BlockTime: 2 * time.Second},
+		{Engine: "poa", Validators: []crypto.PublicKey{key}, BlockTime: time.Second, Difficulty: 1},
+		{Engine: "poa", Validators: []crypto.PublicKey{key}, Powers: []uint64{2}, BlockTime: time.Second},
+		{Engine: "poa", Validators: []crypto.PublicKey{key}, BlockTime: time.Second, EpochLength: 10},
+	} {
+		assert.NotEqual(t, hash, g.Block().Hash(BlockHasher{}))
+	}
+
+	// checkpoints are not.
+	genesis.Checkpoints = []Checkpoint{{Height: 5}}
+	assert.Equal(t, hash, genesis.Block().Hash(BlockHasher{}))
+}
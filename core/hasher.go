@@ -25,5 +25,5 @@ func (bh BlockHasher) Hash(b *Header) types.Hash {
 type TxHasher struct {}
 
 func (TxHasher) Hash(tx *Transaction) types.Hash {
-	return types.Hash(sha256.Sum256(tx.Data))
+	return types.Hash(sha256.Sum256(tx.SignBytes()))
 }
\ No newline at end of file
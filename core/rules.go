@@ -0,0 +1,111 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// The header and size rules every block has to follow. Each has its own
+// error, so a node can tell which rule a peer broke.
+var (
+	ErrBlockVersion = errors.New("unsupported block version")
+	// ErrBlockTooOld is returned for a block whose timestamp is not after
+	// the median time of the blocks before it.
+	ErrBlockTooOld = errors.New("block timestamp not after median time past")
+	// ErrBlockInFuture is returned for a block whose timestamp is too far
+	// ahead of our clock. The block may become valid later.
+	ErrBlockInFuture       = errors.New("block timestamp is in the future")
+	ErrBlockTooLarge       = errors.New("block too large")
+	ErrTooManyTransactions = errors.New("block has too many transactions")
+	ErrBlockGasLimit       = errors.New("block exceeds the gas limit")
+)
+
+// BlockVersion is the version of the blocks we produce and accept.
+const BlockVersion uint32 = 1
+
+var (
+	// MedianTimeBlocks is the number of blocks whose median timestamp a
+	// new block has to be after.
+	MedianTimeBlocks = 11
+	// MaxFutureBlockTime is how far the timestamp of a block may be ahead
+	// of our clock. Engines that produce blocks on a schedule allow less.
+	MaxFutureBlockTime = 2 * time.Minute
+	// MaxBlockSize is the size limit of an encoded block in bytes.
+	MaxBlockSize = 1 << 20
+	// MaxBlockTransactions is the most transactions a block may have.
+	MaxBlockTransactions = 10000
+	// MaxBlockGas is the most gas the transactions of a block may have
+	// together.
+	MaxBlockGas uint64 = 5000000
+	// TxBaseGas and TxDataGas make up the gas of a transaction, see
+	// Transaction.Gas.
+	TxBaseGas uint64 = 1000
+	TxDataGas uint64 = 10
+)
+
+// SetClock sets the clock blocks from the future are checked against. It
+// defaults to the wall clock.
+func (bc *BlockChain) SetClock(now func() time.Time) {
+	bc.now = now
+}
+
+// checkHeader checks b against the rules that do not depend on the
+// consensus engine. parent is the block b builds on.
+func (bc *BlockChain) checkHeader(parent *Header, b *Block) error {
+	hash := b.Hash(BlockHasher{})
+	if b.Version != BlockVersion {
+		return fmt.Errorf("%w: block (%s) with version (%d)", ErrBlockVersion, hash, b.Version)
+	}
+	if len(b.Transactions) > MaxBlockTransactions {
+		return fmt.Errorf("%w: block (%s) with %d transactions", ErrTooManyTransactions, hash, len(b.Transactions))
+	}
+	data, err := MarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxBlockSize {
+		return fmt.Errorf("%w: block (%s) with %d bytes", ErrBlockTooLarge, hash, len(data))
+	}
+	gas := uint64(0)
+	for _, tx := range b.Transactions {
+		gas += tx.Gas()
+	}
+	if gas > MaxBlockGas {
+		return fmt.Errorf("%w: block (%s) with %d gas", ErrBlockGasLimit, hash, gas)
+	}
+
+	median, err := bc.MedianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if b.Timestamp <= median {
+		return fmt.Errorf("%w: block (%s) at %s, median %s", ErrBlockTooOld, hash, time.Unix(0, b.Timestamp).UTC(), time.Unix(0, median).UTC())
+	}
+	if limit := bc.now().Add(MaxFutureBlockTime); b.Timestamp > limit.UnixNano() {
+		return fmt.Errorf("%w: block (%s) at %s", ErrBlockInFuture, hash, time.Unix(0, b.Timestamp).UTC())
+	}
+	return nil
+}
+
+// MedianTimePast returns the median timestamp of tip and the blocks before
+// it, up to MedianTimeBlocks of them, the later middle one of an even
+// number. A block on top of tip has to be later.
+func (bc *BlockChain) MedianTimePast(tip *Header) (int64, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	timestamps := []int64{tip.Timestamp}
+	h := tip
+	for len(timestamps) < MedianTimeBlocks && h.Height > 0 {
+		prev, ok := bc.blockStore[h.PrevBlockHash]
+		if !ok {
+			return 0, fmt.Errorf("block with hash (%s) not exist", h.PrevBlockHash)
+		}
+		h = prev.Header
+		timestamps = append(timestamps, h.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
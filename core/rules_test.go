@@ -0,0 +1,96 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockAt returns a signed block on top of parent with timestamp.
+func blockAt(t *testing.T, parent *Block, timestamp int64, txx ...*Transaction) *Block {
+	b := blockWithTxs(t, parent, txx...)
+	b.Timestamp = timestamp
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	return b
+}
+
+func TestMedianTimePast(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	// the median of a single block is its timestamp.
+	median, err := bc.MedianTimePast(genesis.Header)
+	assert.Nil(t, err)
+	assert.Equal(t, genesis.Timestamp, median)
+
+	// timestamps need not increase, only beat the median.
+	base := genesis.Timestamp
+	parent := genesis
+	for _, offset := range []int64{10, 20, 15, 30, 25} {
+		b := blockAt(t, parent, base+offset)
+		assert.Nil(t, bc.AddBlock(b))
+		parent = b
+	}
+	// of an even number the later of the middle two counts.
+	median, err = bc.MedianTimePast(parent.Header)
+	assert.Nil(t, err)
+	assert.Equal(t, base+20, median)
+
+	tooOld := blockAt(t, parent, base+20)
+	assert.True(t, errors.Is(bc.AddBlock(tooOld), ErrBlockTooOld))
+	assert.Nil(t, bc.AddBlock(blockAt(t, parent, base+21)))
+
+	// only the last MedianTimeBlocks count.
+	for i := 0; i < MedianTimeBlocks; i++ {
+		tip, err := bc.GetBlock(bc.Height())
+		assert.Nil(t, err)
+		assert.Nil(t, bc.AddBlock(blockAt(t, tip, base+int64(100+i))))
+	}
+	tip, err := bc.GetBlock(bc.Height())
+	assert.Nil(t, err)
+	median, err = bc.MedianTimePast(tip.Header)
+	assert.Nil(t, err)
+	assert.Equal(t, base+int64(100+MedianTimeBlocks/2), median)
+}
+
+func TestCheckHeader(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	now := time.Unix(0, genesis.Timestamp).Add(time.Hour)
+	bc.SetClock(func() time.Time { return now })
+
+	future := blockAt(t, genesis, now.Add(MaxFutureBlockTime).UnixNano()+1)
+	assert.True(t, errors.Is(bc.AddBlock(future), ErrBlockInFuture))
+	assert.True(t, errors.Is(bc.CheckBlock(future), ErrBlockInFuture))
+
+	version := blockAt(t, genesis, now.UnixNano())
+	version.Version = BlockVersion + 1
+	assert.Nil(t, version.Sign(crypto.GeneratePrivateKey()))
+	assert.True(t, errors.Is(bc.AddBlock(version), ErrBlockVersion))
+
+	txx := []*Transaction{randomTxWithSignature(t), randomTxWithSignature(t), randomTxWithSignature(t)}
+	full := blockAt(t, genesis, now.UnixNano(), txx...)
+
+	defer func(n int) { MaxBlockTransactions = n }(MaxBlockTransactions)
+	MaxBlockTransactions = 2
+	assert.True(t, errors.Is(bc.AddBlock(full), ErrTooManyTransactions))
+	MaxBlockTransactions = 3
+
+	data, err := MarshalBinary(full)
+	assert.Nil(t, err)
+	defer func(n int) { MaxBlockSize = n }(MaxBlockSize)
+	MaxBlockSize = len(data) - 1
+	assert.True(t, errors.Is(bc.AddBlock(full), ErrBlockTooLarge))
+	MaxBlockSize = len(data)
+
+	defer func(n uint64) { MaxBlockGas = n }(MaxBlockGas)
+	MaxBlockGas = 3*txx[0].Gas() - 1
+	assert.True(t, errors.Is(bc.AddBlock(full), ErrBlockGasLimit))
+	MaxBlockGas = 3 * txx[0].Gas()
+	assert.Nil(t, bc.AddBlock(full))
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+// Seal is what seals a block besides its header: the signature of the
+// validator and, for BFT engines, the commit. With it a header can be
+// checked before the transactions of its block are downloaded.
+type Seal struct {
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+	Commit    *Commit
+}
+
+// Seal returns the seal of b.
+func (b *Block) Seal() *Seal {
+	return &Seal{Validator: b.Validator, Signature: b.Signature, Commit: b.Commit}
+}
+
+// VerifyHeaders checks the signatures and consensus seals of headers, a
+// chain of headers on top of a block we have, with their seals. It returns
+// how many of them are checked. Checking stops early without an error at
+// the first header of an epoch whose validators only the blocks before it
+// decide, those blocks have to be added first.
+func (bc *BlockChain) VerifyHeaders(headers []*Header, seals []*Seal) (int, error) {
+	if len(seals) != len(headers) {
+		return 0, fmt.Errorf("%d seals for %d headers", len(seals), len(headers))
+	}
+	if len(headers) == 0 {
+		return 0, nil
+	}
+	base, err := bc.GetBlockByHash(headers[0].PrevBlockHash)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, h := range headers {
+		b := &Block{Header: h, Validator: seals[i].Validator, Signature: seals[i].Signature, Commit: seals[i].Commit}
+		// a checkpoint vouches for the blocks it pins.
+		pinned, err := bc.checkCheckpoint(b)
+		if err != nil {
+			return i, err
+		}
+		if pinned {
+			continue
+		}
+		if err := h.Verify(b.Validator, b.Signature); err != nil {
+			return i, err
+		}
+		if bc.consensus == nil {
+			continue
+		}
+
+		parent := base.Header
+		if i > 0 {
+			parent = headers[i-1]
+		}
+		err = bc.consensus.VerifySeal(&headerReader{bc: bc, base: base.Header, headers: headers[:i]}, parent, b)
+		if errors.Is(err, ErrUnknownEpoch) {
+			return i, nil
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(headers), nil
+}
+
+// headerReader is the chain that ends in headers on top of base. We have
+// the blocks up to base, of headers only the headers.
+type headerReader struct {
+	bc      *BlockChain
+	base    *Header
+	headers []*Header
+}
+
+func (r *headerReader) Height() uint32 {
+	if len(r.headers) == 0 {
+		return r.base.Height
+	}
+	return r.headers[len(r.headers)-1].Height
+}
+
+func (r *headerReader) GetHeader(height uint32) (*Header, error) {
+	if height <= r.base.Height {
+		return r.bc.branch(r.base).GetHeader(height)
+	}
+	if i := int(height - r.base.Height - 1); i < len(r.headers) {
+		return r.headers[i], nil
+	}
+	return nil, fmt.Errorf("height (%d) too high", height)
+}
+
+// ValidatorSet returns the validators of the epochs the blocks up to base
+// decide. Headers carry no validator updates or evidence.
+func (r *headerReader) ValidatorSet(height uint32) (ValidatorSet, error) {
+	if epoch := height / r.bc.epochLength; epoch > 0 && epoch*r.bc.epochLength-1 > r.base.Height {
+		return nil, fmt.Errorf("%w: height (%d) on top of the blocks up to height (%d)", ErrUnknownEpoch, height, r.base.Height)
+	}
+	return r.bc.branch(r.base).ValidatorSet(height)
+}
@@ -0,0 +1,78 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// setConsensus accepts every block whose validators it can look up.
+type setConsensus struct {
+	weightConsensus
+}
+
+func (c *setConsensus) VerifySeal(chain ChainReader, parent *Header, b *Block) error {
+	_, err := chain.ValidatorSet(b.Height)
+	return err
+}
+
+// headerChain returns n blocks on top of parent that are not added, their
+// headers and seals.
+func headerChain(t *testing.T, parent *Block, n int) ([]*Header, []*Seal) {
+	headers := []*Header{}
+	seals := []*Seal{}
+	for i := 0; i < n; i++ {
+		parent = childBlock(t, parent, 0)
+		headers = append(headers, parent.Header)
+		seals = append(seals, parent.Seal())
+	}
+	return headers, seals
+}
+
+func TestVerifyHeaders(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	headers, seals := headerChain(t, genesis, 3)
+
+	n, err := bc.VerifyHeaders(headers, seals)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	_, err = bc.VerifyHeaders(headers, seals[:2])
+	assert.NotNil(t, err)
+
+	// a forged signature.
+	forged := append([]*Seal{}, seals...)
+	forged[1] = &Seal{Validator: crypto.GeneratePrivateKey().PublicKey(), Signature: seals[1].Signature}
+	n, err = bc.VerifyHeaders(headers, forged)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n)
+
+	// the seal of the engine.
+	bc.SetConsensus(&sealConsensus{})
+	n, err = bc.VerifyHeaders(headers, seals)
+	assert.True(t, errors.Is(err, errBadSeal))
+	assert.Equal(t, 0, n)
+
+	// a checkpoint vouches for the blocks it pins.
+	assert.Nil(t, bc.AddCheckpoints(Checkpoint{Height: 1, Hash: BlockHasher{}.Hash(headers[0])}))
+	n, err = bc.VerifyHeaders(headers, seals)
+	assert.True(t, errors.Is(err, errBadSeal))
+	assert.Equal(t, 1, n)
+}
+
+func TestVerifyHeadersStopsAtUnknownEpoch(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	bc.SetValidators(ValidatorSet{{Key: crypto.GeneratePrivateKey().PublicKey(), Power: 1}}, 2)
+	bc.SetConsensus(&setConsensus{})
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	headers, seals := headerChain(t, genesis, 4)
+
+	// the validators of height 2 on depend on the block at height 1.
+	n, err := bc.VerifyHeaders(headers, seals)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
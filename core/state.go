@@ -1,17 +1,41 @@
 package core
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
 
 type State struct {
 	data map[string][]byte
+
+	lock sync.RWMutex
+	// nonces holds the nonce of the next transaction of every sender.
+	nonces map[string]uint64
 }
 
 func NewState() *State {
 	return &State{
-		data: make(map[string][]byte),
+		data:   make(map[string][]byte),
+		nonces: make(map[string]uint64),
 	}
 }
 
+// Copy returns a state that changes independently of s.
+func (s *State) Copy() *State {
+	c := NewState()
+	for k, v := range s.data {
+		c.data[k] = v
+	}
+	s.lock.RLock()
+	for k, v := range s.nonces {
+		c.nonces[k] = v
+	}
+	s.lock.RUnlock()
+	return c
+}
+
 func (s *State) Put(k, v []byte) error {
 	s.data[string(k)] = v
 
@@ -32,3 +56,41 @@ func (s *State) Get(k []byte) ([]byte, error) {
 	}
 	return value, nil
 }
+
+// Nonce returns the nonce the next transaction of from needs.
+func (s *State) Nonce(from crypto.PublicKey) uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.nonces[string(from)]
+}
+
+// nextNonces checks that the transactions of every sender in txx follow
+// each other from the nonce the sender needs and returns the nonces after
+// them. s does not change.
+func (s *State) nextNonces(txx []*Transaction) (map[string]uint64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	next := make(map[string]uint64)
+	for _, tx := range txx {
+		nonce, ok := next[string(tx.From)]
+		if !ok {
+			nonce = s.nonces[string(tx.From)]
+		}
+		if tx.Nonce != nonce {
+			return nil, fmt.Errorf("%w: transaction (%s) of %s with nonce (%d), expected (%d)", ErrInvalidNonce, tx.Hash(TxHasher{}), tx.From.Address(), tx.Nonce, nonce)
+		}
+		next[string(tx.From)] = nonce + 1
+	}
+	return next, nil
+}
+
+func (s *State) setNonces(nonces map[string]uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, v := range nonces {
+		s.nonces[k] = v
+	}
+}
@@ -2,6 +2,8 @@ package core
 
 type Storage interface {
 	Put(*Block) error	
+	// Close flushes everything to disk and releases the storage.
+	Close() error
 }
 
 type MemoryStore struct {
@@ -14,4 +16,8 @@ func NewMemStore() *MemoryStore {
 
 func (s *MemoryStore) Put(b *Block) error {
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -1,13 +1,39 @@
 package core
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 
 	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/types"
 )
 
+// TxType tells what the data of a transaction is.
+type TxType uint8
+
+const (
+	// TxTypeContract transactions carry VM bytecode.
+	TxTypeContract TxType = iota
+	// TxTypeValidatorUpdate transactions carry an encoded ValidatorUpdate,
+	// a validator's vote to change the validator set.
+	TxTypeValidatorUpdate
+)
+
+// ErrInvalidNonce is returned for a transaction whose nonce is not the
+// next one of its sender.
+var ErrInvalidNonce = errors.New("invalid transaction nonce")
+
 type Transaction struct {
+	Type TxType
+	// Nonce numbers the transactions of the sender, starting at 0. A
+	// transaction is valid only with the nonce after the last one of the
+	// sender on the chain.
+	Nonce uint64
+	// Fee is what the sender offers for the transaction to be included,
+	// block producers prefer the highest fee per gas.
+	Fee  uint64
 	Data []byte
 	
 	// sender
@@ -31,13 +57,40 @@ func (tx *Transaction) Hash(hasher Hasher[*Transaction]) types.Hash {
 	return tx.hash
 }
 
+// Gas returns the gas of the transaction: a base amount plus an amount
+// per byte of data. The gas of the transactions of a block is limited.
+func (tx *Transaction) Gas() uint64 {
+	return TxBaseGas + TxDataGas*uint64(len(tx.Data))
+}
+
+// SignBytes returns what the sender signs and the hash covers: the type,
+// sender, nonce, fee and data. The same data sent by two senders or twice
+// by one are different transactions.
+func (tx *Transaction) SignBytes() []byte {
+	buf := new(bytes.Buffer)
+	w := NewBinaryWriter(buf)
+	w.WriteUint8(uint8(tx.Type))
+	w.WriteBytes(tx.From)
+	w.WriteUint64(tx.Nonce)
+	w.WriteUint64(tx.Fee)
+	w.WriteBytes(tx.Data)
+	return buf.Bytes()
+}
+
+// signData returns what the signature is computed over, the SHA-256 of
+// the sign bytes.
+func (tx *Transaction) signData() []byte {
+	hash := sha256.Sum256(tx.SignBytes())
+	return hash[:]
+}
+
 func (tx *Transaction) Sign(privKey crypto.PrivateKey) error {
-	sig, err := privKey.Sign(tx.Data)
+	tx.From = privKey.PublicKey()
+	sig, err := privKey.Sign(tx.signData())
 	if err!=nil{
 		return err
 	}
 
-	tx.From = privKey.PublicKey()
 	tx.Signature = sig
 	return nil
 }
@@ -47,7 +100,7 @@ func (tx *Transaction) Verify() error {
 		return fmt.Errorf("tx has no signature")
 	}
 
-	if !tx.Signature.Verify(tx.From, tx.Data) {
+	if !tx.Signature.Verify(tx.From, tx.signData()) {
 		return fmt.Errorf("invalid tx signature")
 	}
 
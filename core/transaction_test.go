@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/LeiZhou-97/blockchain/crypto"
@@ -51,3 +52,38 @@ func TestTxEncode_Decode(t *testing.T) {
 	assert.Nil(t, txDecoded.Decode(NewGobTxDecoder(buf)))
 	assert.Equal(t, tx, txDecoded)
 }
+
+func TestTransactionNonces(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+	key := crypto.GeneratePrivateKey()
+	nonceTx := func(nonce uint64) *Transaction {
+		tx := &Transaction{Data: []byte("foo"), Nonce: nonce}
+		assert.Nil(t, tx.Sign(key))
+		return tx
+	}
+	assert.Equal(t, uint64(0), bc.Nonce(key.PublicKey()))
+
+	// the nonce is signed.
+	tx := nonceTx(0)
+	tx.Nonce = 1
+	assert.NotNil(t, tx.Verify())
+
+	for _, txx := range [][]*Transaction{{nonceTx(1)}, {nonceTx(0), nonceTx(0)}, {nonceTx(1), nonceTx(0)}} {
+		assert.True(t, errors.Is(bc.AddBlock(blockWithTxs(t, genesis, txx...)), ErrInvalidNonce))
+	}
+	assert.Equal(t, uint64(0), bc.Nonce(key.PublicKey()))
+
+	b1 := blockWithTxs(t, genesis, nonceTx(0), nonceTx(1))
+	assert.Nil(t, bc.AddBlock(b1))
+	assert.Equal(t, uint64(2), bc.Nonce(key.PublicKey()))
+	assert.True(t, errors.Is(bc.CheckBlock(blockWithTxs(t, b1, nonceTx(1))), ErrInvalidNonce))
+	assert.Nil(t, bc.CheckBlock(blockWithTxs(t, b1, nonceTx(2))))
+
+	// the nonces follow the chain to another branch.
+	branch := blockWithTxs(t, genesis, nonceTx(0))
+	assert.Nil(t, bc.AddBlock(branch))
+	assert.Nil(t, bc.AddBlock(blockWithTxs(t, branch)))
+	assert.Equal(t, uint64(1), bc.Nonce(key.PublicKey()))
+}
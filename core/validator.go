@@ -3,16 +3,61 @@ package core
 import (
 	"errors"
 	"fmt"
+	"math/big"
 )
 
-var ErrBlockKnown = errors.New("block already known")
+var (
+	ErrBlockKnown   = errors.New("block already known")
+	ErrBlockTooHigh = errors.New("block too high")
+	// ErrUnknownParent is returned for a block on a branch of the chain
+	// we do not know.
+	ErrUnknownParent = errors.New("parent of block unknown")
+	// ErrFinalized is returned for a block that conflicts with a
+	// finalized block.
+	ErrFinalized = errors.New("block conflicts with a finalized block")
+)
 
 type Validator interface {
 	ValidateBlock(*Block) error
 }
 
+// ChainReader is the read access to a chain the consensus rules need.
+type ChainReader interface {
+	Height() uint32
+	GetHeader(height uint32) (*Header, error)
+	// ValidatorSet returns the validators of the block at height.
+	ValidatorSet(height uint32) (ValidatorSet, error)
+}
+
+// SealVerifier checks the consensus fields of a block on top of its parent,
+// e.g. who signed it. chain ends in parent.
+type SealVerifier interface {
+	VerifySeal(chain ChainReader, parent *Header, b *Block) error
+}
+
+// CommitVerifier checks the commit of a block, the proof of the engines
+// that decide blocks by vote. A signed checkpoint is checked with it.
+type CommitVerifier interface {
+	// VerifyCommit checks that the commit of b holds the votes of a
+	// quorum of vs for b.
+	VerifyCommit(vs ValidatorSet, b *Block) error
+}
+
+// Consensus is what the chain needs from its consensus engine, see the
+// consensus package.
+type Consensus interface {
+	SealVerifier
+	// Work is the weight a block adds to its chain. Of two branches the
+	// one with more work is the chain.
+	Work(h *Header) *big.Int
+	// Finalized returns the height of the highest block of chain that can
+	// not be reverted anymore.
+	Finalized(chain ChainReader) uint32
+}
+
 type BlockValidator struct {
-	bc *BlockChain
+	bc   *BlockChain
+	seal SealVerifier
 }
 
 func NewBlockValidator(bc *BlockChain) *BlockValidator {
@@ -21,27 +66,55 @@ func NewBlockValidator(bc *BlockChain) *BlockValidator {
 	}
 }
 
+// NewSealValidator returns a validator that also checks every block with
+// seal.
+func NewSealValidator(bc *BlockChain, seal SealVerifier) *BlockValidator {
+	return &BlockValidator{
+		bc:   bc,
+		seal: seal,
+	}
+}
+
+// ValidateBlock checks b on top of its parent, which may be the tip of the
+// chain or any other block we know.
 func (v *BlockValidator) ValidateBlock(b *Block) error {
-	if v.bc.HasBlock(b.Height) {
+	hash := b.Hash(BlockHasher{})
+	if _, err := v.bc.GetBlockByHash(hash); err == nil {
 		return ErrBlockKnown
 	}
 
-	if b.Height != v.bc.Height()+1 {
-		return fmt.Errorf("block (%s) with height (%d) is too high ==> current height (%d)", b.Hash(BlockHasher{}), b.Height, v.bc.Height())
+	parent, err := v.bc.GetBlockByHash(b.PrevBlockHash)
+	if err != nil {
+		if b.Height > v.bc.Height()+1 {
+			return fmt.Errorf("%w: block (%s) with height (%d) ==> current height (%d)", ErrBlockTooHigh, hash, b.Height, v.bc.Height())
+		}
+		return fmt.Errorf("%w: block (%s) with height (%d)", ErrUnknownParent, hash, b.Height)
 	}
 
-	prevHeader, err := v.bc.GetHeader(b.Height - 1)
+	if b.Height != parent.Height+1 {
+		return fmt.Errorf("block (%s) with height (%d) on top of height (%d)", hash, b.Height, parent.Height)
+	}
+	pinned, err := v.bc.checkCheckpoint(b)
 	if err != nil {
 		return err
 	}
-
-	hash := BlockHasher{}.Hash(prevHeader)
-	if hash != b.PrevBlockHash {
-		return fmt.Errorf("the hash of the previous block is invalid")
+	if b.Height <= v.bc.Finalized() {
+		return fmt.Errorf("%w: block (%s) with height (%d)", ErrFinalized, hash, b.Height)
 	}
 
+	if err := v.bc.checkHeader(parent.Header, b); err != nil {
+		return err
+	}
 	if err := b.Verify(); err != nil {
 		return err
 	}
+	if err := v.bc.verifyBlockEvidence(parent.Header, b); err != nil {
+		return err
+	}
+
+	// a checkpoint vouches for the blocks it pins.
+	if v.seal != nil && !pinned {
+		return v.seal.VerifySeal(v.bc.branch(parent.Header), parent.Header, b)
+	}
 	return nil
 }
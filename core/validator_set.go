@@ -0,0 +1,261 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+// ErrUnknownEpoch is returned for the validators of an epoch whose
+// previous epoch the chain has not finished yet.
+var ErrUnknownEpoch = errors.New("validator set of epoch not known yet")
+
+// DefaultEpochLength is the number of blocks of an epoch if the genesis
+// does not set it.
+var DefaultEpochLength uint32 = 100
+
+// maxValidatorPower keeps the total voting power far from overflowing.
+var maxValidatorPower uint64 = 1 << 48
+
+// ValidatorPower is a validator and its voting power.
+type ValidatorPower struct {
+	Key   crypto.PublicKey
+	Power uint64
+}
+
+// ValidatorSet is the validators of an epoch in the order of their turns.
+type ValidatorSet []ValidatorPower
+
+// Index returns the turn of key, -1 if it is no validator.
+func (vs ValidatorSet) Index(key crypto.PublicKey) int {
+	for i, v := range vs {
+		if bytes.Equal(v.Key, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (vs ValidatorSet) Contains(key crypto.PublicKey) bool {
+	return vs.Index(key) >= 0
+}
+
+// Power returns the voting power of key, 0 if it is no validator.
+func (vs ValidatorSet) Power(key crypto.PublicKey) uint64 {
+	if i := vs.Index(key); i >= 0 {
+		return vs[i].Power
+	}
+	return 0
+}
+
+func (vs ValidatorSet) TotalPower() uint64 {
+	total := uint64(0)
+	for _, v := range vs {
+		total += v.Power
+	}
+	return total
+}
+
+// Quorum returns the voting power that decides, more than two thirds of
+// the total.
+func (vs ValidatorSet) Quorum() uint64 {
+	return vs.TotalPower()*2/3 + 1
+}
+
+// apply returns the set with u applied. A new validator takes the last
+// turn, a validator with power 0 is removed. An update that would leave
+// no validator is not applied.
+func (vs ValidatorSet) apply(u ValidatorUpdate) ValidatorSet {
+	next := ValidatorSet{}
+	found := false
+	for _, v := range vs {
+		if bytes.Equal(v.Key, u.Key) {
+			found = true
+			if u.Power == 0 {
+				continue
+			}
+			v.Power = u.Power
+		}
+		next = append(next, v)
+	}
+	if !found && u.Power > 0 {
+		next = append(next, ValidatorPower{Key: u.Key, Power: u.Power})
+	}
+	if len(next) == 0 {
+		return vs
+	}
+	return next
+}
+
+// ValidatorUpdate sets the voting power of a validator, adding it if it
+// is new. Power 0 removes it.
+type ValidatorUpdate struct {
+	Key   crypto.PublicKey
+	Power uint64
+}
+
+// NewValidatorUpdateTx returns an unsigned transaction that votes for u.
+// Validators send it signed with their key.
+func NewValidatorUpdateTx(u ValidatorUpdate) (*Transaction, error) {
+	data, err := MarshalBinary(&u)
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{Type: TxTypeValidatorUpdate, Data: data}, nil
+}
+
+// nextValidatorSet returns the validators of the epoch after the one of
+// blocks, which vs validated. An update is adopted once validators with
+// a quorum of the power of vs voted for it with the same transaction data
+// in the epoch, votes do not carry over into the next epoch. Updates
+// apply in the order they were adopted, invalid ones are ignored. Then
+// the validators the blocks carry evidence against are removed.
+func nextValidatorSet(vs ValidatorSet, blocks []*Block) ValidatorSet {
+	var (
+		quorum  = vs.Quorum()
+		tally   = make(map[string]uint64)
+		voted   = make(map[string]map[string]bool)
+		adopted = make(map[string]bool)
+		updates = []ValidatorUpdate{}
+	)
+	for _, b := range blocks {
+		for _, tx := range b.Transactions {
+			if tx.Type != TxTypeValidatorUpdate {
+				continue
+			}
+			id := string(tx.Data)
+			power := vs.Power(tx.From)
+			if power == 0 || adopted[id] || voted[id][string(tx.From)] {
+				continue
+			}
+			u := ValidatorUpdate{}
+			if err := UnmarshalBinary(tx.Data, &u); err != nil || len(u.Key) != 33 || u.Power > maxValidatorPower {
+				continue
+			}
+
+			if voted[id] == nil {
+				voted[id] = make(map[string]bool)
+			}
+			voted[id][string(tx.From)] = true
+			tally[id] += power
+			if tally[id] >= quorum {
+				adopted[id] = true
+				updates = append(updates, u)
+			}
+		}
+	}
+
+	for _, u := range updates {
+		vs = vs.apply(u)
+	}
+	for _, b := range blocks {
+		for _, ev := range b.Evidence {
+			vs = vs.apply(ValidatorUpdate{Key: ev.Validator, Power: 0})
+		}
+	}
+	return vs
+}
+
+// SetValidators sets the validators of the first epoch and the length of
+// the epochs. Validator updates of an epoch take effect in the next one.
+func (bc *BlockChain) SetValidators(vs ValidatorSet, epochLength uint32) {
+	if epochLength == 0 {
+		epochLength = DefaultEpochLength
+	}
+	bc.validators = vs
+	bc.epochLength = epochLength
+}
+
+// EpochLength returns the number of blocks of an epoch.
+func (bc *BlockChain) EpochLength() uint32 {
+	return bc.epochLength
+}
+
+// ValidatorSet returns the validators of the block at height on top of the
+// chain. Heights of the epoch after the one of the tip are not known yet.
+func (bc *BlockChain) ValidatorSet(height uint32) (ValidatorSet, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return bc.validatorSetLocked(bc.headers[len(bc.headers)-1], height)
+}
+
+func (r *branchReader) ValidatorSet(height uint32) (ValidatorSet, error) {
+	r.bc.lock.RLock()
+	defer r.bc.lock.RUnlock()
+
+	return r.bc.validatorSetLocked(r.tip, height)
+}
+
+// validatorSetLocked returns the validators at height on the branch that
+// ends in tip. The set of an epoch is cached by the hash of the last block
+// before it, so every branch gets its own. bc.lock must be held.
+func (bc *BlockChain) validatorSetLocked(tip *Header, height uint32) (ValidatorSet, error) {
+	epoch := height / bc.epochLength
+	if epoch == 0 {
+		return bc.validators, nil
+	}
+	start := epoch * bc.epochLength
+	if tip.Height < start-1 {
+		return nil, fmt.Errorf("%w: height (%d) on top of height (%d)", ErrUnknownEpoch, height, tip.Height)
+	}
+
+	last, err := bc.ancestorLocked(tip, start-1)
+	if err != nil {
+		return nil, err
+	}
+	hash := last.Hash(BlockHasher{})
+	bc.setLock.Lock()
+	vs, ok := bc.validatorSets[hash]
+	bc.setLock.Unlock()
+	if ok {
+		return vs, nil
+	}
+
+	prev, err := bc.validatorSetLocked(last.Header, start-bc.epochLength)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]*Block, bc.epochLength)
+	b := last
+	for i := len(blocks) - 1; i >= 0; i-- {
+		blocks[i] = b
+		if i > 0 {
+			if b, ok = bc.blockStore[b.PrevBlockHash]; !ok {
+				return nil, fmt.Errorf("block with hash (%s) not exist", blocks[i].PrevBlockHash)
+			}
+		}
+	}
+	vs = nextValidatorSet(prev, blocks)
+
+	bc.setLock.Lock()
+	bc.validatorSets[hash] = vs
+	bc.setLock.Unlock()
+	return vs, nil
+}
+
+// ancestorLocked returns the block at height on the branch that ends in
+// tip. bc.lock must be held.
+func (bc *BlockChain) ancestorLocked(tip *Header, height uint32) (*Block, error) {
+	if height > tip.Height {
+		return nil, fmt.Errorf("height (%d) too high", height)
+	}
+
+	hash := BlockHasher{}.Hash(tip)
+	for {
+		b, ok := bc.blockStore[hash]
+		if !ok {
+			return nil, fmt.Errorf("block with hash (%s) not exist", hash)
+		}
+		if int(b.Height) < len(bc.blocks) && bc.blocks[b.Height].Hash(BlockHasher{}) == hash {
+			// the rest of the branch is the main chain.
+			return bc.blocks[height], nil
+		}
+		if b.Height == height {
+			return b, nil
+		}
+		hash = b.PrevBlockHash
+	}
+}
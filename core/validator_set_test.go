@@ -0,0 +1,145 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func updateTx(t *testing.T, key crypto.PrivateKey, u ValidatorUpdate) *Transaction {
+	tx, err := NewValidatorUpdateTx(u)
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Sign(key))
+	return tx
+}
+
+func blockWithTxs(t *testing.T, parent *Block, txx ...*Transaction) *Block {
+	header := &Header{
+		Version:       1,
+		PrevBlockHash: parent.Hash(BlockHasher{}),
+		Height:        parent.Height + 1,
+		Timestamp:     time.Now().UnixNano(),
+	}
+	b, err := NewBlock(header, txx)
+	assert.Nil(t, err)
+	b.DataHash, err = CalculateDataHash(b.Transactions)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(crypto.GeneratePrivateKey()))
+	return b
+}
+
+func TestValidatorUpdateTx(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+	tx := updateTx(t, key, ValidatorUpdate{Key: key.PublicKey(), Power: 3})
+	assert.Nil(t, tx.Verify())
+
+	data, err := MarshalBinary(tx)
+	assert.Nil(t, err)
+	decoded := new(Transaction)
+	assert.Nil(t, UnmarshalBinary(data, decoded))
+	assert.Equal(t, TxTypeValidatorUpdate, decoded.Type)
+	assert.Nil(t, decoded.Verify())
+
+	// the type is signed and hashed, the same data as a contract is
+	// another transaction.
+	contract := &Transaction{Data: tx.Data, From: tx.From, Signature: tx.Signature}
+	assert.NotNil(t, contract.Verify())
+	assert.NotEqual(t, tx.Hash(TxHasher{}), contract.Hash(TxHasher{}))
+}
+
+func TestNextValidatorSet(t *testing.T) {
+	keys := []crypto.PrivateKey{}
+	vs := ValidatorSet{}
+	for i := 0; i < 4; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		vs = append(vs, ValidatorPower{Key: keys[i].PublicKey(), Power: 1})
+	}
+	// a total power of 5, a quorum is 4.
+	vs[0].Power = 2
+	assert.Equal(t, uint64(4), vs.Quorum())
+
+	newKey := crypto.GeneratePrivateKey()
+	add := ValidatorUpdate{Key: newKey.PublicKey(), Power: 1}
+	votes := &Block{Transactions: []*Transaction{
+		updateTx(t, keys[1], add),
+		updateTx(t, keys[1], add),
+		updateTx(t, keys[2], add),
+		updateTx(t, keys[3], add),
+		// not a validator.
+		updateTx(t, newKey, add),
+	}}
+	assert.Equal(t, vs, nextValidatorSet(vs, []*Block{votes}))
+
+	// the votes may spread over the blocks of the epoch.
+	next := nextValidatorSet(vs, []*Block{votes, {Transactions: []*Transaction{updateTx(t, keys[0], add)}}})
+	assert.Equal(t, append(append(ValidatorSet{}, vs...), ValidatorPower{Key: newKey.PublicKey(), Power: 1}), next)
+
+	// remove one validator and change the power of another.
+	remove := ValidatorUpdate{Key: keys[3].PublicKey(), Power: 0}
+	change := ValidatorUpdate{Key: keys[1].PublicKey(), Power: 3}
+	next = nextValidatorSet(vs, []*Block{{Transactions: []*Transaction{
+		updateTx(t, keys[0], remove), updateTx(t, keys[1], remove), updateTx(t, keys[2], remove),
+		updateTx(t, keys[0], change), updateTx(t, keys[1], change), updateTx(t, keys[3], change),
+	}}})
+	assert.Equal(t, ValidatorSet{vs[0], {Key: keys[1].PublicKey(), Power: 3}, vs[2]}, next)
+
+	// invalid updates are ignored.
+	bad := &Transaction{Type: TxTypeValidatorUpdate, Data: []byte{1, 2, 3}}
+	assert.Nil(t, bad.Sign(keys[0]))
+	assert.Equal(t, vs, nextValidatorSet(vs, []*Block{{Transactions: []*Transaction{bad}}}))
+
+	// the last validator can not be removed.
+	single := ValidatorSet{vs[1]}
+	leave := updateTx(t, keys[1], ValidatorUpdate{Key: keys[1].PublicKey(), Power: 0})
+	assert.Equal(t, single, nextValidatorSet(single, []*Block{{Transactions: []*Transaction{leave}}}))
+}
+
+func TestBlockChainValidatorSet(t *testing.T) {
+	bc := newBlockChainWithGenesis(t)
+	keys := []crypto.PrivateKey{}
+	vs := ValidatorSet{}
+	for i := 0; i < 3; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		vs = append(vs, ValidatorPower{Key: keys[i].PublicKey(), Power: 1})
+	}
+	bc.SetValidators(vs, 3)
+	genesis, err := bc.GetBlock(0)
+	assert.Nil(t, err)
+
+	// all three vote for a new validator in the first epoch.
+	newKey := crypto.GeneratePrivateKey()
+	add := ValidatorUpdate{Key: newKey.PublicKey(), Power: 1}
+	b1 := blockWithTxs(t, genesis, updateTx(t, keys[0], add), updateTx(t, keys[1], add))
+	assert.Nil(t, bc.AddBlock(b1))
+
+	// the epoch of the next block is not over yet.
+	_, err = bc.ValidatorSet(3)
+	assert.True(t, errors.Is(err, ErrUnknownEpoch))
+
+	b2 := blockWithTxs(t, b1, updateTx(t, keys[2], add))
+	assert.Nil(t, bc.AddBlock(b2))
+
+	set, err := bc.ValidatorSet(2)
+	assert.Nil(t, err)
+	assert.Equal(t, vs, set)
+	for _, height := range []uint32{3, 5} {
+		set, err = bc.ValidatorSet(height)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, len(set))
+		assert.True(t, set.Contains(newKey.PublicKey()))
+	}
+	_, err = bc.ValidatorSet(6)
+	assert.True(t, errors.Is(err, ErrUnknownEpoch))
+
+	// a branch without the votes keeps the old validators.
+	fork := blockWithTxs(t, genesis)
+	assert.Nil(t, bc.AddBlock(fork))
+	branch := blockWithTxs(t, fork, updateTx(t, keys[0], add))
+	assert.Nil(t, bc.AddBlock(branch))
+	set, err = bc.branch(branch.Header).ValidatorSet(3)
+	assert.Nil(t, err)
+	assert.Equal(t, vs, set)
+}
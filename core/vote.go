@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// VoteType is the step of a BFT round a vote belongs to.
+type VoteType uint8
+
+const (
+	VotePrevote   VoteType = 1
+	VotePrecommit VoteType = 2
+)
+
+func (t VoteType) String() string {
+	switch t {
+	case VotePrevote:
+		return "prevote"
+	case VotePrecommit:
+		return "precommit"
+	}
+	return fmt.Sprintf("vote type %d", uint8(t))
+}
+
+// Vote is the vote of a validator in a round of BFT consensus.
+type Vote struct {
+	Type   VoteType
+	Height uint32
+	Round  uint32
+	// BlockHash is the block voted for, the zero hash is a vote for no
+	// block.
+	BlockHash types.Hash
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+}
+
+// SignBytes returns what the validator signs: the codec version followed
+// by the type, height, round and block hash of the vote.
+func (v *Vote) SignBytes() []byte {
+	buf := new(bytes.Buffer)
+	w := NewBinaryWriter(buf)
+	w.WriteUint8(CodecVersion)
+	w.WriteUint8(uint8(v.Type))
+	w.WriteUint32(v.Height)
+	w.WriteUint32(v.Round)
+	w.WriteHash(v.BlockHash)
+	return buf.Bytes()
+}
+
+func (v *Vote) Sign(key crypto.PrivateKey) error {
+	hash := sha256.Sum256(v.SignBytes())
+	sig, err := key.Sign(hash[:])
+	if err != nil {
+		return err
+	}
+
+	v.Validator = key.PublicKey()
+	v.Signature = sig
+	return nil
+}
+
+// Verify checks the signature of the vote. Whether the signer is a
+// validator is up to the consensus engine.
+func (v *Vote) Verify() error {
+	if v.Type != VotePrevote && v.Type != VotePrecommit {
+		return fmt.Errorf("invalid %s", v.Type)
+	}
+	if v.Signature == nil {
+		return fmt.Errorf("%s has no signature", v.Type)
+	}
+	hash := sha256.Sum256(v.SignBytes())
+	if !v.Signature.Verify(v.Validator, hash[:]) {
+		return fmt.Errorf("%s of %s has an invalid signature", v.Type, v.Validator.Address())
+	}
+	return nil
+}
+
+// Commit is the proof that a block was decided by BFT consensus: the
+// precommits for the block of a quorum of the validators in one round.
+type Commit struct {
+	Round      uint32
+	Precommits []*Vote
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVoteSignVerify(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+	v := &Vote{Type: VotePrecommit, Height: 3, Round: 1, BlockHash: types.Hash{1}}
+	assert.NotNil(t, v.Verify())
+	assert.Nil(t, v.Sign(key))
+	assert.Nil(t, v.Verify())
+	assert.Equal(t, key.PublicKey(), v.Validator)
+
+	// the signature covers every field.
+	for _, change := range []func(){
+		func() { v.Type = VotePrevote },
+		func() { v.Height++ },
+		func() { v.Round++ },
+		func() { v.BlockHash = types.Hash{} },
+		func() { v.Validator = crypto.GeneratePrivateKey().PublicKey() },
+	} {
+		signed := *v
+		change()
+		assert.NotNil(t, v.Verify())
+		*v = signed
+	}
+
+	v.Type = 3
+	assert.NotNil(t, v.Verify())
+}
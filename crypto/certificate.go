@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// Bytes encodes the key in SEC 1 DER form.
+func (k PrivateKey) Bytes() ([]byte, error) {
+	return x509.MarshalECPrivateKey(k.key)
+}
+
+func PrivateKeyFromBytes(b []byte) (PrivateKey, error) {
+	key, err := x509.ParseECPrivateKey(b)
+	if err != nil {
+		return PrivateKey{}, err
+	}
+	if key.Curve != elliptic.P256() {
+		return PrivateKey{}, errors.New("private key is not on curve P-256")
+	}
+	return PrivateKey{key: key}, nil
+}
+
+// TLSCertificate returns a self-signed certificate for the key. Nodes use
+// it to prove in the TLS handshake that they own the key.
+func (k PrivateKey) TLSCertificate() (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: k.PublicKey().Address().String()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+		// the certificate only carries the key, it is never checked
+		// against a CA.
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &k.key.PublicKey, k.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  k.key,
+	}, nil
+}
+
+// PublicKeyFromCertificate returns the key of a self-signed node certificate.
+// It fails if the certificate is not signed by its own P-256 key.
+func PublicKeyFromCertificate(cert *x509.Certificate) (PublicKey, error) {
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P256() {
+		return nil, errors.New("certificate key is not an ECDSA P-256 key")
+	}
+	if err := cert.CheckSignatureFrom(cert); err != nil {
+		return nil, err
+	}
+
+	return elliptic.MarshalCompressed(key.Curve, key.X, key.Y), nil
+}
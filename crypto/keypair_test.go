@@ -1,6 +1,7 @@
 package crypto
 
 import (
+	"crypto/x509"
 	"fmt"
 	"testing"
 
@@ -31,3 +32,31 @@ func TestKeypair_Sign_Verify(t *testing.T) {
 
 	assert.True(t, sig.Verify(pubKey, msg))
 }
+
+func TestPrivateKeyBytes(t *testing.T) {
+	privKey := GeneratePrivateKey()
+
+	b, err := privKey.Bytes()
+	assert.Nil(t, err)
+
+	decoded, err := PrivateKeyFromBytes(b)
+	assert.Nil(t, err)
+	assert.Equal(t, privKey.PublicKey(), decoded.PublicKey())
+
+	_, err = PrivateKeyFromBytes([]byte("garbage"))
+	assert.NotNil(t, err)
+}
+
+func TestTLSCertificate(t *testing.T) {
+	privKey := GeneratePrivateKey()
+
+	cert, err := privKey.TLSCertificate()
+	assert.Nil(t, err)
+
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+
+	pubKey, err := PublicKeyFromCertificate(x509Cert)
+	assert.Nil(t, err)
+	assert.Equal(t, privKey.PublicKey(), pubKey)
+}
@@ -2,11 +2,13 @@ module github.com/LeiZhou-97/blockchain
 
 go 1.19
 
-require github.com/stretchr/testify v1.9.0
+require (
+	github.com/labstack/echo/v4 v4.12.0
+	github.com/stretchr/testify v1.9.0
+)
 
 require (
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
-	github.com/labstack/echo/v4 v4.12.0 // indirect
 	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
@@ -22,7 +24,7 @@ require (
 	github.com/go-kit/log v0.2.1
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/sirupsen/logrus v1.9.3 // indirect
+	github.com/sirupsen/logrus v1.9.3
 	golang.org/x/sys v0.19.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
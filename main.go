@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/LeiZhou-97/blockchain/consensus"
 	"github.com/LeiZhou-97/blockchain/core"
 	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/network"
@@ -18,38 +22,57 @@ import (
 // Keypair
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	privKey := crypto.GeneratePrivateKey()
-	localNode := makeServer("LOCAL", &privKey, ":3000", []string{":4000"}, ":9999")
+	// the local node is the only validator of the chain.
+	genesis := &core.Genesis{
+		Engine:     consensus.EnginePoA,
+		Timestamp:  time.Now().UnixNano(),
+		Validators: []crypto.PublicKey{privKey.PublicKey()},
+		BlockTime:  5 * time.Second,
+	}
+
+	localNode := makeServer("LOCAL", newTCPTransport(":3000"), genesis, &privKey, []string{":4000"}, ":9999")
 	go localNode.Start()
 
-	remoteNode := makeServer("REMOTE_NODE", nil, ":4000", []string{":5000"}, "")
+	remoteNode := makeServer("REMOTE_NODE", newTCPTransport(":4000"), genesis, nil, []string{":5000"}, "")
 	go remoteNode.Start()
 
-	remoteNodeB := makeServer("REMOTE_NODE_B", nil, ":5000", nil, "")
+	remoteNodeB := makeServer("REMOTE_NODE_B", newTCPTransport(":5000"), genesis, nil, nil, "")
 	go remoteNodeB.Start()
-	// tr := network.NewTCPTransport(":3000")
-	// go tr.Start()
 
+	lateNode := makeServer("LATE_NODE", newTCPTransport(":6000"), genesis, nil, []string{":4000"}, "")
 	go func() {
-		time.Sleep(16 * time.Second)
-
-		lateNode := makeServer("LATE_NODE", nil, ":6000", []string{":4000"}, "")
-		go lateNode.Start()
+		select {
+		case <-time.After(16 * time.Second):
+			lateNode.Start()
+		case <-ctx.Done():
+		}
 	}()
 
 	time.Sleep(time.Second)
 
 	txSender()
-	//
-	select {}
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	for _, s := range []*network.Server{localNode, remoteNode, remoteNodeB, lateNode} {
+		if err := s.Stop(); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
-func makeServer(id string, pk *crypto.PrivateKey, addr string, seedNodes []string, apiListenAddr string) *network.Server {
+func makeServer(id string, tr network.Transport, genesis *core.Genesis, pk *crypto.PrivateKey, seedNodes []string, apiListenAddr string) *network.Server {
 	opts := network.ServerOpts{
 		APIListenAddr: apiListenAddr,
 		SeedNodes:  seedNodes,
-		ListenAddr: addr,
+		Transport:  tr,
 		PrivateKey: pk,
+		Genesis:    genesis,
 		ID:         id,
 	}
 
@@ -61,114 +84,33 @@ func makeServer(id string, pk *crypto.PrivateKey, addr string, seedNodes []strin
 	return s
 }
 
+// newTCPTransport creates a transport with a fresh node key.
+func newTCPTransport(addr string) network.Transport {
+	tr, err := network.NewTCPTransport(addr, crypto.GeneratePrivateKey())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tr
+}
+
 func txSender() {
-	conn, err := net.Dial("tcp", ":3000")
+	privKey := crypto.GeneratePrivateKey()
+	peer, err := network.DialTCPPeer(":3000", privKey)
 	if err != nil {
 		panic(err)
 	}
 
-	privKey := crypto.GeneratePrivateKey()
 	data := []byte{0x03, 0x0a, 0x02, 0x0a, 0x0e}
 	tx := core.NewTransaction(data)
 	tx.Sign(privKey)
 	buf := &bytes.Buffer{}
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+	if err := tx.Encode(core.NewBinaryTxEncoder(buf)); err != nil {
 		panic(err)
 	}
 
 	msg := network.NewMessage(network.MessageTypeTx, buf.Bytes())
 
-	_, err = conn.Write(msg.Bytes())
-	if err != nil {
+	if err := peer.Send(msg.Bytes()); err != nil {
 		panic(err)
 	}
 }
-
-// var transports = []network.Transport{
-//     network.NewLocalTransport("LOCAL"),
-//     // network.NewLocalTransport("REMOTE_B"),
-//     // network.NewLocalTransport("REMOTE_C"),
-// }
-
-// func main() {
-//     initRemoteServers(transports)
-//     localNode := transports[0]
-//     trLate := network.NewLocalTransport("LATE_NODE")
-//     // remoteNodeA := transports[1]
-//     // remoteNodeC := transports[3]
-//
-//     // go func() {
-//     // 	for {
-//     // 		if err := sendTransaction(remoteNodeA, localNode.Addr()); err != nil {
-//     // 			logrus.Error(err)
-//     // 		}
-//     // 		time.Sleep(2 * time.Second)
-//     // 	}
-//     // }()
-//
-//     go func() {
-//         time.Sleep(7 * time.Second)
-//         // connect the late node with localNode
-//         lateServer := makeLateServer(string(trLate.Addr()), trLate, nil)
-//         go lateServer.Start()
-//     }()
-//
-//     privKey := crypto.GeneratePrivateKey()
-//     localServer := makeServer("LOCAL", localNode, &privKey)
-//     localServer.Start()
-// }
-//
-// func initRemoteServers(trs []network.Transport) {
-//     for i := 0; i < len(trs); i++ {
-//         id := fmt.Sprintf("REMOTE_%d", i)
-//         s := makeServer(id, trs[i], nil)
-//         go s.Start()
-//     }
-// }
-//
-//
-// // WA
-// func makeLateServer(id string, tr network.Transport, pk *crypto.PrivateKey) *network.Server {
-//     opts := network.ServerOpts{
-//         Transport:  tr,
-//         PrivateKey: pk,
-//         ID:         id,
-//         Transports: append(transports, tr),
-//     }
-//
-//     s, err := network.NewServer(opts)
-//     if err != nil {
-//         log.Fatal(err)
-//     }
-//
-//     return s
-// }
-//
-// func sendGetStatusMessage(tr network.Transport, to network.NetAddr) error {
-//     var (
-//         getStatusMsg = new(network.GetStatusMessage)
-//         buf          = new(bytes.Buffer)
-//     )
-//     if err := gob.NewEncoder(buf).Encode(getStatusMsg); err != nil {
-//         return err
-//     }
-//     msg := network.NewMessage(network.MessageTypeGetStatus, buf.Bytes())
-//     return tr.SendMessage(to, msg.Bytes())
-// }
-//
-// func sendTransaction(tr network.Transport, to network.NetAddr) error {
-//     privKey := crypto.GeneratePrivateKey()
-//     data := []byte{0x01, 0x0a, 0x02, 0x0a, 0x0b}
-//     tx := core.NewTransaction(data)
-//     tx.Sign(privKey)
-//     buf := &bytes.Buffer{}
-//
-//     if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
-//         return err
-//     }
-//
-//     msg := network.NewMessage(network.MessageTypeTx, buf.Bytes())
-//     tr.SendMessage(to, msg.Bytes())
-//
-//     return nil
-// }
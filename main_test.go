@@ -6,32 +6,27 @@ import (
 
 	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/network"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestMain(t *testing.T) {
-	initRemoteServers(transports)
-	localNode := transports[0]
+func TestLocalNetwork(t *testing.T) {
+	trLocal := network.NewLocalTransport("LOCAL")
+	trRemote := network.NewLocalTransport("REMOTE")
 	trLate := network.NewLocalTransport("LATE_NODE")
-	// remoteNodeA := transports[1]
-	// remoteNodeC := transports[3]
 
-	// go func() {
-	// 	for {
-	// 		if err := sendTransaction(remoteNodeA, localNode.Addr()); err != nil {
-	// 			logrus.Error(err)
-	// 		}
-	// 		time.Sleep(2 * time.Second)
-	// 	}
-	// }()
-
-	go func() {
-		time.Sleep(7 * time.Second)
-		// connect the late node with localNode
-		lateServer := makeServer(string(trLate.Addr()), trLate, nil)
-		go lateServer.Start()
-	}()
+	for _, pair := range [][2]network.Transport{{trLocal, trRemote}, {trRemote, trLate}} {
+		assert.Nil(t, pair[0].Connect(pair[1]))
+		assert.Nil(t, pair[1].Connect(pair[0]))
+	}
 
 	privKey := crypto.GeneratePrivateKey()
-	localServer := makeServer("LOCAL", localNode, &privKey)
-	localServer.Start()
-}
\ No newline at end of file
+	go makeServer("LOCAL", trLocal, nil, &privKey, nil, "").Start()
+	remoteServer := makeServer("REMOTE", trRemote, nil, nil, nil, "")
+	go remoteServer.Start()
+	go makeServer("LATE_NODE", trLate, nil, nil, nil, "").Start()
+
+	assert.Eventually(t, func() bool {
+		peers := remoteServer.Peers()
+		return len(peers) == 2 && peers[0].ID == "LATE_NODE" && peers[1].ID == "LOCAL"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,294 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// retryBackoff is the minimum time we wait before dialing an address again
+// after a failed attempt. It doubles with every consecutive failure.
+var retryBackoff = 2 * time.Second
+
+// maxConsecutiveFailures is the number of failed dials in a row after which
+// an address that never worked is dropped from the book.
+const maxConsecutiveFailures = 10
+
+// KnownAddress is an entry of the address book together with the dial
+// statistics we collected for it.
+type KnownAddress struct {
+	Addr string
+	// Source is the address of the peer that told us about Addr.
+	Source      string
+	Attempts    int
+	Successes   int
+	Failures    int
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastFailure time.Time
+	// consecutive failures since the last successful connection
+	failStreak int
+}
+
+func (ka *KnownAddress) isBackingOff(now time.Time) bool {
+	if ka.failStreak == 0 {
+		return false
+	}
+	backoff := retryBackoff << uint(ka.failStreak-1)
+	return now.Sub(ka.LastFailure) < backoff
+}
+
+// AddrBook keeps track of the listen addresses of other nodes. If it has a
+// path it is persisted to disk as JSON, so a restarted node does not depend
+// on its seed nodes anymore.
+type AddrBook struct {
+	lock  sync.RWMutex
+	path  string
+	addrs map[string]*KnownAddress
+	dirty bool
+}
+
+// NewAddrBook creates an address book backed by the file at path. An empty
+// path means the book only lives in memory.
+func NewAddrBook(path string) (*AddrBook, error) {
+	ab := &AddrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+	}
+	if path == "" {
+		return ab, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ab, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	known := []*KnownAddress{}
+	if err := json.Unmarshal(b, &known); err != nil {
+		return nil, err
+	}
+	for _, ka := range known {
+		ab.addrs[ka.Addr] = ka
+	}
+
+	return ab, nil
+}
+
+// Add adds addr to the book. It returns false if the address is invalid or
+// already known.
+func (ab *AddrBook) Add(addr, source string) bool {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return false
+	}
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if _, ok := ab.addrs[addr]; ok {
+		return false
+	}
+	ab.addrs[addr] = &KnownAddress{
+		Addr:   addr,
+		Source: source,
+	}
+	ab.dirty = true
+
+	return true
+}
+
+func (ab *AddrBook) Remove(addr string) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if _, ok := ab.addrs[addr]; ok {
+		delete(ab.addrs, addr)
+		ab.dirty = true
+	}
+}
+
+func (ab *AddrBook) Get(addr string) (KnownAddress, bool) {
+	ab.lock.RLock()
+	defer ab.lock.RUnlock()
+
+	ka, ok := ab.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *ka, true
+}
+
+func (ab *AddrBook) Len() int {
+	ab.lock.RLock()
+	defer ab.lock.RUnlock()
+
+	return len(ab.addrs)
+}
+
+func (ab *AddrBook) MarkAttempt(addr string) {
+	ab.update(addr, func(ka *KnownAddress) {
+		ka.Attempts++
+		ka.LastAttempt = time.Now()
+	})
+}
+
+func (ab *AddrBook) MarkSuccess(addr string) {
+	ab.update(addr, func(ka *KnownAddress) {
+		ka.Successes++
+		ka.LastSuccess = time.Now()
+		ka.failStreak = 0
+	})
+}
+
+func (ab *AddrBook) MarkFailure(addr string) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	ka, ok := ab.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Failures++
+	ka.LastFailure = time.Now()
+	ka.failStreak++
+	// addresses that never worked are most likely stale or bogus.
+	if ka.Successes == 0 && ka.failStreak >= maxConsecutiveFailures {
+		delete(ab.addrs, addr)
+	}
+	ab.dirty = true
+}
+
+func (ab *AddrBook) update(addr string, fn func(*KnownAddress)) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	ka, ok := ab.addrs[addr]
+	if !ok {
+		return
+	}
+	fn(ka)
+	ab.dirty = true
+}
+
+// Addresses returns at most max known addresses, the most reliable ones
+// first.
+func (ab *AddrBook) Addresses(max int) []string {
+	ab.lock.RLock()
+	defer ab.lock.RUnlock()
+
+	addrs := ab.sorted(func(*KnownAddress) bool { return true })
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+	return addrs
+}
+
+// Candidates returns up to n addresses worth dialing. Addresses for which
+// skip returns true and addresses that recently failed are left out.
+func (ab *AddrBook) Candidates(n int, skip func(string) bool) []string {
+	ab.lock.RLock()
+	defer ab.lock.RUnlock()
+
+	now := time.Now()
+	addrs := ab.sorted(func(ka *KnownAddress) bool {
+		return !ka.isBackingOff(now) && !skip(ka.Addr)
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+// sorted returns the addresses accepted by filter, ordered by successes and
+// then by the fewest failures.
+func (ab *AddrBook) sorted(filter func(*KnownAddress) bool) []string {
+	known := []*KnownAddress{}
+	for _, ka := range ab.addrs {
+		if filter(ka) {
+			known = append(known, ka)
+		}
+	}
+	sort.Slice(known, func(i, j int) bool {
+		if known[i].Successes != known[j].Successes {
+			return known[i].Successes > known[j].Successes
+		}
+		if known[i].Failures != known[j].Failures {
+			return known[i].Failures < known[j].Failures
+		}
+		return known[i].Addr < known[j].Addr
+	})
+
+	addrs := make([]string, len(known))
+	for i, ka := range known {
+		addrs[i] = ka.Addr
+	}
+	return addrs
+}
+
+// Save writes the book to disk if anything changed since the last save.
+func (ab *AddrBook) Save() error {
+	if ab.path == "" {
+		return nil
+	}
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if !ab.dirty {
+		return nil
+	}
+
+	known := make([]*KnownAddress, 0, len(ab.addrs))
+	for _, ka := range ab.addrs {
+		known = append(known, ka)
+	}
+	sort.Slice(known, func(i, j int) bool {
+		return known[i].Addr < known[j].Addr
+	})
+
+	b, err := json.MarshalIndent(known, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(ab.path, b, 0o644); err != nil {
+		return err
+	}
+	ab.dirty = false
+
+	return nil
+}
+
+// writeFileAtomic writes to a temporary file first and renames it, so a
+// crash never leaves a half written file behind.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// normalizeAddr turns addr into a dialable "host:port". An empty or
+// unspecified host is replaced with fallbackHost.
+func normalizeAddr(addr, fallbackHost string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = fallbackHost
+	} else if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = fallbackHost
+	}
+	return net.JoinHostPort(host, port), nil
+}
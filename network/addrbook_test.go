@@ -0,0 +1,117 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddrBookAdd(t *testing.T) {
+	ab, err := NewAddrBook("")
+	assert.Nil(t, err)
+
+	assert.True(t, ab.Add("127.0.0.1:3000", "seed"))
+	// cannot add twice
+	assert.False(t, ab.Add("127.0.0.1:3000", "seed"))
+	// not a valid address
+	assert.False(t, ab.Add("foo", "seed"))
+	assert.Equal(t, 1, ab.Len())
+
+	ka, ok := ab.Get("127.0.0.1:3000")
+	assert.True(t, ok)
+	assert.Equal(t, "seed", ka.Source)
+}
+
+func TestAddrBookStats(t *testing.T) {
+	ab, err := NewAddrBook("")
+	assert.Nil(t, err)
+	ab.Add("127.0.0.1:3000", "seed")
+
+	ab.MarkAttempt("127.0.0.1:3000")
+	ab.MarkSuccess("127.0.0.1:3000")
+	ab.MarkAttempt("127.0.0.1:3000")
+	ab.MarkFailure("127.0.0.1:3000")
+
+	ka, _ := ab.Get("127.0.0.1:3000")
+	assert.Equal(t, 2, ka.Attempts)
+	assert.Equal(t, 1, ka.Successes)
+	assert.Equal(t, 1, ka.Failures)
+	assert.False(t, ka.LastSuccess.IsZero())
+	assert.False(t, ka.LastFailure.IsZero())
+}
+
+func TestAddrBookCandidates(t *testing.T) {
+	ab, err := NewAddrBook("")
+	assert.Nil(t, err)
+	ab.Add("127.0.0.1:3000", "seed")
+	ab.Add("127.0.0.1:4000", "seed")
+	ab.Add("127.0.0.1:5000", "seed")
+
+	ab.MarkSuccess("127.0.0.1:4000")
+	// a failed address backs off and is not a candidate for a while
+	ab.MarkFailure("127.0.0.1:5000")
+
+	candidates := ab.Candidates(10, func(string) bool { return false })
+	assert.Equal(t, []string{"127.0.0.1:4000", "127.0.0.1:3000"}, candidates)
+
+	candidates = ab.Candidates(10, func(addr string) bool { return addr == "127.0.0.1:4000" })
+	assert.Equal(t, []string{"127.0.0.1:3000"}, candidates)
+
+	assert.Len(t, ab.Candidates(1, func(string) bool { return false }), 1)
+}
+
+func TestAddrBookDropsDeadAddress(t *testing.T) {
+	ab, err := NewAddrBook("")
+	assert.Nil(t, err)
+	ab.Add("127.0.0.1:3000", "seed")
+
+	for i := 0; i < maxConsecutiveFailures; i++ {
+		ab.MarkFailure("127.0.0.1:3000")
+	}
+	assert.Equal(t, 0, ab.Len())
+}
+
+func TestAddrBookPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrbook.json")
+	ab, err := NewAddrBook(path)
+	assert.Nil(t, err)
+
+	ab.Add("127.0.0.1:3000", "seed")
+	ab.Add("127.0.0.1:4000", "127.0.0.1:3000")
+	ab.MarkAttempt("127.0.0.1:3000")
+	ab.MarkSuccess("127.0.0.1:3000")
+	ab.MarkFailure("127.0.0.1:4000")
+	assert.Nil(t, ab.Save())
+
+	loaded, err := NewAddrBook(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, loaded.Len())
+
+	ka, ok := loaded.Get("127.0.0.1:3000")
+	assert.True(t, ok)
+	assert.Equal(t, 1, ka.Attempts)
+	assert.Equal(t, 1, ka.Successes)
+
+	ka, ok = loaded.Get("127.0.0.1:4000")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:3000", ka.Source)
+	assert.Equal(t, 1, ka.Failures)
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	addr, err := normalizeAddr(":3000", "127.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:3000", addr)
+
+	addr, err = normalizeAddr("0.0.0.0:3000", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1:3000", addr)
+
+	addr, err = normalizeAddr("10.0.0.2:3000", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.2:3000", addr)
+
+	_, err = normalizeAddr("3000", "127.0.0.1")
+	assert.NotNil(t, err)
+}
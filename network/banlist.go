@@ -0,0 +1,119 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanEntry is a single banned peer.
+type BanEntry struct {
+	// Peer is the node ID of the banned peer.
+	Peer   string
+	Until  time.Time
+	Reason string
+}
+
+// BanList holds the peers we refuse to talk to until their ban expires. Like
+// the AddrBook it is persisted as JSON if it has a path.
+type BanList struct {
+	lock  sync.RWMutex
+	path  string
+	clock Clock
+	bans  map[string]BanEntry
+}
+
+// NewBanList creates a ban list backed by the file at path. An empty path
+// means the list only lives in memory. Bans expire by clock.
+func NewBanList(path string, clock Clock) (*BanList, error) {
+	bl := &BanList{
+		path:  path,
+		clock: clock,
+		bans:  make(map[string]BanEntry),
+	}
+	if path == "" {
+		return bl, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []BanEntry{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	now := clock.Now()
+	for _, entry := range entries {
+		if entry.Until.After(now) {
+			bl.bans[entry.Peer] = entry
+		}
+	}
+
+	return bl, nil
+}
+
+// Ban bans the peer for the given duration and writes the list to disk.
+func (bl *BanList) Ban(peer string, d time.Duration, reason string) error {
+	bl.lock.Lock()
+	bl.bans[peer] = BanEntry{
+		Peer:   peer,
+		Until:  bl.clock.Now().Add(d),
+		Reason: reason,
+	}
+	bl.lock.Unlock()
+
+	return bl.Save()
+}
+
+func (bl *BanList) Unban(peer string) error {
+	bl.lock.Lock()
+	delete(bl.bans, peer)
+	bl.lock.Unlock()
+
+	return bl.Save()
+}
+
+func (bl *BanList) IsBanned(peer string) bool {
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	entry, ok := bl.bans[peer]
+	return ok && entry.Until.After(bl.clock.Now())
+}
+
+// Entries returns all bans that did not expire yet.
+func (bl *BanList) Entries() []BanEntry {
+	bl.lock.RLock()
+	defer bl.lock.RUnlock()
+
+	now := bl.clock.Now()
+	entries := []BanEntry{}
+	for _, entry := range bl.bans {
+		if entry.Until.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Peer < entries[j].Peer
+	})
+	return entries
+}
+
+func (bl *BanList) Save() error {
+	if bl.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(bl.Entries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bl.path, b, 0o644)
+}
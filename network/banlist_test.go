@@ -0,0 +1,56 @@
+package network
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanListBan(t *testing.T) {
+	bl, err := NewBanList("", realClock{})
+	assert.Nil(t, err)
+
+	assert.False(t, bl.IsBanned("127.0.0.1:3000"))
+	assert.Nil(t, bl.Ban("127.0.0.1:3000", time.Hour, "invalid block"))
+	assert.True(t, bl.IsBanned("127.0.0.1:3000"))
+	assert.False(t, bl.IsBanned("127.0.0.1:4000"))
+
+	assert.Nil(t, bl.Unban("127.0.0.1:3000"))
+	assert.False(t, bl.IsBanned("127.0.0.1:3000"))
+}
+
+func TestBanListExpires(t *testing.T) {
+	clock := NewSimClock(simEpoch)
+	bl, err := NewBanList("", clock)
+	assert.Nil(t, err)
+
+	assert.Nil(t, bl.Ban("127.0.0.1:3000", time.Hour, "invalid block"))
+	clock.step(simEpoch.Add(time.Hour - time.Second))
+	assert.True(t, bl.IsBanned("127.0.0.1:3000"))
+	assert.Len(t, bl.Entries(), 1)
+
+	// the ban expires by the clock of the list.
+	clock.step(simEpoch.Add(time.Hour))
+	assert.False(t, bl.IsBanned("127.0.0.1:3000"))
+	assert.Len(t, bl.Entries(), 0)
+}
+
+func TestBanListPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "banlist.json")
+	bl, err := NewBanList(path, realClock{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, bl.Ban("127.0.0.1:3000", time.Hour, "invalid block"))
+	assert.Nil(t, bl.Ban("127.0.0.1:4000", -time.Second, "expired"))
+
+	loaded, err := NewBanList(path, realClock{})
+	assert.Nil(t, err)
+	assert.True(t, loaded.IsBanned("127.0.0.1:3000"))
+	assert.False(t, loaded.IsBanned("127.0.0.1:4000"))
+
+	entries := loaded.Entries()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "invalid block", entries[0].Reason)
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+)
+
+// bftDriver runs the BFT rounds of a server on its network, clock, chain
+// and mempool.
+type bftDriver struct {
+	s *Server
+}
+
+func (d bftDriver) BroadcastProposal(p *consensus.Proposal) {
+	d.s.broadcastConsensus(MessageTypeProposal, p, nil)
+}
+
+func (d bftDriver) BroadcastVote(v *core.Vote) {
+	d.s.broadcastConsensus(MessageTypeVote, v, nil)
+}
+
+func (d bftDriver) Schedule(after time.Duration, t consensus.BFTTimeout) {
+	s := d.s
+	wake, done := wakeAfter(s.Clock, after)
+	s.spawn(func() {
+		select {
+		case <-wake:
+			s.bft.HandleTimeout(t)
+			done()
+		case <-s.ctx.Done():
+		}
+	})
+}
+
+// Propose builds a block with the pending transactions on top of the
+// chain. Unlike sealBlock it does not add the block, the validators have
+// to decide it first.
+func (d bftDriver) Propose() (*core.Block, error) {
+	s := d.s
+	if s.syncer.behind() {
+		return nil, errors.New("still syncing")
+	}
+
+	parent, err := s.chain.GetHeader(s.chain.Height())
+	if err != nil {
+		return nil, err
+	}
+	txx := s.mempool.BlockTransactions()
+
+	b, err := core.NewBlockFromPrevHeader(parent, txx)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.SetEvidence(s.evidence.Pending(s.chain)); err != nil {
+		return nil, err
+	}
+	if err := s.engine.Prepare(s.chain, b.Header); err != nil {
+		return nil, err
+	}
+	if err := s.engine.Seal(s.ctx, s.chain, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (d bftDriver) Check(b *core.Block) error {
+	return d.s.chain.CheckBlock(b)
+}
+
+// Commit adds the decided block to the chain and relays it to the peers
+// that did not decide it themselves.
+func (d bftDriver) Commit(b *core.Block) error {
+	s := d.s
+	if err := s.chain.AddBlock(b); err != nil && !errors.Is(err, core.ErrBlockKnown) {
+		return err
+	}
+	// drops the transactions of the block, whoever proposed it.
+	s.mempool.Update()
+	s.spawnWork(func() { s.broadcastBlock(b) })
+	return nil
+}
+
+// broadcastConsensus sends a proposal or vote to every peer but except.
+func (s *Server) broadcastConsensus(msgType MessageType, msg core.BinaryCodec, except net.Addr) {
+	s.mu.RLock()
+	peers := make([]net.Addr, 0, len(s.peerMap))
+	for addr := range s.peerMap {
+		if addr != except {
+			peers = append(peers, addr)
+		}
+	}
+	filter := s.consensusFilter
+	s.mu.RUnlock()
+
+	for _, addr := range peers {
+		out := msg
+		if filter != nil {
+			if out = filter(addr, msg); out == nil {
+				continue
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := core.WriteBinary(buf, out); err != nil {
+			s.Logger.Log("err", err)
+			return
+		}
+		if err := s.sendToPeer(addr, NewMessage(msgType, buf.Bytes()).Bytes()); err != nil {
+			s.Logger.Log("msg", "could not send consensus message", "addr", addr, "err", err)
+		}
+	}
+}
+
+func (s *Server) processProposal(from net.Addr, p *consensus.Proposal) error {
+	if s.bft == nil {
+		return nil
+	}
+	if p.Height > s.chain.Height()+1 {
+		s.syncer.setPeerHeight(from, p.Height-1)
+	}
+
+	added, err := s.bft.HandleProposal(p)
+	if err != nil {
+		return misbehavior(penaltyInvalidVote, err)
+	}
+	if p.Block != nil {
+		s.observeBlock(p.Block)
+	}
+	if added {
+		s.broadcastConsensus(MessageTypeProposal, p, from)
+	}
+	return nil
+}
+
+func (s *Server) processVote(from net.Addr, v *core.Vote) error {
+	if s.bft == nil {
+		return nil
+	}
+	if v.Height > s.chain.Height()+1 {
+		s.syncer.setPeerHeight(from, v.Height-1)
+	}
+
+	added, err := s.bft.HandleVote(v)
+	if err != nil {
+		return misbehavior(penaltyInvalidVote, err)
+	}
+	if added {
+		s.broadcastConsensus(MessageTypeVote, v, from)
+	}
+	return nil
+}
+
+// newTip updates the mempool and lets the BFT rounds move on after the
+// chain grew.
+func (s *Server) newTip() {
+	s.mempool.Update()
+	if s.bft != nil {
+		s.bft.NewTip()
+	}
+}
@@ -0,0 +1,269 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSimBFT starts 4 BFT validators, so one of them may be faulty, and an
+// observer without a key, all connected to each other. An epochLength of
+// 0 is the default.
+func newSimBFT(t *testing.T, seed int64, epochLength uint32) (*SimNetwork, []crypto.PrivateKey, []NetAddr) {
+	sim := NewSimNetwork(SimConfig{
+		Seed:       seed,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 50 * time.Millisecond,
+	})
+
+	keys := []crypto.PrivateKey{}
+	genesis := &core.Genesis{Engine: consensus.EngineBFT, Timestamp: simEpoch.UnixNano(), BlockTime: time.Second, EpochLength: epochLength}
+	for i := 0; i < 4; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		genesis.Validators = append(genesis.Validators, keys[i].PublicKey())
+	}
+
+	addrs := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "VALIDATOR_3", "OBSERVER"}
+	for i, addr := range addrs {
+		opts := ServerOpts{Genesis: genesis}
+		if i < len(keys) {
+			opts.PrivateKey = &keys[i]
+		}
+		_, err := sim.AddNode(addr, opts)
+		assert.Nil(t, err)
+		for _, other := range addrs[:i] {
+			assert.Nil(t, sim.Connect(other, addr))
+		}
+	}
+	return sim, keys, addrs
+}
+
+// assertSameChain checks that the nodes agree on every block up to height
+// and that every block carries a valid commit.
+func assertSameChain(t *testing.T, sim *SimNetwork, addrs []NetAddr, height uint32) {
+	first := sim.Node(addrs[0]).Server
+	engine := first.engine.(*consensus.BFT)
+	for h := uint32(1); h <= height; h++ {
+		want, err := first.chain.GetBlock(h)
+		assert.Nil(t, err)
+		vs, err := first.chain.ValidatorSet(h)
+		assert.Nil(t, err)
+		assert.Nil(t, engine.VerifyCommit(vs, want))
+		for _, addr := range addrs[1:] {
+			b, err := sim.Node(addr).Server.chain.GetBlock(h)
+			assert.Nil(t, err)
+			assert.Equal(t, want.Hash(core.BlockHasher{}), b.Hash(core.BlockHasher{}), "block %d of %s", h, addr)
+			assert.Nil(t, engine.VerifyCommit(vs, b))
+		}
+	}
+}
+
+func TestSimBFT(t *testing.T) {
+	sim, _, addrs := newSimBFT(t, 7, 0)
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 10), 30*time.Second))
+	assertSameChain(t, sim, addrs, 10)
+	// every block is final.
+	assert.Equal(t, simHeight(sim, "OBSERVER"), sim.Node("OBSERVER").Server.SyncStatus().FinalizedHeight)
+}
+
+// equivocate makes the validator at addr byzantine: it sends every peer
+// another proposal and votes for another block to each of them.
+func equivocate(t *testing.T, sim *SimNetwork, addr NetAddr, key crypto.PrivateKey) {
+	var n atomic.Int64
+	sim.Node(addr).Byzantine(func(to net.Addr, msg core.BinaryCodec) core.BinaryCodec {
+		n := n.Add(1)
+		switch msg := msg.(type) {
+		case *core.Vote:
+			if !bytes.Equal(msg.Validator, key.PublicKey()) {
+				return msg
+			}
+			v := *msg
+			v.BlockHash = core.BlockHasher{}.Hash(&core.Header{Height: v.Height, Nonce: uint64(n)})
+			assert.Nil(t, v.Sign(key))
+			return &v
+		case *consensus.Proposal:
+			if !bytes.Equal(msg.Proposer, key.PublicKey()) {
+				return msg
+			}
+			header := *msg.Block.Header
+			header.Timestamp += int64(n)
+			b, err := core.NewBlock(&header, msg.Block.Transactions)
+			assert.Nil(t, err)
+			b.Evidence = msg.Block.Evidence
+			assert.Nil(t, b.Sign(key))
+			p := &consensus.Proposal{Height: msg.Height, Round: msg.Round, POLRound: msg.POLRound, Block: b}
+			assert.Nil(t, p.Sign(key))
+			return p
+		}
+		return msg
+	})
+}
+
+// TestSimBFTByzantine lets one validator equivocate.
+func TestSimBFTByzantine(t *testing.T) {
+	sim, keys, _ := newSimBFT(t, 8, 0)
+	equivocate(t, sim, "VALIDATOR_3", keys[3])
+
+	honest := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "OBSERVER"}
+	assert.True(t, sim.RunUntil(simSynced(sim, honest, 12), 60*time.Second))
+	assertSameChain(t, sim, honest, 12)
+
+	// the heights the byzantine validator proposes take another round.
+	b, err := sim.Node("OBSERVER").Server.chain.GetBlock(3)
+	assert.Nil(t, err)
+	assert.Greater(t, b.Commit.Round, uint32(0))
+}
+
+// TestSimBFTPartition splits the validators 2|2: no half is a quorum, so
+// nothing is decided until the partition heals.
+func TestSimBFTPartition(t *testing.T) {
+	sim, _, addrs := newSimBFT(t, 9, 0)
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 3), 30*time.Second))
+
+	sim.Partition(addrs[:2], addrs[2:])
+	sim.Run(time.Second)
+	cut := uint32(0)
+	for _, addr := range addrs {
+		if h := simHeight(sim, addr); h > cut {
+			cut = h
+		}
+	}
+	sim.Run(20 * time.Second)
+	for _, addr := range addrs {
+		assert.Equal(t, cut, simHeight(sim, addr), addr)
+	}
+
+	sim.Heal()
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, cut+5), 60*time.Second))
+	assertSameChain(t, sim, addrs, cut+5)
+}
+
+// TestSimBFTMinority cuts off a single validator: the other three go on
+// without it and it catches up after the partition heals.
+func TestSimBFTMinority(t *testing.T) {
+	sim, _, addrs := newSimBFT(t, 10, 0)
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 3), 30*time.Second))
+
+	majority := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "OBSERVER"}
+	sim.Partition(majority, []NetAddr{"VALIDATOR_3"})
+	cut := simHeight(sim, "VALIDATOR_3")
+	assert.True(t, sim.RunUntil(simSynced(sim, majority, cut+8), 60*time.Second))
+	assert.LessOrEqual(t, simHeight(sim, "VALIDATOR_3"), cut+1)
+
+	sim.Heal()
+	height := simHeight(sim, "VALIDATOR_0")
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, height+3), 60*time.Second))
+	assertSameChain(t, sim, addrs, height+3)
+}
+
+// TestSimBFTValidatorSetChange lets the validators add a fifth validator
+// and remove one of theirs: the new set takes over with the next epoch.
+func TestSimBFTValidatorSetChange(t *testing.T) {
+	sim := NewSimNetwork(SimConfig{
+		Seed:       11,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 50 * time.Millisecond,
+	})
+
+	keys := []crypto.PrivateKey{}
+	genesis := &core.Genesis{Engine: consensus.EngineBFT, Timestamp: simEpoch.UnixNano(), BlockTime: time.Second, EpochLength: 10}
+	for i := 0; i < 5; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		if i < 4 {
+			genesis.Validators = append(genesis.Validators, keys[i].PublicKey())
+		}
+	}
+	addrs := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "VALIDATOR_3", "VALIDATOR_4", "OBSERVER"}
+	for i, addr := range addrs {
+		opts := ServerOpts{Genesis: genesis}
+		if i < len(keys) {
+			opts.PrivateKey = &keys[i]
+		}
+		_, err := sim.AddNode(addr, opts)
+		assert.Nil(t, err)
+		for _, other := range addrs[:i] {
+			assert.Nil(t, sim.Connect(other, addr))
+		}
+	}
+	sim.Run(time.Second)
+
+	updates := []core.ValidatorUpdate{
+		{Key: keys[4].PublicKey(), Power: 1},
+		{Key: keys[3].PublicKey(), Power: 0},
+	}
+	for nonce, u := range updates {
+		for i := 0; i < 3; i++ {
+			tx, err := core.NewValidatorUpdateTx(u)
+			assert.Nil(t, err)
+			tx.Nonce = uint64(nonce)
+			assert.Nil(t, tx.Sign(keys[i]))
+			assert.Nil(t, sim.Node(addrs[i]).Server.processTransaction(NetAddr("CLIENT"), tx))
+		}
+	}
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 16), 60*time.Second))
+	assertSameChain(t, sim, addrs, 16)
+
+	chain := sim.Node("OBSERVER").Server.chain
+	before, err := chain.ValidatorSet(9)
+	assert.Nil(t, err)
+	assert.Equal(t, genesis.ValidatorSet(), before)
+	after, err := chain.ValidatorSet(10)
+	assert.Nil(t, err)
+	assert.Equal(t, core.ValidatorSet{before[0], before[1], before[2], {Key: keys[4].PublicKey(), Power: 1}}, after)
+
+	// the new validator proposes and votes, the removed one does not.
+	proposed := false
+	for h := uint32(10); h <= 16; h++ {
+		b, err := chain.GetBlock(h)
+		assert.Nil(t, err)
+		proposed = proposed || bytes.Equal(b.Validator, keys[4].PublicKey())
+		for _, v := range b.Commit.Precommits {
+			assert.False(t, bytes.Equal(v.Validator, keys[3].PublicKey()), "block %d", h)
+		}
+	}
+	assert.True(t, proposed)
+}
+
+// TestSimBFTDoubleSign checks that the blocks a byzantine validator signs
+// twice end up as evidence on the chain, which removes the validator with
+// the next epoch.
+func TestSimBFTDoubleSign(t *testing.T) {
+	sim, keys, _ := newSimBFT(t, 12, 8)
+	equivocate(t, sim, "VALIDATOR_3", keys[3])
+
+	honest := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "OBSERVER"}
+	assert.True(t, sim.RunUntil(simSynced(sim, honest, 12), 60*time.Second))
+	assertSameChain(t, sim, honest, 12)
+
+	chain := sim.Node("OBSERVER").Server.chain
+	blocks := chain.Evidence()
+	assert.NotEmpty(t, blocks)
+	assert.Less(t, blocks[0].Height, uint32(8))
+	for _, b := range blocks {
+		for _, ev := range b.Evidence {
+			assert.Equal(t, keys[3].PublicKey(), ev.Validator)
+			assert.Nil(t, chain.VerifyEvidence(ev))
+		}
+	}
+
+	vs, err := chain.ValidatorSet(8)
+	assert.Nil(t, err)
+	assert.False(t, vs.Contains(keys[3].PublicKey()))
+	assert.Equal(t, 3, len(vs))
+	for h := uint32(8); h <= 12; h++ {
+		b, err := chain.GetBlock(h)
+		assert.Nil(t, err)
+		for _, v := range b.Commit.Precommits {
+			assert.False(t, bytes.Equal(v.Validator, keys[3].PublicKey()), "block %d", h)
+		}
+	}
+}
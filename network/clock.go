@@ -0,0 +1,70 @@
+package network
+
+import "time"
+
+// Clock is the source of time for a server. The simulator swaps it for a
+// virtual clock, so timeouts and block times pass without waiting for them.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// wakeAfter is like c.After for a timer that wakes a loop to do work that
+// no message triggered, like producing a block. done has to be called once
+// that work is finished, the simulator does not move time on before.
+// Calling done before the timer fired stops it.
+func wakeAfter(c Clock, d time.Duration) (ch <-chan time.Time, done func()) {
+	if wc, ok := c.(interface {
+		wakeAfter(time.Duration) (<-chan time.Time, func())
+	}); ok {
+		return wc.wakeAfter(d)
+	}
+	return c.After(d), func() {}
+}
+
+// holdWork tells the simulator that work was handed to another goroutine,
+// e.g. one that was just started. It does not move time on before the
+// work is given back with releaseWork. Work is not tied to a goroutine:
+// the one that waits for the result of another one takes over its work.
+func holdWork(c Clock) {
+	if wc, ok := c.(interface{ addWork(int64) }); ok {
+		wc.addWork(1)
+	}
+}
+
+// releaseWork gives back work taken with holdWork, e.g. before a goroutine
+// blocks until a message or timer wakes it.
+func releaseWork(c Clock) {
+	if wc, ok := c.(interface{ addWork(int64) }); ok {
+		wc.addWork(-1)
+	}
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
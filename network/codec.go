@@ -0,0 +1,283 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// This file holds the binary encoding of the network messages, see
+// docs/encoding.md.
+
+func (msg *Message) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint8(uint8(msg.Header))
+	w.WriteUint64(msg.ID)
+	w.WriteUint64(msg.ReplyTo)
+	w.WriteBytes(msg.Data)
+}
+
+func (msg *Message) DecodeBinary(r *core.BinaryReader) {
+	msg.Header = MessageType(r.ReadUint8())
+	msg.ID = r.ReadUint64()
+	msg.ReplyTo = r.ReadUint64()
+	msg.Data = r.ReadBytes()
+}
+
+func (m *GetBlocksMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint32(m.From)
+	w.WriteUint32(m.To)
+}
+
+func (m *GetBlocksMessage) DecodeBinary(r *core.BinaryReader) {
+	m.From = r.ReadUint32()
+	m.To = r.ReadUint32()
+}
+
+func (m *BlocksMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteLen(len(m.Blocks))
+	for _, b := range m.Blocks {
+		b.EncodeBinary(w)
+	}
+}
+
+func (m *BlocksMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Blocks = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		b := new(core.Block)
+		b.DecodeBinary(r)
+		m.Blocks = append(m.Blocks, b)
+	}
+}
+
+func (m *NotFoundMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint32(m.From)
+	w.WriteUint32(m.To)
+}
+
+func (m *NotFoundMessage) DecodeBinary(r *core.BinaryReader) {
+	m.From = r.ReadUint32()
+	m.To = r.ReadUint32()
+}
+
+func (m *GetStatusMessage) EncodeBinary(w *core.BinaryWriter) {}
+
+func (m *GetStatusMessage) DecodeBinary(r *core.BinaryReader) {}
+
+func (m *StatusMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteString(m.ID)
+	w.WriteUint32(m.Version)
+	w.WriteUint32(m.CurrentHeight)
+	w.WriteString(m.ListenAddr)
+}
+
+func (m *StatusMessage) DecodeBinary(r *core.BinaryReader) {
+	m.ID = r.ReadString()
+	m.Version = r.ReadUint32()
+	m.CurrentHeight = r.ReadUint32()
+	m.ListenAddr = r.ReadString()
+}
+
+func (m *GetHeadersMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint32(m.From)
+	w.WriteUint32(m.To)
+}
+
+func (m *GetHeadersMessage) DecodeBinary(r *core.BinaryReader) {
+	m.From = r.ReadUint32()
+	m.To = r.ReadUint32()
+}
+
+func (m *HeadersMessage) EncodeBinary(w *core.BinaryWriter) {
+	if len(m.Seals) != len(m.Headers) {
+		w.Fail(fmt.Errorf("%d seals for %d headers", len(m.Seals), len(m.Headers)))
+		return
+	}
+	w.WriteLen(len(m.Headers))
+	for i, h := range m.Headers {
+		h.EncodeBinary(w)
+		m.Seals[i].EncodeBinary(w)
+	}
+}
+
+func (m *HeadersMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Headers, m.Seals = nil, nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		h := new(core.Header)
+		h.DecodeBinary(r)
+		seal := new(core.Seal)
+		seal.DecodeBinary(r)
+		m.Headers = append(m.Headers, h)
+		m.Seals = append(m.Seals, seal)
+	}
+}
+
+func (m *GetBlocksByHashMessage) EncodeBinary(w *core.BinaryWriter) {
+	writeHashes(w, m.Hashes)
+}
+
+func (m *GetBlocksByHashMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Hashes = readHashes(r)
+}
+
+func (m *InvMessage) EncodeBinary(w *core.BinaryWriter) {
+	writeInvItems(w, m.Items)
+}
+
+func (m *InvMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Items = readInvItems(r)
+}
+
+func (m *GetDataMessage) EncodeBinary(w *core.BinaryWriter) {
+	writeInvItems(w, m.Items)
+}
+
+func (m *GetDataMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Items = readInvItems(r)
+}
+
+func (m *GetPeersMessage) EncodeBinary(w *core.BinaryWriter) {}
+
+func (m *GetPeersMessage) DecodeBinary(r *core.BinaryReader) {}
+
+func (m *PeersMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteLen(len(m.Addrs))
+	for _, addr := range m.Addrs {
+		w.WriteString(addr)
+	}
+}
+
+func (m *PeersMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Addrs = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		m.Addrs = append(m.Addrs, r.ReadString())
+	}
+}
+
+func (m *PingMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint64(m.Nonce)
+}
+
+func (m *PingMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Nonce = r.ReadUint64()
+}
+
+func (m *PongMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteUint64(m.Nonce)
+}
+
+func (m *PongMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Nonce = r.ReadUint64()
+}
+
+func (m *CompactBlockMessage) EncodeBinary(w *core.BinaryWriter) {
+	if m.Header == nil {
+		w.Fail(errors.New("compact block has no header"))
+		return
+	}
+	m.Header.EncodeBinary(w)
+	w.WriteBytes(m.Validator)
+	core.WriteSignature(w, m.Signature)
+	w.WriteBool(m.Commit != nil)
+	if m.Commit != nil {
+		m.Commit.EncodeBinary(w)
+	}
+	w.WriteLen(len(m.ShortIDs))
+	for _, id := range m.ShortIDs {
+		w.WriteFixed(id[:])
+	}
+	w.WriteLen(len(m.Evidence))
+	for _, ev := range m.Evidence {
+		ev.EncodeBinary(w)
+	}
+}
+
+func (m *CompactBlockMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Header = new(core.Header)
+	m.Header.DecodeBinary(r)
+	m.Validator = r.ReadBytes()
+	m.Signature = core.ReadSignature(r)
+	m.Commit = nil
+	if r.ReadBool() {
+		m.Commit = new(core.Commit)
+		m.Commit.DecodeBinary(r)
+	}
+	m.ShortIDs = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		var id ShortTxID
+		r.ReadFixed(id[:])
+		m.ShortIDs = append(m.ShortIDs, id)
+	}
+	m.Evidence = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		ev := new(core.Evidence)
+		ev.DecodeBinary(r)
+		m.Evidence = append(m.Evidence, ev)
+	}
+}
+
+func (m *GetBlockTxnMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteHash(m.Hash)
+	w.WriteLen(len(m.Indexes))
+	for _, idx := range m.Indexes {
+		w.WriteUint32(idx)
+	}
+}
+
+func (m *GetBlockTxnMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Hash = r.ReadHash()
+	m.Indexes = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		m.Indexes = append(m.Indexes, r.ReadUint32())
+	}
+}
+
+func (m *BlockTxnMessage) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteHash(m.Hash)
+	w.WriteLen(len(m.Transactions))
+	for _, tx := range m.Transactions {
+		tx.EncodeBinary(w)
+	}
+}
+
+func (m *BlockTxnMessage) DecodeBinary(r *core.BinaryReader) {
+	m.Hash = r.ReadHash()
+	m.Transactions = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		tx := new(core.Transaction)
+		tx.DecodeBinary(r)
+		m.Transactions = append(m.Transactions, tx)
+	}
+}
+
+func writeHashes(w *core.BinaryWriter, hashes []types.Hash) {
+	w.WriteLen(len(hashes))
+	for _, h := range hashes {
+		w.WriteHash(h)
+	}
+}
+
+func readHashes(r *core.BinaryReader) []types.Hash {
+	var hashes []types.Hash
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		hashes = append(hashes, r.ReadHash())
+	}
+	return hashes
+}
+
+func writeInvItems(w *core.BinaryWriter, items []InvItem) {
+	w.WriteLen(len(items))
+	for _, item := range items {
+		w.WriteUint8(uint8(item.Type))
+		w.WriteHash(item.Hash)
+	}
+}
+
+func readInvItems(r *core.BinaryReader) []InvItem {
+	var items []InvItem
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		items = append(items, InvItem{Type: InvType(r.ReadUint8()), Hash: r.ReadHash()})
+	}
+	return items
+}
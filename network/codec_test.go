@@ -0,0 +1,73 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/LeiZhou-97/blockchain/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPingEncoding checks the example of docs/encoding.md.
+func TestPingEncoding(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, core.WriteBinary(buf, &PingMessage{Nonce: 1}))
+	msg := NewMessage(MessageTypePing, buf.Bytes())
+
+	want := "07" + "0f" + "0000000000000000" + "0000000000000000" + "00000009" + "07" + "0000000000000001"
+	assert.Equal(t, want, hex.EncodeToString(msg.Bytes()))
+}
+
+func TestMessageEncodeDecode(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+	blocks := makeTestBlocks(t, 2)
+	tx := util.NewRandomTransactionWithSignature(t, key, 16)
+
+	vote := &core.Vote{Type: core.VotePrecommit, Height: 2, BlockHash: blocks[1].Hash(core.BlockHasher{})}
+	assert.Nil(t, vote.Sign(key))
+	committed := *blocks[1]
+	committed.Commit = &core.Commit{Precommits: []*core.Vote{vote}}
+	proposal := &consensus.Proposal{Height: 2, POLRound: -1, Block: &committed}
+	assert.Nil(t, proposal.Sign(key))
+
+	messages := map[MessageType]core.BinaryCodec{
+		MessageTypeTx:              tx,
+		MessageTypeBlock:           blocks[0],
+		MessageTypeGetBlocks:       &GetBlocksMessage{From: 1, To: 10},
+		MessageTypeStatus:          &StatusMessage{ID: "A", Version: 1, CurrentHeight: 7, ListenAddr: ":3000"},
+		MessageTypeBlocks:          &BlocksMessage{Blocks: blocks},
+		MessageTypePeers:           &PeersMessage{Addrs: []string{"a:1", "b:2"}},
+		MessageTypeGetHeaders:      &GetHeadersMessage{From: 3},
+		MessageTypeHeaders:         &HeadersMessage{Headers: []*core.Header{blocks[0].Header, committed.Header}, Seals: []*core.Seal{blocks[0].Seal(), committed.Seal()}},
+		MessageTypeGetBlocksByHash: &GetBlocksByHashMessage{Hashes: []types.Hash{util.RandomHash()}},
+		MessageTypeNotFound:        &NotFoundMessage{From: 4, To: 5},
+		MessageTypeInv:             &InvMessage{Items: []InvItem{{Type: InvTypeTx, Hash: util.RandomHash()}}},
+		MessageTypeGetData:         &GetDataMessage{Items: []InvItem{{Type: InvTypeBlock, Hash: util.RandomHash()}}},
+		MessageTypePing:            &PingMessage{Nonce: 42},
+		MessageTypePong:            &PongMessage{Nonce: 42},
+		MessageTypeCompactBlock:    newCompactBlock(&committed),
+		MessageTypeGetBlockTxn:     &GetBlockTxnMessage{Hash: util.RandomHash(), Indexes: []uint32{0, 2}},
+		MessageTypeBlockTxn:        &BlockTxnMessage{Hash: util.RandomHash(), Transactions: []*core.Transaction{tx}},
+		MessageTypeProposal:        proposal,
+		MessageTypeVote:            vote,
+	}
+
+	for msgType, data := range messages {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, core.WriteBinary(buf, data))
+		msg := NewReply(9, msgType, buf.Bytes())
+
+		dmsg, err := DefaultRPCDecodeFunc(RPC{From: NetAddr("A"), Payload: bytes.NewReader(msg.Bytes())})
+		assert.Nil(t, err, "%x", msgType)
+		assert.Equal(t, uint64(9), dmsg.ReplyTo)
+		// the decoded message encodes to the same bytes.
+		again := new(bytes.Buffer)
+		assert.Nil(t, core.WriteBinary(again, dmsg.Data.(core.BinaryCodec)))
+		assert.Equal(t, buf.Bytes(), again.Bytes(), "%x", msgType)
+	}
+}
@@ -0,0 +1,230 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// blockTxnTimeout is how long we wait for the missing transactions of a
+// compact block before we ask for the full block.
+var blockTxnTimeout = 5 * time.Second
+
+// ShortTxID identifies a transaction within a compact block.
+type ShortTxID [6]byte
+
+// shortTxID returns the short ID of the transaction with hash txHash in the
+// block with hash blockHash. Mixing in the block hash means a collision of
+// two transactions only ever affects a single block.
+func shortTxID(blockHash, txHash types.Hash) ShortTxID {
+	h := sha256.Sum256(append(blockHash.ToSlice(), txHash.ToSlice()...))
+
+	var id ShortTxID
+	copy(id[:], h[:])
+	return id
+}
+
+func newCompactBlock(b *core.Block) *CompactBlockMessage {
+	hash := b.Hash(core.BlockHasher{})
+	ids := make([]ShortTxID, len(b.Transactions))
+	for i, tx := range b.Transactions {
+		ids[i] = shortTxID(hash, tx.Hash(core.TxHasher{}))
+	}
+
+	return &CompactBlockMessage{
+		Header:    b.Header,
+		Validator: b.Validator,
+		Signature: b.Signature,
+		Commit:    b.Commit,
+		ShortIDs:  ids,
+		Evidence:  b.Evidence,
+	}
+}
+
+// sendCompactBlock sends b as a compact block to every peer that does not
+// know it yet.
+func (s *Server) sendCompactBlock(b *core.Block) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, newCompactBlock(b)); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypeCompactBlock, buf.Bytes())
+
+	for _, addr := range s.relay.announce(b.Hash(core.BlockHasher{})) {
+		if err := s.sendToPeer(addr, msg.Bytes()); err != nil {
+			s.Logger.Log("msg", "could not send compact block", "addr", addr, "err", err)
+		}
+	}
+	return nil
+}
+
+// rebuildBlock fills in the transactions of the compact block from our
+// mempool. It returns the indexes of the transactions we do not have.
+// Short IDs that match more than one transaction count as missing.
+func (s *Server) rebuildBlock(hash types.Hash, data *CompactBlockMessage) (*core.Block, []uint32) {
+	byID := make(map[ShortTxID]*core.Transaction)
+	ambiguous := make(map[ShortTxID]bool)
+	for _, tx := range s.mempool.All() {
+		id := shortTxID(hash, tx.Hash(core.TxHasher{}))
+		if _, ok := byID[id]; ok {
+			ambiguous[id] = true
+		}
+		byID[id] = tx
+	}
+
+	txx := make([]*core.Transaction, len(data.ShortIDs))
+	missing := []uint32{}
+	for i, id := range data.ShortIDs {
+		if tx, ok := byID[id]; ok && !ambiguous[id] {
+			txx[i] = tx
+			continue
+		}
+		missing = append(missing, uint32(i))
+	}
+
+	b, _ := core.NewBlock(data.Header, txx)
+	b.Validator = data.Validator
+	b.Signature = data.Signature
+	b.Commit = data.Commit
+	b.Evidence = data.Evidence
+	return b, missing
+}
+
+func (s *Server) processCompactBlockMessage(from net.Addr, data *CompactBlockMessage) error {
+	if data.Header == nil || data.Signature == nil {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent an incomplete compact block", from))
+	}
+	if len(data.ShortIDs) > core.MaxBlockTransactions {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent a compact block with too many transactions (%d)", from, len(data.ShortIDs)))
+	}
+
+	hash := core.BlockHasher{}.Hash(data.Header)
+	s.relay.received(from, hash)
+	if s.haveItem(InvItem{Type: InvTypeBlock, Hash: hash}) {
+		return nil
+	}
+	if data.Header.Height > s.chain.Height()+1 {
+		// the peer is ahead of us, catch up with it.
+		s.syncer.setPeerHeight(from, data.Header.Height)
+		return nil
+	}
+	// check the signature before we spend a request on the block.
+	if err := data.Header.Verify(data.Validator, data.Signature); err != nil {
+		return misbehavior(penaltyInvalidBlock, err)
+	}
+
+	b, missing := s.rebuildBlock(hash, data)
+	if len(missing) == 0 {
+		return s.completeBlock(from, b)
+	}
+
+	// the answer arrives through the server loop, so we must not wait for
+	// it here.
+	s.spawnWork(func() {
+		txx, err := s.requestBlockTxn(from, hash, data.ShortIDs, missing)
+		if err != nil {
+			s.Logger.Log("msg", "could not get block transactions", "addr", from, "err", err)
+			s.handleError(from, err)
+			s.requestFullBlock(from, hash)
+			return
+		}
+		for i, idx := range missing {
+			b.Transactions[idx] = txx[i]
+		}
+		s.handleError(from, s.completeBlock(from, b))
+	})
+	return nil
+}
+
+// completeBlock processes a rebuilt block. A block that does not match its
+// data hash was rebuilt with the wrong transaction, which is not the fault
+// of the peer, so we ask for the full block instead.
+func (s *Server) completeBlock(from net.Addr, b *core.Block) error {
+	dataHash, err := core.CalculateDataHash(b.Transactions, b.Evidence...)
+	if err != nil {
+		return err
+	}
+	if dataHash != b.DataHash {
+		s.requestFullBlock(from, b.Hash(core.BlockHasher{}))
+		return nil
+	}
+	return s.processBlock(from, b)
+}
+
+// requestBlockTxn asks the peer at addr for the transactions of the block
+// at the given indexes and checks that they match their short IDs.
+func (s *Server) requestBlockTxn(addr net.Addr, hash types.Hash, ids []ShortTxID, indexes []uint32) ([]*core.Transaction, error) {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &GetBlockTxnMessage{Hash: hash, Indexes: indexes}); err != nil {
+		return nil, err
+	}
+	msg := NewMessage(MessageTypeGetBlockTxn, buf.Bytes())
+
+	resp, err := s.request(s.ctx, addr, msg, blockTxnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	txn, ok := resp.Data.(*BlockTxnMessage)
+	if !ok {
+		return nil, unexpectedReply(addr, MessageTypeGetBlockTxn, resp.Data)
+	}
+	if txn.Hash != hash || len(txn.Transactions) != len(indexes) {
+		return nil, misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent the wrong transactions for block %s", addr, hash))
+	}
+	for i, tx := range txn.Transactions {
+		if shortTxID(hash, tx.Hash(core.TxHasher{})) != ids[indexes[i]] {
+			return nil, misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent a transaction that is not in block %s", addr, hash))
+		}
+	}
+	return txn.Transactions, nil
+}
+
+// requestFullBlock asks the peer at addr for the whole block.
+func (s *Server) requestFullBlock(addr net.Addr, hash types.Hash) {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &GetDataMessage{Items: []InvItem{{Type: InvTypeBlock, Hash: hash}}}); err != nil {
+		s.Logger.Log("err", err)
+		return
+	}
+	msg := NewMessage(MessageTypeGetData, buf.Bytes())
+
+	if err := s.sendToPeer(addr, msg.Bytes()); err != nil {
+		s.Logger.Log("msg", "could not request block", "addr", addr, "err", err)
+	}
+}
+
+func (s *Server) processGetBlockTxnMessage(from net.Addr, id uint64, data *GetBlockTxnMessage) error {
+	block, err := s.chain.GetBlockByHash(data.Hash)
+	if err != nil {
+		// the requester falls back to the full block once its request
+		// times out.
+		return nil
+	}
+
+	txx := make([]*core.Transaction, len(data.Indexes))
+	for i, idx := range data.Indexes {
+		if int(idx) >= len(block.Transactions) {
+			return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s asked for transaction %d of block %s with %d transactions", from, idx, data.Hash, len(block.Transactions)))
+		}
+		txx[i] = block.Transactions[idx]
+	}
+
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &BlockTxnMessage{Hash: data.Hash, Transactions: txx}); err != nil {
+		return err
+	}
+	msg := NewReply(id, MessageTypeBlockTxn, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
+}
+
+// processBlockTxnMessage handles transactions nobody asked for or that
+// arrived after the request timed out. They are of no use to us.
+func (s *Server) processBlockTxnMessage(from net.Addr, data *BlockTxnMessage) error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/util"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebuildBlock(t *testing.T) {
+	s, err := NewServer(ServerOpts{Transport: NewLocalTransport("LOCAL"), Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+
+	key := crypto.GeneratePrivateKey()
+	txx := []*core.Transaction{}
+	for i := 0; i < 3; i++ {
+		txx = append(txx, util.NewRandomTransactionWithSignature(t, crypto.GeneratePrivateKey(), 32))
+	}
+	b, err := core.NewBlockFromPrevHeader(&core.Header{}, txx)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Sign(key))
+
+	s.mempool.Add(txx[0])
+	s.mempool.Add(txx[2])
+
+	hash := b.Hash(core.BlockHasher{})
+	rebuilt, missing := s.rebuildBlock(hash, newCompactBlock(b))
+	assert.Equal(t, []uint32{1}, missing)
+	assert.Equal(t, txx[0], rebuilt.Transactions[0])
+	assert.Nil(t, rebuilt.Transactions[1])
+	assert.Equal(t, txx[2], rebuilt.Transactions[2])
+	assert.Equal(t, hash, rebuilt.Hash(core.BlockHasher{}))
+}
+
+func TestCompactBlockMissingTxs(t *testing.T) {
+	sim, addrs := newSimCluster(t, SimConfig{
+		Seed:       5,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 20 * time.Millisecond,
+	}, 1)
+	sim.Run(time.Second)
+
+	// the transactions only reach the validator, its peer has to ask for
+	// them when the block arrives.
+	key := crypto.GeneratePrivateKey()
+	validator := sim.Node("VALIDATOR").Server
+	for i := 0; i < 5; i++ {
+		// hex digits are no VM instructions.
+		tx := core.NewTransaction([]byte(util.RandomHash().String()))
+		tx.Nonce = uint64(i)
+		assert.Nil(t, tx.Sign(key))
+		validator.mempool.Add(tx)
+	}
+	height := simHeight(sim, "VALIDATOR")
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, height+1), 10*time.Second))
+	b, err := sim.Node("NODE_0").Server.chain.GetBlock(height + 1)
+	assert.Nil(t, err)
+	assert.Len(t, b.Transactions, 5)
+}
@@ -0,0 +1,254 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+// evidenceWindow is how many heights below the tip we remember the blocks
+// the validators signed to catch them signing another one.
+var evidenceWindow uint32 = 100
+
+// evidencePool detects validators that sign two blocks at the same height
+// and holds the evidence until a block carries it.
+type evidencePool struct {
+	lock sync.Mutex
+	// signed holds the first block we saw of every validator on every
+	// parent by height.
+	signed map[uint32]map[signer]*core.Block
+	// pending is the evidence no block of the chain carries yet.
+	pending map[types.Hash]*core.Evidence
+}
+
+func newEvidencePool() *evidencePool {
+	return &evidencePool{
+		signed:  make(map[uint32]map[signer]*core.Block),
+		pending: make(map[types.Hash]*core.Evidence),
+	}
+}
+
+// signer is who signed a block on which parent.
+type signer struct {
+	validator string
+	parent    types.Hash
+}
+
+// observe remembers that the validator of b signed it and returns the
+// evidence if it signed another block at that height on the same parent
+// before. The caller checks the signature.
+func (p *evidencePool) observe(b *core.Block, tip uint32) *core.Evidence {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if tip > evidenceWindow {
+		for height := range p.signed {
+			if height < tip-evidenceWindow {
+				delete(p.signed, height)
+			}
+		}
+		if b.Height < tip-evidenceWindow {
+			return nil
+		}
+	}
+
+	bySigner, ok := p.signed[b.Height]
+	if !ok {
+		bySigner = make(map[signer]*core.Block)
+		p.signed[b.Height] = bySigner
+	}
+	key := signer{validator: string(b.Validator), parent: b.PrevBlockHash}
+	first, ok := bySigner[key]
+	if !ok {
+		// keep only what the evidence needs.
+		bySigner[key] = &core.Block{Header: b.Header, Validator: b.Validator, Signature: b.Signature}
+		return nil
+	}
+	return core.NewEvidence(first, b)
+}
+
+// add adds ev to the pending evidence and reports whether it is new.
+func (p *evidencePool) add(ev *core.Evidence) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	hash := ev.Hash()
+	if _, ok := p.pending[hash]; ok {
+		return false
+	}
+	p.pending[hash] = ev
+	return true
+}
+
+func (p *evidencePool) contains(hash types.Hash) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	_, ok := p.pending[hash]
+	return ok
+}
+
+// Pending returns the evidence a new block on top of chain should carry,
+// lowest height first. Evidence the chain carries already is dropped,
+// evidence of the height of the new block waits for the next one.
+func (p *evidencePool) Pending(chain *core.BlockChain) []*core.Evidence {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	height := chain.Height()
+	var evidence []*core.Evidence
+	for hash, ev := range p.pending {
+		if chain.IncludedEvidence(hash) {
+			delete(p.pending, hash)
+			continue
+		}
+		if ev.Height() <= height && chain.VerifyEvidence(ev) == nil {
+			evidence = append(evidence, ev)
+		}
+	}
+	sort.Slice(evidence, func(i, j int) bool {
+		if evidence[i].Height() != evidence[j].Height() {
+			return evidence[i].Height() < evidence[j].Height()
+		}
+		return bytes.Compare(evidence[i].Hash().ToSlice(), evidence[j].Hash().ToSlice()) < 0
+	})
+	if len(evidence) > core.MaxBlockEvidence {
+		evidence = evidence[:core.MaxBlockEvidence]
+	}
+	return evidence
+}
+
+// Save writes the pending evidence to path, so it survives a restart.
+func (p *evidencePool) Save(path string) error {
+	p.lock.Lock()
+	file := &evidenceFile{Evidence: make([]*core.Evidence, 0, len(p.pending))}
+	for _, ev := range p.pending {
+		file.Evidence = append(file.Evidence, ev)
+	}
+	p.lock.Unlock()
+
+	b, err := core.MarshalBinary(file)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0o644)
+}
+
+// Load adds the evidence saved at path to the pool and returns how much it
+// added. Evidence that does not verify is skipped.
+func (p *evidencePool) Load(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	file := new(evidenceFile)
+	if err := core.UnmarshalBinary(b, file); err != nil {
+		return 0, fmt.Errorf("could not decode %s: %w", path, err)
+	}
+
+	added := 0
+	for _, ev := range file.Evidence {
+		if ev.Verify() != nil || !p.add(ev) {
+			continue
+		}
+		added++
+	}
+	return added, nil
+}
+
+// evidenceFile is what Save writes, the pending evidence in the binary
+// encoding with its version byte.
+type evidenceFile struct {
+	Evidence []*core.Evidence
+}
+
+func (f *evidenceFile) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteLen(len(f.Evidence))
+	for _, ev := range f.Evidence {
+		ev.EncodeBinary(w)
+	}
+}
+
+func (f *evidenceFile) DecodeBinary(r *core.BinaryReader) {
+	f.Evidence = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		ev := new(core.Evidence)
+		ev.DecodeBinary(r)
+		f.Evidence = append(f.Evidence, ev)
+	}
+}
+
+// observeBlock checks whether the validator of b signed another block at
+// its height. Blocks of validators that are not in the set of their
+// height are ignored.
+func (s *Server) observeBlock(b *core.Block) {
+	if b.Header == nil || b.Header.Verify(b.Validator, b.Signature) != nil {
+		return
+	}
+	vs, err := s.chain.ValidatorSet(b.Height)
+	if err != nil || !vs.Contains(b.Validator) {
+		return
+	}
+
+	ev := s.evidence.observe(b, s.chain.Height())
+	if ev == nil || s.chain.IncludedEvidence(ev.Hash()) || !s.evidence.add(ev) {
+		return
+	}
+	s.Logger.Log(
+		"msg", "validator signed two blocks",
+		"validator", ev.Validator.Address(),
+		"height", ev.Height(),
+		"evidence", ev.Hash(),
+	)
+	s.spawnWork(func() { s.broadcastEvidence(ev) })
+}
+
+func (s *Server) processEvidence(from net.Addr, ev *core.Evidence) error {
+	hash := ev.Hash()
+	s.relay.received(from, hash)
+
+	if s.evidence.contains(hash) || s.chain.IncludedEvidence(hash) {
+		return nil
+	}
+	if err := s.chain.VerifyEvidence(ev); err != nil {
+		if errors.Is(err, core.ErrUnknownEpoch) {
+			// we are behind the peer and can not check it yet.
+			return nil
+		}
+		return misbehavior(penaltyInvalidEvidence, err)
+	}
+	if !s.evidence.add(ev) {
+		return nil
+	}
+
+	s.Logger.Log("msg", "received evidence of double signing", "validator", ev.Validator.Address(), "height", ev.Height(), "evidence", hash)
+	s.spawnWork(func() { s.broadcastEvidence(ev) })
+	return nil
+}
+
+// broadcastEvidence sends ev to every peer that does not know it yet.
+func (s *Server) broadcastEvidence(ev *core.Evidence) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, ev); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypeEvidence, buf.Bytes())
+
+	for _, addr := range s.relay.announce(ev.Hash()) {
+		if err := s.sendToPeer(addr, msg.Bytes()); err != nil {
+			s.Logger.Log("msg", "could not send evidence", "addr", addr, "err", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// signedBlock returns a block on top of parent, timestamp after it, signed
+// by key.
+func signedBlock(t *testing.T, key crypto.PrivateKey, parent *core.Header, after time.Duration) *core.Block {
+	b, err := core.NewBlockFromPrevHeader(parent, nil)
+	assert.Nil(t, err)
+	b.Timestamp = parent.Timestamp + int64(after)
+	assert.Nil(t, b.Sign(key))
+	return b
+}
+
+func TestEvidencePoolSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "evidence.dat")
+
+	key := crypto.GeneratePrivateKey()
+	genesis := new(core.Genesis).Block().Header
+	ev := core.NewEvidence(signedBlock(t, key, genesis, time.Second), signedBlock(t, key, genesis, 2*time.Second))
+	assert.NotNil(t, ev)
+
+	p := newEvidencePool()
+	assert.True(t, p.add(ev))
+	assert.Nil(t, p.Save(path))
+
+	p = newEvidencePool()
+	n, err := p.Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, p.contains(ev.Hash()))
+
+	// a missing file is an empty pool.
+	n, err = newEvidencePool().Load(filepath.Join(t.TempDir(), "evidence.dat"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// a file of another codec version is refused, not misread.
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, core.CodecVersion, b[0])
+	b[0] = core.CodecVersion + 1
+	assert.Nil(t, os.WriteFile(path, b, 0o644))
+	_, err = newEvidencePool().Load(path)
+	assert.True(t, errors.Is(err, core.ErrUnknownCodecVersion))
+}
+
+// TestEvidenceReorg lets a validator sign at a height again on another
+// branch, as it does after a reorg, which is no double signing.
+func TestEvidenceReorg(t *testing.T) {
+	key, a, b := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	s, err := NewServer(ServerOpts{
+		Transport: NewLocalTransport("LOCAL"),
+		Logger:    log.NewNopLogger(),
+		Genesis:   &core.Genesis{Validators: []crypto.PublicKey{key.PublicKey(), a.PublicKey(), b.PublicKey()}},
+	})
+	assert.Nil(t, err)
+	genesis, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+	from := NetAddr("PEER")
+
+	// key signs the second block of both branches.
+	a1 := signedBlock(t, a, genesis, time.Second)
+	a2 := signedBlock(t, key, a1.Header, time.Second)
+	b1 := signedBlock(t, b, genesis, 2*time.Second)
+	b2 := signedBlock(t, key, b1.Header, time.Second)
+	b3 := signedBlock(t, b, b2.Header, time.Second)
+	for _, block := range []*core.Block{a1, a2, b1, b2, b3} {
+		assert.Nil(t, s.processBlock(from, block))
+	}
+	tip, err := s.chain.GetHeader(s.chain.Height())
+	assert.Nil(t, err)
+	assert.Equal(t, b3.Header, tip)
+	assert.Empty(t, s.evidence.Pending(s.chain))
+
+	// another block on the same parent is double signing.
+	b2x := signedBlock(t, key, b1.Header, 2*time.Second)
+	s.processBlock(from, b2x)
+	evidence := s.evidence.Pending(s.chain)
+	assert.Len(t, evidence, 1)
+	assert.Equal(t, core.NewEvidence(b2, b2x).Hash(), evidence[0].Hash())
+}
@@ -0,0 +1,366 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+)
+
+// maxInboundQueue is the number of messages per peer that wait to be
+// processed. Once a peer fills its queue, its least important messages are
+// dropped.
+var maxInboundQueue = 256
+
+// penaltyRateLimit is subtracted from the score of a peer for every message
+// it sends above its rate limit.
+const penaltyRateLimit = 1
+
+// priority decides the order in which queued messages are processed, lower
+// values first.
+type priority int
+
+const (
+	// priorityHigh is for blocks and everything needed to sync them.
+	priorityHigh priority = iota
+	priorityNormal
+	// priorityLow is for transaction gossip.
+	priorityLow
+	numPriorities
+)
+
+// inboundClass describes how the messages of a type are handled.
+type inboundClass struct {
+	priority priority
+	// rate is the number of messages a peer may send per second, burst
+	// the number it may send at once. A rate of 0 means no limit.
+	rate  float64
+	burst int
+}
+
+// inboundClasses holds the class of every message type. Answers to our own
+// requests never get here, they go straight to the request, see enqueue.
+// Blocks, Headers, NotFound and BlockTxn messages that do reach the queue
+// were not asked for or came too late, they are of no use to us and are
+// limited and processed last.
+var inboundClasses = map[MessageType]inboundClass{
+	MessageTypeBlock:           {priority: priorityHigh, rate: 10, burst: 50},
+	MessageTypeProposal:        {priority: priorityHigh, rate: 10, burst: 20},
+	MessageTypeVote:            {priority: priorityHigh, rate: 100, burst: 200},
+	MessageTypeEvidence:        {priority: priorityNormal, rate: 5, burst: 20},
+	MessageTypeCompactBlock:    {priority: priorityHigh, rate: 10, burst: 50},
+	MessageTypeBlockTxn:        {priority: priorityLow, rate: 1, burst: 5},
+	MessageTypeGetBlockTxn:     {priority: priorityHigh, rate: 50, burst: 100},
+	MessageTypeBlocks:          {priority: priorityLow, rate: 1, burst: 5},
+	MessageTypeHeaders:         {priority: priorityLow, rate: 1, burst: 5},
+	MessageTypeNotFound:        {priority: priorityLow, rate: 1, burst: 5},
+	MessageTypeGetBlocks:       {priority: priorityNormal, rate: 1, burst: 10},
+	MessageTypeGetHeaders:      {priority: priorityHigh, rate: 50, burst: 100},
+	MessageTypeGetBlocksByHash: {priority: priorityHigh, rate: 50, burst: 100},
+	MessageTypeStatus:          {priority: priorityNormal, rate: 1, burst: 5},
+	MessageTypeGetStatus:       {priority: priorityNormal, rate: 1, burst: 5},
+	MessageTypePeers:           {priority: priorityNormal, rate: 10, burst: 20},
+	MessageTypeGetPeers:        {priority: priorityNormal, rate: 10, burst: 20},
+	MessageTypePing:            {priority: priorityNormal, rate: 1, burst: 5},
+	MessageTypePong:            {priority: priorityNormal, rate: 1, burst: 5},
+	MessageTypeInv:             {priority: priorityNormal, rate: 50, burst: 100},
+	MessageTypeGetData:         {priority: priorityNormal, rate: 50, burst: 100},
+	MessageTypeTx:              {priority: priorityLow, rate: 100, burst: 200},
+}
+
+// messageType returns the type of a decoded message. Messages of a custom
+// RPCDecodeFunc that are unknown here have type 0.
+func messageType(data any) MessageType {
+	switch data.(type) {
+	case *core.Transaction:
+		return MessageTypeTx
+	case *core.Block:
+		return MessageTypeBlock
+	case *GetBlocksMessage:
+		return MessageTypeGetBlocks
+	case *StatusMessage:
+		return MessageTypeStatus
+	case *GetStatusMessage:
+		return MessageTypeGetStatus
+	case *BlocksMessage:
+		return MessageTypeBlocks
+	case *GetPeersMessage:
+		return MessageTypeGetPeers
+	case *PeersMessage:
+		return MessageTypePeers
+	case *GetHeadersMessage:
+		return MessageTypeGetHeaders
+	case *HeadersMessage:
+		return MessageTypeHeaders
+	case *GetBlocksByHashMessage:
+		return MessageTypeGetBlocksByHash
+	case *NotFoundMessage:
+		return MessageTypeNotFound
+	case *InvMessage:
+		return MessageTypeInv
+	case *GetDataMessage:
+		return MessageTypeGetData
+	case *PingMessage:
+		return MessageTypePing
+	case *PongMessage:
+		return MessageTypePong
+	case *CompactBlockMessage:
+		return MessageTypeCompactBlock
+	case *GetBlockTxnMessage:
+		return MessageTypeGetBlockTxn
+	case *BlockTxnMessage:
+		return MessageTypeBlockTxn
+	case *consensus.Proposal:
+		return MessageTypeProposal
+	case *core.Vote:
+		return MessageTypeVote
+	case *core.Evidence:
+		return MessageTypeEvidence
+	}
+	return 0
+}
+
+func classOf(msgType MessageType) inboundClass {
+	if class, ok := inboundClasses[msgType]; ok {
+		return class
+	}
+	return inboundClass{priority: priorityNormal}
+}
+
+// tokenBucket allows rate events per second on average and up to burst at
+// once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// allow takes a token from the bucket if there is one.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowMessage reports whether the peer at addr is within the rate limit of
+// the message type. Messages from peers we do not know are not limited.
+func (s *Server) allowMessage(addr net.Addr, msgType MessageType) bool {
+	class := classOf(msgType)
+	if class.rate == 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peerMap[addr]
+	if !ok {
+		return true
+	}
+	bucket, ok := peer.limits[msgType]
+	if !ok {
+		bucket = newTokenBucket(class.rate, class.burst, s.Clock.Now())
+		peer.limits[msgType] = bucket
+	}
+	return bucket.allow(s.Clock.Now())
+}
+
+// inboundQueue holds the messages of a single peer that wait to be
+// processed, one FIFO per priority.
+type inboundQueue struct {
+	addr net.Addr
+	msgs [numPriorities][]*DecodeMessage
+	len  int
+	// scheduled tells whether the queue is in the ready list of a
+	// priority.
+	scheduled [numPriorities]bool
+	removed   bool
+}
+
+// inbox queues the decoded messages of all peers until the server gets to
+// them. Messages are taken by priority and, within a priority, round robin
+// from the peers, so a single busy peer cannot starve the others.
+type inbox struct {
+	lock   sync.Mutex
+	size   int
+	queues map[net.Addr]*inboundQueue
+	// ready holds per priority the queues with messages of that priority
+	// in the order they get their next turn.
+	ready  [numPriorities][]*inboundQueue
+	notify chan struct{}
+}
+
+func newInbox(size int) *inbox {
+	return &inbox{
+		size:   size,
+		queues: make(map[net.Addr]*inboundQueue),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push queues msg with priority prio. It never blocks, if the queue of the
+// sender is full the newest message of a lower priority makes room, or msg
+// itself is rejected. push returns the message that was dropped, if any.
+func (in *inbox) push(msg *DecodeMessage, prio priority) *DecodeMessage {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	q, ok := in.queues[msg.From]
+	if !ok {
+		q = &inboundQueue{addr: msg.From}
+		in.queues[msg.From] = q
+	}
+
+	var dropped *DecodeMessage
+	if q.len >= in.size {
+		for p := numPriorities - 1; p > prio; p-- {
+			if n := len(q.msgs[p]); n > 0 {
+				dropped = q.msgs[p][n-1]
+				q.msgs[p] = q.msgs[p][:n-1]
+				q.len--
+				break
+			}
+		}
+		if dropped == nil {
+			return msg
+		}
+	}
+
+	q.msgs[prio] = append(q.msgs[prio], msg)
+	q.len++
+	if !q.scheduled[prio] {
+		q.scheduled[prio] = true
+		in.ready[prio] = append(in.ready[prio], q)
+	}
+
+	select {
+	case in.notify <- struct{}{}:
+	default:
+	}
+
+	return dropped
+}
+
+// pop returns the next message to process or nil if there is none.
+func (in *inbox) pop() *DecodeMessage {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	for p := priority(0); p < numPriorities; p++ {
+		for len(in.ready[p]) > 0 {
+			q := in.ready[p][0]
+			in.ready[p][0] = nil
+			in.ready[p] = in.ready[p][1:]
+
+			if q.removed || len(q.msgs[p]) == 0 {
+				q.scheduled[p] = false
+				continue
+			}
+
+			msg := q.msgs[p][0]
+			q.msgs[p][0] = nil
+			q.msgs[p] = q.msgs[p][1:]
+			q.len--
+
+			if len(q.msgs[p]) > 0 {
+				in.ready[p] = append(in.ready[p], q)
+			} else {
+				q.scheduled[p] = false
+			}
+			if q.len == 0 {
+				q.removed = true
+				delete(in.queues, q.addr)
+			}
+			return msg
+		}
+	}
+	return nil
+}
+
+// remove drops the queue of the peer at addr and returns the messages that
+// were still in it.
+func (in *inbox) remove(addr net.Addr) []*DecodeMessage {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+
+	q, ok := in.queues[addr]
+	if !ok {
+		return nil
+	}
+	q.removed = true
+	delete(in.queues, addr)
+
+	msgs := []*DecodeMessage{}
+	for _, queued := range q.msgs {
+		msgs = append(msgs, queued...)
+	}
+	return msgs
+}
+
+// enqueue hands a decoded message to the process loop. Messages above the
+// rate limit of the sender are dropped and cost it some score.
+func (s *Server) enqueue(msg *DecodeMessage) {
+	// answers go straight to the request waiting for them, which takes
+	// over the work of handling them.
+	if s.requests.deliver(msg) {
+		return
+	}
+
+	msgType := messageType(msg.Data)
+	if !s.allowMessage(msg.From, msgType) {
+		s.dropMessage(msg, "rate limit exceeded")
+		s.misbehave(msg.From, penaltyRateLimit, fmt.Errorf("peer %s exceeded the rate limit of message type %x", msg.From, msgType))
+		return
+	}
+
+	if dropped := s.inbound.push(msg, classOf(msgType).priority); dropped != nil {
+		s.dropMessage(dropped, "inbound queue full")
+	}
+}
+
+// processLoop processes the queued messages one at a time.
+func (s *Server) processLoop() {
+	for {
+		select {
+		case <-s.inbound.notify:
+		case <-s.ctx.Done():
+			return
+		}
+		for msg := s.inbound.pop(); msg != nil; msg = s.inbound.pop() {
+			s.handleMessage(msg)
+		}
+	}
+}
+
+func (s *Server) dropMessage(msg *DecodeMessage, reason string) {
+	s.Logger.Log("msg", "dropped message", "from", msg.From, "type", messageType(msg.Data), "reason", reason)
+	s.skip(msg)
+}
+
+func (s *Server) skip(msg *DecodeMessage) {
+	if s.onSkip != nil {
+		s.onSkip(msg)
+	}
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := simEpoch
+	b := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now))
+	}
+	assert.False(t, b.allow(now))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+
+	// the bucket never holds more than burst tokens.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		assert.True(t, b.allow(now))
+	}
+	assert.False(t, b.allow(now))
+}
+
+func TestInboxPriority(t *testing.T) {
+	in := newInbox(10)
+
+	tx := &DecodeMessage{From: NetAddr("A"), Data: &core.Transaction{}}
+	status := &DecodeMessage{From: NetAddr("A"), Data: &StatusMessage{}}
+	block := &DecodeMessage{From: NetAddr("A"), Data: &core.Block{}}
+	assert.Nil(t, in.push(tx, priorityLow))
+	assert.Nil(t, in.push(status, priorityNormal))
+	assert.Nil(t, in.push(block, priorityHigh))
+
+	assert.Equal(t, block, in.pop())
+	assert.Equal(t, status, in.pop())
+	assert.Equal(t, tx, in.pop())
+	assert.Nil(t, in.pop())
+}
+
+func TestInboxRoundRobin(t *testing.T) {
+	in := newInbox(10)
+
+	for i := 0; i < 3; i++ {
+		in.push(&DecodeMessage{From: NetAddr("BUSY"), Data: i}, priorityLow)
+	}
+	in.push(&DecodeMessage{From: NetAddr("QUIET"), Data: 0}, priorityLow)
+
+	from := []NetAddr{}
+	for msg := in.pop(); msg != nil; msg = in.pop() {
+		from = append(from, msg.From.(NetAddr))
+	}
+	assert.Equal(t, []NetAddr{"BUSY", "QUIET", "BUSY", "BUSY"}, from)
+}
+
+func TestInboxFull(t *testing.T) {
+	in := newInbox(2)
+
+	tx1 := &DecodeMessage{From: NetAddr("A"), Data: 1}
+	tx2 := &DecodeMessage{From: NetAddr("A"), Data: 2}
+	assert.Nil(t, in.push(tx1, priorityLow))
+	assert.Nil(t, in.push(tx2, priorityLow))
+
+	// a block pushes out the newest transaction.
+	block := &DecodeMessage{From: NetAddr("A"), Data: 3}
+	assert.Equal(t, tx2, in.push(block, priorityHigh))
+
+	// there is nothing less important left to drop.
+	tx3 := &DecodeMessage{From: NetAddr("A"), Data: 4}
+	assert.Equal(t, tx3, in.push(tx3, priorityLow))
+
+	// other peers have their own queue.
+	other := &DecodeMessage{From: NetAddr("B"), Data: 5}
+	assert.Nil(t, in.push(other, priorityLow))
+
+	assert.Len(t, in.remove(NetAddr("A")), 2)
+	assert.Equal(t, other, in.pop())
+	assert.Nil(t, in.pop())
+}
+
+func TestRateLimitedPeer(t *testing.T) {
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+
+	remote := NewLocalTransport("REMOTE")
+	assert.Nil(t, tr.Connect(remote))
+	s.drainPeerEvents()
+
+	limit := inboundClasses[MessageTypeGetPeers].burst
+	for i := 0; i < limit+3; i++ {
+		s.enqueue(&DecodeMessage{From: remote.Addr(), Data: &GetPeersMessage{}})
+	}
+
+	queued := 0
+	for msg := s.inbound.pop(); msg != nil; msg = s.inbound.pop() {
+		queued++
+	}
+	assert.Equal(t, limit, queued)
+	assert.Equal(t, initialPeerScore-3*penaltyRateLimit, s.Peers()[0].Score)
+}
+
+func TestUnsolicitedReplies(t *testing.T) {
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+
+	remote := NewLocalTransport("REMOTE")
+	assert.Nil(t, tr.Connect(remote))
+	s.drainPeerEvents()
+
+	// nobody asked for the blocks, they wait behind everything else.
+	limit := inboundClasses[MessageTypeBlocks].burst
+	for i := 0; i < limit+1; i++ {
+		s.enqueue(&DecodeMessage{From: remote.Addr(), ReplyTo: uint64(i + 1), Data: &BlocksMessage{}})
+	}
+	getPeers := &DecodeMessage{From: remote.Addr(), Data: &GetPeersMessage{}}
+	s.enqueue(getPeers)
+
+	assert.Equal(t, getPeers, s.inbound.pop())
+	queued := 0
+	for msg := s.inbound.pop(); msg != nil; msg = s.inbound.pop() {
+		queued++
+	}
+	assert.Equal(t, limit, queued)
+	assert.Equal(t, initialPeerScore-penaltyRateLimit, s.Peers()[0].Score)
+}
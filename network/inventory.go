@@ -0,0 +1,254 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+type InvType byte
+
+const (
+	InvTypeTx    InvType = 0x1
+	InvTypeBlock InvType = 0x2
+)
+
+const (
+	// maxInvPerMessage is the maximum number of items in a single
+	// InvMessage or GetDataMessage.
+	maxInvPerMessage = 1000
+	// maxKnownInventory is the number of items we remember per peer.
+	maxKnownInventory = 10000
+)
+
+// getDataTimeout is how long we wait for an item we requested before we
+// ask the next peer that announced it.
+var getDataTimeout = 5 * time.Second
+
+// InvItem identifies a transaction or block by its hash.
+type InvItem struct {
+	Type InvType
+	Hash types.Hash
+}
+
+// knownSet is a set of hashes that forgets the oldest entry once it holds
+// max items.
+type knownSet struct {
+	items map[types.Hash]struct{}
+	order []types.Hash
+	max   int
+}
+
+func newKnownSet(max int) *knownSet {
+	return &knownSet{
+		items: make(map[types.Hash]struct{}),
+		order: []types.Hash{},
+		max:   max,
+	}
+}
+
+func (k *knownSet) Add(h types.Hash) {
+	if _, ok := k.items[h]; ok {
+		return
+	}
+	if len(k.order) == k.max {
+		delete(k.items, k.order[0])
+		k.order = k.order[1:]
+	}
+	k.items[h] = struct{}{}
+	k.order = append(k.order, h)
+}
+
+func (k *knownSet) Contains(h types.Hash) bool {
+	_, ok := k.items[h]
+	return ok
+}
+
+func (k *knownSet) Len() int {
+	return len(k.items)
+}
+
+// invRelay decides what to announce to and request from which peer. It
+// remembers per peer which items it already knows about, so we never echo
+// an item back to a peer that announced or sent it to us.
+type invRelay struct {
+	clock Clock
+	// timeout is getDataTimeout at the time the relay was made.
+	timeout time.Duration
+	lock    sync.Mutex
+	known   map[net.Addr]*knownSet
+	// requested holds the items we asked for.
+	requested map[types.Hash]*getDataRequest
+}
+
+// getDataRequest is an item we asked a peer for.
+type getDataRequest struct {
+	item InvItem
+	// peer is who we asked and at when.
+	peer net.Addr
+	at   time.Time
+	// announcers are the other peers that announced the item since, the
+	// next one is asked if it does not arrive in time.
+	announcers []net.Addr
+}
+
+func newInvRelay(clock Clock) *invRelay {
+	return &invRelay{
+		clock:     clock,
+		timeout:   getDataTimeout,
+		known:     make(map[net.Addr]*knownSet),
+		requested: make(map[types.Hash]*getDataRequest),
+	}
+}
+
+func (r *invRelay) addPeer(addr net.Addr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.known[addr] = newKnownSet(maxKnownInventory)
+}
+
+func (r *invRelay) removePeer(addr net.Addr) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.known, addr)
+}
+
+// markKnown records that the peer at addr knows about hash.
+func (r *invRelay) markKnown(addr net.Addr, hash types.Hash) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if known, ok := r.known[addr]; ok {
+		known.Add(hash)
+	}
+}
+
+// received is called when the full item arrived from the peer at addr.
+func (r *invRelay) received(addr net.Addr, hash types.Hash) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.requested, hash)
+	if known, ok := r.known[addr]; ok {
+		known.Add(hash)
+	}
+}
+
+// announce returns the peers that do not know about hash yet and marks it
+// as known for them, the caller is expected to send them an inv.
+func (r *invRelay) announce(hash types.Hash) []net.Addr {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	peers := []net.Addr{}
+	for addr, known := range r.known {
+		if !known.Contains(hash) {
+			known.Add(hash)
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// wanted handles the items announced by the peer at addr and returns the
+// ones we should request from it. Items we have, as reported by have, or
+// already requested from another peer are skipped.
+func (r *invRelay) wanted(addr net.Addr, items []InvItem, have func(InvItem) bool) []InvItem {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	known := r.known[addr]
+	now := r.clock.Now()
+	if len(r.requested) > maxKnownInventory {
+		for hash, req := range r.requested {
+			if now.Sub(req.at) >= r.timeout {
+				delete(r.requested, hash)
+			}
+		}
+	}
+
+	want := []InvItem{}
+	for _, item := range items {
+		if known != nil {
+			known.Add(item.Hash)
+		}
+		if have(item) {
+			continue
+		}
+		if req, ok := r.requested[item.Hash]; ok && now.Sub(req.at) < r.timeout {
+			req.announced(addr)
+			continue
+		}
+		r.requested[item.Hash] = &getDataRequest{item: item, peer: addr, at: now}
+		want = append(want, item)
+	}
+	return want
+}
+
+// retry is called once the timeout passed since we requested the item
+// with hash. If it did not arrive it returns the next peer that announced
+// it to ask instead, and false if there is none or nothing to do.
+func (r *invRelay) retry(hash types.Hash, have func(InvItem) bool) (net.Addr, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	req, ok := r.requested[hash]
+	if !ok {
+		return nil, false
+	}
+	return r.retryLocked(req, r.clock.Now(), have)
+}
+
+// retryAll retries every item that is overdue and returns the items to ask
+// for by peer.
+func (r *invRelay) retryAll(have func(InvItem) bool) map[net.Addr][]InvItem {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.clock.Now()
+	byPeer := make(map[net.Addr][]InvItem)
+	for _, req := range r.requested {
+		if addr, ok := r.retryLocked(req, now, have); ok {
+			byPeer[addr] = append(byPeer[addr], req.item)
+		}
+	}
+	return byPeer
+}
+
+func (r *invRelay) retryLocked(req *getDataRequest, now time.Time, have func(InvItem) bool) (net.Addr, bool) {
+	if now.Sub(req.at) < r.timeout {
+		return nil, false
+	}
+	if have(req.item) {
+		delete(r.requested, req.item.Hash)
+		return nil, false
+	}
+	for len(req.announcers) > 0 {
+		addr := req.announcers[0]
+		req.announcers = req.announcers[1:]
+		if _, ok := r.known[addr]; ok {
+			req.peer, req.at = addr, now
+			return addr, true
+		}
+	}
+	// whoever announces it next is asked right away.
+	delete(r.requested, req.item.Hash)
+	return nil, false
+}
+
+// announced adds the peer at addr to the announcers of the item.
+func (req *getDataRequest) announced(addr net.Addr) {
+	if addr == req.peer {
+		return
+	}
+	for _, other := range req.announcers {
+		if other == addr {
+			return
+		}
+	}
+	req.announcers = append(req.announcers, addr)
+}
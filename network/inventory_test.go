@@ -0,0 +1,225 @@
+package network
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/LeiZhou-97/blockchain/util"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnownSet(t *testing.T) {
+	k := newKnownSet(3)
+	hashes := []types.Hash{util.RandomHash(), util.RandomHash(), util.RandomHash(), util.RandomHash()}
+
+	for _, h := range hashes[:3] {
+		k.Add(h)
+		// cannot add twice
+		k.Add(h)
+	}
+	assert.Equal(t, 3, k.Len())
+
+	// the oldest one is forgotten
+	k.Add(hashes[3])
+	assert.Equal(t, 3, k.Len())
+	assert.False(t, k.Contains(hashes[0]))
+	for _, h := range hashes[1:] {
+		assert.True(t, k.Contains(h))
+	}
+}
+
+func TestInvRelayAnnounce(t *testing.T) {
+	r := newInvRelay(realClock{})
+	a, b, c := NetAddr("A"), NetAddr("B"), NetAddr("C")
+	r.addPeer(a)
+	r.addPeer(b)
+	r.addPeer(c)
+
+	// A sent us the item, so only B and C need to hear about it.
+	hash := util.RandomHash()
+	r.received(a, hash)
+	assert.ElementsMatch(t, []net.Addr{b, c}, r.announce(hash))
+
+	// nobody is told twice.
+	assert.Empty(t, r.announce(hash))
+}
+
+func TestInvRelayWanted(t *testing.T) {
+	r := newInvRelay(realClock{})
+	a, b := NetAddr("A"), NetAddr("B")
+	r.addPeer(a)
+	r.addPeer(b)
+
+	have := util.RandomHash()
+	missing := util.RandomHash()
+	items := []InvItem{
+		{Type: InvTypeTx, Hash: have},
+		{Type: InvTypeTx, Hash: missing},
+	}
+	haveFunc := func(item InvItem) bool { return item.Hash == have }
+
+	want := r.wanted(a, items, haveFunc)
+	assert.Equal(t, []InvItem{{Type: InvTypeTx, Hash: missing}}, want)
+
+	// already requested from A, so B is not asked.
+	assert.Empty(t, r.wanted(b, items, haveFunc))
+
+	// both peers announced the items, we never echo them back.
+	assert.Empty(t, r.announce(have))
+	assert.Empty(t, r.announce(missing))
+}
+
+func TestInvRelayRetry(t *testing.T) {
+	clock := NewSimClock(simEpoch)
+	wait := func() { clock.step(clock.Now().Add(getDataTimeout)) }
+	r := newInvRelay(clock)
+	a, b, c := NetAddr("A"), NetAddr("B"), NetAddr("C")
+	for _, addr := range []NetAddr{a, b, c} {
+		r.addPeer(addr)
+	}
+	haveNothing := func(InvItem) bool { return false }
+
+	item := InvItem{Type: InvTypeTx, Hash: util.RandomHash()}
+	assert.Equal(t, []InvItem{item}, r.wanted(a, []InvItem{item}, haveNothing))
+	for _, addr := range []NetAddr{b, a, c, b} {
+		assert.Empty(t, r.wanted(addr, []InvItem{item}, haveNothing))
+	}
+
+	// A gets its time to answer.
+	_, ok := r.retry(item.Hash, haveNothing)
+	assert.False(t, ok)
+
+	// then the others are asked in the order they announced it.
+	for _, next := range []NetAddr{b, c} {
+		wait()
+		addr, ok := r.retry(item.Hash, haveNothing)
+		assert.True(t, ok)
+		assert.Equal(t, next, addr)
+	}
+	wait()
+	_, ok = r.retry(item.Hash, haveNothing)
+	assert.False(t, ok)
+	// the next peer that announces it is asked right away.
+	assert.Equal(t, []InvItem{item}, r.wanted(a, []InvItem{item}, haveNothing))
+
+	// nothing to do once the item arrived.
+	r.wanted(b, []InvItem{item}, haveNothing)
+	r.received(a, item.Hash)
+	wait()
+	_, ok = r.retry(item.Hash, haveNothing)
+	assert.False(t, ok)
+}
+
+func TestGetDataRetry(t *testing.T) {
+	defer func(d time.Duration) { getDataTimeout = d }(getDataTimeout)
+	getDataTimeout = 50 * time.Millisecond
+
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+	defer s.Stop()
+
+	slow, fast := NewLocalTransport("SLOW"), NewLocalTransport("FAST")
+	assert.Nil(t, tr.Connect(slow))
+	assert.Nil(t, tr.Connect(fast))
+	s.drainPeerEvents()
+	go s.Start()
+
+	// getData returns the items the remote is asked for next.
+	getData := func(remote *LocalTransport) []InvItem {
+		for {
+			select {
+			case rpc := <-remote.Consume():
+				msg, err := DefaultRPCDecodeFunc(rpc)
+				assert.Nil(t, err)
+				if data, ok := msg.Data.(*GetDataMessage); ok {
+					return data.Items
+				}
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+	}
+
+	inv := &InvMessage{Items: []InvItem{{Type: InvTypeTx, Hash: util.RandomHash()}}}
+	assert.Nil(t, s.processInvMessage(slow.Addr(), inv))
+	assert.Nil(t, s.processInvMessage(fast.Addr(), inv))
+	assert.Equal(t, inv.Items, getData(slow))
+
+	// SLOW never answers, FAST is asked instead.
+	assert.Equal(t, inv.Items, getData(fast))
+}
+
+// TestInvGossipSavesBandwidth spreads transactions through a random network
+// of servers and compares the bytes sent with what flooding the full
+// transactions to every peer would have cost.
+func TestInvGossipSavesBandwidth(t *testing.T) {
+	const (
+		nodeCount = 20
+		txCount   = 20
+	)
+	sim := NewSimNetwork(SimConfig{
+		Seed:       5,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 20 * time.Millisecond,
+	})
+	rnd := rand.New(rand.NewSource(5))
+
+	addrs := make([]NetAddr, nodeCount)
+	for i := range addrs {
+		addrs[i] = NetAddr(fmt.Sprintf("NODE_%d", i))
+		_, err := sim.AddNode(addrs[i], ServerOpts{})
+		assert.Nil(t, err)
+	}
+	// a ring keeps the network connected, the random edges give every node
+	// a handful of peers.
+	for i := range addrs {
+		assert.Nil(t, sim.Connect(addrs[i], addrs[(i+1)%nodeCount]))
+		for j := 0; j < 2; j++ {
+			if other := rnd.Intn(nodeCount); other != i {
+				assert.Nil(t, sim.Connect(addrs[i], addrs[other]))
+			}
+		}
+	}
+	sim.Run(time.Second)
+
+	before := sim.Stats().Bytes
+	txx := make([]*core.Transaction, txCount)
+	for i := range txx {
+		txx[i] = core.NewTransaction(make([]byte, 2048))
+		rnd.Read(txx[i].Data)
+		assert.Nil(t, txx[i].Sign(crypto.GeneratePrivateKey()))
+		node := sim.Node(addrs[rnd.Intn(nodeCount)])
+		assert.Nil(t, node.Server.processTransaction(NetAddr("CLIENT"), txx[i]))
+	}
+	assert.True(t, sim.RunUntil(func() bool {
+		for _, addr := range addrs {
+			if sim.Node(addr).Server.mempool.PendingCount() != txCount {
+				return false
+			}
+		}
+		return true
+	}, 30*time.Second))
+	inv := sim.Stats().Bytes - before
+
+	// flooding sends every transaction over every connection but the one
+	// a node got it from.
+	links := 0
+	for _, addr := range addrs {
+		links += len(sim.Node(addr).Server.Peers())
+	}
+	flood := 0
+	for _, tx := range txx {
+		flood += len(encodeMessage(t, MessageTypeTx, tx)) * (links - (nodeCount - 1))
+	}
+
+	t.Logf("flood: %d bytes, inv: %d bytes, saved %.1f%%", flood, inv, 100-float64(inv)/float64(flood)*100)
+	assert.Less(t, inv, flood/2)
+}
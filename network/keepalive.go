@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+)
+
+var (
+	// pingInterval is how often we ping every peer.
+	pingInterval = 10 * time.Second
+	// pongTimeout is how long a peer has to answer a ping.
+	pongTimeout = 20 * time.Second
+	// idleTimeout is how long a peer may stay silent before we drop it.
+	idleTimeout = time.Minute
+)
+
+// keepaliveLoop pings the peers and drops the ones that stopped answering.
+// Without it a half-open connection would stay around forever.
+func (s *Server) keepaliveLoop(started func()) {
+	// done marks the work of the last wake-up as finished. At first it
+	// tells spawnLoop that our first timer is set.
+	done := started
+	for {
+		wake, next := wakeAfter(s.Clock, pingInterval)
+		done()
+		select {
+		case <-wake:
+			done = next
+		case <-s.ctx.Done():
+			return
+		}
+		s.checkPeers()
+	}
+}
+
+func (s *Server) checkPeers() {
+	now := s.Clock.Now()
+
+	var (
+		dead = []*peerState{}
+		ping = []*peerState{}
+	)
+	s.mu.Lock()
+	for _, peer := range s.peerMap {
+		switch {
+		case peer.pingNonce != 0 && now.Sub(peer.lastSeen) >= pongTimeout:
+			// we are waiting for a pong and did not hear anything
+			// else from the peer either.
+			dead = append(dead, peer)
+		case now.Sub(peer.lastSeen) >= idleTimeout:
+			dead = append(dead, peer)
+		case peer.pingNonce == 0 || now.Sub(peer.pingSent) >= pingInterval:
+			// a ping or its pong may get lost, a new ping replaces
+			// the one that is still unanswered.
+			peer.pingNonce = newPingNonce()
+			peer.pingSent = now
+			ping = append(ping, peer)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, peer := range dead {
+		s.Logger.Log("msg", "dropping unresponsive peer", "addr", peer.Addr())
+		peer.Close()
+	}
+	for _, peer := range ping {
+		if err := s.sendPingMessage(peer); err != nil {
+			s.Logger.Log("msg", "could not ping peer", "addr", peer.Addr(), "err", err)
+		}
+	}
+}
+
+func newPingNonce() uint64 {
+	for {
+		if nonce := rand.Uint64(); nonce != 0 {
+			return nonce
+		}
+	}
+}
+
+// touch records that we just heard from the peer at addr.
+func (s *Server) touch(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer, ok := s.peerMap[addr]; ok {
+		peer.lastSeen = s.Clock.Now()
+	}
+}
+
+func (s *Server) sendPingMessage(peer *peerState) error {
+	s.mu.RLock()
+	nonce := peer.pingNonce
+	s.mu.RUnlock()
+
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &PingMessage{Nonce: nonce}); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypePing, buf.Bytes())
+
+	return peer.Send(msg.Bytes())
+}
+
+func (s *Server) processPingMessage(from net.Addr, data *PingMessage) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &PongMessage{Nonce: data.Nonce}); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypePong, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
+}
+
+func (s *Server) processPongMessage(from net.Addr, data *PongMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peerMap[from]
+	if !ok {
+		return fmt.Errorf("peer %s not known", from)
+	}
+	// late or unsolicited pongs tell us nothing about the round trip time.
+	if peer.pingNonce == 0 || data.Nonce != peer.pingNonce {
+		return nil
+	}
+
+	sample := s.Clock.Now().Sub(peer.pingSent)
+	if peer.rtt == 0 {
+		peer.rtt = sample
+	} else {
+		peer.rtt = (7*peer.rtt + sample) / 8
+	}
+	peer.pingNonce = 0
+
+	return nil
+}
+
+// peerRTTs returns the round trip times of the peers we measured one for.
+func (s *Server) peerRTTs() map[net.Addr]time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rtts := make(map[net.Addr]time.Duration, len(s.peerMap))
+	for addr, peer := range s.peerMap {
+		if peer.rtt > 0 {
+			rtts[addr] = peer.rtt
+		}
+	}
+	return rtts
+}
+
+// byLatency sorts addrs by their round trip time, the peers we have no
+// measurement for last.
+func byLatency(addrs []net.Addr, rtts map[net.Addr]time.Duration) func(i, j int) bool {
+	return func(i, j int) bool {
+		a, okA := rtts[addrs[i]]
+		b, okB := rtts[addrs[j]]
+		if okA != okB {
+			return okA
+		}
+		if a != b {
+			return a < b
+		}
+		return addrs[i].String() < addrs[j].String()
+	}
+}
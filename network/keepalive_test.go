@@ -0,0 +1,73 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKeepaliveSim(t *testing.T) *SimNetwork {
+	sim := NewSimNetwork(SimConfig{
+		Seed:       1,
+		MinLatency: 25 * time.Millisecond,
+		MaxLatency: 25 * time.Millisecond,
+	})
+	for _, addr := range []NetAddr{"A", "B"} {
+		_, err := sim.AddNode(addr, ServerOpts{})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, sim.Connect("A", "B"))
+	return sim
+}
+
+func TestKeepaliveMeasuresRTT(t *testing.T) {
+	sim := newKeepaliveSim(t)
+
+	sim.Run(pingInterval + time.Second)
+
+	for _, addr := range []NetAddr{"A", "B"} {
+		peers := sim.Node(addr).Server.Peers()
+		assert.Len(t, peers, 1)
+		assert.Equal(t, 50*time.Millisecond, peers[0].RTT)
+	}
+}
+
+func TestKeepaliveDropsUnresponsivePeer(t *testing.T) {
+	sim := newKeepaliveSim(t)
+
+	sim.Run(time.Second)
+	assert.Len(t, sim.Node("A").Server.Peers(), 1)
+
+	// the connection stays open, but nothing gets through anymore.
+	sim.Partition([]NetAddr{"A"}, []NetAddr{"B"})
+	sim.Run(pingInterval + pongTimeout)
+
+	for _, addr := range []NetAddr{"A", "B"} {
+		assert.Len(t, sim.Node(addr).Server.Peers(), 0)
+	}
+}
+
+func TestPeersAboveByLatency(t *testing.T) {
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+
+	rtts := map[NetAddr]time.Duration{
+		"SLOW":    300 * time.Millisecond,
+		"FAST":    10 * time.Millisecond,
+		"MEDIUM":  50 * time.Millisecond,
+		"UNKNOWN": 0,
+	}
+	for addr, rtt := range rtts {
+		peer := newPeerState(&LocalPeer{t: tr, remote: NewLocalTransport(addr)})
+		peer.rtt = rtt
+		s.peerMap[addr] = peer
+		s.syncer.peerHeights[addr] = 10
+	}
+	s.syncer.peerHeights[NetAddr("BEHIND")] = 0
+
+	assert.Equal(t, []net.Addr{NetAddr("FAST"), NetAddr("MEDIUM"), NetAddr("SLOW"), NetAddr("UNKNOWN")}, s.syncer.peersAbove(0))
+}
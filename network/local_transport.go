@@ -5,38 +5,89 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 type LocalTransport struct {
-	addr net.Addr
+	addr      net.Addr
 	consumeCh chan RPC
-	lock sync.RWMutex
-	peers map[net.Addr]*LocalTransport
+	eventCh   chan PeerEvent
+	lock      sync.RWMutex
+	peers     map[net.Addr]*LocalTransport
+	// sim is the simulated network the transport sends its messages
+	// through, if any.
+	sim *SimNetwork
+	// events, if set, counts the peer events that were not handled yet.
+	events *atomic.Int64
 }
 
-func NewLocalTransport(addr net.Addr) *LocalTransport {
+func NewLocalTransport(addr NetAddr) *LocalTransport {
 	return &LocalTransport{
-		addr: addr,
+		addr:      addr,
 		consumeCh: make(chan RPC, 1024),
-		peers: make(map[net.Addr]*LocalTransport),
-
+		eventCh:   make(chan PeerEvent, 1024),
+		peers:     make(map[net.Addr]*LocalTransport),
 	}
 }
 
+func (t *LocalTransport) Start() error {
+	return nil
+}
+
 func (t *LocalTransport) Consume() <-chan RPC {
 	return t.consumeCh
 }
 
+func (t *LocalTransport) Events() <-chan PeerEvent {
+	return t.eventCh
+}
+
+// Connect makes tr a peer of t. Connections are one way, tr has to connect
+// to t as well to send messages back.
 func (t *LocalTransport) Connect(tr Transport) error {
 	trans := tr.(*LocalTransport)
 	t.lock.Lock()
-	defer t.lock.Unlock()
-	
 	t.peers[tr.Addr()] = trans
+	t.lock.Unlock()
+
+	t.event(PeerEvent{
+		Peer:      &LocalPeer{t: t, remote: trans},
+		Connected: true,
+	})
 
 	return nil
 }
 
+// Dial is only supported in a simulated network, otherwise local transports
+// only know each other through Connect.
+func (t *LocalTransport) Dial(addr string) error {
+	if t.sim != nil {
+		return t.sim.dial(t.addr.(NetAddr), NetAddr(addr))
+	}
+	return fmt.Errorf("%s: local transport cannot dial %s", t.addr, addr)
+}
+
+func (t *LocalTransport) disconnect(addr net.Addr) {
+	t.lock.Lock()
+	peer, ok := t.peers[addr]
+	delete(t.peers, addr)
+	t.lock.Unlock()
+
+	if ok {
+		t.event(PeerEvent{
+			Peer:      &LocalPeer{t: t, remote: peer},
+			Connected: false,
+		})
+	}
+}
+
+func (t *LocalTransport) event(ev PeerEvent) {
+	if t.events != nil {
+		t.events.Add(1)
+	}
+	t.eventCh <- ev
+}
+
 func (t *LocalTransport) SendMessage(to net.Addr, payload []byte) error {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
@@ -45,9 +96,11 @@ func (t *LocalTransport) SendMessage(to net.Addr, payload []byte) error {
 	}
 	if peer, ok := t.peers[to]; !ok {
 		return fmt.Errorf("%s: could not send msg to %s", t.addr, to)
+	} else if t.sim != nil {
+		t.sim.send(t.addr, to, payload)
 	} else {
-		peer.consumeCh <- RPC {
-			From: t.addr,
+		peer.consumeCh <- RPC{
+			From:    t.addr,
 			Payload: bytes.NewReader(payload),
 		}
 	}
@@ -56,8 +109,15 @@ func (t *LocalTransport) SendMessage(to net.Addr, payload []byte) error {
 }
 
 func (t *LocalTransport) Broadcast(payload []byte) error {
-	for _, peer := range t.peers {
-		if err := t.SendMessage(peer.addr, payload); err != nil {
+	t.lock.RLock()
+	peers := make([]net.Addr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
+	}
+	t.lock.RUnlock()
+
+	for _, addr := range peers {
+		if err := t.SendMessage(addr, payload); err != nil {
 			return err
 		}
 	}
@@ -67,3 +127,55 @@ func (t *LocalTransport) Broadcast(payload []byte) error {
 func (t *LocalTransport) Addr() net.Addr {
 	return t.addr
 }
+
+// Close disconnects all peers.
+func (t *LocalTransport) Close() error {
+	t.lock.RLock()
+	peers := make([]net.Addr, 0, len(t.peers))
+	for addr := range t.peers {
+		peers = append(peers, addr)
+	}
+	t.lock.RUnlock()
+
+	for _, addr := range peers {
+		t.disconnect(addr)
+	}
+	return nil
+}
+
+// NodeID of a local transport is its address.
+func (t *LocalTransport) NodeID() string {
+	return t.addr.String()
+}
+
+// LocalPeer is the peer a LocalTransport hands out for every transport it
+// is connected to.
+type LocalPeer struct {
+	t      *LocalTransport
+	remote *LocalTransport
+}
+
+func (p *LocalPeer) Send(b []byte) error {
+	return p.t.SendMessage(p.remote.addr, b)
+}
+
+func (p *LocalPeer) Close() error {
+	p.t.disconnect(p.remote.addr)
+	return nil
+}
+
+func (p *LocalPeer) Addr() net.Addr {
+	return p.remote.addr
+}
+
+func (p *LocalPeer) Outgoing() bool {
+	return true
+}
+
+func (p *LocalPeer) DialAddr() string {
+	return p.remote.addr.String()
+}
+
+func (p *LocalPeer) NodeID() string {
+	return p.remote.NodeID()
+}
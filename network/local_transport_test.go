@@ -58,3 +58,19 @@ func TestBroadcast(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, c, msg)
 }
+
+func TestLocalPeerEvents(t *testing.T) {
+	tra := NewLocalTransport("A")
+	trb := NewLocalTransport("B")
+
+	tra.Connect(trb)
+
+	ev := <-tra.Events()
+	assert.True(t, ev.Connected)
+	assert.Equal(t, trb.addr, ev.Peer.Addr())
+
+	assert.Nil(t, ev.Peer.Close())
+	ev = <-tra.Events()
+	assert.False(t, ev.Connected)
+	assert.NotNil(t, tra.SendMessage(trb.addr, []byte("foo")))
+}
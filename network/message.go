@@ -1,6 +1,10 @@
 package network
 
-import "github.com/LeiZhou-97/blockchain/core"
+import (
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+)
 
 type GetBlocksMessage struct {
 	From uint32
@@ -12,10 +16,96 @@ type BlocksMessage struct {
 	Blocks []*core.Block
 }
 
+// NotFoundMessage is the answer to a GetBlocksMessage for blocks above our
+// current height.
+type NotFoundMessage struct {
+	From uint32
+	// If To is 0 everything from From on is missing.
+	To uint32
+}
+
 type GetStatusMessage struct {}
 
 type StatusMessage struct {
 	ID            string
 	Version       uint32
 	CurrentHeight uint32
+	// ListenAddr is the address the node accepts connections on. An empty
+	// host means the node listens on all interfaces.
+	ListenAddr string
+}
+
+// GetHeadersMessage asks for the headers starting at height From. If To is
+// 0 as many headers as allowed will be returned.
+type GetHeadersMessage struct {
+	From uint32
+	To   uint32
+}
+
+// HeadersMessage holds headers and the seal of each, so the seals can be
+// checked before the blocks are downloaded.
+type HeadersMessage struct {
+	Headers []*core.Header
+	Seals   []*core.Seal
+}
+
+// GetBlocksByHashMessage asks for the blocks with the given hashes, the
+// answer is a BlocksMessage.
+type GetBlocksByHashMessage struct {
+	Hashes []types.Hash
+}
+
+// InvMessage announces transactions and blocks by their hash. Peers that
+// do not have them ask for them with a GetDataMessage.
+type InvMessage struct {
+	Items []InvItem
+}
+
+// GetDataMessage asks for the full transactions and blocks, which are sent
+// back as regular tx and block messages.
+type GetDataMessage struct {
+	Items []InvItem
+}
+
+type GetPeersMessage struct{}
+
+type PeersMessage struct {
+	Addrs []string
+}
+
+// PingMessage checks that a peer is still alive. The peer answers with a
+// PongMessage carrying the same nonce.
+type PingMessage struct {
+	Nonce uint64
+}
+
+type PongMessage struct {
+	Nonce uint64
+}
+
+// CompactBlockMessage announces a block without its transactions. Peers
+// rebuild the block from their mempool and ask for the transactions they
+// miss with a GetBlockTxnMessage.
+type CompactBlockMessage struct {
+	Header    *core.Header
+	Validator crypto.PublicKey
+	Signature *crypto.Signature
+	// Commit is the commit of a BFT block.
+	Commit *core.Commit
+	// ShortIDs holds the short ID of every transaction, in block order.
+	ShortIDs []ShortTxID
+	// Evidence is sent in full, peers rarely have it.
+	Evidence []*core.Evidence
+}
+
+// GetBlockTxnMessage asks for the transactions of a block by their index,
+// the answer is a BlockTxnMessage.
+type GetBlockTxnMessage struct {
+	Hash    types.Hash
+	Indexes []uint32
+}
+
+type BlockTxnMessage struct {
+	Hash         types.Hash
+	Transactions []*core.Transaction
 }
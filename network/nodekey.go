@@ -0,0 +1,35 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+)
+
+// loadNodeKey returns the key that identifies the node to its peers. It is
+// created on first start and kept in dataDir, without a dataDir the node
+// gets a new identity every time it starts.
+func loadNodeKey(dataDir string) (crypto.PrivateKey, error) {
+	if dataDir == "" {
+		return crypto.GeneratePrivateKey(), nil
+	}
+
+	path := filepath.Join(dataDir, "nodekey")
+	b, err := os.ReadFile(path)
+	if err == nil {
+		return crypto.PrivateKeyFromBytes(b)
+	}
+	if !os.IsNotExist(err) {
+		return crypto.PrivateKey{}, err
+	}
+
+	key := crypto.GeneratePrivateKey()
+	if b, err = key.Bytes(); err != nil {
+		return crypto.PrivateKey{}, err
+	}
+	if err := writeFileAtomic(path, b, 0o600); err != nil {
+		return crypto.PrivateKey{}, err
+	}
+	return key, nil
+}
@@ -0,0 +1,25 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadNodeKey(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := loadNodeKey(dir)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(filepath.Join(dir, "nodekey"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// a restarted node keeps its identity.
+	again, err := loadNodeKey(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, key.PublicKey(), again.PublicKey())
+}
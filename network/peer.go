@@ -0,0 +1,206 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/api"
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+)
+
+const (
+	// initialPeerScore is the score every peer starts with.
+	initialPeerScore = 100
+	// banScore is the score at which a peer is disconnected and banned.
+	banScore = 0
+
+	penaltyInvalidBlock      = 50
+	penaltyInvalidTx         = 20
+	penaltyDecodeFailure     = 25
+	penaltyProtocolViolation = 10
+	// penaltyInvalidVote is for a BFT proposal or vote that was not
+	// signed by the validator it claims.
+	penaltyInvalidVote = 50
+	// penaltyInvalidEvidence is for evidence of double signing that does
+	// not prove it.
+	penaltyInvalidEvidence = 50
+)
+
+var (
+	defaultBanDuration = 24 * time.Hour
+)
+
+// MisbehaviorError is returned by the message handlers when the sender of a
+// message broke the protocol. Penalty is subtracted from its score.
+type MisbehaviorError struct {
+	Penalty int
+	Err     error
+}
+
+func (e *MisbehaviorError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MisbehaviorError) Unwrap() error {
+	return e.Err
+}
+
+func misbehavior(penalty int, err error) error {
+	return &MisbehaviorError{
+		Penalty: penalty,
+		Err:     err,
+	}
+}
+
+// blockError decides if a block that could not be added to the chain is the
+// fault of the peer that sent it.
+func blockError(err error) error {
+	// a block from the future may be honest, our clocks differ. A block
+	// on a branch we do not know yet is honest too.
+	if errors.Is(err, core.ErrBlockKnown) || errors.Is(err, core.ErrBlockTooHigh) || errors.Is(err, core.ErrUnknownParent) || errors.Is(err, consensus.ErrBlockInFuture) {
+		return err
+	}
+	return misbehavior(penaltyInvalidBlock, err)
+}
+
+// peerState is what the server knows about a connected peer on top of the
+// connection itself.
+type peerState struct {
+	Peer
+	s *Server
+	// id is the server ID the peer reported in its status message.
+	id string
+	// listenAddr is the address the peer accepts connections on. For
+	// outgoing peers it is the address we dialed, inbound peers tell us
+	// in their status message.
+	listenAddr string
+	score      int
+
+	// lastSeen is when we last received a message from the peer.
+	lastSeen time.Time
+	// pingNonce is the nonce of the ping we wait an answer for, 0 if
+	// there is none.
+	pingNonce uint64
+	pingSent  time.Time
+	// rtt is the smoothed round trip time, 0 until the first pong.
+	rtt time.Duration
+
+	// limits holds the rate limit of every message type the peer sent.
+	limits map[MessageType]*tokenBucket
+}
+
+func newPeerState(peer Peer) *peerState {
+	return &peerState{
+		Peer:       peer,
+		listenAddr: peer.DialAddr(),
+		score:      initialPeerScore,
+		limits:     make(map[MessageType]*tokenBucket),
+	}
+}
+
+// banKey is what a ban of this peer applies to. It is the node ID the peer
+// authenticated with, so the ban sticks no matter where it connects from.
+func (p *peerState) banKey() string {
+	if id := p.NodeID(); id != "" {
+		return id
+	}
+	return p.Addr().String()
+}
+
+// maxRememberedScores is the number of disconnected peers whose score we
+// remember until they connect again.
+const maxRememberedScores = 10000
+
+// restoreScore gives a reconnecting peer the score it left with, so it
+// cannot reset its score by reconnecting. It expects s.mu to be held.
+func (s *Server) restoreScore(peer *peerState) {
+	if score, ok := s.scores[peer.banKey()]; ok {
+		peer.score = score
+		delete(s.scores, peer.banKey())
+	}
+}
+
+// rememberScore keeps the score of a peer that disconnects with a penalty.
+// It expects s.mu to be held.
+func (s *Server) rememberScore(peer *peerState) {
+	if peer.score >= initialPeerScore || peer.score <= banScore {
+		return
+	}
+	if len(s.scores) < maxRememberedScores {
+		s.scores[peer.banKey()] = peer.score
+	}
+}
+
+// misbehave lowers the score of the peer at addr. Once the score drops to
+// banScore the peer gets banned.
+func (s *Server) misbehave(addr net.Addr, penalty int, reason error) {
+	s.mu.Lock()
+	peer, ok := s.peerMap[addr]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	peer.score -= penalty
+	score := peer.score
+	s.mu.Unlock()
+
+	s.Logger.Log("msg", "peer misbehaved", "addr", addr, "penalty", penalty, "score", score, "reason", reason)
+
+	if score <= banScore {
+		s.banPeer(peer, reason.Error())
+	}
+}
+
+// banPeer bans the peer for BanDuration and disconnects it.
+func (s *Server) banPeer(peer *peerState, reason string) {
+	if err := s.banList.Ban(peer.banKey(), s.BanDuration, reason); err != nil {
+		s.Logger.Log("msg", "could not save ban list", "err", err)
+	}
+	s.Logger.Log("msg", "banned peer", "nodeID", peer.banKey(), "reason", reason)
+
+	if peer.listenAddr != "" {
+		s.addrBook.Remove(peer.listenAddr)
+	}
+	peer.Close()
+}
+
+// Peers returns the connected peers together with their scores.
+func (s *Server) Peers() []api.Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peers := make([]api.Peer, 0, len(s.peerMap))
+	for addr, peer := range s.peerMap {
+		peers = append(peers, api.Peer{
+			ID:         peer.id,
+			NodeID:     peer.NodeID(),
+			Addr:       addr.String(),
+			ListenAddr: peer.listenAddr,
+			Outgoing:   peer.Outgoing(),
+			Score:      peer.score,
+			RTT:        peer.rtt,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Addr < peers[j].Addr
+	})
+
+	return peers
+}
+
+// Bans returns the peers that are currently banned.
+func (s *Server) Bans() []api.Ban {
+	entries := s.banList.Entries()
+	bans := make([]api.Ban, len(entries))
+	for i, entry := range entries {
+		bans[i] = api.Ban{
+			Peer:   entry.Peer,
+			Until:  entry.Until.Unix(),
+			Reason: entry.Reason,
+		}
+	}
+	return bans
+}
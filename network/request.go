@@ -0,0 +1,163 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// requestTimeout is how long Request waits for an answer.
+var requestTimeout = 10 * time.Second
+
+var (
+	ErrRequestTimeout   = errors.New("request timed out")
+	ErrPeerDisconnected = errors.New("peer disconnected")
+)
+
+type requestResult struct {
+	msg *DecodeMessage
+	err error
+}
+
+type pendingRequest struct {
+	peer   net.Addr
+	result chan requestResult
+}
+
+// requestTable keeps track of the requests we wait an answer for. An
+// answer is matched by the ID of the request and has to come from the
+// peer the request was sent to.
+type requestTable struct {
+	// clock is the clock of the server, a failed request holds work on
+	// it until the waiter takes it over.
+	clock   Clock
+	lock    sync.Mutex
+	lastID  uint64
+	pending map[uint64]*pendingRequest
+}
+
+func newRequestTable(clock Clock) *requestTable {
+	return &requestTable{
+		clock:   clock,
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+func (rt *requestTable) add(peer net.Addr) (uint64, <-chan requestResult) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.lastID++
+	req := &pendingRequest{
+		peer:   peer,
+		result: make(chan requestResult, 1),
+	}
+	rt.pending[rt.lastID] = req
+
+	return rt.lastID, req.result
+}
+
+func (rt *requestTable) remove(id uint64) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	delete(rt.pending, id)
+}
+
+// deliver hands msg to the request it answers. It returns false if nobody
+// waits for msg, e.g. because the request already timed out.
+func (rt *requestTable) deliver(msg *DecodeMessage) bool {
+	if msg.ReplyTo == 0 {
+		return false
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	req, ok := rt.pending[msg.ReplyTo]
+	if !ok || req.peer.String() != msg.From.String() {
+		return false
+	}
+	delete(rt.pending, msg.ReplyTo)
+	req.result <- requestResult{msg: msg}
+
+	return true
+}
+
+// failPeer fails all requests to the peer at addr.
+func (rt *requestTable) failPeer(addr net.Addr) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for id, req := range rt.pending {
+		if req.peer.String() == addr.String() {
+			delete(rt.pending, id)
+			holdWork(rt.clock)
+			req.result <- requestResult{err: fmt.Errorf("%w: %s", ErrPeerDisconnected, addr)}
+		}
+	}
+}
+
+// request sends msg to the peer at addr and waits until it answers, the
+// timeout passes, ctx is done or the server stops. The caller has to hold
+// work, request gives it back while it waits.
+func (s *Server) request(ctx context.Context, addr net.Addr, msg *Message, timeout time.Duration) (*DecodeMessage, error) {
+	id, result := s.requests.add(addr)
+
+	req := *msg
+	req.ID = id
+	if err := s.sendToPeer(addr, req.Bytes()); err != nil {
+		s.requests.remove(id)
+		return nil, err
+	}
+
+	wake, done := wakeAfter(s.Clock, timeout)
+	releaseWork(s.Clock)
+	select {
+	case res := <-result:
+		// the answer, or the failure of the peer, hands us its work.
+		done()
+		return res.msg, res.err
+	case <-wake:
+		s.cancelRequest(id, result)
+		return nil, fmt.Errorf("%w: %x to %s", ErrRequestTimeout, msg.Header, addr)
+	case <-ctx.Done():
+		holdWork(s.Clock)
+		done()
+		s.cancelRequest(id, result)
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		holdWork(s.Clock)
+		done()
+		s.cancelRequest(id, result)
+		return nil, s.ctx.Err()
+	}
+}
+
+// cancelRequest stops waiting for the request. An answer that arrived in
+// the meantime is dropped.
+func (s *Server) cancelRequest(id uint64, result <-chan requestResult) {
+	s.requests.remove(id)
+	select {
+	case res := <-result:
+		if res.msg != nil {
+			s.skip(res.msg)
+		} else {
+			releaseWork(s.Clock)
+		}
+	default:
+	}
+}
+
+// Request sends msg to the peer and waits for its answer.
+func (p *peerState) Request(ctx context.Context, msg *Message) (*DecodeMessage, error) {
+	return p.s.request(ctx, p.Addr(), msg, requestTimeout)
+}
+
+// unexpectedReply is the error for an answer of the wrong type.
+func unexpectedReply(from net.Addr, req MessageType, reply any) error {
+	return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s answered request %x with %T", from, req, reply))
+}
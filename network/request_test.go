@@ -0,0 +1,81 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestTable(t *testing.T) {
+	rt := newRequestTable(realClock{})
+
+	id, result := rt.add(NetAddr("A"))
+	other, otherResult := rt.add(NetAddr("B"))
+	assert.NotEqual(t, id, other)
+
+	// messages that answer nothing or come from the wrong peer are not
+	// replies.
+	assert.False(t, rt.deliver(&DecodeMessage{From: NetAddr("A")}))
+	assert.False(t, rt.deliver(&DecodeMessage{From: NetAddr("B"), ReplyTo: id}))
+
+	reply := &DecodeMessage{From: NetAddr("A"), ReplyTo: id}
+	assert.True(t, rt.deliver(reply))
+	assert.Equal(t, reply, (<-result).msg)
+	// a request is answered only once.
+	assert.False(t, rt.deliver(reply))
+
+	rt.failPeer(NetAddr("B"))
+	assert.True(t, errors.Is((<-otherResult).err, ErrPeerDisconnected))
+	assert.Empty(t, rt.pending)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+	defer s.Stop()
+
+	// the remote never answers.
+	remote := NewLocalTransport("REMOTE")
+	assert.Nil(t, tr.Connect(remote))
+	s.drainPeerEvents()
+
+	_, err = s.request(context.Background(), remote.Addr(), NewMessage(MessageTypeGetStatus, nil), 20*time.Millisecond)
+	assert.True(t, errors.Is(err, ErrRequestTimeout))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.request(ctx, remote.Addr(), NewMessage(MessageTypeGetStatus, nil), time.Minute)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestPeerRequest(t *testing.T) {
+	remote := startTestServer(t, ServerOpts{})
+	s := startTestServer(t, ServerOpts{SeedNodes: []string{remote.ListenAddr}})
+
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	s.mu.RLock()
+	var peer *peerState
+	for _, p := range s.peerMap {
+		peer = p
+	}
+	s.mu.RUnlock()
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, core.WriteBinary(buf, &GetStatusMessage{}))
+	resp, err := peer.Request(context.Background(), NewMessage(MessageTypeGetStatus, buf.Bytes()))
+	assert.Nil(t, err)
+
+	status, ok := resp.Data.(*StatusMessage)
+	assert.True(t, ok)
+	assert.Equal(t, remote.ID, status.ID)
+}
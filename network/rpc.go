@@ -1,13 +1,11 @@
 package network
 
 import (
-	"bytes"
-	"crypto/elliptic"
-	"encoding/gob"
 	"fmt"
 	"io"
 	"net"
 
+	"github.com/LeiZhou-97/blockchain/consensus"
 	"github.com/LeiZhou-97/blockchain/core"
 	"github.com/sirupsen/logrus"
 )
@@ -21,6 +19,22 @@ const (
 	MessageTypeStatus MessageType = 0x4
 	MessageTypeGetStatus MessageType = 0x5
 	MessageTypeBlocks MessageType = 0x6
+	MessageTypeGetPeers MessageType = 0x7
+	MessageTypePeers MessageType = 0x8
+	MessageTypeGetHeaders MessageType = 0x9
+	MessageTypeHeaders MessageType = 0xa
+	MessageTypeGetBlocksByHash MessageType = 0xb
+	MessageTypeNotFound MessageType = 0xc
+	MessageTypeInv MessageType = 0xd
+	MessageTypeGetData MessageType = 0xe
+	MessageTypePing MessageType = 0xf
+	MessageTypePong MessageType = 0x10
+	MessageTypeCompactBlock MessageType = 0x11
+	MessageTypeGetBlockTxn MessageType = 0x12
+	MessageTypeBlockTxn MessageType = 0x13
+	MessageTypeProposal MessageType = 0x14
+	MessageTypeVote MessageType = 0x15
+	MessageTypeEvidence MessageType = 0x16
 )
 
 type RPC struct {
@@ -31,6 +45,10 @@ type RPC struct {
 type Message struct {
 	Header MessageType
 	Data []byte
+	// ID identifies a request, it is 0 for messages that expect no answer.
+	ID uint64
+	// ReplyTo is the ID of the request this message answers.
+	ReplyTo uint64
 }
 
 func NewMessage(t MessageType, data []byte) *Message {
@@ -40,22 +58,37 @@ func NewMessage(t MessageType, data []byte) *Message {
 	}
 }
 
+// NewReply returns a message that answers the request with the given ID.
+func NewReply(replyTo uint64, t MessageType, data []byte) *Message {
+	return &Message{
+		Header: t,
+		Data: data,
+		ReplyTo: replyTo,
+	}
+}
+
 func (msg *Message) Bytes() []byte {
-	buf := &bytes.Buffer{}
-	gob.NewEncoder(buf).Encode(msg)
-	return buf.Bytes()
+	b, _ := core.MarshalBinary(msg)
+	return b
 }
 
 type DecodeMessage struct {
 	From net.Addr
 	Data any
+	// ID and ReplyTo are copied from the Message.
+	ID uint64
+	ReplyTo uint64
 }
 
 type RPCDecodeFunc func(RPC) (*DecodeMessage, error)
 
 func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
+	payload, err := io.ReadAll(rpc.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message from %s: %s", rpc.From, err)
+	}
 	msg := Message{}
-	if err := gob.NewDecoder(rpc.Payload).Decode(&msg); err != nil {
+	if err := core.UnmarshalBinary(payload, &msg); err != nil {
 		return nil, fmt.Errorf("failed to decode message from %s: %s", rpc.From, err)
 	}
 
@@ -64,10 +97,21 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 		"type": msg.Header,
 	}).Debug(" incoming msg ")
 
+	dmsg, err := decodeMessageData(rpc, msg)
+	if err != nil {
+		return nil, err
+	}
+	dmsg.ID = msg.ID
+	dmsg.ReplyTo = msg.ReplyTo
+
+	return dmsg, nil
+}
+
+func decodeMessageData(rpc RPC, msg Message) (*DecodeMessage, error) {
 	switch msg.Header {
 		case MessageTypeTx:
 			tx := new(core.Transaction)
-			if err := tx.Decode(core.NewGobTxDecoder(bytes.NewReader(msg.Data))); err != nil {
+			if err := core.UnmarshalBinary(msg.Data, tx); err != nil {
 				return nil, err
 			}
 			return &DecodeMessage{
@@ -76,7 +120,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 			}, nil
 		case MessageTypeBlock:
 			b := new(core.Block)	
-			if err := b.Decode(core.NewGobBlockDecoder(bytes.NewReader(msg.Data))); err != nil {
+			if err := core.UnmarshalBinary(msg.Data, b); err != nil {
 				return nil, err
 			}
 			return &DecodeMessage{
@@ -85,7 +129,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 			}, nil
 		case MessageTypeGetBlocks:
 			getBlocks := new(GetBlocksMessage)
-			if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(getBlocks); err != nil {
+			if err := core.UnmarshalBinary(msg.Data, getBlocks); err != nil {
 				return nil, err
 			}
 			return &DecodeMessage{
@@ -99,7 +143,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 			}, nil
 		case MessageTypeStatus:
 			statusMessage := new(StatusMessage)
-			if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(statusMessage); err != nil {
+			if err := core.UnmarshalBinary(msg.Data, statusMessage); err != nil {
 				return nil, err
 			}
 			return &DecodeMessage{
@@ -108,13 +152,153 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 			}, nil
 		case MessageTypeBlocks:
 			blocks := new(BlocksMessage)
-			if err := gob.NewDecoder(bytes.NewReader(msg.Data)).Decode(blocks); err != nil {
+			if err := core.UnmarshalBinary(msg.Data, blocks); err != nil {
 				return nil, err
 			}
 			return &DecodeMessage{
 				From: rpc.From,
 				Data: blocks,
 			}, nil
+		case MessageTypeGetPeers:
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: &GetPeersMessage{},
+			}, nil
+		case MessageTypePeers:
+			peers := new(PeersMessage)
+			if err := core.UnmarshalBinary(msg.Data, peers); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: peers,
+			}, nil
+		case MessageTypeGetHeaders:
+			getHeaders := new(GetHeadersMessage)
+			if err := core.UnmarshalBinary(msg.Data, getHeaders); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: getHeaders,
+			}, nil
+		case MessageTypeHeaders:
+			headers := new(HeadersMessage)
+			if err := core.UnmarshalBinary(msg.Data, headers); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: headers,
+			}, nil
+		case MessageTypeGetBlocksByHash:
+			getBlocks := new(GetBlocksByHashMessage)
+			if err := core.UnmarshalBinary(msg.Data, getBlocks); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: getBlocks,
+			}, nil
+		case MessageTypeNotFound:
+			notFound := new(NotFoundMessage)
+			if err := core.UnmarshalBinary(msg.Data, notFound); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: notFound,
+			}, nil
+		case MessageTypeInv:
+			inv := new(InvMessage)
+			if err := core.UnmarshalBinary(msg.Data, inv); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: inv,
+			}, nil
+		case MessageTypeGetData:
+			getData := new(GetDataMessage)
+			if err := core.UnmarshalBinary(msg.Data, getData); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: getData,
+			}, nil
+		case MessageTypePing:
+			ping := new(PingMessage)
+			if err := core.UnmarshalBinary(msg.Data, ping); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: ping,
+			}, nil
+		case MessageTypePong:
+			pong := new(PongMessage)
+			if err := core.UnmarshalBinary(msg.Data, pong); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: pong,
+			}, nil
+		case MessageTypeCompactBlock:
+			compact := new(CompactBlockMessage)
+			if err := core.UnmarshalBinary(msg.Data, compact); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: compact,
+			}, nil
+		case MessageTypeGetBlockTxn:
+			getTxn := new(GetBlockTxnMessage)
+			if err := core.UnmarshalBinary(msg.Data, getTxn); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: getTxn,
+			}, nil
+		case MessageTypeBlockTxn:
+			txn := new(BlockTxnMessage)
+			if err := core.UnmarshalBinary(msg.Data, txn); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: txn,
+			}, nil
+		case MessageTypeProposal:
+			proposal := new(consensus.Proposal)
+			if err := core.UnmarshalBinary(msg.Data, proposal); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: proposal,
+			}, nil
+		case MessageTypeVote:
+			vote := new(core.Vote)
+			if err := core.UnmarshalBinary(msg.Data, vote); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: vote,
+			}, nil
+		case MessageTypeEvidence:
+			ev := new(core.Evidence)
+			if err := core.UnmarshalBinary(msg.Data, ev); err != nil {
+				return nil, err
+			}
+			return &DecodeMessage{
+				From: rpc.From,
+				Data: ev,
+			}, nil
 		default:
 			return nil, fmt.Errorf("invalid message header %x", msg.Header)
 	}
@@ -124,7 +308,3 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodeMessage, error) {
 type RPCProcessor interface {
 	ProcessMessage(*DecodeMessage) error
 }
-
-func init() {
-	gob.Register(elliptic.P256())
-}
@@ -2,52 +2,154 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/LeiZhou-97/blockchain/api"
+	"github.com/LeiZhou-97/blockchain/consensus"
 	"github.com/LeiZhou-97/blockchain/core"
 	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/types"
 	"github.com/go-kit/log"
 )
 
-var defaultBlockTime = 5 * time.Second
+var (
+	defaultBlockTime           = 5 * time.Second
+	defaultDiscoveryInterval   = 10 * time.Second
+	defaultTargetOutboundPeers = 8
+	dialTimeout                = 5 * time.Second
+	// shutdownTimeout is how long Stop waits for the api requests in
+	// progress.
+	shutdownTimeout = 5 * time.Second
+	// maxBlocksMessageSize caps the encoded size of the blocks in a single
+	// BlocksMessage. A block that is bigger on its own is sent alone.
+	maxBlocksMessageSize = 4 << 20
+)
+
+const (
+	// maxAddrsPerMessage is the maximum number of addresses a PeersMessage
+	// may carry.
+	maxAddrsPerMessage = 1000
+	// maxBlocksPerRange is the maximum number of blocks we serve for a
+	// single GetBlocksMessage. Peers have to ask again for the rest.
+	maxBlocksPerRange = 1000
+	// statusAttempts is how often we ask a new peer for its status before
+	// we give up.
+	statusAttempts = 3
+)
 
 type ServerOpts struct {
-	APIListenAddr    string
+	APIListenAddr string
 	SeedNodes     []string
 	ListenAddr    string
-	TCPTransport  *TCPTransport
+	// Transport connects the node to its peers. It defaults to a
+	// TCPTransport listening on ListenAddr.
+	Transport     Transport
 	ID            string
 	Logger        log.Logger
 	RPCDecodeFunc RPCDecodeFunc
 	RPCProcessor  RPCProcessor
 	BlockTIme     time.Duration
 	PrivateKey    *crypto.PrivateKey
+	// Genesis is the first block of the chain and its consensus rules. If
+	// it sets a block time, BlockTIme is ignored.
+	Genesis *core.Genesis
+	// DataDir is where the node keeps its state on disk. If it is empty
+	// nothing is persisted.
+	DataDir string
+	// TargetOutboundPeers is the number of outgoing connections the node
+	// tries to maintain by dialing addresses from its address book.
+	TargetOutboundPeers int
+	// DiscoveryInterval is how often the node checks its outbound peer
+	// count and asks peers for new addresses.
+	DiscoveryInterval time.Duration
+	// BanDuration is how long a misbehaving peer stays banned.
+	BanDuration time.Duration
+	// Clock drives block production and all timeouts. It defaults to the
+	// wall clock.
+	Clock Clock
+	// NodeKey identifies the node to its peers. If it is nil the key is
+	// loaded from DataDir or created.
+	NodeKey *crypto.PrivateKey
+	// FullBlockRelay announces new blocks with an inv and sends them in
+	// full to the peers that ask, instead of pushing compact blocks.
+	FullBlockRelay bool
+	// Checkpoints pin blocks on top of the checkpoints of the genesis,
+	// e.g. the one a node we trust reports at /checkpoint. Sync starts
+	// from the highest of them.
+	Checkpoints []core.Checkpoint
+	// SignedCheckpoints are pinned like Checkpoints once their commits
+	// check out. The chain starts at the genesis, so only the validators
+	// of the first epoch are known to check them.
+	SignedCheckpoints []*core.SignedCheckpoint
 }
 
 type Server struct {
 	ServerOpts
-	TCPTransport *TCPTransport
-	mu           sync.RWMutex
-	peerCh       chan *TCPPeer
-	peerMap      map[net.Addr]*TCPPeer
-	mempool      *TxPool
-	chain        *core.BlockChain
-	isValidator  bool
-	rpcCh        chan RPC
-	quitCh       chan struct{}
+	mu      sync.RWMutex
+	peerMap map[net.Addr]*peerState
+	// scores holds the scores of disconnected peers by node ID.
+	scores map[string]int
+	// dialing holds the addresses we are currently dialing.
+	dialing map[string]struct{}
+	// branches holds the parents of the branches we are fetching, and
+	// branchPeers the peers we fetch them from. A peer gets one at a time.
+	branches    map[types.Hash]struct{}
+	branchPeers map[net.Addr]struct{}
+	addrBook    *AddrBook
+	banList     *BanList
+	selfAddr    string
+	mempool     *TxPool
+	evidence    *evidencePool
+	chain       *core.BlockChain
+	isValidator bool
+	syncer      *syncManager
+	relay       *invRelay
+	inbound     *inbox
+	apiServer   *api.Server
+	requests    *requestTable
+	engine      consensus.Engine
+	// bft runs the rounds of the BFT engine, it is nil for the other
+	// engines.
+	bft *consensus.BFTState
+	// consensusFilter may replace or, by returning nil, drop the BFT
+	// messages we send to a peer. Tests use it to make a validator
+	// byzantine.
+	consensusFilter func(to net.Addr, msg core.BinaryCodec) core.BinaryCodec
+	// onSkip is called for every message that does not reach the
+	// RPCProcessor, because it was dropped or answered a request.
+	onSkip func(*DecodeMessage)
+
+	// ctx is cancelled by Stop, wg tracks the goroutines that run until
+	// then.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	stopErr  error
 }
 
 func NewServer(opts ServerOpts) (*Server, error) {
 	if opts.BlockTIme == time.Duration(0) {
 		opts.BlockTIme = defaultBlockTime
 	}
+	if opts.DiscoveryInterval == time.Duration(0) {
+		opts.DiscoveryInterval = defaultDiscoveryInterval
+	}
+	if opts.TargetOutboundPeers == 0 {
+		opts.TargetOutboundPeers = defaultTargetOutboundPeers
+	}
+	if opts.BanDuration == time.Duration(0) {
+		opts.BanDuration = defaultBanDuration
+	}
 	if opts.RPCDecodeFunc == nil {
 		opts.RPCDecodeFunc = DefaultRPCDecodeFunc
 	}
@@ -55,41 +157,126 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		opts.Logger = log.NewLogfmtLogger(os.Stderr)
 		opts.Logger = log.With(opts.Logger, "addr", opts.ID)
 	}
+	if opts.Clock == nil {
+		opts.Clock = realClock{}
+	}
+	if opts.Genesis == nil {
+		opts.Genesis = &core.Genesis{}
+	}
+	if opts.Genesis.BlockTime > 0 {
+		opts.BlockTIme = opts.Genesis.BlockTime
+	}
+	if opts.Transport == nil {
+		if opts.NodeKey == nil {
+			key, err := loadNodeKey(opts.DataDir)
+			if err != nil {
+				return nil, err
+			}
+			opts.NodeKey = &key
+		}
+		tr, err := NewTCPTransport(opts.ListenAddr, *opts.NodeKey)
+		if err != nil {
+			return nil, err
+		}
+		opts.Transport = tr
+	}
+	if tr, ok := opts.Transport.(*TCPTransport); ok {
+		tr.SetLogger(opts.Logger)
+	}
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = opts.Transport.Addr().String()
+	}
 
-	chain, err := core.NewBlockChain(opts.Logger, genesisBlock())
+	engine, err := consensus.New(opts.Genesis, consensus.Config{
+		Key:       opts.PrivateKey,
+		Now:       opts.Clock.Now,
+		BlockTime: opts.BlockTIme,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if opts.APIListenAddr != "" {
-		apiServercfg := api.ServerConfig{
-			Logger: opts.Logger,
-			ListenAddr: opts.APIListenAddr,
+	chain, err := core.NewBlockChain(opts.Logger, opts.Genesis.Block())
+	if err != nil {
+		return nil, err
+	}
+	chain.SetValidators(opts.Genesis.ValidatorSet(), opts.Genesis.EpochLength)
+	chain.SetClock(opts.Clock.Now)
+	chain.SetConsensus(engine)
+	if err := chain.AddCheckpoints(opts.Genesis.Checkpoints...); err != nil {
+		return nil, err
+	}
+	if err := chain.AddCheckpoints(opts.Checkpoints...); err != nil {
+		return nil, err
+	}
+	for _, cp := range opts.SignedCheckpoints {
+		if err := chain.AddSignedCheckpoint(cp); err != nil {
+			return nil, err
 		}
+	}
 
-		apiServer := api.NewServer(apiServercfg, chain)
-
-		go apiServer.Start()
-
-		opts.Logger.Log("msg", "json api server running", "port", opts.APIListenAddr)
+	addrBookPath, banListPath := "", ""
+	if opts.DataDir != "" {
+		addrBookPath = filepath.Join(opts.DataDir, "addrbook.json")
+		banListPath = filepath.Join(opts.DataDir, "banlist.json")
+	}
+	addrBook, err := NewAddrBook(addrBookPath)
+	if err != nil {
+		return nil, err
+	}
+	banList, err := NewBanList(banListPath, opts.Clock)
+	if err != nil {
+		return nil, err
 	}
 
-	peerCh := make(chan *TCPPeer)
-	tr := NewTCPTransport(opts.ListenAddr, peerCh)
+	// transports that are not addressed by host and port, like the
+	// LocalTransport, use their address as is.
+	selfAddr, err := normalizeAddr(opts.ListenAddr, "127.0.0.1")
+	if err != nil {
+		selfAddr = opts.ListenAddr
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
-		ServerOpts:   opts,
-		TCPTransport: tr,
-		peerCh:       peerCh,
-		peerMap:      make(map[net.Addr]*TCPPeer),
-		mempool:      NewTxPool(1000),
-		chain:        chain,
-		isValidator:  opts.PrivateKey != nil,
-		rpcCh:        make(chan RPC),
-		quitCh:       make(chan struct{}, 1),
+		ServerOpts:  opts,
+		peerMap:     make(map[net.Addr]*peerState),
+		scores:      make(map[string]int),
+		dialing:     make(map[string]struct{}),
+		branches:    make(map[types.Hash]struct{}),
+		branchPeers: make(map[net.Addr]struct{}),
+		addrBook:    addrBook,
+		banList:     banList,
+		selfAddr:    selfAddr,
+		mempool:     NewTxPool(1000, chain),
+		evidence:    newEvidencePool(),
+		chain:       chain,
+		isValidator: opts.PrivateKey != nil,
+		engine:      engine,
+		inbound:     newInbox(maxInboundQueue),
+		requests:    newRequestTable(opts.Clock),
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 
-	s.TCPTransport.peerCh = peerCh
+	s.syncer = newSyncManager(s)
+	s.relay = newInvRelay(opts.Clock)
+
+	if opts.DataDir != "" {
+		n, err := s.mempool.Load(filepath.Join(opts.DataDir, "mempool.dat"))
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			opts.Logger.Log("msg", "restored mempool", "transactions", n)
+		}
+		n, err = s.evidence.Load(filepath.Join(opts.DataDir, "evidence.dat"))
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			opts.Logger.Log("msg", "restored evidence", "evidence", n)
+		}
+	}
 
 	// if we do not get any processor form the server opts, we going to
 	// use the server as default
@@ -97,147 +284,649 @@ func NewServer(opts ServerOpts) (*Server, error) {
 		s.RPCProcessor = s
 	}
 
-	if s.isValidator {
-		go s.validatorLoop()
+	if opts.APIListenAddr != "" {
+		apiServercfg := api.ServerConfig{
+			Logger:     opts.Logger,
+			ListenAddr: opts.APIListenAddr,
+			Peers:      s,
+			Sync:       s,
+		}
+
+		s.apiServer = api.NewServer(apiServercfg, chain)
+
+		s.spawn(func() {
+			if err := s.apiServer.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				opts.Logger.Log("msg", "json api server failed", "err", err)
+			}
+		})
+
+		opts.Logger.Log("msg", "json api server running", "port", opts.APIListenAddr)
+	}
+
+	if bft, ok := engine.(*consensus.BFT); ok {
+		s.bft = consensus.NewBFTState(bft, chain, bftDriver{s}, opts.Logger)
+	} else if s.isValidator {
+		s.spawnLoop(s.validatorLoop)
 	}
 
 	return s, nil
 }
 
 func (s *Server) bootstrapNetwork() {
-	for _, addr := range s.SeedNodes {
-		fmt.Println("trying to connect to: ", addr)
-		go func(addr string) {
-			conn, err := net.Dial("tcp", addr)
+	for _, seed := range s.SeedNodes {
+		addr, err := normalizeAddr(seed, "127.0.0.1")
+		if err != nil {
+			s.Logger.Log("msg", "invalid seed node", "addr", seed, "err", err)
+			continue
+		}
+		s.addrBook.Add(addr, "seed")
 
-			if err != nil {
-				fmt.Printf("could not connect to %+v\n", conn)
-				return
-			}
+		s.Logger.Log("msg", "dialing seed node", "addr", addr)
+		s.dial(addr)
+	}
+}
 
-			s.peerCh <- &TCPPeer{
-				conn: conn,
-			}
-		}(addr)
+// dial connects to addr in the background. The transport hands the new
+// peer to the server loop.
+func (s *Server) dial(addr string) {
+	s.mu.Lock()
+	if _, ok := s.dialing[addr]; ok {
+		s.mu.Unlock()
+		return
+	}
+	s.dialing[addr] = struct{}{}
+	s.mu.Unlock()
+
+	s.spawnWork(func() {
+		s.addrBook.MarkAttempt(addr)
+
+		err := s.Transport.Dial(addr)
+		if s.ctx.Err() != nil {
+			// we are stopping, the dial failed or is about to be closed
+			// for a reason that is none of the peer's fault.
+			return
+		}
+		if err != nil {
+			s.addrBook.MarkFailure(addr)
+			s.mu.Lock()
+			delete(s.dialing, addr)
+			s.mu.Unlock()
+			s.Logger.Log("msg", "could not connect to peer", "addr", addr, "err", err)
+			return
+		}
+		s.addrBook.MarkSuccess(addr)
+	})
+}
+
+// spawn runs fn in a goroutine that Stop waits for. fn is not run at all
+// once the server is stopping.
+func (s *Server) spawn(fn func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if s.ctx.Err() != nil {
+			return
+		}
+		fn()
+	}()
+}
 
+// spawnWork is spawn for work the simulator has to wait for, like asking
+// a peer or relaying a block, as opposed to the loops of the server.
+func (s *Server) spawnWork(fn func()) {
+	holdWork(s.Clock)
+	s.spawn(func() {
+		defer releaseWork(s.Clock)
+		fn()
+	})
+}
+
+// spawnLoop is spawn for a loop that wakes up on timers. fn calls started
+// once it set its first timer and spawnLoop waits for that, so the loops
+// of a server always set their timers in the same order. The simulator
+// replays a scenario only if they do.
+func (s *Server) spawnLoop(fn func(started func())) {
+	started := make(chan struct{})
+	s.spawn(func() {
+		fn(func() { close(started) })
+	})
+	select {
+	case <-started:
+	case <-s.ctx.Done():
 	}
 }
 
+// Start runs the server until Stop is called.
 func (s *Server) Start() {
-	s.TCPTransport.Start()
+	if s.ctx.Err() != nil {
+		return
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
 
-	s.Logger.Log("msg", "accepting TCP connection on", "addr", s.ListenAddr, "id", s.ID)
+	if err := s.Transport.Start(); err != nil {
+		s.Logger.Log("msg", "could not start transport", "err", err)
+		return
+	}
+
+	s.Logger.Log("msg", "accepting connections on", "addr", s.Transport.Addr(), "id", s.ID)
 	s.bootstrapNetwork()
 
-free:
+	s.spawnLoop(s.discoveryLoop)
+	s.spawnLoop(s.keepaliveLoop)
+	s.spawnLoop(func(started func()) { s.getDataLoop(s.relay.timeout, started) })
+	s.spawnLoop(s.syncer.loop)
+	s.spawn(s.processLoop)
+	if s.bft != nil {
+		s.bft.Start()
+	}
+
+	// the simulator counts starting the server as work, it is done once
+	// we wait for peers and messages.
+	releaseWork(s.Clock)
 	for {
 		select {
-		case peer := <-s.peerCh:
-			s.peerMap[peer.conn.RemoteAddr()] = peer
-			go peer.readLoop(s.rpcCh)
-
-			if err := s.sendGetStatusMessage(peer); err != nil {
-				s.Logger.Log("err:", err)
-				continue
-			}
-
-			s.Logger.Log("msg", "peer added to the server", "Outgoing", peer.Outgoing, "addr", peer.conn.RemoteAddr())
+		case ev := <-s.Transport.Events():
+			s.handlePeerEvent(ev)
 		// consumer
-		case rpc := <-s.rpcCh:
+		case rpc := <-s.Transport.Consume():
+			// a peer is announced before its first message, make sure we
+			// know about it before handling the message.
+			s.drainPeerEvents()
+			s.touch(rpc.From)
+
 			msg, err := s.RPCDecodeFunc(rpc)
 			if err != nil {
 				s.Logger.Log("error", err)
+				s.misbehave(rpc.From, penaltyDecodeFailure, err)
 				continue
 			}
-			if err := s.RPCProcessor.ProcessMessage(msg); err != nil {
-				if err != core.ErrBlockKnown {
-					s.Logger.Log("error", err)
-				}
-			}
-		case <-s.quitCh:
-			break free
+			// processing happens in processLoop, so a slow message never
+			// keeps us from reading the next one.
+			s.enqueue(msg)
+		case <-s.ctx.Done():
+			return
 		}
 	}
+}
+
+// Stop stops block production, disconnects all peers and waits for the
+// server to finish what it is doing. What the node keeps on disk is saved
+// before Stop returns.
+func (s *Server) Stop() error {
+	s.stopOnce.Do(func() {
+		s.stopErr = s.stop()
+	})
+	return s.stopErr
+}
+
+func (s *Server) stop() error {
+	s.Logger.Log("msg", "stopping server")
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	keep(s.halt())
+	if s.DataDir != "" {
+		keep(s.mempool.Save(filepath.Join(s.DataDir, "mempool.dat")))
+		keep(s.evidence.Save(filepath.Join(s.DataDir, "evidence.dat")))
+	}
+	keep(s.addrBook.Save())
+	keep(s.chain.Close())
 
 	s.Logger.Log("msg", "Server shutdown")
+	return firstErr
 }
 
-func (s *Server) validatorLoop() {
-	s.Logger.Log("msg", "Starting validatorLoop")
-	ticker := time.NewTicker(s.BlockTIme)
+// halt stops the goroutines of the server and disconnects all peers, but
+// saves nothing. The simulator halts the nodes it crashes.
+func (s *Server) halt() error {
+	s.cancel()
 
+	var firstErr error
+	if s.apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		firstErr = s.apiServer.Shutdown(ctx)
+		cancel()
+	}
+	if err := s.Transport.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	s.wg.Wait()
+	return firstErr
+}
+
+func (s *Server) handleMessage(msg *DecodeMessage) {
+	s.handleError(msg.From, s.RPCProcessor.ProcessMessage(msg))
+}
+
+// handleError logs err and punishes the peer at from if err is its fault.
+func (s *Server) handleError(from net.Addr, err error) {
+	if err == nil {
+		return
+	}
+	if !errors.Is(err, core.ErrBlockKnown) {
+		s.Logger.Log("error", err)
+	}
+	var merr *MisbehaviorError
+	if errors.As(err, &merr) {
+		s.misbehave(from, merr.Penalty, merr.Err)
+	}
+}
+
+func (s *Server) handlePeerEvent(ev PeerEvent) {
+	// the simulator counts every event as work until it is handled.
+	defer releaseWork(s.Clock)
+
+	if ev.Connected {
+		s.addPeer(ev.Peer)
+	} else {
+		s.removePeer(ev.Peer)
+	}
+}
+
+func (s *Server) drainPeerEvents() {
 	for {
-		<-ticker.C
-		if err := s.createNewBlock(); err != nil {
+		select {
+		case ev := <-s.Transport.Events():
+			s.handlePeerEvent(ev)
+		default:
+			return
+		}
+	}
+}
+
+func (s *Server) addPeer(peer Peer) {
+	if peer.Outgoing() {
+		// the dial is over, whether we keep the peer or not.
+		defer func() {
+			s.mu.Lock()
+			delete(s.dialing, peer.DialAddr())
+			s.mu.Unlock()
+		}()
+	}
+
+	if peer.NodeID() == s.Transport.NodeID() {
+		// we connected to ourselves, make sure we never dial that
+		// address again.
+		s.addrBook.Remove(peer.DialAddr())
+		peer.Close()
+		return
+	}
+
+	ps := newPeerState(peer)
+	ps.s = s
+	if s.banList.IsBanned(ps.banKey()) {
+		s.Logger.Log("msg", "disconnecting banned peer", "nodeID", ps.banKey())
+		peer.Close()
+		return
+	}
+
+	ps.lastSeen = s.Clock.Now()
+
+	s.mu.Lock()
+	s.restoreScore(ps)
+	s.peerMap[peer.Addr()] = ps
+	s.mu.Unlock()
+
+	s.relay.addPeer(peer.Addr())
+
+	// the answer arrives through the server loop, so we must not wait for
+	// it here.
+	s.spawnWork(func() { s.requestStatus(ps) })
+
+	s.Logger.Log("msg", "peer added to the server", "Outgoing", peer.Outgoing(), "addr", peer.Addr())
+}
+
+func (s *Server) removePeer(peer Peer) {
+	s.mu.Lock()
+	if ps, ok := s.peerMap[peer.Addr()]; ok {
+		s.rememberScore(ps)
+		delete(s.peerMap, peer.Addr())
+	}
+	s.mu.Unlock()
+
+	s.syncer.removePeer(peer.Addr())
+	s.relay.removePeer(peer.Addr())
+	s.requests.failPeer(peer.Addr())
+	for _, msg := range s.inbound.remove(peer.Addr()) {
+		s.dropMessage(msg, "peer disconnected")
+	}
+
+	peer.Close()
+
+	s.Logger.Log("msg", "peer removed from the server", "addr", peer.Addr())
+}
+
+// discoveryLoop keeps the number of outbound peers at TargetOutboundPeers.
+// As long as we are below the target we keep asking peers for addresses.
+func (s *Server) discoveryLoop(started func()) {
+	// done marks the work of the last wake-up as finished. At first it
+	// tells spawnLoop that our first timer is set.
+	done := started
+	for {
+		wake, next := wakeAfter(s.Clock, s.DiscoveryInterval)
+		done()
+		select {
+		case <-wake:
+			done = next
+		case <-s.ctx.Done():
+			return
+		}
+		if missing := s.ensureOutboundPeers(); missing > 0 {
+			if err := s.requestPeers(); err != nil {
+				s.Logger.Log("err", err)
+			}
+		}
+		if err := s.addrBook.Save(); err != nil {
+			s.Logger.Log("msg", "could not save address book", "err", err)
+		}
+	}
+}
+
+// ensureOutboundPeers dials addresses from the address book until the
+// outbound target is reached. It returns how many outbound peers were
+// missing.
+func (s *Server) ensureOutboundPeers() int {
+	connected := make(map[string]bool)
+
+	s.mu.RLock()
+	outbound := len(s.dialing)
+	for addr := range s.dialing {
+		connected[addr] = true
+	}
+	for _, peer := range s.peerMap {
+		if peer.Outgoing() {
+			outbound++
+		}
+		if peer.listenAddr != "" {
+			connected[peer.listenAddr] = true
+		}
+	}
+	s.mu.RUnlock()
+
+	missing := s.TargetOutboundPeers - outbound
+	if missing <= 0 {
+		return 0
+	}
+
+	candidates := s.addrBook.Candidates(missing, func(addr string) bool {
+		return connected[addr] || addr == s.selfAddr
+	})
+	for _, addr := range candidates {
+		s.dial(addr)
+	}
+
+	return missing
+}
+
+// requestPeers asks a random connected peer for the addresses it knows.
+func (s *Server) requestPeers() error {
+	s.mu.RLock()
+	peers := make([]*peerState, 0, len(s.peerMap))
+	for _, peer := range s.peerMap {
+		peers = append(peers, peer)
+	}
+	s.mu.RUnlock()
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	return s.sendGetPeersMessage(peers[rand.Intn(len(peers))].Peer)
+}
+
+// validatorLoop seals a block whenever the engine lets us. It wakes up at
+// least once per block time, so a block that arrives in the meantime moves
+// our next turn.
+func (s *Server) validatorLoop(started func()) {
+	s.Logger.Log("msg", "Starting validatorLoop", "address", s.PrivateKey.PublicKey().Address())
+	// done marks the work of the last wake-up as finished. At first it
+	// tells spawnLoop that our first timer is set.
+	done := started
+	// give our peers a block time to tell us how far the chain is before
+	// we build on it.
+	wait := s.BlockTIme
+
+	for {
+		wake, next := wakeAfter(s.Clock, wait)
+		done()
+		select {
+		case <-wake:
+			done = next
+		case <-s.ctx.Done():
+			return
+		}
+
+		tip, err := s.chain.GetHeader(s.chain.Height())
+		if err != nil {
+			s.Logger.Log("err", err)
+			return
+		}
+
+		now := s.Clock.Now()
+		at, ok := s.engine.NextSeal(s.chain, tip, now)
+		if !ok {
+			s.Logger.Log("msg", "the consensus engine does not let us seal blocks, stopping validatorLoop")
+			done()
+			return
+		}
+		if wait = at.Sub(now); wait > 0 {
+			if wait > s.BlockTIme {
+				wait = s.BlockTIme
+			}
+			continue
+		}
+
+		block, err := s.sealBlock()
+		if err != nil {
 			s.Logger.Log("err", err)
 		}
+		if block != nil {
+			// there is nothing else to do before our next turn.
+			s.broadcastBlock(block)
+			wait = 0
+			continue
+		}
+		// no block was added, e.g. because we are still syncing. Try
+		// again a little later.
+		wait = s.BlockTIme / 4
 	}
 }
 
 func (s *Server) ProcessMessage(dmsg *DecodeMessage) error {
 	switch t := dmsg.Data.(type) {
 	case *core.Transaction:
-		return s.processTransaction(t)
+		return s.processTransaction(dmsg.From, t)
 	case *core.Block:
-		return s.processBlock(t)
+		return s.processBlock(dmsg.From, t)
 	case *GetStatusMessage:
-		return s.processGetStatusMessage(dmsg.From, t)
+		return s.processGetStatusMessage(dmsg.From, dmsg.ID, t)
 	case *StatusMessage:
 		return s.processStatusMessage(dmsg.From, t)
 	case *GetBlocksMessage:
-		return s.processGetBlocksMessage(dmsg.From, t)
+		return s.processGetBlocksMessage(dmsg.From, dmsg.ID, t)
 	case *BlocksMessage:
 		return s.processBlocksMessage(dmsg.From, t)
+	case *GetPeersMessage:
+		return s.processGetPeersMessage(dmsg.From, dmsg.ID, t)
+	case *PeersMessage:
+		return s.processPeersMessage(dmsg.From, t)
+	case *GetHeadersMessage:
+		return s.processGetHeadersMessage(dmsg.From, dmsg.ID, t)
+	case *HeadersMessage:
+		return s.processHeadersMessage(dmsg.From, t)
+	case *GetBlocksByHashMessage:
+		return s.processGetBlocksByHashMessage(dmsg.From, dmsg.ID, t)
+	case *NotFoundMessage:
+		return s.processNotFoundMessage(dmsg.From, t)
+	case *InvMessage:
+		return s.processInvMessage(dmsg.From, t)
+	case *GetDataMessage:
+		return s.processGetDataMessage(dmsg.From, t)
+	case *PingMessage:
+		return s.processPingMessage(dmsg.From, t)
+	case *PongMessage:
+		return s.processPongMessage(dmsg.From, t)
+	case *CompactBlockMessage:
+		return s.processCompactBlockMessage(dmsg.From, t)
+	case *GetBlockTxnMessage:
+		return s.processGetBlockTxnMessage(dmsg.From, dmsg.ID, t)
+	case *BlockTxnMessage:
+		return s.processBlockTxnMessage(dmsg.From, t)
+	case *consensus.Proposal:
+		return s.processProposal(dmsg.From, t)
+	case *core.Vote:
+		return s.processVote(dmsg.From, t)
+	case *core.Evidence:
+		return s.processEvidence(dmsg.From, t)
 	}
 	return nil
 }
 
-func (s *Server) processGetBlocksMessage(from net.Addr, data *GetBlocksMessage) error {
-	fmt.Printf("received getBlocksMessage => %+v\n", data)	
+// processGetBlocksMessage sends the blocks of the range in as many replies
+// as needed, followed by a NotFound for the part above our tip.
+func (s *Server) processGetBlocksMessage(from net.Addr, id uint64, data *GetBlocksMessage) error {
+	if data.To != 0 && data.To < data.From {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s asked for invalid block range (%d - %d)", from, data.From, data.To))
+	}
 
-	blocks := []*core.Block{}
-	
 	ourHeight := s.chain.Height()
-	if data.To == 0 {
-		for i:=int(data.From); i<=int(ourHeight); i++ {
-			blcok, err := s.chain.GetBlock(uint32(i))
-			if err != nil {
+	if data.From > ourHeight {
+		return s.sendNotFoundMessage(from, id, data.From, data.To)
+	}
+
+	to := ourHeight
+	if data.To != 0 && data.To < to {
+		to = data.To
+	}
+	if to-data.From >= maxBlocksPerRange {
+		to = data.From + maxBlocksPerRange - 1
+	}
+
+	// the range is sent in as many BlocksMessages as needed to stay within
+	// maxBlocksPerMessage and maxBlocksMessageSize.
+	var (
+		blocks = []*core.Block{}
+		size   = 0
+	)
+	for height := data.From; height <= to; height++ {
+		block, err := s.chain.GetBlock(height)
+		if err != nil {
+			return err
+		}
+		n, err := encodedBlockSize(block)
+		if err != nil {
+			return err
+		}
+
+		if len(blocks) == maxBlocksPerMessage || (len(blocks) > 0 && size+n > maxBlocksMessageSize) {
+			if err := s.sendBlocksMessage(from, id, blocks); err != nil {
 				return err
 			}
-
-			blocks = append(blocks, blcok)
+			blocks, size = []*core.Block{}, 0
 		}
+		blocks = append(blocks, block)
+		size += n
+	}
+	if err := s.sendBlocksMessage(from, id, blocks); err != nil {
+		return err
+	}
+
+	if data.To > ourHeight {
+		return s.sendNotFoundMessage(from, id, ourHeight+1, data.To)
 	}
+	return nil
+}
 
-	blocksMsg := &BlocksMessage{
-		Blocks: blocks,
+func (s *Server) sendBlocksMessage(to net.Addr, replyTo uint64, blocks []*core.Block) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &BlocksMessage{Blocks: blocks}); err != nil {
+		return err
 	}
+	msg := NewReply(replyTo, MessageTypeBlocks, buf.Bytes())
+
+	return s.sendToPeer(to, msg.Bytes())
+}
+
+func (s *Server) sendNotFoundMessage(to net.Addr, replyTo uint64, from, until uint32) error {
 	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(blocksMsg); err != nil {
+	if err := core.WriteBinary(buf, &NotFoundMessage{From: from, To: until}); err != nil {
 		return err
 	}
+	msg := NewReply(replyTo, MessageTypeNotFound, buf.Bytes())
+
+	return s.sendToPeer(to, msg.Bytes())
+}
+
+func (s *Server) processNotFoundMessage(from net.Addr, data *NotFoundMessage) error {
+	s.Logger.Log("msg", "peer does not have the requested blocks", "from", from, "start", data.From, "end", data.To)
+	return nil
+}
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+func encodedBlockSize(b *core.Block) (int, error) {
+	var c byteCounter
+	if err := b.Encode(core.NewBinaryBlockEncoder(&c)); err != nil {
+		return 0, err
+	}
+	return int(c), nil
+}
+
+// sendToPeer sends payload to the connected peer with the given address.
+func (s *Server) sendToPeer(to net.Addr, payload []byte) error {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	msg := NewMessage(MessageTypeBlocks, buf.Bytes())
-	peer, ok := s.peerMap[from]
+	peer, ok := s.peerMap[to]
+	s.mu.RUnlock()
 	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
+		return fmt.Errorf("peer %s not known", to)
 	}
-	return peer.Send(msg.Bytes())
+	return peer.Send(payload)
 }
 
-func (s *Server) sendGetStatusMessage(peer *TCPPeer) error {
+// requestStatus asks the peer for its status, up to statusAttempts times
+// if the requests time out.
+func (s *Server) requestStatus(peer *peerState) {
 	var (
 		getStatusMsg = new(GetStatusMessage)
 		buf          = new(bytes.Buffer)
 	)
-	if err := gob.NewEncoder(buf).Encode(getStatusMsg); err != nil {
-		return err
+	if err := core.WriteBinary(buf, getStatusMsg); err != nil {
+		s.Logger.Log("err", err)
+		return
 	}
 	msg := NewMessage(MessageTypeGetStatus, buf.Bytes())
 
-	/// ask to sync with peer
-	return peer.Send(msg.Bytes())
+	for attempt := 1; ; attempt++ {
+		/// ask to sync with peer
+		resp, err := peer.Request(s.ctx, msg)
+		if err != nil {
+			if errors.Is(err, ErrRequestTimeout) && attempt < statusAttempts {
+				continue
+			}
+			s.Logger.Log("msg", "could not get peer status", "addr", peer.Addr(), "err", err)
+			return
+		}
+
+		status, ok := resp.Data.(*StatusMessage)
+		if !ok {
+			s.handleError(resp.From, unexpectedReply(resp.From, MessageTypeGetStatus, resp.Data))
+			return
+		}
+		s.handleError(resp.From, s.processStatusMessage(resp.From, status))
+		return
+	}
 }
 
 func (s *Server) broadcast(payload []byte) error {
@@ -245,198 +934,391 @@ func (s *Server) broadcast(payload []byte) error {
 	defer s.mu.RUnlock()
 	for netAddr, peer := range s.peerMap {
 		if err := peer.Send(payload); err != nil {
-			fmt.Printf("peer send err => addr %s [err : %s]", netAddr, err)
+			s.Logger.Log("msg", "could not send message", "addr", netAddr, "err", err)
 		}
 	}
 	return nil
 }
 
 func (s *Server) processBlocksMessage(from net.Addr, data *BlocksMessage) error {
-	s.Logger.Log("msg", "received BLOCKS!!!!!!!!", "from", from)
+	s.Logger.Log("msg", "received blocks", "from", from, "count", len(data.Blocks))
 
 	for _, block := range data.Blocks {
-		fmt.Printf("BlOCK with %+v\n", block.Header)
 		if err := s.chain.AddBlock(block); err != nil {
-			fmt.Errorf("late node err add block: %s\n", err)
-			return err
+			s.Logger.Log("msg", "could not add block", "from", from, "height", block.Height, "err", err)
+			return blockError(err)
 		}
 	}
 
 	return nil
 }
 
+func (s *Server) sendGetPeersMessage(peer Peer) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, new(GetPeersMessage)); err != nil {
+		return err
+	}
+	msg := NewMessage(MessageTypeGetPeers, buf.Bytes())
+
+	return peer.Send(msg.Bytes())
+}
+
+func (s *Server) processGetPeersMessage(from net.Addr, id uint64, data *GetPeersMessage) error {
+	s.mu.RLock()
+	var requester string
+	if peer, ok := s.peerMap[from]; ok {
+		requester = peer.listenAddr
+	}
+	s.mu.RUnlock()
+
+	addrs := []string{}
+	for _, addr := range s.addrBook.Addresses(maxAddrsPerMessage) {
+		if addr != requester {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &PeersMessage{Addrs: addrs}); err != nil {
+		return err
+	}
+	msg := NewReply(id, MessageTypePeers, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
+}
+
+func (s *Server) processPeersMessage(from net.Addr, data *PeersMessage) error {
+	if len(data.Addrs) > maxAddrsPerMessage {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent too many addresses (%d)", from, len(data.Addrs)))
+	}
+
+	added := 0
+	for _, addr := range data.Addrs {
+		if addr == s.selfAddr {
+			continue
+		}
+		if s.addrBook.Add(addr, from.String()) {
+			added++
+		}
+	}
+
+	if added > 0 {
+		s.Logger.Log("msg", "learned new peer addresses", "count", added, "from", from)
+		s.ensureOutboundPeers()
+	}
+
+	return nil
+}
+
 func (s *Server) processStatusMessage(from net.Addr, data *StatusMessage) error {
-	fmt.Printf("=> received status msg from %s => %+v\n", from, data)
+	s.Logger.Log("msg", "received status msg", "from", from, "id", data.ID, "height", data.CurrentHeight)
+
+	s.mu.Lock()
+	peer, ok := s.peerMap[from]
+	if ok {
+		peer.id = data.ID
+		if peer.listenAddr == "" && data.ListenAddr != "" {
+			host, _, _ := net.SplitHostPort(from.String())
+			if addr, err := normalizeAddr(data.ListenAddr, host); err == nil {
+				peer.listenAddr = addr
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s not known", from)
+	}
+
+	if data.ID != "" && data.ID == s.ID {
+		// we connected to ourselves, make sure we never dial that
+		// address again.
+		s.addrBook.Remove(peer.listenAddr)
+		return peer.Close()
+	}
+
+	if peer.listenAddr != "" {
+		s.addrBook.Add(peer.listenAddr, from.String())
+	}
+
+	if err := s.sendGetPeersMessage(peer.Peer); err != nil {
+		return err
+	}
+
 	if data.CurrentHeight <= s.chain.Height() {
 		s.Logger.Log("msg", "cannot sync blockHeight to low", "ourHeight", s.chain.Height(), "theirHeight", data.CurrentHeight, "addr", from)
-		return nil
 	}
 
-	go s.requestBlocksLoop(from)
+	s.syncer.setPeerHeight(from, data.CurrentHeight)
 	return nil
 }
 
-func (s *Server) processGetStatusMessage(from net.Addr, data *GetStatusMessage) error {
+// SyncStatus reports the progress of the chain synchronization.
+func (s *Server) SyncStatus() api.SyncStatus {
+	return s.syncer.Status()
+}
+
+func (s *Server) processGetStatusMessage(from net.Addr, id uint64, data *GetStatusMessage) error {
 	s.Logger.Log("msg", "received get status msg", "from", from)
 
 	statusMessage := &StatusMessage{
 		CurrentHeight: s.chain.Height(),
 		ID:            s.ID,
+		ListenAddr:    s.ListenAddr,
 	}
 	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(statusMessage); err != nil {
+	if err := core.WriteBinary(buf, statusMessage); err != nil {
 		return err
 	}
 
 	// response status msg
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	msg := NewMessage(MessageTypeStatus, buf.Bytes())
-	peer, ok := s.peerMap[from]
-	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
-	}
-	return peer.Send(msg.Bytes())
+	msg := NewReply(id, MessageTypeStatus, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
 }
 
-// TODO: Find a way to make sure we dont keep syncing when we are at the highest
-// block height in the network.
-func (s *Server) requestBlocksLoop(peer net.Addr) error {
-	ticker := time.NewTicker(3 * time.Second)
-	for {
-		ourHeight := s.chain.Height()
-		s.Logger.Log("msg", "requesting new blocks", "requesting height", ourHeight+1)
-		// In this case we are 100% sure that the node has blocks heigher than us.
-		getBlocksMessage := &GetBlocksMessage{
-			From: ourHeight + 1,
-			To:   0,
-		}
-		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(getBlocksMessage); err != nil {
-			return err
-		}
-		s.mu.RLock()
-		defer s.mu.RUnlock()
-		msg := NewMessage(MessageTypeGetBlocks, buf.Bytes())
-		peer, ok := s.peerMap[peer]
-		if !ok {
-			return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
+func (s *Server) processBlock(from net.Addr, b *core.Block) error {
+	s.relay.received(from, b.Hash(core.BlockHasher{}))
+	s.observeBlock(b)
+
+	if err := s.chain.AddBlock(b); err != nil {
+		if errors.Is(err, core.ErrBlockTooHigh) {
+			// the peer is ahead of us, catch up with it.
+			s.syncer.setPeerHeight(from, b.Height)
 		}
-		if err := peer.Send(msg.Bytes()); err != nil {
-			s.Logger.Log("error", "failed to send to peer", "err", err, "peer", peer)
+		if errors.Is(err, core.ErrUnknownParent) && s.startBranch(from, b.PrevBlockHash) {
+			// the block is on a branch we have not seen, e.g. of
+			// a miner that was cut off from us.
+			s.spawnWork(func() {
+				defer s.endBranch(from, b.PrevBlockHash)
+				s.addBranchBlock(from, b)
+			})
 		}
-		<-ticker.C
+		return blockError(err)
 	}
+	s.newTip()
+	s.spawnWork(func() { s.broadcastBlock(b) })
+
+	return nil
 }
 
-func (s *Server) processBlock(b *core.Block) error {
+// addBranchBlock adds b after the blocks of its branch we are missing.
+func (s *Server) addBranchBlock(from net.Addr, b *core.Block) {
+	if err := s.fetchBranch(from, b.PrevBlockHash); err != nil {
+		if s.ctx.Err() == nil {
+			s.handleError(from, err)
+		}
+		return
+	}
+	if s.ctx.Err() != nil {
+		return
+	}
 	if err := s.chain.AddBlock(b); err != nil {
-		return err
+		s.handleError(from, blockError(err))
+		return
 	}
-	go s.broadcastBlock(b)
-
-	return nil
+	s.newTip()
+	s.broadcastBlock(b)
 }
 
-func (s *Server) processTransaction(tx *core.Transaction) error {
+func (s *Server) processTransaction(from net.Addr, tx *core.Transaction) error {
 	hash := tx.Hash(core.TxHasher{})
+	s.relay.received(from, hash)
 
-	if s.mempool.Contains(hash) {
+	if s.haveItem(InvItem{Type: InvTypeTx, Hash: hash}) {
 		return nil
 	}
 
 	if err := tx.Verify(); err != nil {
-		return err
+		return misbehavior(penaltyInvalidTx, err)
 	}
 
 	s.Logger.Log("msg", "adding new tx to mempool",
 		"hash", hash,
 		"mempoolLen", s.mempool.PendingCount())
 
-	//// TODO: broadcast this tx to peers <23-10-24, Lei Zhou> //
-	go s.broadcastTx(tx)
+	if err := s.mempool.Add(tx); err != nil {
+		s.Logger.Log("msg", "mempool refused tx", "hash", hash, "err", err)
+		return nil
+	}
 
-	s.mempool.Add(tx)
+	s.spawnWork(func() { s.broadcastTx(tx) })
 
 	return nil
 }
 
 func (s *Server) broadcastBlock(b *core.Block) error {
-	buf := &bytes.Buffer{}
-	if err := b.Encode(core.NewGobBlockEncoder(buf)); err != nil {
-		return err
+	if !s.FullBlockRelay {
+		return s.sendCompactBlock(b)
 	}
-
-	msg := NewMessage(MessageTypeBlock, buf.Bytes())
-
-	return s.broadcast(msg.Bytes())
+	return s.announce(InvItem{Type: InvTypeBlock, Hash: b.Hash(core.BlockHasher{})})
 }
 
 func (s *Server) broadcastTx(tx *core.Transaction) error {
-	buf := &bytes.Buffer{}
+	return s.announce(InvItem{Type: InvTypeTx, Hash: tx.Hash(core.TxHasher{})})
+}
 
-	if err := tx.Encode(core.NewGobTxEncoder(buf)); err != nil {
+// announce sends an inv for item to every peer that does not know about
+// it yet. Peers that need the item ask for it with a GetDataMessage.
+func (s *Server) announce(item InvItem) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &InvMessage{Items: []InvItem{item}}); err != nil {
 		return err
 	}
-	msg := NewMessage(MessageTypeTx, buf.Bytes())
+	msg := NewMessage(MessageTypeInv, buf.Bytes())
 
-	return s.broadcast(msg.Bytes())
+	for _, addr := range s.relay.announce(item.Hash) {
+		if err := s.sendToPeer(addr, msg.Bytes()); err != nil {
+			s.Logger.Log("msg", "could not send inv", "addr", addr, "err", err)
+		}
+	}
+	return nil
 }
 
-func (s *Server) createNewBlock() error {
-	currentHeader, err := s.chain.GetHeader(s.chain.Height())
-	if err != nil {
-		return err
+// haveItem reports whether we already have the transaction or block.
+func (s *Server) haveItem(item InvItem) bool {
+	switch item.Type {
+	case InvTypeTx:
+		if s.mempool.Contains(item.Hash) {
+			return true
+		}
+		_, err := s.chain.GetTxByHash(item.Hash)
+		return err == nil
+	case InvTypeBlock:
+		_, err := s.chain.GetBlockByHash(item.Hash)
+		return err == nil
 	}
+	return false
+}
 
-	// we are going to use all transactions that are in the pending memPool
-	// Later on when we know the internal structure of our transaction
-	// we ill implement some kind of complexity function to determine
-	// how many transactions can be included in a block.
-	txx := s.mempool.Pending()
+func (s *Server) processInvMessage(from net.Addr, data *InvMessage) error {
+	if len(data.Items) > maxInvPerMessage {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s sent too many inv items (%d)", from, len(data.Items)))
+	}
 
-	block, err := core.NewBlockFromPrevHeader(currentHeader, txx)
-	if err != nil {
+	want := s.relay.wanted(from, data.Items, s.haveItem)
+	if len(want) == 0 {
+		return nil
+	}
+	if err := s.sendGetData(from, want); err != nil {
 		return err
 	}
+	return nil
+}
 
-	if err := block.Sign(*s.PrivateKey); err != nil {
+func (s *Server) sendGetData(to net.Addr, items []InvItem) error {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &GetDataMessage{Items: items}); err != nil {
 		return err
 	}
+	msg := NewMessage(MessageTypeGetData, buf.Bytes())
 
-	if err := s.chain.AddBlock(block); err != nil {
-		return err
+	return s.sendToPeer(to, msg.Bytes())
+}
+
+// getDataLoop asks the other peers that announced an item in turn, for as
+// long as it does not arrive within the timeout.
+func (s *Server) getDataLoop(timeout time.Duration, started func()) {
+	// done marks the work of the last wake-up as finished. At first it
+	// tells spawnLoop that our first timer is set.
+	done := started
+	for {
+		wake, next := wakeAfter(s.Clock, timeout)
+		done()
+		select {
+		case <-wake:
+			done = next
+		case <-s.ctx.Done():
+			return
+		}
+		for addr, want := range s.relay.retryAll(s.haveItem) {
+			if err := s.sendGetData(addr, want); err != nil {
+				s.Logger.Log("msg", "could not send getdata", "addr", addr, "err", err)
+			}
+		}
 	}
+}
 
-	s.mempool.ClearPending()
+func (s *Server) processGetDataMessage(from net.Addr, data *GetDataMessage) error {
+	if len(data.Items) > maxInvPerMessage {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s asked for too many items (%d)", from, len(data.Items)))
+	}
 
-	go s.broadcastBlock(block)
+	for _, item := range data.Items {
+		buf := new(bytes.Buffer)
+		var msgType MessageType
+
+		switch item.Type {
+		case InvTypeTx:
+			tx := s.mempool.Get(item.Hash)
+			if tx == nil {
+				var err error
+				if tx, err = s.chain.GetTxByHash(item.Hash); err != nil {
+					continue
+				}
+			}
+			if err := tx.Encode(core.NewBinaryTxEncoder(buf)); err != nil {
+				return err
+			}
+			msgType = MessageTypeTx
+		case InvTypeBlock:
+			block, err := s.chain.GetBlockByHash(item.Hash)
+			if err != nil {
+				continue
+			}
+			if err := block.Encode(core.NewBinaryBlockEncoder(buf)); err != nil {
+				return err
+			}
+			msgType = MessageTypeBlock
+		default:
+			return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s asked for unknown inv type %x", from, item.Type))
+		}
+
+		s.relay.markKnown(from, item.Hash)
+		msg := NewMessage(msgType, buf.Bytes())
+		if err := s.sendToPeer(from, msg.Bytes()); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-// func (s *Server) initTransport() {
-//     for _, tr := range s.Transports {
-//         go func(tr Transport) {
-//             // block if no new element
-//             for rpc := range tr.Consume() {
-//                 s.rpcCh <- rpc
-//             }
-//         }(tr)
-//     }
-// }
-
-func genesisBlock() *core.Block {
-	header := &core.Header{
-		Version:   1,
-		DataHash:  types.Hash{},
-		Height:    0,
-		Timestamp: 000000,
-	}
-	b, _ := core.NewBlock(header, nil)
-	privKey := crypto.GeneratePrivateKey()
-	if err := b.Sign(privKey); err != nil {
-		panic(err)
-	}
-	return b
+// sealBlock adds a block with the pending transactions on top of our chain
+// and returns it. It returns nil if we are not ready to produce blocks.
+func (s *Server) sealBlock() (*core.Block, error) {
+	// a validator that is behind, e.g. after a restart, would fork off
+	// the chain with its next block. Catch up first.
+	if s.syncer.behind() {
+		return nil, nil
+	}
+
+	currentHeader, err := s.chain.GetHeader(s.chain.Height())
+	if err != nil {
+		return nil, err
+	}
+
+	// the pending transactions that pay the most and fit into the block.
+	txx := s.mempool.BlockTransactions()
+
+	block, err := core.NewBlockFromPrevHeader(currentHeader, txx)
+	if err != nil {
+		return nil, err
+	}
+	if err := block.SetEvidence(s.evidence.Pending(s.chain)); err != nil {
+		return nil, err
+	}
+	if err := s.engine.Prepare(s.chain, block.Header); err != nil {
+		return nil, err
+	}
+	if err := s.engine.Seal(s.ctx, s.chain, block); err != nil {
+		return nil, err
+	}
+
+	if err := s.chain.AddBlock(block); err != nil {
+		return nil, err
+	}
+
+	s.mempool.RemovePending(block.Transactions)
+
+	return block, nil
 }
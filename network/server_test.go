@@ -0,0 +1,573 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/util"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerDiscoveryCluster(t *testing.T) {
+	n := 20
+	addrs := make([]string, n)
+	for i := 0; i < n; i++ {
+		addrs[i] = freeAddr(t)
+	}
+
+	servers := make([]*Server, n)
+	for i := 0; i < n; i++ {
+		opts := ServerOpts{
+			ID:                  fmt.Sprintf("NODE_%d", i),
+			ListenAddr:          addrs[i],
+			Logger:              log.NewNopLogger(),
+			TargetOutboundPeers: n - 1,
+			DiscoveryInterval:   100 * time.Millisecond,
+		}
+		// every node only knows about the first one.
+		if i > 0 {
+			opts.SeedNodes = []string{addrs[0]}
+		}
+		s, err := NewServer(opts)
+		assert.Nil(t, err)
+		servers[i] = s
+		go s.Start()
+	}
+
+	assert.Eventually(t, func() bool {
+		for _, s := range servers {
+			if len(connectedListenAddrs(s)) != n-1 {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 100*time.Millisecond)
+
+	for i, s := range servers {
+		assert.GreaterOrEqual(t, s.addrBook.Len(), n-1, "node %d", i)
+	}
+}
+
+// connectedListenAddrs returns the distinct listen addresses of the peers s
+// is connected to.
+func connectedListenAddrs(s *Server) map[string]struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	addrs := make(map[string]struct{})
+	for _, peer := range s.peerMap {
+		if peer.listenAddr != "" {
+			addrs[peer.listenAddr] = struct{}{}
+		}
+	}
+	return addrs
+}
+
+// freeAddr returns a free local address. The port is picked below the
+// ephemeral port range, so outgoing connections cannot grab it before the
+// server listens on it.
+func freeAddr(t *testing.T) string {
+	for i := 0; i < 100; i++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", 20000+rand.Intn(10000))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			continue
+		}
+		ln.Close()
+		return addr
+	}
+	t.Fatal("could not find a free port")
+	return ""
+}
+
+func TestBanMisbehavingPeer(t *testing.T) {
+	s := startTestServer(t, ServerOpts{DataDir: t.TempDir()})
+
+	key := crypto.GeneratePrivateKey()
+	nodeID := NodeID(key.PublicKey())
+	peer, err := DialTCPPeer(s.ListenAddr, key)
+	assert.Nil(t, err)
+
+	listenAddr := "127.0.0.1:7777"
+	assert.Nil(t, peer.Send(encodeMessage(t, MessageTypeStatus, &StatusMessage{
+		ID:         "BAD_NODE",
+		ListenAddr: listenAddr,
+	})))
+	assert.Eventually(t, func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].ListenAddr == listenAddr
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, nodeID, s.Peers()[0].NodeID)
+
+	// transactions without a signature are invalid.
+	buf := &bytes.Buffer{}
+	assert.Nil(t, util.NewRandomTransaction(10).Encode(core.NewBinaryTxEncoder(buf)))
+	invalidTx := NewMessage(MessageTypeTx, buf.Bytes()).Bytes()
+
+	assert.Nil(t, peer.Send(invalidTx))
+	assert.Eventually(t, func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].Score == initialPeerScore-penaltyInvalidTx
+	}, time.Second, 10*time.Millisecond)
+
+	for i := 0; i < initialPeerScore/penaltyInvalidTx; i++ {
+		peer.Send(invalidTx)
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, s.banList.IsBanned(nodeID))
+
+	bans := s.Bans()
+	assert.Len(t, bans, 1)
+	assert.Equal(t, nodeID, bans[0].Peer)
+
+	// the ban survives a restart.
+	bl, err := NewBanList(filepath.Join(s.DataDir, "banlist.json"), realClock{})
+	assert.Nil(t, err)
+	assert.True(t, bl.IsBanned(nodeID))
+
+	// and sticks to the node key, not to the connection.
+	peer, err = DialTCPPeer(s.ListenAddr, key)
+	assert.Nil(t, err)
+	_, err = peer.conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.Len(t, s.Peers(), 0)
+
+	_, err = DialTCPPeer(s.ListenAddr, crypto.GeneratePrivateKey())
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDialBannedPeer(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+	banned := startTestServer(t, ServerOpts{})
+	assert.Nil(t, s.banList.Ban(banned.Transport.NodeID(), time.Hour, "invalid block"))
+
+	// neither a banned peer nor ourselves take up an outbound slot once
+	// the dial is over.
+	for _, addr := range []string{banned.ListenAddr, s.ListenAddr} {
+		s.dial(addr)
+		assert.Eventually(t, func() bool {
+			return outboundPeers(s) == 0
+		}, time.Second, 10*time.Millisecond)
+	}
+	assert.Len(t, s.Peers(), 0)
+}
+
+// outboundPeers returns the number of outbound peers ensureOutboundPeers
+// counts for s.
+func outboundPeers(s *Server) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := len(s.dialing)
+	for _, peer := range s.peerMap {
+		if peer.Outgoing() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestScoreSticksToNodeID(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+
+	key := crypto.GeneratePrivateKey()
+	peer, err := DialTCPPeer(s.ListenAddr, key)
+	assert.Nil(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, util.NewRandomTransaction(10).Encode(core.NewBinaryTxEncoder(buf)))
+	assert.Nil(t, peer.Send(NewMessage(MessageTypeTx, buf.Bytes()).Bytes()))
+	assert.Eventually(t, func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].Score == initialPeerScore-penaltyInvalidTx
+	}, time.Second, 10*time.Millisecond)
+
+	peer.Close()
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = DialTCPPeer(s.ListenAddr, key)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		peers := s.Peers()
+		return len(peers) == 1 && peers[0].Score == initialPeerScore-penaltyInvalidTx
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBanPeerSendingGarbage(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+
+	key := crypto.GeneratePrivateKey()
+	peer, err := DialTCPPeer(s.ListenAddr, key)
+	assert.Nil(t, err)
+
+	for i := 0; i < initialPeerScore/penaltyDecodeFailure; i++ {
+		assert.Nil(t, peer.Send([]byte("garbage")))
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(s.Bans()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, NodeID(key.PublicKey()), s.Bans()[0].Peer)
+}
+
+func TestBlockError(t *testing.T) {
+	assert.Equal(t, core.ErrBlockKnown, blockError(core.ErrBlockKnown))
+
+	tooHigh := fmt.Errorf("%w: height 10", core.ErrBlockTooHigh)
+	assert.Equal(t, tooHigh, blockError(tooHigh))
+
+	unknownParent := fmt.Errorf("%w: height 10", core.ErrUnknownParent)
+	assert.Equal(t, unknownParent, blockError(unknownParent))
+
+	var merr *MisbehaviorError
+	assert.True(t, errors.As(blockError(fmt.Errorf("block has invalid sign")), &merr))
+	assert.Equal(t, penaltyInvalidBlock, merr.Penalty)
+}
+
+func TestServerStop(t *testing.T) {
+	dataDir := t.TempDir()
+	apiAddr := freeAddr(t)
+	s, err := NewServer(ServerOpts{
+		ListenAddr:    freeAddr(t),
+		APIListenAddr: apiAddr,
+		DataDir:       dataDir,
+		Logger:        log.NewNopLogger(),
+	})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		s.Start()
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		for _, addr := range []string{s.ListenAddr, apiAddr} {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return false
+			}
+			conn.Close()
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	peer, err := DialTCPPeer(s.ListenAddr, crypto.GeneratePrivateKey())
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return len(s.Peers()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	tx := util.NewRandomTransactionWithSignature(t, crypto.GeneratePrivateKey(), 10)
+	s.mempool.Add(tx)
+
+	assert.Nil(t, s.Stop())
+	assert.Nil(t, s.Stop())
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return")
+	}
+
+	// the peer got disconnected and nobody listens anymore.
+	peer.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = io.Copy(io.Discard, peer.conn)
+	assert.Nil(t, err)
+	_, err = net.Dial("tcp", s.ListenAddr)
+	assert.NotNil(t, err)
+	_, err = net.Dial("tcp", apiAddr)
+	assert.NotNil(t, err)
+
+	// the pending transactions are back after a restart.
+	s, err = NewServer(ServerOpts{
+		ListenAddr: freeAddr(t),
+		DataDir:    dataDir,
+		Logger:     log.NewNopLogger(),
+	})
+	assert.Nil(t, err)
+	assert.True(t, s.mempool.Contains(tx.Hash(core.TxHasher{})))
+	assert.Nil(t, s.Stop())
+}
+
+func startTestServer(t *testing.T, opts ServerOpts) *Server {
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = freeAddr(t)
+	}
+	if opts.ID == "" {
+		opts.ID = "NODE_" + opts.ListenAddr
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+
+	s, err := NewServer(opts)
+	assert.Nil(t, err)
+	go s.Start()
+	t.Cleanup(func() { s.Stop() })
+
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", opts.ListenAddr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	return s
+}
+
+func encodeMessage(t *testing.T, msgType MessageType, data core.BinaryCodec) []byte {
+	buf := &bytes.Buffer{}
+	assert.Nil(t, core.WriteBinary(buf, data))
+	return NewMessage(msgType, buf.Bytes()).Bytes()
+}
+
+func TestGetBlocksRange(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+	blocks := makeTestBlocks(t, 50)
+	for _, b := range blocks {
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+	client := dialTestClient(t, s)
+
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 10, To: 20})
+	msg := client.receive(t).(*BlocksMessage)
+	assert.Len(t, msg.Blocks, 11)
+	for i, b := range msg.Blocks {
+		assert.Equal(t, uint32(10+i), b.Height)
+		assert.Equal(t, blocks[9+i].Hash(core.BlockHasher{}), b.Hash(core.BlockHasher{}))
+	}
+
+	// To = 0 means everything up to the tip
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 45})
+	msg = client.receive(t).(*BlocksMessage)
+	assert.Len(t, msg.Blocks, 6)
+	assert.Equal(t, uint32(50), msg.Blocks[5].Height)
+}
+
+func TestGetBlocksSplitsLargeRanges(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+	blocks := makeTestBlocks(t, 300)
+	for _, b := range blocks {
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+	client := dialTestClient(t, s)
+
+	// the range goes past our tip, every block we have arrives in order
+	// and the rest is not found.
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 1, To: 310})
+	received := []*core.Block{}
+	messages := 0
+	for len(received) < len(blocks) {
+		msg := client.receive(t).(*BlocksMessage)
+		assert.NotEmpty(t, msg.Blocks)
+		assert.LessOrEqual(t, len(msg.Blocks), maxBlocksPerMessage)
+		received = append(received, msg.Blocks...)
+		messages++
+	}
+	assert.Greater(t, messages, 1)
+	assert.Len(t, received, len(blocks))
+	for i, b := range received {
+		assert.Equal(t, blocks[i].Hash(core.BlockHasher{}), b.Hash(core.BlockHasher{}))
+	}
+	notFound := client.receive(t).(*NotFoundMessage)
+	assert.Equal(t, uint32(301), notFound.From)
+	assert.Equal(t, uint32(310), notFound.To)
+}
+
+func TestGetBlocksSizeLimit(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+	blocks := makeTestBlocks(t, 10)
+	for _, b := range blocks {
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+	size, err := encodedBlockSize(blocks[0])
+	assert.Nil(t, err)
+
+	defer func(max int) { maxBlocksMessageSize = max }(maxBlocksMessageSize)
+	maxBlocksMessageSize = 3 * size
+
+	client := dialTestClient(t, s)
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 1, To: 10})
+	messages := 0
+	for total := 0; total < 10; messages++ {
+		msg := client.receive(t).(*BlocksMessage)
+		msgSize := 0
+		for _, b := range msg.Blocks {
+			n, err := encodedBlockSize(b)
+			assert.Nil(t, err)
+			msgSize += n
+		}
+		assert.LessOrEqual(t, msgSize, maxBlocksMessageSize)
+		total += len(msg.Blocks)
+	}
+	assert.GreaterOrEqual(t, messages, 4)
+}
+
+func TestGetBlocksNotFound(t *testing.T) {
+	s := startTestServer(t, ServerOpts{})
+	for _, b := range makeTestBlocks(t, 5) {
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+	client := dialTestClient(t, s)
+
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 10, To: 20})
+	notFound := client.receive(t).(*NotFoundMessage)
+	assert.Equal(t, uint32(10), notFound.From)
+	assert.Equal(t, uint32(20), notFound.To)
+
+	// the part we have is served, the rest is not found
+	client.send(t, MessageTypeGetBlocks, &GetBlocksMessage{From: 4, To: 8})
+	msg := client.receive(t).(*BlocksMessage)
+	assert.Len(t, msg.Blocks, 2)
+	notFound = client.receive(t).(*NotFoundMessage)
+	assert.Equal(t, uint32(6), notFound.From)
+	assert.Equal(t, uint32(8), notFound.To)
+}
+
+// testClient is a bare connection to a server that lets tests send
+// messages and read the answers.
+type testClient struct {
+	peer  *TCPPeer
+	rpcCh chan RPC
+}
+
+func dialTestClient(t *testing.T, s *Server) *testClient {
+	peer, err := DialTCPPeer(s.ListenAddr, crypto.GeneratePrivateKey())
+	assert.Nil(t, err)
+
+	c := &testClient{
+		peer:  peer,
+		rpcCh: make(chan RPC, 1024),
+	}
+	go c.peer.readLoop(c.rpcCh, nil, log.NewNopLogger())
+
+	return c
+}
+
+func (c *testClient) send(t *testing.T, msgType MessageType, data core.BinaryCodec) {
+	assert.Nil(t, c.peer.Send(encodeMessage(t, msgType, data)))
+}
+
+// receive returns the next message that is not part of the handshake.
+func (c *testClient) receive(t *testing.T) any {
+	for {
+		select {
+		case rpc := <-c.rpcCh:
+			msg, err := DefaultRPCDecodeFunc(rpc)
+			assert.Nil(t, err)
+			switch msg.Data.(type) {
+			case *GetStatusMessage, *GetPeersMessage:
+				continue
+			}
+			return msg.Data
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+			return nil
+		}
+	}
+}
+
+func TestTxGossip(t *testing.T) {
+	a := startTestServer(t, ServerOpts{})
+	b := startTestServer(t, ServerOpts{SeedNodes: []string{a.ListenAddr}})
+	c := startTestServer(t, ServerOpts{SeedNodes: []string{b.ListenAddr}, TargetOutboundPeers: 1})
+
+	assert.Eventually(t, func() bool {
+		return len(b.Peers()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	sender := dialTestClient(t, a)
+	listener := dialTestClient(t, a)
+	assert.Eventually(t, func() bool {
+		return len(a.Peers()) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tx := util.NewRandomTransactionWithSignature(t, crypto.GeneratePrivateKey(), 10)
+	sender.send(t, MessageTypeTx, tx)
+
+	hash := tx.Hash(core.TxHasher{})
+	assert.Eventually(t, func() bool {
+		return c.mempool.Contains(hash)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, b.mempool.Contains(hash))
+
+	// other peers get an inv, not the tx itself
+	inv := listener.receive(t).(*InvMessage)
+	assert.Equal(t, []InvItem{{Type: InvTypeTx, Hash: hash}}, inv.Items)
+
+	// and the tx is never echoed back to where it came from
+	time.Sleep(100 * time.Millisecond)
+	for len(sender.rpcCh) > 0 {
+		msg, err := DefaultRPCDecodeFunc(<-sender.rpcCh)
+		assert.Nil(t, err)
+		_, isInv := msg.Data.(*InvMessage)
+		assert.False(t, isInv)
+	}
+}
+
+func TestServerOverLocalTransport(t *testing.T) {
+	newLocalServer := func(id string, tr Transport) *Server {
+		s, err := NewServer(ServerOpts{
+			ID:        id,
+			Transport: tr,
+			Logger:    log.NewNopLogger(),
+		})
+		assert.Nil(t, err)
+		return s
+	}
+
+	trLocal := NewLocalTransport("LOCAL")
+	trRemote := NewLocalTransport("REMOTE")
+	trLate := NewLocalTransport("LATE")
+
+	trLocal.Connect(trRemote)
+	trRemote.Connect(trLocal)
+
+	blocks := makeTestBlocks(t, 10)
+	local := newLocalServer("LOCAL", trLocal)
+	for _, b := range blocks {
+		assert.Nil(t, local.chain.AddBlock(b))
+	}
+	remote := newLocalServer("REMOTE", trRemote)
+	go local.Start()
+	go remote.Start()
+
+	assert.Eventually(t, func() bool {
+		return remote.chain.Height() == uint32(len(blocks))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	late := newLocalServer("LATE", trLate)
+	go late.Start()
+	trLate.Connect(trRemote)
+	trRemote.Connect(trLate)
+
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	peers := remote.Peers()
+	assert.Len(t, peers, 2)
+	assert.Equal(t, "LATE", peers[0].ID)
+	assert.Equal(t, "LOCAL", peers[1].ID)
+}
@@ -0,0 +1,656 @@
+package network
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/go-kit/log"
+)
+
+// simEpoch is the time every simulation starts at.
+var simEpoch = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SimClock is a virtual clock. Time only moves when the simulation steps to
+// the next timer, so a simulated minute passes in milliseconds.
+type SimClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	seq    uint64
+	timers simTimers
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	return c.schedule(nil, d, 0, nil).ch
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	return &simTicker{c: c, t: c.schedule(nil, d, d, nil)}
+}
+
+// AfterFunc calls f on the simulation goroutine once d has passed.
+func (c *SimClock) AfterFunc(d time.Duration, f func()) {
+	c.schedule(nil, d, 0, f)
+}
+
+// schedule adds a timer. Timers owned by a crashed node never fire.
+func (c *SimClock) schedule(owner *SimNode, d, period time.Duration, fn func()) *simTimer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &simTimer{
+		when:   c.now.Add(d),
+		seq:    c.seq,
+		period: period,
+		fn:     fn,
+		owner:  owner,
+	}
+	if fn == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+	c.seq++
+	heap.Push(&c.timers, t)
+
+	return t
+}
+
+// step fires the earliest timer that is due no later than end. It reports
+// false if there is none.
+func (c *SimClock) step(end time.Time) bool {
+	c.lock.Lock()
+	for len(c.timers) > 0 && !c.timers[0].when.After(end) {
+		t := heap.Pop(&c.timers).(*simTimer)
+		if t.stopped || (t.owner != nil && t.owner.down.Load()) {
+			continue
+		}
+
+		c.now = t.when
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			t.seq = c.seq
+			c.seq++
+			heap.Push(&c.timers, t)
+		}
+		now := c.now
+		c.lock.Unlock()
+
+		if t.fn != nil {
+			t.fn()
+		} else {
+			// like time.Ticker, a slow receiver misses ticks.
+			select {
+			case t.ch <- now:
+			default:
+			}
+		}
+		return true
+	}
+
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.lock.Unlock()
+	return false
+}
+
+type simTimer struct {
+	when    time.Time
+	seq     uint64
+	period  time.Duration
+	ch      chan time.Time
+	fn      func()
+	owner   *SimNode
+	stopped bool
+}
+
+// simTimers is a heap of timers ordered by time. Timers due at the same
+// time fire in the order they were scheduled.
+type simTimers []*simTimer
+
+func (h simTimers) Len() int { return len(h) }
+
+func (h simTimers) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h simTimers) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *simTimers) Push(x any) { *h = append(*h, x.(*simTimer)) }
+
+func (h *simTimers) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+type simTicker struct {
+	c *SimClock
+	t *simTimer
+}
+
+func (t *simTicker) C() <-chan time.Time {
+	return t.t.ch
+}
+
+func (t *simTicker) Stop() {
+	t.c.lock.Lock()
+	defer t.c.lock.Unlock()
+
+	t.t.stopped = true
+}
+
+// simNodeClock is the clock of a single node. Its timers stop firing when
+// the node crashes.
+type simNodeClock struct {
+	c    *SimClock
+	node *SimNode
+}
+
+func (c simNodeClock) Now() time.Time {
+	return c.c.Now()
+}
+
+func (c simNodeClock) After(d time.Duration) <-chan time.Time {
+	return c.c.schedule(c.node, d, 0, nil).ch
+}
+
+func (c simNodeClock) NewTicker(d time.Duration) Ticker {
+	return &simTicker{c: c.c, t: c.c.schedule(c.node, d, d, nil)}
+}
+
+// wakeAfter counts the work that the timer starts as pending for the node
+// until done is called. done stops the timer if it did not fire yet.
+func (c simNodeClock) wakeAfter(d time.Duration) (<-chan time.Time, func()) {
+	var (
+		ch    = make(chan time.Time, 1)
+		state atomic.Int32 // 0 waiting, 1 fired, 2 done
+	)
+	c.c.schedule(c.node, d, 0, func() {
+		if state.CompareAndSwap(0, 1) {
+			c.node.pending.Add(1)
+			ch <- c.c.Now()
+		}
+	})
+	return ch, func() {
+		if state.Swap(2) == 1 {
+			c.node.pending.Add(-1)
+		}
+	}
+}
+
+func (c simNodeClock) addWork(n int64) {
+	c.node.pending.Add(n)
+}
+
+// SimConfig describes the faults of a simulated network.
+type SimConfig struct {
+	// Seed seeds all random decisions, a scenario with the same seed
+	// drops and delays the same messages.
+	Seed int64
+	// MinLatency and MaxLatency bound the delay of every message.
+	MinLatency time.Duration
+	MaxLatency time.Duration
+	// LossRate is the probability that a message is dropped.
+	LossRate float64
+	// ReorderRate is the probability that a message does not wait for
+	// the messages sent before it on the same link and may overtake them.
+	ReorderRate float64
+	// Trace, if set, is called with every message the network delivers,
+	// in the order they are delivered.
+	Trace func(SimEvent)
+}
+
+// SimEvent is a message delivered by a SimNetwork.
+type SimEvent struct {
+	At   time.Time
+	From net.Addr
+	To   net.Addr
+	Type MessageType
+}
+
+type SimStats struct {
+	Sent      int
+	Delivered int
+	Dropped   int
+	// Bytes is the size of all messages sent.
+	Bytes int
+}
+
+// SimNode is a server running in a SimNetwork.
+type SimNode struct {
+	Addr   NetAddr
+	Server *Server
+
+	opts      ServerOpts
+	transport *LocalTransport
+	// peers are the nodes this node was connected to, a restarted node
+	// connects to them again.
+	peers map[NetAddr]bool
+	down  atomic.Bool
+	// pending counts the messages delivered to the node that it did not
+	// handle yet, the peer events its transport queued and the work its
+	// goroutines hold.
+	pending atomic.Int64
+}
+
+// simLink holds the random source of the messages from one node to
+// another. Every link has its own source, so the fate of a message only
+// depends on the seed and the messages sent before it on the same link.
+type simLink struct {
+	rng *rand.Rand
+	// last is the delivery time of the last message that was not
+	// reordered, later messages are not delivered before it.
+	last time.Time
+}
+
+func newSimLink(seed int64, from, to net.Addr) *simLink {
+	h := fnv.New64a()
+	h.Write([]byte(from.String() + "->" + to.String()))
+
+	return &simLink{
+		rng: rand.New(rand.NewSource(seed ^ int64(h.Sum64()))),
+	}
+}
+
+// next decides whether the next message on the link is dropped and, if
+// not, how long it takes to arrive.
+func (l *simLink) next(cfg SimConfig, now time.Time) (bool, time.Duration) {
+	if l.rng.Float64() < cfg.LossRate {
+		return true, 0
+	}
+
+	delay := cfg.MinLatency
+	if span := cfg.MaxLatency - cfg.MinLatency; span > 0 {
+		delay += time.Duration(l.rng.Int63n(int64(span) + 1))
+	}
+	if l.rng.Float64() < cfg.ReorderRate {
+		return false, delay
+	}
+
+	at := now.Add(delay)
+	if at.Before(l.last) {
+		at = l.last
+	}
+	l.last = at
+	return false, at.Sub(now)
+}
+
+// SimNetwork runs servers in memory on top of LocalTransport. All servers
+// share a virtual clock and every message goes through the network, which
+// delays, drops, reorders and partitions them based on the seed.
+//
+// The simulation steps from one timer or message to the next and waits for
+// the nodes to settle in between, so a scenario replays the same as long
+// as the nodes react to each step the same way.
+type SimNetwork struct {
+	cfg   SimConfig
+	Clock *SimClock
+
+	lock  sync.Mutex
+	nodes map[net.Addr]*SimNode
+	links map[[2]net.Addr]*simLink
+	// side maps the nodes of a partition to their side of it. Nodes on
+	// different sides cannot reach each other.
+	side  map[net.Addr]int
+	stats SimStats
+}
+
+func NewSimNetwork(cfg SimConfig) *SimNetwork {
+	if cfg.MinLatency <= 0 {
+		cfg.MinLatency = time.Millisecond
+	}
+	if cfg.MaxLatency < cfg.MinLatency {
+		cfg.MaxLatency = cfg.MinLatency
+	}
+
+	return &SimNetwork{
+		cfg:   cfg,
+		Clock: NewSimClock(simEpoch),
+		nodes: make(map[net.Addr]*SimNode),
+		links: make(map[[2]net.Addr]*simLink),
+		side:  make(map[net.Addr]int),
+	}
+}
+
+// AddNode creates a server with the given options and starts it. The
+// transport and clock of the options are replaced by simulated ones.
+func (n *SimNetwork) AddNode(addr NetAddr, opts ServerOpts) (*SimNode, error) {
+	n.lock.Lock()
+	if node, ok := n.nodes[addr]; ok && !node.down.Load() {
+		n.lock.Unlock()
+		return nil, fmt.Errorf("node %s already exists", addr)
+	}
+	n.lock.Unlock()
+
+	node := &SimNode{
+		Addr:  addr,
+		opts:  opts,
+		peers: make(map[NetAddr]bool),
+	}
+	if err := n.start(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (n *SimNetwork) start(node *SimNode) error {
+	tr := NewLocalTransport(node.Addr)
+	tr.sim = n
+	tr.events = &node.pending
+	node.transport = tr
+
+	opts := node.opts
+	opts.Transport = tr
+	opts.Clock = simNodeClock{c: n.Clock, node: node}
+	if opts.ID == "" {
+		opts.ID = string(node.Addr)
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	decode := opts.RPCDecodeFunc
+	if decode == nil {
+		decode = DefaultRPCDecodeFunc
+	}
+	opts.RPCDecodeFunc = func(rpc RPC) (*DecodeMessage, error) {
+		msg, err := decode(rpc)
+		if err != nil {
+			node.pending.Add(-1)
+		}
+		return msg, err
+	}
+
+	s, err := NewServer(opts)
+	if err != nil {
+		return err
+	}
+	s.RPCProcessor = &simProcessor{next: s.RPCProcessor, node: node}
+	s.onSkip = func(*DecodeMessage) { node.pending.Add(-1) }
+	node.Server = s
+
+	n.lock.Lock()
+	n.nodes[node.Addr] = node
+	n.lock.Unlock()
+
+	// Start gives back the work of starting the server once it runs.
+	node.pending.Add(1)
+	go s.Start()
+	return nil
+}
+
+// simProcessor tracks when a node is done with a message.
+type simProcessor struct {
+	next RPCProcessor
+	node *SimNode
+}
+
+func (p *simProcessor) ProcessMessage(msg *DecodeMessage) error {
+	defer p.node.pending.Add(-1)
+	return p.next.ProcessMessage(msg)
+}
+
+func (n *SimNetwork) Node(addr NetAddr) *SimNode {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.nodes[addr]
+}
+
+// Byzantine makes the node send what f returns instead of its BFT
+// proposals and votes, f returns nil to drop a message.
+func (node *SimNode) Byzantine(f func(to net.Addr, msg core.BinaryCodec) core.BinaryCodec) {
+	node.Server.mu.Lock()
+	defer node.Server.mu.Unlock()
+	node.Server.consensusFilter = f
+}
+
+// Connect connects the nodes at a and b with each other.
+func (n *SimNetwork) Connect(a, b NetAddr) error {
+	n.lock.Lock()
+	na, nb := n.nodes[a], n.nodes[b]
+	n.lock.Unlock()
+	if na == nil || nb == nil {
+		return fmt.Errorf("cannot connect unknown nodes %s and %s", a, b)
+	}
+
+	n.connect(na, nb)
+	return nil
+}
+
+func (n *SimNetwork) connect(a, b *SimNode) {
+	n.lock.Lock()
+	a.peers[b.Addr] = true
+	b.peers[a.Addr] = true
+	n.lock.Unlock()
+
+	a.transport.Connect(b.transport)
+	b.transport.Connect(a.transport)
+}
+
+// dial is how a LocalTransport in the network dials another node.
+func (n *SimNetwork) dial(from, to NetAddr) error {
+	n.lock.Lock()
+	src, dst := n.nodes[from], n.nodes[to]
+	ok := n.reachable(src, dst)
+	n.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%s: cannot reach %s", from, to)
+	}
+
+	n.connect(src, dst)
+	return nil
+}
+
+// reachable reports whether messages from src arrive at dst.
+// It expects the lock to be held.
+func (n *SimNetwork) reachable(src, dst *SimNode) bool {
+	return src != nil && dst != nil &&
+		!src.down.Load() && !dst.down.Load() &&
+		n.side[src.Addr] == n.side[dst.Addr]
+}
+
+// send is how a LocalTransport in the network sends a message.
+func (n *SimNetwork) send(from, to net.Addr, payload []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.stats.Sent++
+	n.stats.Bytes += len(payload)
+	src, dst := n.nodes[from], n.nodes[to]
+	if !n.reachable(src, dst) {
+		n.stats.Dropped++
+		return
+	}
+
+	key := [2]net.Addr{from, to}
+	link, ok := n.links[key]
+	if !ok {
+		link = newSimLink(n.cfg.Seed, from, to)
+		n.links[key] = link
+	}
+	drop, delay := link.next(n.cfg, n.Clock.Now())
+	if drop {
+		n.stats.Dropped++
+		return
+	}
+
+	data := append([]byte(nil), payload...)
+	n.Clock.AfterFunc(delay, func() {
+		n.deliver(from, dst, data)
+	})
+}
+
+func (n *SimNetwork) deliver(from net.Addr, dst *SimNode, data []byte) {
+	n.lock.Lock()
+	// a message in flight is lost if a partition or crash happened in
+	// the meantime.
+	if n.nodes[dst.Addr] != dst || !n.reachable(n.nodes[from], dst) {
+		n.stats.Dropped++
+		n.lock.Unlock()
+		return
+	}
+	n.stats.Delivered++
+	dst.pending.Add(1)
+	n.lock.Unlock()
+
+	if n.cfg.Trace != nil {
+		msg := Message{}
+		core.UnmarshalBinary(data, &msg)
+		n.cfg.Trace(SimEvent{At: n.Clock.Now(), From: from, To: dst.Addr, Type: msg.Header})
+	}
+
+	dst.transport.consumeCh <- RPC{
+		From:    from,
+		Payload: bytes.NewReader(data),
+	}
+}
+
+func (n *SimNetwork) Stats() SimStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.stats
+}
+
+// Partition splits the network into the given groups. Nodes that are in
+// no group form a group of their own.
+func (n *SimNetwork) Partition(groups ...[]NetAddr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.side = make(map[net.Addr]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.side[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+// Crash stops the node at addr. It neither sends nor receives messages
+// anymore, its timers stop and its peers see it disconnect. Its server is
+// halted without saving anything, like a process that gets killed.
+func (n *SimNetwork) Crash(addr NetAddr) error {
+	n.lock.Lock()
+	node, ok := n.nodes[addr]
+	if !ok || node.down.Load() {
+		n.lock.Unlock()
+		return fmt.Errorf("node %s is not running", addr)
+	}
+	node.down.Store(true)
+
+	peers := []*LocalTransport{}
+	for peer := range node.peers {
+		if p := n.nodes[peer]; p != nil && !p.down.Load() {
+			peers = append(peers, p.transport)
+		}
+	}
+	n.lock.Unlock()
+
+	for _, tr := range peers {
+		tr.disconnect(addr)
+	}
+	return node.Server.halt()
+}
+
+// Restart starts a crashed node again with the options it was added with
+// and connects it to its former peers. Nothing survives the crash but what
+// the node keeps in its DataDir.
+func (n *SimNetwork) Restart(addr NetAddr) (*SimNode, error) {
+	n.lock.Lock()
+	old, ok := n.nodes[addr]
+	n.lock.Unlock()
+	if !ok || !old.down.Load() {
+		return nil, fmt.Errorf("node %s is not crashed", addr)
+	}
+
+	node := &SimNode{
+		Addr:  addr,
+		opts:  old.opts,
+		peers: make(map[NetAddr]bool),
+	}
+	if err := n.start(node); err != nil {
+		return nil, err
+	}
+
+	for peer := range old.peers {
+		n.lock.Lock()
+		p := n.nodes[peer]
+		up := p != nil && !p.down.Load()
+		n.lock.Unlock()
+		if up {
+			n.connect(node, p)
+		}
+	}
+	return node, nil
+}
+
+// Run advances the simulation by d.
+func (n *SimNetwork) Run(d time.Duration) {
+	n.RunUntil(func() bool { return false }, d)
+}
+
+// RunUntil advances the simulation until cond holds, but at most by max.
+// It reports whether cond holds.
+func (n *SimNetwork) RunUntil(cond func() bool, max time.Duration) bool {
+	end := n.Clock.Now().Add(max)
+
+	n.settle()
+	for !cond() {
+		if !n.Clock.step(end) {
+			return cond()
+		}
+		n.settle()
+	}
+	return true
+}
+
+// settle waits until every running node handled the messages delivered to
+// it and its goroutines are done with the work they hold, see holdWork.
+func (n *SimNetwork) settle() {
+	for !n.idle() {
+		runtime.Gosched()
+	}
+}
+
+func (n *SimNetwork) idle() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, node := range n.nodes {
+		if node.down.Load() {
+			continue
+		}
+		if node.pending.Load() > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,411 @@
+package network
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimClock(t *testing.T) {
+	c := NewSimClock(simEpoch)
+	end := simEpoch.Add(time.Minute)
+
+	fired := []int{}
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, 1) })
+	c.AfterFunc(time.Second, func() { fired = append(fired, 11) })
+	after := c.After(3 * time.Second)
+	ticker := c.NewTicker(10 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, c.step(end))
+	}
+	assert.Equal(t, []int{1, 11, 2}, fired)
+	assert.Equal(t, simEpoch.Add(2*time.Second), c.Now())
+
+	assert.True(t, c.step(end))
+	assert.Equal(t, simEpoch.Add(3*time.Second), <-after)
+
+	assert.True(t, c.step(end))
+	assert.Equal(t, simEpoch.Add(10*time.Second), <-ticker.C())
+	assert.True(t, c.step(end))
+	assert.Equal(t, simEpoch.Add(20*time.Second), <-ticker.C())
+
+	ticker.Stop()
+	assert.False(t, c.step(end))
+	assert.Equal(t, end, c.Now())
+}
+
+func TestSimLinkDeterministic(t *testing.T) {
+	cfg := SimConfig{
+		Seed:        42,
+		MinLatency:  10 * time.Millisecond,
+		MaxLatency:  100 * time.Millisecond,
+		LossRate:    0.2,
+		ReorderRate: 0.2,
+	}
+
+	run := func(seed int64) ([]bool, []time.Duration) {
+		link := newSimLink(seed, NetAddr("A"), NetAddr("B"))
+		drops, delays := []bool{}, []time.Duration{}
+		for i := 0; i < 100; i++ {
+			drop, delay := link.next(cfg, simEpoch)
+			drops = append(drops, drop)
+			delays = append(delays, delay)
+		}
+		return drops, delays
+	}
+
+	drops, delays := run(cfg.Seed)
+	replayDrops, replayDelays := run(cfg.Seed)
+	assert.Equal(t, drops, replayDrops)
+	assert.Equal(t, delays, replayDelays)
+
+	otherDrops, _ := run(cfg.Seed + 1)
+	assert.NotEqual(t, drops, otherDrops)
+
+	dropped := 0
+	for _, drop := range drops {
+		if drop {
+			dropped++
+		}
+	}
+	assert.InDelta(t, 20, dropped, 10)
+}
+
+func TestSimLinkKeepsOrder(t *testing.T) {
+	cfg := SimConfig{MinLatency: time.Millisecond, MaxLatency: time.Second}
+	link := newSimLink(1, NetAddr("A"), NetAddr("B"))
+
+	last := simEpoch
+	for i := 0; i < 100; i++ {
+		now := simEpoch.Add(time.Duration(i) * time.Millisecond)
+		_, delay := link.next(cfg, now)
+		at := now.Add(delay)
+		assert.False(t, at.Before(last))
+		last = at
+	}
+}
+
+// newSimCluster starts a validator and the given number of other nodes,
+// connected in a line: VALIDATOR - NODE_0 - NODE_1 ...
+func newSimCluster(t *testing.T, cfg SimConfig, nodes int) (*SimNetwork, []NetAddr) {
+	sim := NewSimNetwork(cfg)
+
+	privKey := crypto.GeneratePrivateKey()
+	addrs := []NetAddr{"VALIDATOR"}
+	_, err := sim.AddNode(addrs[0], ServerOpts{
+		PrivateKey: &privKey,
+		BlockTIme:  time.Second,
+	})
+	assert.Nil(t, err)
+
+	for i := 0; i < nodes; i++ {
+		addr := NetAddr("NODE_" + string(rune('0'+i)))
+		_, err := sim.AddNode(addr, ServerOpts{})
+		assert.Nil(t, err)
+		assert.Nil(t, sim.Connect(addrs[len(addrs)-1], addr))
+		addrs = append(addrs, addr)
+	}
+
+	return sim, addrs
+}
+
+func simHeight(sim *SimNetwork, addr NetAddr) uint32 {
+	return sim.Node(addr).Server.chain.Height()
+}
+
+// simSynced returns a condition that holds once all nodes are at least at
+// the given height.
+func simSynced(sim *SimNetwork, addrs []NetAddr, height uint32) func() bool {
+	return func() bool {
+		for _, addr := range addrs {
+			if simHeight(sim, addr) < height {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestSimLateJoinSync(t *testing.T) {
+	sim, addrs := newSimCluster(t, SimConfig{
+		Seed:        1,
+		MinLatency:  5 * time.Millisecond,
+		MaxLatency:  50 * time.Millisecond,
+		LossRate:    0.01,
+		ReorderRate: 0.05,
+	}, 3)
+
+	sim.Run(30 * time.Second)
+	height := simHeight(sim, "VALIDATOR")
+	assert.GreaterOrEqual(t, height, uint32(25))
+
+	_, err := sim.AddNode("LATE", ServerOpts{})
+	assert.Nil(t, err)
+	assert.Nil(t, sim.Connect(addrs[len(addrs)-1], "LATE"))
+
+	assert.True(t, sim.RunUntil(simSynced(sim, append(addrs, "LATE"), height), 30*time.Second))
+	assert.Greater(t, sim.Stats().Dropped, 0)
+}
+
+// TestSimReplay runs a scenario with faults, a partition and a crash twice
+// with the same seed. Both runs deliver the same messages at the same time
+// and end with the same chain.
+func TestSimReplay(t *testing.T) {
+	run := func() ([]SimEvent, []*core.Header) {
+		trace := []SimEvent{}
+		sim, addrs := newSimCluster(t, SimConfig{
+			Seed:        5,
+			MinLatency:  5 * time.Millisecond,
+			MaxLatency:  50 * time.Millisecond,
+			LossRate:    0.02,
+			ReorderRate: 0.05,
+			Trace:       func(ev SimEvent) { trace = append(trace, ev) },
+		}, 3)
+
+		sim.Run(5 * time.Second)
+		sim.Partition(addrs[:2], addrs[2:])
+		sim.Run(3 * time.Second)
+		sim.Heal()
+		assert.Nil(t, sim.Crash("NODE_1"))
+		sim.Run(2 * time.Second)
+		_, err := sim.Restart("NODE_1")
+		assert.Nil(t, err)
+		sim.Run(5 * time.Second)
+
+		headers := []*core.Header{}
+		chain := sim.Node("NODE_2").Server.chain
+		for h := uint32(0); h <= chain.Height(); h++ {
+			header, err := chain.GetHeader(h)
+			assert.Nil(t, err)
+			headers = append(headers, header)
+		}
+		return trace, headers
+	}
+
+	trace, headers := run()
+	replayTrace, replayHeaders := run()
+	assert.NotEmpty(t, trace)
+	assert.Equal(t, trace, replayTrace)
+	assert.Greater(t, len(headers), 10)
+	assert.Equal(t, headers, replayHeaders)
+}
+
+func TestSimPartitionHeal(t *testing.T) {
+	sim, addrs := newSimCluster(t, SimConfig{
+		Seed:       2,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 20 * time.Millisecond,
+	}, 3)
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 5), 30*time.Second))
+
+	// cut the line between NODE_0 and NODE_1.
+	cut := simHeight(sim, "VALIDATOR")
+	sim.Partition(addrs[:2], addrs[2:])
+	sim.Run(10 * time.Second)
+
+	assert.LessOrEqual(t, simHeight(sim, "NODE_1"), cut)
+	assert.LessOrEqual(t, simHeight(sim, "NODE_2"), cut)
+	assert.GreaterOrEqual(t, simHeight(sim, "NODE_0"), cut+8)
+
+	sim.Heal()
+	height := simHeight(sim, "VALIDATOR")
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, height), 30*time.Second))
+}
+
+func TestSimValidatorRestart(t *testing.T) {
+	sim, addrs := newSimCluster(t, SimConfig{
+		Seed: 3,
+		// slow enough that catching up takes longer than a block.
+		MinLatency: 200 * time.Millisecond,
+		MaxLatency: 400 * time.Millisecond,
+	}, 2)
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 10), 30*time.Second))
+
+	assert.Nil(t, sim.Crash("VALIDATOR"))
+	sim.Run(5 * time.Second)
+	height := simHeight(sim, "NODE_0")
+	assert.Equal(t, height, simHeight(sim, "NODE_1"))
+	assert.Len(t, sim.Node("NODE_0").Server.Peers(), 1)
+
+	// the validator comes back without its chain. It has to catch up
+	// before it produces blocks again, otherwise it forks off.
+	_, err := sim.Restart("VALIDATOR")
+	assert.Nil(t, err)
+
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, height+5), 30*time.Second))
+	for _, addr := range addrs[1:] {
+		a, err := sim.Node("VALIDATOR").Server.chain.GetHeader(height + 5)
+		assert.Nil(t, err)
+		b, err := sim.Node(addr).Server.chain.GetHeader(height + 5)
+		assert.Nil(t, err)
+		assert.Equal(t, a, b)
+	}
+}
+
+// simRelayTxs runs a line of three nodes in which the last node receives
+// transactions, until all of them are in the chain of every node. It
+// returns the stats of the network.
+func simRelayTxs(t *testing.T, fullBlockRelay bool) SimStats {
+	sim := NewSimNetwork(SimConfig{
+		Seed:       4,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 20 * time.Millisecond,
+	})
+
+	privKey := crypto.GeneratePrivateKey()
+	addrs := []NetAddr{"VALIDATOR", "NODE_0", "NODE_1"}
+	for i, addr := range addrs {
+		opts := ServerOpts{BlockTIme: time.Second, FullBlockRelay: fullBlockRelay}
+		if i == 0 {
+			opts.PrivateKey = &privKey
+		}
+		_, err := sim.AddNode(addr, opts)
+		assert.Nil(t, err)
+		if i > 0 {
+			assert.Nil(t, sim.Connect(addrs[i-1], addr))
+		}
+	}
+
+	// let the nodes connect first, nobody would hear of the first
+	// transactions otherwise.
+	sim.Run(time.Second)
+
+	rng := rand.New(rand.NewSource(4))
+	txKey := crypto.GeneratePrivateKey()
+	sent := 0
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 10; j++ {
+			// printable bytes are no VM instructions.
+			data := make([]byte, 256)
+			for k := range data {
+				data[k] = byte(' ' + rng.Intn(95))
+			}
+			tx := core.NewTransaction(data)
+			tx.Nonce = uint64(sent)
+			assert.Nil(t, tx.Sign(txKey))
+			assert.Nil(t, sim.Node("NODE_1").Server.processTransaction(NetAddr("CLIENT"), tx))
+			sent++
+		}
+		sim.Run(500 * time.Millisecond)
+	}
+
+	// every node has every transaction in its chain.
+	assert.True(t, sim.RunUntil(func() bool {
+		for _, addr := range addrs {
+			if simChainTxs(sim, addr) != sent {
+				return false
+			}
+		}
+		return true
+	}, 30*time.Second))
+
+	return sim.Stats()
+}
+
+func simChainTxs(sim *SimNetwork, addr NetAddr) int {
+	chain := sim.Node(addr).Server.chain
+	n := 0
+	for h := uint32(1); h <= chain.Height(); h++ {
+		b, err := chain.GetBlock(h)
+		if err != nil {
+			return -1
+		}
+		n += len(b.Transactions)
+	}
+	return n
+}
+
+func TestSimCompactBlockRelay(t *testing.T) {
+	full := simRelayTxs(t, true)
+	compact := simRelayTxs(t, false)
+
+	t.Logf("full blocks: %d bytes, compact blocks: %d bytes, saved %.0f%%",
+		full.Bytes, compact.Bytes, 100*float64(full.Bytes-compact.Bytes)/float64(full.Bytes))
+
+	// with full blocks the transactions cross every link twice, once in
+	// gossip and once in the block. Compact blocks only carry their short
+	// IDs, what is left is mostly the inv and GetData of the gossip.
+	assert.Less(t, compact.Bytes, full.Bytes*8/10)
+}
+
+func TestSimPoAFallbackLeader(t *testing.T) {
+	sim := NewSimNetwork(SimConfig{
+		Seed:       6,
+		MinLatency: 5 * time.Millisecond,
+		MaxLatency: 50 * time.Millisecond,
+	})
+
+	keys := []crypto.PrivateKey{}
+	genesis := &core.Genesis{Engine: consensus.EnginePoA, Timestamp: simEpoch.UnixNano(), BlockTime: time.Second}
+	for i := 0; i < 3; i++ {
+		keys = append(keys, crypto.GeneratePrivateKey())
+		genesis.Validators = append(genesis.Validators, keys[i].PublicKey())
+	}
+	// the key of OUTSIDER is not in the genesis, it must not produce
+	// blocks.
+	outsider := crypto.GeneratePrivateKey()
+
+	addrs := []NetAddr{"VALIDATOR_0", "VALIDATOR_1", "VALIDATOR_2", "OUTSIDER"}
+	for i, addr := range addrs {
+		key := &outsider
+		if i < len(keys) {
+			key = &keys[i]
+		}
+		_, err := sim.AddNode(addr, ServerOpts{PrivateKey: key, Genesis: genesis})
+		assert.Nil(t, err)
+		for _, other := range addrs[:i] {
+			assert.Nil(t, sim.Connect(other, addr))
+		}
+	}
+
+	// signers returns the validator index of the blocks from..to.
+	signers := func(from, to uint32) []int {
+		chain := sim.Node("OUTSIDER").Server.chain
+		idx := []int{}
+		for height := from; height <= to; height++ {
+			b, err := chain.GetBlock(height)
+			assert.Nil(t, err)
+			for i, key := range keys {
+				if bytes.Equal(key.PublicKey(), b.Validator) {
+					idx = append(idx, i)
+				}
+			}
+		}
+		return idx
+	}
+
+	// the validators take turns by height.
+	assert.True(t, sim.RunUntil(simSynced(sim, addrs, 6), 30*time.Second))
+	assert.Equal(t, []int{1, 2, 0, 1, 2, 0}, signers(1, 6))
+
+	// without VALIDATOR_1 the next in line takes its slots.
+	assert.Nil(t, sim.Crash("VALIDATOR_1"))
+	height := simHeight(sim, "OUTSIDER")
+	up := []NetAddr{"VALIDATOR_0", "VALIDATOR_2", "OUTSIDER"}
+	assert.True(t, sim.RunUntil(simSynced(sim, up, height+6), 30*time.Second))
+	for i, signer := range signers(height+1, height+6) {
+		leader := int(height+1+uint32(i)) % len(keys)
+		if leader == 1 {
+			assert.Equal(t, 2, signer)
+		} else {
+			assert.Equal(t, leader, signer)
+		}
+	}
+	for _, addr := range up[1:] {
+		a, err := sim.Node("VALIDATOR_0").Server.chain.GetHeader(height + 6)
+		assert.Nil(t, err)
+		b, err := sim.Node(addr).Server.chain.GetHeader(height + 6)
+		assert.Nil(t, err)
+		assert.Equal(t, a, b)
+	}
+}
@@ -0,0 +1,812 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/api"
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/types"
+)
+
+const (
+	// maxHeadersPerMessage is the maximum number of headers we send in a
+	// single HeadersMessage.
+	maxHeadersPerMessage = 2000
+	// maxBlocksPerMessage is the maximum number of blocks a peer may ask
+	// for with a single GetBlocksByHashMessage.
+	maxBlocksPerMessage = 128
+	// maxSyncPeers is the maximum number of peers we ask for headers.
+	maxSyncPeers = 8
+
+	penaltyInvalidHeaders = 25
+	// penaltyUnlinkedBranch is for a branch that does not fork off from
+	// our chain within maxBranchDepth blocks.
+	penaltyUnlinkedBranch = 25
+)
+
+var (
+	// blockWindowSize is the number of blocks requested from a peer at once.
+	blockWindowSize     = 16
+	headersTimeout      = 5 * time.Second
+	blockRequestTimeout = 10 * time.Second
+	// syncStartDelay gives the other peers a moment to report their
+	// status before we pick the peers to sync from.
+	syncStartDelay = 200 * time.Millisecond
+	// maxBranchDepth is how many blocks of another branch we download to
+	// find the block it forks off from.
+	maxBranchDepth = 64
+)
+
+// blockWindow is a range of the best header chain that we download from a
+// single peer.
+type blockWindow struct {
+	start, end int
+	// peers that failed to deliver this window.
+	tried map[net.Addr]bool
+}
+
+// windowResult is the answer of a peer to the request for a window.
+type windowResult struct {
+	w      *blockWindow
+	peer   net.Addr
+	blocks []*core.Block
+	err    error
+}
+
+// syncManager implements headers-first synchronization. It first asks the
+// peers that are ahead of us for their headers, picks the longest valid
+// header chain and then downloads the block bodies in windows from all
+// peers that agree with that chain. It goes idle as soon as no known peer
+// is ahead of us anymore.
+type syncManager struct {
+	s *Server
+
+	lock        sync.RWMutex
+	peerHeights map[net.Addr]uint32
+	syncing     bool
+	target      uint32
+	sources     int
+	// waiting is set while the loop waits for a trigger.
+	waiting bool
+
+	triggerCh chan struct{}
+}
+
+func newSyncManager(s *Server) *syncManager {
+	return &syncManager{
+		s:           s,
+		peerHeights: make(map[net.Addr]uint32),
+		triggerCh:   make(chan struct{}, 1),
+	}
+}
+
+// setPeerHeight records that the peer at addr has at least the given height
+// and starts syncing if that is more than we have.
+func (sm *syncManager) setPeerHeight(addr net.Addr, height uint32) {
+	sm.lock.Lock()
+	if height > sm.peerHeights[addr] {
+		sm.peerHeights[addr] = height
+	}
+	sm.lock.Unlock()
+
+	if height > sm.s.chain.Height() {
+		sm.trigger()
+	}
+}
+
+func (sm *syncManager) removePeer(addr net.Addr) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	delete(sm.peerHeights, addr)
+}
+
+// behind reports whether we are syncing or know a peer that is ahead of us.
+func (sm *syncManager) behind() bool {
+	height := sm.s.chain.Height()
+
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+
+	if sm.syncing {
+		return true
+	}
+	for _, h := range sm.peerHeights {
+		if h > height {
+			return true
+		}
+	}
+	return false
+}
+
+func (sm *syncManager) trigger() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if sm.waiting {
+		// the loop wakes up, it takes over the work of the trigger.
+		sm.waiting = false
+		holdWork(sm.s.Clock)
+	}
+	select {
+	case sm.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for a trigger and reports false if the server stops instead.
+// done gives back the work the loop holds, it goes on with the work of the
+// trigger.
+func (sm *syncManager) wait(done func()) bool {
+	sm.lock.Lock()
+	select {
+	case <-sm.triggerCh:
+		// we were triggered while we were busy, nobody holds work
+		// for it.
+		sm.lock.Unlock()
+		holdWork(sm.s.Clock)
+		done()
+		return true
+	default:
+	}
+	sm.waiting = true
+	sm.lock.Unlock()
+
+	done()
+	select {
+	case <-sm.triggerCh:
+		return true
+	case <-sm.s.ctx.Done():
+		return false
+	}
+}
+
+func (sm *syncManager) Status() api.SyncStatus {
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+
+	height := sm.s.chain.Height()
+	target := sm.target
+	for _, h := range sm.peerHeights {
+		if h > target {
+			target = h
+		}
+	}
+	if height > target {
+		target = height
+	}
+
+	progress := 100.0
+	if target > 0 {
+		progress = float64(height) / float64(target) * 100
+	}
+
+	return api.SyncStatus{
+		Syncing:         sm.syncing,
+		CurrentHeight:   height,
+		TargetHeight:    target,
+		Progress:        progress,
+		Peers:           sm.sources,
+		FinalizedHeight: sm.s.chain.Finalized(),
+	}
+}
+
+func (sm *syncManager) loop(started func()) {
+	// done marks the work of the last round as finished. At first it
+	// tells spawnLoop that we wait for a trigger.
+	done := started
+	for {
+		if !sm.wait(done) {
+			return
+		}
+		// the timer takes over the work of the trigger.
+		wake, next := wakeAfter(sm.s.Clock, syncStartDelay)
+		releaseWork(sm.s.Clock)
+		select {
+		case <-wake:
+			done = next
+		case <-sm.s.ctx.Done():
+			return
+		}
+
+		for sm.s.ctx.Err() == nil && sm.syncRound() {
+			sm.s.newTip()
+		}
+
+		sm.lock.Lock()
+		sm.syncing = false
+		sm.sources = 0
+		sm.lock.Unlock()
+	}
+}
+
+// peersAbove returns the peers that claim a height above the given one,
+// the ones with the lowest latency first. The highest peer is always part
+// of them.
+func (sm *syncManager) peersAbove(height uint32) []net.Addr {
+	rtts := sm.s.peerRTTs()
+
+	sm.lock.RLock()
+	defer sm.lock.RUnlock()
+
+	var (
+		peers   = []net.Addr{}
+		highest net.Addr
+	)
+	for addr, h := range sm.peerHeights {
+		if h > height {
+			peers = append(peers, addr)
+			if highest == nil || h > sm.peerHeights[highest] {
+				highest = addr
+			}
+		}
+	}
+	sort.Slice(peers, byLatency(peers, rtts))
+	if len(peers) > maxSyncPeers {
+		included := false
+		for _, addr := range peers[:maxSyncPeers] {
+			included = included || addr == highest
+		}
+		peers = peers[:maxSyncPeers]
+		if !included {
+			peers[maxSyncPeers-1] = highest
+		}
+	}
+	return peers
+}
+
+// syncRound fetches one batch of headers and downloads the matching blocks.
+// It returns true if the chain grew.
+func (sm *syncManager) syncRound() bool {
+	ourHeight := sm.s.chain.Height()
+	peers := sm.peersAbove(ourHeight)
+	if len(peers) == 0 {
+		return false
+	}
+
+	sm.lock.Lock()
+	sm.syncing = true
+	sm.lock.Unlock()
+
+	if cp, ok := sm.s.chain.PendingCheckpoint(); ok {
+		sm.anchor(peers, cp)
+	}
+	chains := sm.fetchHeaders(peers, ourHeight)
+
+	best := sm.bestChain(chains)
+	if len(best) == 0 {
+		return false
+	}
+
+	sm.lock.Lock()
+	if target := best[len(best)-1].Height; target > sm.target {
+		sm.target = target
+	}
+	sm.lock.Unlock()
+
+	sm.s.Logger.Log("msg", "syncing blocks", "from", ourHeight+1, "to", best[len(best)-1].Height, "peers", len(chains))
+
+	return sm.downloadBlocks(best, chains) > 0
+}
+
+// bestChain returns the header chain of chains with the most work, the
+// rule the chain picks its branch by. Of chains with the same work the
+// longest wins.
+func (sm *syncManager) bestChain(chains map[net.Addr][]*core.Header) []*core.Header {
+	var (
+		best     []*core.Header
+		bestWork *big.Int
+	)
+	for addr, headers := range chains {
+		work, err := sm.s.chain.HeadersWork(headers)
+		if err != nil {
+			sm.s.Logger.Log("msg", "could not weigh headers", "addr", addr, "err", err)
+			continue
+		}
+		if bestWork == nil || work.Cmp(bestWork) > 0 || work.Cmp(bestWork) == 0 && len(headers) > len(best) {
+			best, bestWork = headers, work
+		}
+	}
+	return best
+}
+
+// fetchHeaders asks all peers for the headers above ourHeight and returns
+// the valid header chains that extend our chain.
+func (sm *syncManager) fetchHeaders(peers []net.Addr, ourHeight uint32) map[net.Addr][]*core.Header {
+	tip, err := sm.s.chain.GetHeader(ourHeight)
+	if err != nil {
+		return nil
+	}
+
+	type headersResult struct {
+		from    net.Addr
+		headers []*core.Header
+		seals   []*core.Seal
+		err     error
+	}
+	results := make(chan headersResult, len(peers))
+	for _, addr := range peers {
+		addr := addr
+		// every request hands its work over with its result.
+		holdWork(sm.s.Clock)
+		go func() {
+			res := headersResult{from: addr}
+			msg, err := sm.s.requestHeaders(addr, ourHeight+1, 0)
+			if err == nil {
+				res.headers, res.seals = msg.Headers, msg.Seals
+			}
+			res.err = err
+			results <- res
+		}()
+	}
+
+	chains := make(map[net.Addr][]*core.Header)
+	for range peers {
+		releaseWork(sm.s.Clock)
+		res := <-results
+		if res.err != nil {
+			sm.s.Logger.Log("msg", "could not get headers", "addr", res.from, "err", res.err)
+			sm.s.handleError(res.from, res.err)
+			continue
+		}
+
+		if err := validateHeaderChain(tip, res.headers); err != nil {
+			sm.s.misbehave(res.from, penaltyInvalidHeaders, err)
+			continue
+		}
+		if err := sm.s.chain.VerifyCheckpoints(res.headers); err != nil {
+			sm.s.misbehave(res.from, penaltyInvalidHeaders, err)
+			continue
+		}
+
+		var height uint32
+		if len(res.headers) > 0 {
+			height = res.headers[len(res.headers)-1].Height
+		}
+		if len(res.headers) > 0 && res.headers[0].PrevBlockHash != (core.BlockHasher{}).Hash(tip) {
+			// the peer is on another branch. Get the part of it
+			// below our height, the rest is downloaded like any
+			// other chain and wins if it has more work.
+			if err := sm.s.fetchBranch(res.from, res.headers[0].PrevBlockHash); err != nil {
+				sm.s.Logger.Log("msg", "could not get branch", "addr", res.from, "err", err)
+				sm.s.handleError(res.from, err)
+				height = ourHeight
+			}
+		}
+		if height > ourHeight {
+			// only the blocks of headers whose seals check out are
+			// worth downloading. The seals of later epochs are
+			// checked in later rounds.
+			n, err := sm.s.chain.VerifyHeaders(res.headers, res.seals)
+			if err != nil {
+				sm.s.misbehave(res.from, penaltyInvalidHeaders, err)
+				continue
+			}
+			res.headers = res.headers[:n]
+		}
+		if len(res.headers) == 0 {
+			// the peer has nothing for us, we are as far as we get
+			// with it.
+			height = ourHeight
+		}
+		sm.lock.Lock()
+		if _, ok := sm.peerHeights[res.from]; ok {
+			sm.peerHeights[res.from] = height
+		}
+		sm.lock.Unlock()
+
+		if height > ourHeight {
+			chains[res.from] = res.headers
+		}
+	}
+
+	return chains
+}
+
+// anchor downloads the headers from our finalized block up to cp from one
+// of peers and trusts them. The blocks up to cp are then accepted without
+// checking their seals and no other chain below cp is. If no peer serves
+// the headers sync goes on without them, cp still refuses the chains that
+// conflict with it.
+func (sm *syncManager) anchor(peers []net.Addr, cp core.Checkpoint) {
+	base, err := sm.s.chain.GetHeader(sm.s.chain.Finalized())
+	if err != nil {
+		return
+	}
+
+	for _, addr := range peers {
+		sm.lock.RLock()
+		height := sm.peerHeights[addr]
+		sm.lock.RUnlock()
+		if height < cp.Height {
+			continue
+		}
+
+		headers, err := sm.s.fetchAnchor(addr, base, cp)
+		if err != nil {
+			sm.s.Logger.Log("msg", "could not get headers up to checkpoint", "addr", addr, "height", cp.Height, "err", err)
+			sm.s.handleError(addr, err)
+			continue
+		}
+		if err := sm.s.chain.TrustHeaders(headers); err != nil {
+			sm.s.misbehave(addr, penaltyInvalidHeaders, err)
+			continue
+		}
+		sm.s.Logger.Log("msg", "syncing from checkpoint", "height", cp.Height, "hash", cp.Hash, "addr", addr)
+		return
+	}
+}
+
+// fetchAnchor asks the peer at addr for the headers from base up to cp and
+// checks that they link base to cp.
+func (s *Server) fetchAnchor(addr net.Addr, base *core.Header, cp core.Checkpoint) ([]*core.Header, error) {
+	headers := []*core.Header{}
+	prev := base
+	for prev.Height < cp.Height {
+		msg, err := s.requestHeaders(addr, prev.Height+1, cp.Height)
+		if err != nil {
+			return nil, err
+		}
+		batch := msg.Headers
+		if len(batch) == 0 {
+			return nil, fmt.Errorf("peer %s sent no headers above height (%d)", addr, prev.Height)
+		}
+		if err := validateHeaderChain(prev, batch); err != nil {
+			return nil, misbehavior(penaltyInvalidHeaders, err)
+		}
+		if batch[0].PrevBlockHash != (core.BlockHasher{}).Hash(prev) {
+			return nil, misbehavior(penaltyInvalidHeaders, fmt.Errorf("headers of peer %s fork off below our finalized height (%d)", addr, base.Height))
+		}
+		if last := batch[len(batch)-1]; last.Height > cp.Height {
+			return nil, misbehavior(penaltyInvalidHeaders, fmt.Errorf("peer %s sent headers above height (%d)", addr, cp.Height))
+		}
+		if err := s.chain.VerifyCheckpoints(batch); err != nil {
+			return nil, misbehavior(penaltyInvalidHeaders, err)
+		}
+		headers = append(headers, batch...)
+		prev = batch[len(batch)-1]
+	}
+	return headers, nil
+}
+
+// validateHeaderChain checks that headers is a contiguous chain starting
+// right above tip. A chain that forks off below our tip is not an error,
+// only an inconsistent chain is.
+func validateHeaderChain(tip *core.Header, headers []*core.Header) error {
+	if len(headers) > maxHeadersPerMessage {
+		return fmt.Errorf("too many headers (%d)", len(headers))
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	if headers[0].Height != tip.Height+1 {
+		return fmt.Errorf("first header has height (%d) expected (%d)", headers[0].Height, tip.Height+1)
+	}
+
+	for i := 1; i < len(headers); i++ {
+		prev, h := headers[i-1], headers[i]
+		if h.Height != prev.Height+1 {
+			return fmt.Errorf("header with height (%d) does not follow height (%d)", h.Height, prev.Height)
+		}
+		if h.PrevBlockHash != (core.BlockHasher{}).Hash(prev) {
+			return fmt.Errorf("header with height (%d) does not link to its previous header", h.Height)
+		}
+		if h.Timestamp < prev.Timestamp {
+			return fmt.Errorf("header with height (%d) is older than its previous header", h.Height)
+		}
+	}
+
+	return nil
+}
+
+// downloadBlocks downloads the blocks of the best header chain in parallel
+// windows and adds them to the chain in order. It returns the number of
+// blocks added.
+func (sm *syncManager) downloadBlocks(best []*core.Header, chains map[net.Addr][]*core.Header) int {
+	hashes := make([]types.Hash, len(best))
+	index := make(map[types.Hash]int, len(best))
+	for i, h := range best {
+		hashes[i] = core.BlockHasher{}.Hash(h)
+		index[hashes[i]] = i
+	}
+
+	// a peer can serve a window if its header chain contains the last block
+	// of the window, the linkage guarantees the rest.
+	canServe := func(addr net.Addr, w *blockWindow) bool {
+		chain := chains[addr]
+		return len(chain) >= w.end && core.BlockHasher{}.Hash(chain[w.end-1]) == hashes[w.end-1]
+	}
+
+	// the fastest peers get the first windows.
+	sources := []net.Addr{}
+	for addr := range chains {
+		sources = append(sources, addr)
+	}
+	sort.Slice(sources, byLatency(sources, sm.s.peerRTTs()))
+
+	sm.lock.Lock()
+	sm.sources = len(sources)
+	sm.lock.Unlock()
+
+	pending := []*blockWindow{}
+	for start := 0; start < len(best); start += blockWindowSize {
+		end := start + blockWindowSize
+		if end > len(best) {
+			end = len(best)
+		}
+		pending = append(pending, &blockWindow{
+			start: start,
+			end:   end,
+			tried: make(map[net.Addr]bool),
+		})
+	}
+
+	var (
+		received = make([]*core.Block, len(best))
+		from     = make([]net.Addr, len(best))
+		active   = make(map[net.Addr]*blockWindow)
+		next     = 0
+		rr       = 0
+		// every source has at most one request in flight, so the
+		// requests that are still running when we return never block.
+		results = make(chan windowResult, len(sources))
+	)
+	defer func() {
+		// take over the work of the requests that are still running.
+		n := len(active)
+		go func() {
+			for i := 0; i < n; i++ {
+				<-results
+				releaseWork(sm.s.Clock)
+			}
+		}()
+	}()
+
+	for next < len(best) {
+		// hand out pending windows to idle peers, round robin.
+		for i := 0; i < len(pending); {
+			w := pending[i]
+			var peer net.Addr
+			for j := 0; j < len(sources); j++ {
+				addr := sources[(rr+j)%len(sources)]
+				if _, busy := active[addr]; !busy && !w.tried[addr] && canServe(addr, w) {
+					peer = addr
+					rr = (rr + j + 1) % len(sources)
+					break
+				}
+			}
+			if peer == nil {
+				i++
+				continue
+			}
+
+			active[peer] = w
+			pending = append(pending[:i], pending[i+1:]...)
+
+			holdWork(sm.s.Clock)
+			go func(w *blockWindow, peer net.Addr) {
+				blocks, err := sm.s.requestBlocks(peer, hashes[w.start:w.end])
+				results <- windowResult{w: w, peer: peer, blocks: blocks, err: err}
+			}(w, peer)
+		}
+
+		if len(active) == 0 {
+			sm.s.Logger.Log("msg", "no peer left to download blocks from", "height", sm.s.chain.Height())
+			return next
+		}
+
+		var res windowResult
+		releaseWork(sm.s.Clock)
+		select {
+		case res = <-results:
+		case <-sm.s.ctx.Done():
+			return next
+		}
+		w := res.w
+		delete(active, res.peer)
+
+		if res.err != nil {
+			// let another peer have a go at the window.
+			sm.s.Logger.Log("msg", "block request failed", "addr", res.peer, "err", res.err)
+			sm.s.handleError(res.peer, res.err)
+			w.tried[res.peer] = true
+			pending = append([]*blockWindow{w}, pending...)
+			continue
+		}
+
+		for _, b := range res.blocks {
+			i, ok := index[b.Hash(core.BlockHasher{})]
+			if !ok || i < w.start || i >= w.end {
+				sm.s.misbehave(res.peer, penaltyInvalidBlock, fmt.Errorf("peer sent a block we did not ask for"))
+				continue
+			}
+			received[i] = b
+			from[i] = res.peer
+		}
+
+		for i := w.start; i < w.end; i++ {
+			if received[i] == nil {
+				// the window is incomplete, let someone else
+				// have a go at it.
+				w.tried[res.peer] = true
+				pending = append([]*blockWindow{w}, pending...)
+				break
+			}
+		}
+
+		for next < len(best) && received[next] != nil {
+			err := sm.s.chain.AddBlock(received[next])
+			if err != nil && !errors.Is(err, core.ErrBlockKnown) {
+				sm.s.misbehave(from[next], penaltyInvalidBlock, err)
+				return next
+			}
+			next++
+		}
+	}
+
+	return next
+}
+
+// requestHeaders asks the peer at addr for its headers from the given
+// height on, up to height to if it is not 0.
+func (s *Server) requestHeaders(addr net.Addr, from, to uint32) (*HeadersMessage, error) {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &GetHeadersMessage{From: from, To: to}); err != nil {
+		return nil, err
+	}
+	msg := NewMessage(MessageTypeGetHeaders, buf.Bytes())
+
+	resp, err := s.request(s.ctx, addr, msg, headersTimeout)
+	if err != nil {
+		return nil, err
+	}
+	headers, ok := resp.Data.(*HeadersMessage)
+	if !ok {
+		return nil, unexpectedReply(addr, MessageTypeGetHeaders, resp.Data)
+	}
+	return headers, nil
+}
+
+// requestBlocks asks the peer at addr for the blocks with the given hashes.
+func (s *Server) requestBlocks(addr net.Addr, hashes []types.Hash) ([]*core.Block, error) {
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &GetBlocksByHashMessage{Hashes: hashes}); err != nil {
+		return nil, err
+	}
+	msg := NewMessage(MessageTypeGetBlocksByHash, buf.Bytes())
+
+	resp, err := s.request(s.ctx, addr, msg, blockRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	blocks, ok := resp.Data.(*BlocksMessage)
+	if !ok {
+		return nil, unexpectedReply(addr, MessageTypeGetBlocksByHash, resp.Data)
+	}
+	return blocks.Blocks, nil
+}
+
+// fetchBranch downloads the block with the given hash and the ancestors of
+// it we do not know from the peer at addr and adds them to the chain. It
+// gives up on branches that fork off more than maxBranchDepth blocks
+// below the block.
+func (s *Server) fetchBranch(addr net.Addr, hash types.Hash) error {
+	branch := []*core.Block{}
+	for {
+		if _, err := s.chain.GetBlockByHash(hash); err == nil {
+			break
+		}
+		if len(branch) == maxBranchDepth {
+			return misbehavior(penaltyUnlinkedBranch, fmt.Errorf("branch of peer %s forks off more than %d blocks deep", addr, maxBranchDepth))
+		}
+
+		blocks, err := s.requestBlocks(addr, []types.Hash{hash})
+		if err != nil {
+			return err
+		}
+		if len(blocks) != 1 || blocks[0].Hash(core.BlockHasher{}) != hash {
+			return fmt.Errorf("peer %s did not send block (%s)", addr, hash)
+		}
+		branch = append(branch, blocks[0])
+		hash = blocks[0].PrevBlockHash
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.chain.AddBlock(branch[i]); err != nil && !errors.Is(err, core.ErrBlockKnown) {
+			return blockError(err)
+		}
+	}
+	return nil
+}
+
+// startBranch reserves the fetch of the branch below parent from the peer
+// at addr. It returns false if that branch is fetched already or the peer
+// has a fetch of its own running.
+func (s *Server) startBranch(addr net.Addr, parent types.Hash) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.branches[parent]; ok {
+		return false
+	}
+	if _, ok := s.branchPeers[addr]; ok {
+		return false
+	}
+	s.branches[parent] = struct{}{}
+	s.branchPeers[addr] = struct{}{}
+	return true
+}
+
+// endBranch releases what startBranch reserved.
+func (s *Server) endBranch(addr net.Addr, parent types.Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.branches, parent)
+	delete(s.branchPeers, addr)
+}
+
+func (s *Server) processGetHeadersMessage(from net.Addr, id uint64, data *GetHeadersMessage) error {
+	headers := &HeadersMessage{Headers: []*core.Header{}, Seals: []*core.Seal{}}
+
+	ourHeight := s.chain.Height()
+	to := ourHeight
+	if data.To != 0 && data.To < to {
+		to = data.To
+	}
+	for h := data.From; h <= to && len(headers.Headers) < maxHeadersPerMessage; h++ {
+		b, err := s.chain.GetBlock(h)
+		if err != nil {
+			return err
+		}
+		headers.Headers = append(headers.Headers, b.Header)
+		headers.Seals = append(headers.Seals, b.Seal())
+	}
+
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, headers); err != nil {
+		return err
+	}
+	msg := NewReply(id, MessageTypeHeaders, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
+}
+
+// processHeadersMessage handles headers nobody asked for or that arrived
+// after the request timed out. They are of no use to us.
+func (s *Server) processHeadersMessage(from net.Addr, data *HeadersMessage) error {
+	return nil
+}
+
+func (s *Server) processGetBlocksByHashMessage(from net.Addr, id uint64, data *GetBlocksByHashMessage) error {
+	if len(data.Hashes) > maxBlocksPerMessage {
+		return misbehavior(penaltyProtocolViolation, fmt.Errorf("peer %s asked for too many blocks (%d)", from, len(data.Hashes)))
+	}
+
+	blocks := []*core.Block{}
+	for _, hash := range data.Hashes {
+		block, err := s.chain.GetBlockByHash(hash)
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, &BlocksMessage{Blocks: blocks}); err != nil {
+		return err
+	}
+	msg := NewReply(id, MessageTypeBlocks, buf.Bytes())
+
+	return s.sendToPeer(from, msg.Bytes())
+}
@@ -0,0 +1,433 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/consensus"
+	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/LeiZhou-97/blockchain/types"
+	"github.com/LeiZhou-97/blockchain/util"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingProcessor counts the messages a server processes per type.
+type countingProcessor struct {
+	s      *Server
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (p *countingProcessor) ProcessMessage(msg *DecodeMessage) error {
+	p.lock.Lock()
+	switch msg.Data.(type) {
+	case *GetHeadersMessage:
+		p.counts["headers"]++
+	case *GetBlocksByHashMessage:
+		p.counts["blocks"]++
+	}
+	p.lock.Unlock()
+
+	return p.s.ProcessMessage(msg)
+}
+
+func (p *countingProcessor) count(key string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.counts[key]
+}
+
+func TestHeadersFirstSync(t *testing.T) {
+	blocks := makeTestBlocks(t, 300)
+
+	processors := []*countingProcessor{}
+	addrs := []string{}
+	for i := 0; i < 2; i++ {
+		p := &countingProcessor{counts: make(map[string]int)}
+		s := startTestServer(t, ServerOpts{RPCProcessor: p})
+		p.s = s
+		for _, b := range blocks {
+			assert.Nil(t, s.chain.AddBlock(b))
+		}
+		processors = append(processors, p)
+		addrs = append(addrs, s.ListenAddr)
+	}
+
+	late := startTestServer(t, ServerOpts{SeedNodes: addrs})
+
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks))
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return !late.SyncStatus().Syncing
+	}, time.Second, 10*time.Millisecond)
+
+	status := late.SyncStatus()
+	assert.Equal(t, uint32(len(blocks)), status.CurrentHeight)
+	assert.Equal(t, uint32(len(blocks)), status.TargetHeight)
+	assert.Equal(t, 100.0, status.Progress)
+
+	for i, b := range blocks {
+		fetched, err := late.chain.GetBlock(uint32(i + 1))
+		assert.Nil(t, err)
+		assert.Equal(t, b.Hash(core.BlockHasher{}), fetched.Hash(core.BlockHasher{}))
+	}
+
+	// both peers served headers and a share of the blocks.
+	for _, p := range processors {
+		assert.Equal(t, 1, p.count("headers"))
+		assert.Greater(t, p.count("blocks"), 0)
+	}
+	assert.Equal(t, (len(blocks)+blockWindowSize-1)/blockWindowSize, processors[0].count("blocks")+processors[1].count("blocks"))
+
+	// once synced we stop asking for headers.
+	time.Sleep(200 * time.Millisecond)
+	for _, p := range processors {
+		assert.Equal(t, 1, p.count("headers"))
+	}
+}
+
+func TestSyncFollowsLongestChain(t *testing.T) {
+	blocks := makeTestBlocks(t, 40)
+
+	short := startTestServer(t, ServerOpts{})
+	for _, b := range blocks[:20] {
+		assert.Nil(t, short.chain.AddBlock(b))
+	}
+	long := startTestServer(t, ServerOpts{})
+	for _, b := range blocks {
+		assert.Nil(t, long.chain.AddBlock(b))
+	}
+
+	late := startTestServer(t, ServerOpts{SeedNodes: []string{short.ListenAddr, long.ListenAddr}})
+
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks)) && !late.SyncStatus().Syncing
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestSyncSwitchesBranch(t *testing.T) {
+	blocks := makeTestBlocks(t, 30)
+	fork := makeTestBlocksOn(t, blocks[9].Header, 10)
+
+	long := startTestServer(t, ServerOpts{})
+	for _, b := range blocks {
+		assert.Nil(t, long.chain.AddBlock(b))
+	}
+	// the late node mined a shorter branch on its own.
+	late, err := NewServer(ServerOpts{
+		ID:         "LATE",
+		ListenAddr: freeAddr(t),
+		SeedNodes:  []string{long.ListenAddr},
+		Logger:     log.NewNopLogger(),
+	})
+	assert.Nil(t, err)
+	for _, b := range append(blocks[:10:10], fork...) {
+		assert.Nil(t, late.chain.AddBlock(b))
+	}
+	go late.Start()
+	t.Cleanup(func() { late.Stop() })
+
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks)) && !late.SyncStatus().Syncing
+	}, 10*time.Second, 10*time.Millisecond)
+	tip, err := late.chain.GetBlock(uint32(len(blocks)))
+	assert.Nil(t, err)
+	assert.Equal(t, blocks[len(blocks)-1].Hash(core.BlockHasher{}), tip.Hash(core.BlockHasher{}))
+}
+
+func TestSyncFromCheckpoint(t *testing.T) {
+	blocks := makeTestBlocks(t, 40)
+	fork := makeTestBlocksOn(t, blocks[9].Header, 60)
+
+	honest := startTestServer(t, ServerOpts{})
+	for _, b := range blocks {
+		assert.Nil(t, honest.chain.AddBlock(b))
+	}
+	// the longer chain conflicts with the checkpoint.
+	evil := startTestServer(t, ServerOpts{})
+	for _, b := range append(blocks[:10:10], fork...) {
+		assert.Nil(t, evil.chain.AddBlock(b))
+	}
+
+	checkpoint := core.Checkpoint{Height: 30, Hash: blocks[29].Hash(core.BlockHasher{})}
+	late := startTestServer(t, ServerOpts{
+		SeedNodes:   []string{evil.ListenAddr, honest.ListenAddr},
+		Checkpoints: []core.Checkpoint{checkpoint},
+	})
+
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks)) && !late.SyncStatus().Syncing
+	}, 10*time.Second, 10*time.Millisecond)
+	tip, err := late.chain.GetBlock(uint32(len(blocks)))
+	assert.Nil(t, err)
+	assert.Equal(t, blocks[len(blocks)-1].Hash(core.BlockHasher{}), tip.Hash(core.BlockHasher{}))
+	assert.Equal(t, uint32(30), late.SyncStatus().FinalizedHeight)
+	_, pending := late.chain.PendingCheckpoint()
+	assert.False(t, pending)
+
+	for _, peer := range late.Peers() {
+		if peer.ListenAddr == evil.ListenAddr {
+			assert.Less(t, peer.Score, initialPeerScore)
+		}
+	}
+}
+
+// silentProcessor ignores block requests.
+type silentProcessor struct {
+	s *Server
+}
+
+func (p *silentProcessor) ProcessMessage(msg *DecodeMessage) error {
+	if _, ok := msg.Data.(*GetBlocksByHashMessage); ok {
+		return nil
+	}
+	return p.s.ProcessMessage(msg)
+}
+
+func TestSyncRetriesTimedOutRequest(t *testing.T) {
+	old := blockRequestTimeout
+	blockRequestTimeout = 200 * time.Millisecond
+	defer func() { blockRequestTimeout = old }()
+
+	blocks := makeTestBlocks(t, 300)
+
+	silent := &silentProcessor{}
+	addrs := []string{}
+	for i := 0; i < 2; i++ {
+		opts := ServerOpts{}
+		if i == 0 {
+			opts.RPCProcessor = silent
+		}
+		s := startTestServer(t, opts)
+		if i == 0 {
+			silent.s = s
+		}
+		for _, b := range blocks {
+			assert.Nil(t, s.chain.AddBlock(b))
+		}
+		addrs = append(addrs, s.ListenAddr)
+	}
+
+	late := startTestServer(t, ServerOpts{SeedNodes: addrs})
+
+	// the windows the silent peer does not deliver are fetched from the
+	// other one.
+	assert.Eventually(t, func() bool {
+		return late.chain.Height() == uint32(len(blocks))
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+// forgingProcessor answers header requests with the headers of its chain
+// and seals it did not sign.
+type forgingProcessor struct {
+	*countingProcessor
+}
+
+func (p *forgingProcessor) ProcessMessage(msg *DecodeMessage) error {
+	data, ok := msg.Data.(*GetHeadersMessage)
+	if !ok {
+		return p.countingProcessor.ProcessMessage(msg)
+	}
+
+	headers := &HeadersMessage{}
+	forger := crypto.GeneratePrivateKey().PublicKey()
+	for h := data.From; h <= p.s.chain.Height(); h++ {
+		b, err := p.s.chain.GetBlock(h)
+		if err != nil {
+			return err
+		}
+		headers.Headers = append(headers.Headers, b.Header)
+		headers.Seals = append(headers.Seals, &core.Seal{Validator: forger, Signature: b.Signature})
+	}
+	buf := new(bytes.Buffer)
+	if err := core.WriteBinary(buf, headers); err != nil {
+		return err
+	}
+	return p.s.sendToPeer(msg.From, NewReply(msg.ID, MessageTypeHeaders, buf.Bytes()).Bytes())
+}
+
+func TestSyncRejectsForgedSeals(t *testing.T) {
+	p := &forgingProcessor{&countingProcessor{counts: make(map[string]int)}}
+	forger := startTestServer(t, ServerOpts{RPCProcessor: p})
+	p.s = forger
+	for _, b := range makeTestBlocks(t, 50) {
+		assert.Nil(t, forger.chain.AddBlock(b))
+	}
+
+	late := startTestServer(t, ServerOpts{SeedNodes: []string{forger.ListenAddr}})
+
+	// the forger is penalized without a single block requested from it.
+	assert.Eventually(t, func() bool {
+		peers := late.Peers()
+		return len(peers) == 1 && peers[0].Score == initialPeerScore-penaltyInvalidHeaders
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return !late.SyncStatus().Syncing
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, p.count("blocks"))
+	assert.Equal(t, uint32(0), late.chain.Height())
+}
+
+func TestSyncPicksMostWork(t *testing.T) {
+	s, err := NewServer(ServerOpts{
+		Transport: NewLocalTransport("LOCAL"),
+		Logger:    log.NewNopLogger(),
+		Genesis:   &core.Genesis{Engine: consensus.EnginePoW, Difficulty: 1, BlockTime: time.Second},
+	})
+	assert.Nil(t, err)
+	genesis, err := s.chain.GetHeader(0)
+	assert.Nil(t, err)
+
+	// headers with the given difficulties on top of the genesis.
+	chain := func(difficulties ...uint64) []*core.Header {
+		headers := []*core.Header{}
+		prev := genesis
+		for _, d := range difficulties {
+			h := &core.Header{Version: core.BlockVersion, PrevBlockHash: core.BlockHasher{}.Hash(prev), Height: prev.Height + 1, Difficulty: d}
+			headers = append(headers, h)
+			prev = h
+		}
+		return headers
+	}
+	long := chain(1, 1, 1, 1, 1)
+	heavy := chain(4, 4)
+	chains := map[net.Addr][]*core.Header{NetAddr("A"): long, NetAddr("B"): heavy}
+	assert.Equal(t, heavy, s.syncer.bestChain(chains))
+
+	// of the same work the longer.
+	even := chain(1, 4)
+	chains = map[net.Addr][]*core.Header{NetAddr("A"): chain(5), NetAddr("B"): even}
+	assert.Equal(t, even, s.syncer.bestChain(chains))
+}
+
+func TestValidateHeaderChain(t *testing.T) {
+	blocks := makeTestBlocks(t, 5)
+	headers := make([]*core.Header, len(blocks))
+	for i, b := range blocks {
+		headers[i] = b.Header
+	}
+	genesis := new(core.Genesis).Block().Header
+
+	assert.Nil(t, validateHeaderChain(genesis, headers))
+	assert.Nil(t, validateHeaderChain(genesis, nil))
+	assert.Nil(t, validateHeaderChain(headers[1], headers[2:]))
+
+	// does not start right above the tip
+	assert.NotNil(t, validateHeaderChain(genesis, headers[1:]))
+	// gap in the chain
+	assert.NotNil(t, validateHeaderChain(genesis, []*core.Header{headers[0], headers[2]}))
+
+	// broken link
+	broken := *headers[3]
+	broken.PrevBlockHash = types.Hash{}
+	assert.NotNil(t, validateHeaderChain(genesis, []*core.Header{headers[0], headers[1], headers[2], &broken}))
+}
+
+// makeTestBlocks returns a chain of n signed blocks on top of the genesis
+// block.
+// TestBranchFetchLimits sends blocks of branches that never link to our
+// chain. Every branch is fetched once, a peer fetches one at a time and
+// pays for a branch that does not link.
+func TestBranchFetchLimits(t *testing.T) {
+	defer func(n int) { maxBranchDepth = n }(maxBranchDepth)
+	maxBranchDepth = 2
+
+	tr := NewLocalTransport("LOCAL")
+	s, err := NewServer(ServerOpts{Transport: tr, Logger: log.NewNopLogger()})
+	assert.Nil(t, err)
+	defer s.Stop()
+	for _, b := range makeTestBlocks(t, 5) {
+		assert.Nil(t, s.chain.AddBlock(b))
+	}
+
+	a, b := NewLocalTransport("A"), NewLocalTransport("B")
+	for _, remote := range []*LocalTransport{a, b} {
+		assert.Nil(t, tr.Connect(remote))
+		assert.Nil(t, remote.Connect(tr))
+	}
+	s.drainPeerEvents()
+	go s.Start()
+
+	// getBlocks returns the next request for blocks the remote gets.
+	getBlocks := func(remote *LocalTransport) *DecodeMessage {
+		for {
+			select {
+			case rpc := <-remote.Consume():
+				msg, err := DefaultRPCDecodeFunc(rpc)
+				assert.Nil(t, err)
+				if _, ok := msg.Data.(*GetBlocksByHashMessage); ok {
+					return msg
+				}
+			case <-time.After(200 * time.Millisecond):
+				return nil
+			}
+		}
+	}
+	hashes := func(msg *DecodeMessage) []types.Hash {
+		assert.NotNil(t, msg)
+		if msg == nil {
+			return nil
+		}
+		return msg.Data.(*GetBlocksByHashMessage).Hashes
+	}
+	reply := func(req *DecodeMessage, block *core.Block) {
+		buf := new(bytes.Buffer)
+		assert.Nil(t, core.WriteBinary(buf, &BlocksMessage{Blocks: []*core.Block{block}}))
+		assert.Nil(t, a.SendMessage(tr.Addr(), NewReply(req.ID, MessageTypeBlocks, buf.Bytes()).Bytes()))
+	}
+	// branch returns blocks at height 2 to 6 on a parent nobody knows.
+	branch := func() []*core.Block {
+		return makeTestBlocksOn(t, &core.Header{Height: 1, PrevBlockHash: util.RandomHash()}, 5)
+	}
+	one, two := branch(), branch()
+
+	s.processBlock(a.Addr(), one[4])
+	s.processBlock(a.Addr(), two[4])
+	s.processBlock(b.Addr(), one[4])
+	req := getBlocks(a)
+	assert.Equal(t, []types.Hash{one[3].Hash(core.BlockHasher{})}, hashes(req))
+	// A fetches one branch at a time and B's is fetched already.
+	assert.Nil(t, getBlocks(a))
+	assert.Nil(t, getBlocks(b))
+
+	reply(req, one[3])
+	req = getBlocks(a)
+	assert.Equal(t, []types.Hash{one[2].Hash(core.BlockHasher{})}, hashes(req))
+	reply(req, one[2])
+
+	// the branch did not link within maxBranchDepth blocks.
+	assert.Eventually(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.peerMap[a.Addr()].score == initialPeerScore-penaltyUnlinkedBranch
+	}, time.Second, 10*time.Millisecond)
+
+	// once done, the peers may fetch another branch.
+	s.processBlock(b.Addr(), two[4])
+	assert.Equal(t, []types.Hash{two[3].Hash(core.BlockHasher{})}, hashes(getBlocks(b)))
+}
+
+func makeTestBlocks(t *testing.T, n int) []*core.Block {
+	return makeTestBlocksOn(t, new(core.Genesis).Block().Header, n)
+}
+
+// makeTestBlocksOn returns n blocks on top of prev.
+func makeTestBlocksOn(t *testing.T, prev *core.Header, n int) []*core.Block {
+	privKey := crypto.GeneratePrivateKey()
+	blocks := make([]*core.Block, n)
+	for i := 0; i < n; i++ {
+		b, err := core.NewBlockFromPrevHeader(prev, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Sign(privKey))
+		blocks[i] = b
+		prev = b.Header
+	}
+	return blocks
+}
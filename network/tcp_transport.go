@@ -2,68 +2,389 @@ package network
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/go-kit/log"
+)
+
+// maxFrameSize is the largest payload a peer is allowed to send in a single
+// frame. Anything bigger is treated as a broken connection.
+const maxFrameSize = 32 << 20
+
+var (
+	// handshakeTimeout is how long a peer has to complete the TLS
+	// handshake.
+	handshakeTimeout = 5 * time.Second
+	// writeTimeout is how long a peer may take to accept a frame. A peer
+	// that stops reading must not block the sender forever.
+	writeTimeout = 10 * time.Second
 )
 
+// NodeID returns the ID of the node with the given node key.
+func NodeID(key crypto.PublicKey) string {
+	return key.Address().String()
+}
+
 type TCPPeer struct {
-	conn net.Conn
-	Outgoing bool
+	conn     net.Conn
+	outgoing bool
+	// dialAddr is the address an outgoing connection was dialed with.
+	dialAddr string
+	// nodeID is the ID of the key the peer authenticated with in the
+	// handshake.
+	nodeID string
 }
 
+func NewTCPPeer(conn net.Conn, outgoing bool) *TCPPeer {
+	return &TCPPeer{
+		conn:     conn,
+		outgoing: outgoing,
+	}
+}
+
+// Send writes b as a single length prefixed frame, so the reader on the
+// other side can split the stream back into messages.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.conn.Write(b)
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	copy(frame[4:], b)
+
+	p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := p.conn.Write(frame)
 	return err
 }
 
-func (p *TCPPeer) readLoop(rpcCh chan RPC) {
-	buf := make([]byte, 4096)
+func (p *TCPPeer) Close() error {
+	return p.conn.Close()
+}
+
+func (p *TCPPeer) Addr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
+func (p *TCPPeer) Outgoing() bool {
+	return p.outgoing
+}
+
+func (p *TCPPeer) DialAddr() string {
+	return p.dialAddr
+}
+
+// NodeID returns the ID of the remote node. It is empty for connections
+// that did not go through the handshake.
+func (p *TCPPeer) NodeID() string {
+	return p.nodeID
+}
+
+// tlsConfig returns the TLS configuration of a node with the given key.
+// Both sides present a self-signed certificate of their node key, there is
+// no CA to check them against.
+func tlsConfig(key crypto.PrivateKey) (*tls.Config, error) {
+	cert, err := key.TLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// the default verification needs a CA, verifyPeerCertificate
+		// does the checks that make sense for self-signed node keys.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate,
+	}, nil
+}
+
+func verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) != 1 {
+		return errors.New("peer must present exactly one certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	_, err = crypto.PublicKeyFromCertificate(cert)
+	return err
+}
+
+// handshake runs the TLS handshake on conn. TLS 1.3 proves that the peer
+// owns the key of its certificate, so the key is the identity of the peer.
+func handshake(conn net.Conn, config *tls.Config, outgoing bool) (*TCPPeer, error) {
+	var tlsConn *tls.Conn
+	if outgoing {
+		tlsConn = tls.Client(conn, config)
+	} else {
+		tlsConn = tls.Server(conn, config)
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		conn.Close()
+		return nil, errors.New("peer did not present a certificate")
+	}
+	pubKey, err := crypto.PublicKeyFromCertificate(certs[0])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	peer := NewTCPPeer(tlsConn, outgoing)
+	peer.nodeID = NodeID(pubKey)
+	return peer, nil
+}
+
+// DialTCPPeer connects to the node at addr and authenticates with key.
+// It is meant for clients that talk to a node without running a transport.
+func DialTCPPeer(addr string, key crypto.PrivateKey) (*TCPPeer, error) {
+	config, err := tlsConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	return dialTCPPeer(addr, config)
+}
+
+func dialTCPPeer(addr string, config *tls.Config) (*TCPPeer, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := handshake(conn, config, true)
+	if err != nil {
+		return nil, err
+	}
+	peer.dialAddr = addr
+	return peer, nil
+}
+
+// readLoop reads frames from the connection until it fails or quitCh is
+// closed.
+func (p *TCPPeer) readLoop(rpcCh chan<- RPC, quitCh <-chan struct{}, logger log.Logger) {
+	header := make([]byte, 4)
 	for {
-		n, err := p.conn.Read(buf)
-		if err == io.EOF {
-			continue
+		if _, err := io.ReadFull(p.conn, header); err != nil {
+			if err != io.EOF {
+				logger.Log("msg", "read error", "addr", p.conn.RemoteAddr(), "err", err)
+			}
+			return
 		}
-		if err != nil {
-			fmt.Printf("read error from %s", err)
-			continue
+
+		size := binary.BigEndian.Uint32(header)
+		if size > maxFrameSize {
+			logger.Log("msg", "frame too large", "addr", p.conn.RemoteAddr(), "size", size)
+			return
+		}
+
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(p.conn, msg); err != nil {
+			logger.Log("msg", "read error", "addr", p.conn.RemoteAddr(), "err", err)
+			return
 		}
 
-		msg := buf[:n]
 		// producer
-		rpcCh <- RPC{
-			From: p.conn.RemoteAddr(),
-			Payload: bytes.NewBuffer(msg),
+		select {
+		case rpcCh <- RPC{
+			From:    p.conn.RemoteAddr(),
+			Payload: bytes.NewReader(msg),
+		}:
+		case <-quitCh:
+			return
 		}
 	}
 }
 
+// TCPTransport connects nodes over TLS. Every connection is authenticated
+// with the node key of both sides and all frames are encrypted.
 type TCPTransport struct {
-	peerCh     chan *TCPPeer
 	listenAddr string
 	listener   net.Listener
+	nodeID     string
+	tlsConfig  *tls.Config
+	rpcCh      chan RPC
+	eventCh    chan PeerEvent
+	logger     log.Logger
+
+	lock  sync.RWMutex
+	peers map[net.Addr]*TCPPeer
+
+	quitCh    chan struct{}
+	closeOnce sync.Once
+	// wg tracks the accept loop and the read loops.
+	wg sync.WaitGroup
 }
 
-func NewTCPTransport(addr string, peerCh chan *TCPPeer) *TCPTransport {
+func NewTCPTransport(addr string, key crypto.PrivateKey) (*TCPTransport, error) {
+	config, err := tlsConfig(key)
+	if err != nil {
+		return nil, err
+	}
+
 	return &TCPTransport{
-		peerCh: peerCh,
 		listenAddr: addr,
+		nodeID:     NodeID(key.PublicKey()),
+		tlsConfig:  config,
+		rpcCh:      make(chan RPC),
+		eventCh:    make(chan PeerEvent, 1024),
+		logger:     log.NewLogfmtLogger(os.Stderr),
+		peers:      make(map[net.Addr]*TCPPeer),
+		quitCh:     make(chan struct{}),
+	}, nil
+}
+
+// SetLogger sets the logger read, accept and handshake errors go to. Call
+// it before Start.
+func (t *TCPTransport) SetLogger(logger log.Logger) {
+	t.logger = logger
+}
+
+func (t *TCPTransport) NodeID() string {
+	return t.nodeID
+}
+
+func (t *TCPTransport) Consume() <-chan RPC {
+	return t.rpcCh
+}
+
+func (t *TCPTransport) Events() <-chan PeerEvent {
+	return t.eventCh
+}
+
+// Connect dials the listen address of the given transport.
+func (t *TCPTransport) Connect(tr Transport) error {
+	return t.Dial(tr.Addr().String())
+}
+
+func (t *TCPTransport) Dial(addr string) error {
+	peer, err := dialTCPPeer(addr, t.tlsConfig)
+	if err != nil {
+		return err
+	}
+	t.addPeer(peer)
+
+	return nil
+}
+
+func (t *TCPTransport) SendMessage(to net.Addr, payload []byte) error {
+	t.lock.RLock()
+	peer, ok := t.peers[to]
+	t.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: could not send msg to %s", t.Addr(), to)
+	}
+
+	return peer.Send(payload)
+}
+
+func (t *TCPTransport) Broadcast(payload []byte) error {
+	t.lock.RLock()
+	peers := make([]*TCPPeer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.lock.RUnlock()
+
+	for _, peer := range peers {
+		if err := peer.Send(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Addr returns the address we listen on. Before Start it is the configured
+// listen address.
+func (t *TCPTransport) Addr() net.Addr {
+	if t.listener != nil {
+		return t.listener.Addr()
+	}
+	return NetAddr(t.listenAddr)
+}
+
+// addPeer registers the peer and announces it before reading from it, so
+// the consumer always knows a peer before its first message.
+func (t *TCPTransport) addPeer(peer *TCPPeer) {
+	t.lock.Lock()
+	select {
+	case <-t.quitCh:
+		t.lock.Unlock()
+		peer.Close()
+		return
+	default:
+	}
+	t.peers[peer.Addr()] = peer
+	t.wg.Add(1)
+	t.lock.Unlock()
+
+	if !t.emit(PeerEvent{Peer: peer, Connected: true}) {
+		peer.Close()
+		t.wg.Done()
+		return
+	}
+
+	go func() {
+		defer t.wg.Done()
+
+		peer.readLoop(t.rpcCh, t.quitCh, t.logger)
+
+		t.lock.Lock()
+		delete(t.peers, peer.Addr())
+		t.lock.Unlock()
+		peer.Close()
+
+		t.emit(PeerEvent{Peer: peer, Connected: false})
+	}()
+}
+
+// emit hands ev to the consumer. It returns false if the transport was
+// closed in the meantime.
+func (t *TCPTransport) emit(ev PeerEvent) bool {
+	select {
+	case t.eventCh <- ev:
+		return true
+	case <-t.quitCh:
+		return false
 	}
 }
 
 func (t *TCPTransport) acceptLoop() {
+	defer t.wg.Done()
+
 	for {
 		conn, err := t.listener.Accept()
 		if err != nil {
-			fmt.Printf("accept error from %+v\n", conn)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			t.logger.Log("msg", "accept error", "err", err)
 			continue
 		}
 
-		peer := &TCPPeer{
-			conn: conn,
-		}
-
-		t.peerCh <- peer
+		go func() {
+			peer, err := handshake(conn, t.tlsConfig, false)
+			if err != nil {
+				t.logger.Log("msg", "handshake failed", "addr", conn.RemoteAddr(), "err", err)
+				return
+			}
+			t.addPeer(peer)
+		}()
 	}
 }
 
@@ -76,8 +397,32 @@ func (t *TCPTransport) Start() error {
 
 	t.listener = ln
 
+	t.wg.Add(1)
 	go t.acceptLoop()
 
-
 	return nil
 }
+
+// Close closes the listener and all peer connections and waits until the
+// accept loop and the read loops are done.
+func (t *TCPTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		close(t.quitCh)
+		peers := make([]*TCPPeer, 0, len(t.peers))
+		for _, peer := range t.peers {
+			peers = append(peers, peer)
+		}
+		t.lock.Unlock()
+
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+		for _, peer := range peers {
+			peer.Close()
+		}
+		t.wg.Wait()
+	})
+	return err
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/LeiZhou-97/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTCPTransport(t *testing.T) *TCPTransport {
+	tr, err := NewTCPTransport(freeAddr(t), crypto.GeneratePrivateKey())
+	assert.Nil(t, err)
+	assert.Nil(t, tr.Start())
+	return tr
+}
+
+func nextPeerEvent(t *testing.T, tr Transport) PeerEvent {
+	select {
+	case ev := <-tr.Events():
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no peer event")
+	}
+	return PeerEvent{}
+}
+
+func TestTCPTransportConnect(t *testing.T) {
+	tra := startTCPTransport(t)
+	trb := startTCPTransport(t)
+
+	assert.Nil(t, tra.Connect(trb))
+
+	eva := nextPeerEvent(t, tra)
+	assert.True(t, eva.Connected)
+	assert.True(t, eva.Peer.Outgoing())
+	assert.Equal(t, trb.Addr().String(), eva.Peer.DialAddr())
+	assert.Equal(t, trb.NodeID(), eva.Peer.NodeID())
+
+	evb := nextPeerEvent(t, trb)
+	assert.True(t, evb.Connected)
+	assert.False(t, evb.Peer.Outgoing())
+	assert.Equal(t, tra.NodeID(), evb.Peer.NodeID())
+
+	msg := []byte("hello world")
+	assert.Nil(t, tra.SendMessage(eva.Peer.Addr(), msg))
+
+	rpc := <-trb.Consume()
+	b, err := io.ReadAll(rpc.Payload)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, b)
+	assert.Equal(t, evb.Peer.Addr(), rpc.From)
+
+	assert.Nil(t, eva.Peer.Close())
+	assert.False(t, nextPeerEvent(t, tra).Connected)
+	assert.False(t, nextPeerEvent(t, trb).Connected)
+}
+
+func TestTCPTransportBroadcast(t *testing.T) {
+	tra := startTCPTransport(t)
+	trb := startTCPTransport(t)
+	trc := startTCPTransport(t)
+
+	assert.Nil(t, tra.Connect(trb))
+	assert.Nil(t, tra.Connect(trc))
+	nextPeerEvent(t, trb)
+	nextPeerEvent(t, trc)
+
+	msg := []byte("foo")
+	assert.Nil(t, tra.Broadcast(msg))
+
+	for _, tr := range []*TCPTransport{trb, trc} {
+		rpc := <-tr.Consume()
+		b, err := io.ReadAll(rpc.Payload)
+		assert.Nil(t, err)
+		assert.Equal(t, msg, b)
+	}
+}
+
+func TestTCPTransportRejectsPlaintext(t *testing.T) {
+	tr := startTCPTransport(t)
+
+	conn, err := net.Dial("tcp", tr.Addr().String())
+	assert.Nil(t, err)
+	assert.Nil(t, NewTCPPeer(conn, true).Send([]byte("hello world")))
+
+	// the handshake fails and the connection is closed.
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	select {
+	case ev := <-tr.Events():
+		t.Fatalf("unexpected peer event %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
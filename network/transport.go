@@ -4,11 +4,45 @@ import "net"
 
 type NetAddr string
 
+func (a NetAddr) Network() string {
+	return "local"
+}
+
+func (a NetAddr) String() string {
+	return string(a)
+}
+
+// Peer is a connection to another node.
+type Peer interface {
+	Send([]byte) error
+	Close() error
+	// Addr is the address the messages of this peer arrive from.
+	Addr() net.Addr
+	Outgoing() bool
+	// DialAddr is the address an outgoing peer was dialed with.
+	DialAddr() string
+	// NodeID identifies the node behind the connection. Bans and scores
+	// stick to it.
+	NodeID() string
+}
+
+// PeerEvent tells the consumer of a transport that a peer connected or
+// disconnected. A peer is always announced before its first message.
+type PeerEvent struct {
+	Peer      Peer
+	Connected bool
+}
 
 type Transport interface {
+	Start() error
 	Consume() <-chan RPC
+	Events() <-chan PeerEvent
 	Connect(Transport) error
+	Dial(string) error
 	SendMessage(net.Addr, []byte) error
 	Broadcast([]byte) error
 	Addr() net.Addr
+	NodeID() string
+	// Close stops accepting peers and disconnects the connected ones.
+	Close() error
 }
@@ -1,57 +1,642 @@
 package network
 
 import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"os"
+	"sort"
 	"sync"
 
 	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/types"
 )
 
+// NonceReader tells the pool the nonce the next transaction of a sender
+// needs on the chain, core.BlockChain implements it.
+type NonceReader interface {
+	Nonce(from crypto.PublicKey) uint64
+}
+
+// The reasons the pool refuses a transaction. None of them makes the
+// sender of the transaction misbehave, a peer may simply have seen the
+// transactions in another order.
+var (
+	// ErrNonceTooLow is returned for a transaction whose nonce the chain
+	// has a transaction of the sender for already.
+	ErrNonceTooLow = errors.New("nonce too low")
+	// ErrReplaceUnderpriced is returned for a transaction with the sender
+	// and nonce of one in the pool that does not pay enough more to
+	// replace it.
+	ErrReplaceUnderpriced = errors.New("replacement transaction underpriced")
+	// ErrSenderLimit is returned for a transaction whose sender has as
+	// many pending or queued transactions in the pool as it may.
+	ErrSenderLimit = errors.New("too many transactions of the sender")
+	// ErrTxPoolFull is returned for a transaction that pays too little to
+	// push another one out of a full pool.
+	ErrTxPoolFull = errors.New("transaction pool is full")
+)
+
+var (
+	// maxSenderPending is the most pending transactions the pool keeps of
+	// a sender.
+	maxSenderPending = 64
+	// maxSenderQueued is the most queued transactions the pool keeps of a
+	// sender.
+	maxSenderQueued = 32
+	// replaceFeeBump is how many percent more fee per gas a transaction
+	// has to pay to replace the one with its sender and nonce.
+	replaceFeeBump uint64 = 10
+)
+
+// TxPool keeps the transactions no block included yet. Those that follow
+// the nonce the chain expects of their sender without a gap are pending,
+// a block can take them. Those with a later nonce are queued until the
+// transactions before them arrive.
 type TxPool struct {
-	all *TxSortedMap
-	pending *TxSortedMap
-	// The maxLength of the total pool of transactions.
-	// When the pool is full we will prune the oldest transaction.
+	// maxLength is the most pending and queued transactions the pool
+	// keeps. A full pool evicts the transaction that pays the least fee
+	// per gas, queued ones first.
 	maxLength int
+
+	lock sync.RWMutex
+	// pending and queued hold the transactions by sender and nonce.
+	pending map[string]map[uint64]*poolTx
+	queued  map[string]map[uint64]*poolTx
+	byHash  map[types.Hash]*poolTx
+	// chain is nil if the pool was not given one, every sender then
+	// starts at nonce 0.
+	chain NonceReader
+	// seq counts the transactions added to the pool.
+	seq uint64
+}
+
+// poolTx is a transaction of the pool and what the pool orders it by.
+type poolTx struct {
+	tx *core.Transaction
+	// seq orders transactions with the same fee per gas by arrival.
+	seq  uint64
+	size int
 }
 
-func NewTxPool(maxLength int) *TxPool {
+func NewTxPool(maxLength int, chain NonceReader) *TxPool {
 	return &TxPool{
-		all:       NewTxSortedMap(),
-		pending:   NewTxSortedMap(),
 		maxLength: maxLength,
+		pending:   make(map[string]map[uint64]*poolTx),
+		queued:    make(map[string]map[uint64]*poolTx),
+		byHash:    make(map[types.Hash]*poolTx),
+		chain:     chain,
+	}
+}
+
+// Add adds tx to the pool. A transaction with the sender and nonce of one
+// in the pool replaces it if it pays replaceFeeBump percent more fee per
+// gas. Adding a transaction the pool has already does nothing.
+func (p *TxPool) Add(tx *core.Transaction) error {
+	size := 0
+	if data, err := core.MarshalBinary(tx); err == nil {
+		size = len(data)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if _, ok := p.byHash[tx.Hash(core.TxHasher{})]; ok {
+		return nil
+	}
+	if err := p.addLocked(tx, size); err != nil {
+		return err
+	}
+	for len(p.byHash) > p.maxLength {
+		victim := p.evictionLocked()
+		p.removeLocked(victim.tx)
+		if victim.tx == tx {
+			return fmt.Errorf("%w: transaction (%s) pays the least fee per gas", ErrTxPoolFull, tx.Hash(core.TxHasher{}))
+		}
+	}
+	return nil
+}
+
+// addLocked adds tx to the pending or queued transactions of its sender
+// and promotes the queued ones it closes the gap for. p.lock must be held.
+func (p *TxPool) addLocked(tx *core.Transaction, size int) error {
+	from := string(tx.From)
+	nonce := p.nonce(tx.From)
+	if tx.Nonce < nonce {
+		return fmt.Errorf("%w: transaction (%s) with nonce (%d), the chain is at (%d)", ErrNonceTooLow, tx.Hash(core.TxHasher{}), tx.Nonce, nonce)
+	}
+	if p.staleLocked(from, nonce) {
+		p.resetSenderLocked(from, nonce)
+	}
+
+	p.seq++
+	ptx := &poolTx{tx: tx, seq: p.seq, size: size}
+	for _, txs := range []map[uint64]*poolTx{p.pending[from], p.queued[from]} {
+		old, ok := txs[tx.Nonce]
+		if !ok {
+			continue
+		}
+		if !replaces(tx, old.tx) {
+			return fmt.Errorf("%w: transaction (%s) for (%s) needs %d%% more fee per gas", ErrReplaceUnderpriced, tx.Hash(core.TxHasher{}), old.tx.Hash(core.TxHasher{}), replaceFeeBump)
+		}
+		delete(p.byHash, old.tx.Hash(core.TxHasher{}))
+		txs[tx.Nonce] = ptx
+		p.byHash[tx.Hash(core.TxHasher{})] = ptx
+		return nil
+	}
+
+	next := nonce + uint64(len(p.pending[from]))
+	if tx.Nonce == next && len(p.pending[from]) >= maxSenderPending {
+		return fmt.Errorf("%w: (%d) pending", ErrSenderLimit, len(p.pending[from]))
+	}
+	if tx.Nonce > next && len(p.queued[from]) >= maxSenderQueued {
+		return fmt.Errorf("%w: (%d) queued", ErrSenderLimit, len(p.queued[from]))
+	}
+	p.byHash[tx.Hash(core.TxHasher{})] = ptx
+	if tx.Nonce > next {
+		if _, ok := p.queued[from]; !ok {
+			p.queued[from] = make(map[uint64]*poolTx)
+		}
+		p.queued[from][tx.Nonce] = ptx
+		return nil
+	}
+
+	// tx closes the gap before the queued transactions that follow it.
+	pending, ok := p.pending[from]
+	if !ok {
+		pending = make(map[uint64]*poolTx)
+		p.pending[from] = pending
+	}
+	pending[next] = ptx
+	queued := p.queued[from]
+	for n := next + 1; len(pending) < maxSenderPending; n++ {
+		qtx, ok := queued[n]
+		if !ok {
+			break
+		}
+		pending[n] = qtx
+		delete(queued, n)
+	}
+	if len(queued) == 0 {
+		delete(p.queued, from)
+	}
+	return nil
+}
+
+// staleLocked reports whether the pending transactions of from no longer
+// start at nonce or a queued one does, the chain moved on since they were
+// split. p.lock must be held.
+func (p *TxPool) staleLocked(from string, nonce uint64) bool {
+	pending := p.pending[from]
+	if len(pending) == 0 {
+		_, ok := p.queued[from][nonce]
+		return ok
 	}
+	_, first := pending[nonce]
+	_, before := pending[nonce-1]
+	return !first || before
 }
 
-// add adds an transaction to pool, the caller is responsible checking if the 
-// tx already exist
-func (p *TxPool) Add(tx *core.Transaction) {
-	// prune the oldest transaction that is sitting in the all pool
-	if p.all.Count() == p.maxLength {
-		oldest := p.all.First()
-		p.all.Remove(oldest.Hash(core.TxHasher{}))
+// evictionLocked returns the transaction a full pool evicts: the queued
+// one that pays the least fee per gas or, without queued ones, the last
+// pending one of a sender that does, so no gap opens. Of equal fees the
+// later to arrive goes. p.lock must be held.
+func (p *TxPool) evictionLocked() *poolTx {
+	var victim *poolTx
+	consider := func(ptx *poolTx) {
+		if victim == nil {
+			victim = ptx
+			return
+		}
+		if c := compareFeePerGas(ptx.tx, victim.tx); c < 0 || c == 0 && ptx.seq > victim.seq {
+			victim = ptx
+		}
 	}
 
-	if !p.all.Contains(tx.Hash(core.TxHasher{})) {
-		p.all.Add(tx)
-		p.pending.Add(tx)
+	for _, byNonce := range p.queued {
+		for _, ptx := range byNonce {
+			consider(ptx)
+		}
 	}
+	if victim != nil {
+		return victim
+	}
+	for _, byNonce := range p.pending {
+		var last *poolTx
+		for _, ptx := range byNonce {
+			if last == nil || ptx.tx.Nonce > last.tx.Nonce {
+				last = ptx
+			}
+		}
+		consider(last)
+	}
+	return victim
+}
+
+// replaces reports whether tx pays enough more fee per gas than old to
+// replace it.
+func replaces(tx, old *core.Transaction) bool {
+	if compareFeePerGas(tx, old) <= 0 {
+		return false
+	}
+	// tx.Fee / tx.Gas() >= old.Fee / old.Gas() * (100 + replaceFeeBump) / 100
+	have := new(big.Int).SetUint64(tx.Fee)
+	have.Mul(have, new(big.Int).SetUint64(old.Gas()))
+	have.Mul(have, big.NewInt(100))
+	need := new(big.Int).SetUint64(old.Fee)
+	need.Mul(need, new(big.Int).SetUint64(tx.Gas()))
+	need.Mul(need, new(big.Int).SetUint64(100+replaceFeeBump))
+	return have.Cmp(need) >= 0
+}
+
+// Update drops the transactions the chain has the nonces of and promotes
+// the queued transactions that follow the pending ones now. Call it after
+// the chain grew, the chain may have included transactions the pool never
+// saw.
+func (p *TxPool) Update() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.updateLocked()
+}
+
+// updateLocked updates every sender and returns the pending transactions
+// of each by nonce. p.lock must be held.
+func (p *TxPool) updateLocked() [][]*poolTx {
+	senders := make(map[string]struct{}, len(p.pending)+len(p.queued))
+	for from := range p.pending {
+		senders[from] = struct{}{}
+	}
+	for from := range p.queued {
+		senders[from] = struct{}{}
+	}
+	pending := make([][]*poolTx, 0, len(senders))
+	for from := range senders {
+		if txx := p.resetSenderLocked(from, p.nonce(crypto.PublicKey(from))); len(txx) > 0 {
+			pending = append(pending, txx)
+		}
+	}
+	return pending
+}
+
+// resetSenderLocked splits the transactions of from again given the nonce
+// the chain expects of it: those below are dropped, those that follow it
+// without a gap are pending up to maxSenderPending, the others are
+// queued. It returns the pending ones by nonce. p.lock must be held.
+func (p *TxPool) resetSenderLocked(from string, nonce uint64) []*poolTx {
+	txs := make(map[uint64]*poolTx, len(p.pending[from])+len(p.queued[from]))
+	for _, byNonce := range []map[uint64]*poolTx{p.pending[from], p.queued[from]} {
+		for n, ptx := range byNonce {
+			if n < nonce {
+				delete(p.byHash, ptx.tx.Hash(core.TxHasher{}))
+				continue
+			}
+			txs[n] = ptx
+		}
+	}
+
+	txx := []*poolTx{}
+	pending := make(map[uint64]*poolTx)
+	for ptx, ok := txs[nonce]; ok && len(txx) < maxSenderPending; ptx, ok = txs[nonce] {
+		txx = append(txx, ptx)
+		pending[nonce] = ptx
+		delete(txs, nonce)
+		nonce++
+	}
+	if len(pending) > 0 {
+		p.pending[from] = pending
+	} else {
+		delete(p.pending, from)
+	}
+	if len(txs) > 0 {
+		p.queued[from] = txs
+	} else {
+		delete(p.queued, from)
+	}
+	return txx
 }
 
+// Contains reports whether the transaction with the given hash is pending
+// or queued.
 func (p *TxPool) Contains(hash types.Hash) bool {
-	return p.all.Contains(hash)
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	_, ok := p.byHash[hash]
+	return ok
 }
 
-// Pending returns a slice of transactions that are in the pending pool
+// Get returns the pending or queued transaction with the given hash or
+// nil if it is not in the pool.
+func (p *TxPool) Get(hash types.Hash) *core.Transaction {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if ptx, ok := p.byHash[hash]; ok {
+		return ptx.tx
+	}
+	return nil
+}
+
+// Pending returns the pending transactions in the order blocks take them:
+// the highest fee per gas first, the transactions of a sender by nonce.
 func (p *TxPool) Pending() []*core.Transaction {
-	return p.pending.txx.Data
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	cursors := []*txCursor{}
+	for _, byNonce := range p.pending {
+		cursors = append(cursors, &txCursor{txx: sortedByNonce(byNonce)})
+	}
+	return byPriceAndNonce(cursors, func(*poolTx) bool { return true })
+}
+
+// Queued returns the queued transactions, those of a sender by nonce.
+func (p *TxPool) Queued() []*core.Transaction {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	txx := []*core.Transaction{}
+	for _, byNonce := range p.queued {
+		for _, ptx := range sortedByNonce(byNonce) {
+			txx = append(txx, ptx.tx)
+		}
+	}
+	return txx
+}
+
+// All returns the transactions of the pool: the pending ones in the order
+// of Pending, then the queued ones.
+func (p *TxPool) All() []*core.Transaction {
+	return append(p.Pending(), p.Queued()...)
+}
+
+// Save writes the pending and queued transactions to path, so they
+// survive a restart.
+func (p *TxPool) Save(path string) error {
+	p.lock.RLock()
+	pending := make([]*poolTx, 0, len(p.byHash))
+	for _, ptx := range p.byHash {
+		pending = append(pending, ptx)
+	}
+	p.lock.RUnlock()
+
+	// in the order they arrived, which decides between equal fees.
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+	file := &mempoolFile{Transactions: make([]*core.Transaction, len(pending))}
+	for i, ptx := range pending {
+		file.Transactions[i] = ptx.tx
+	}
+
+	b, err := core.MarshalBinary(file)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0o644)
+}
+
+// Load adds the transactions saved at path to the pool and returns how many
+// it added. Transactions that do not verify or the pool refuses are
+// skipped.
+func (p *TxPool) Load(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	file := new(mempoolFile)
+	if err := core.UnmarshalBinary(b, file); err != nil {
+		return 0, fmt.Errorf("could not decode %s: %w", path, err)
+	}
+
+	added := 0
+	for _, tx := range file.Transactions {
+		if tx.Verify() != nil || p.Contains(tx.Hash(core.TxHasher{})) {
+			continue
+		}
+		if p.Add(tx) == nil {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// mempoolFile is what Save writes, the transactions of the pool in the
+// binary encoding with its version byte.
+type mempoolFile struct {
+	Transactions []*core.Transaction
+}
+
+func (f *mempoolFile) EncodeBinary(w *core.BinaryWriter) {
+	w.WriteLen(len(f.Transactions))
+	for _, tx := range f.Transactions {
+		tx.EncodeBinary(w)
+	}
+}
+
+func (f *mempoolFile) DecodeBinary(r *core.BinaryReader) {
+	f.Transactions = nil
+	for n := r.ReadLen(); n > 0 && r.Err() == nil; n-- {
+		tx := new(core.Transaction)
+		tx.DecodeBinary(r)
+		f.Transactions = append(f.Transactions, tx)
+	}
+}
+
+// blockSizeReserve is the part of a block's size limit we keep free of
+// transactions for its header, evidence, signature and commit.
+var blockSizeReserve = 64 << 10
+
+// BlockTransactions returns the pending transactions that pay the most fee
+// per gas and fit into a block within the count, gas and size limits of
+// the chain. The transactions of a sender follow each other by nonce from
+// the nonce the chain expects. The pool is updated to the chain first.
+func (p *TxPool) BlockTransactions() []*core.Transaction {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cursors := []*txCursor{}
+	for _, txx := range p.updateLocked() {
+		cursors = append(cursors, &txCursor{txx: txx})
+	}
+
+	var (
+		count = 0
+		gas   = uint64(0)
+		size  = 0
+	)
+	return byPriceAndNonce(cursors, func(ptx *poolTx) bool {
+		if count == core.MaxBlockTransactions || gas+ptx.tx.Gas() > core.MaxBlockGas || size+ptx.size > core.MaxBlockSize-blockSizeReserve {
+			return false
+		}
+		count++
+		gas += ptx.tx.Gas()
+		size += ptx.size
+		return true
+	})
+}
+
+// RemovePending removes txx from the pool, e.g. after a block included
+// them.
+func (p *TxPool) RemovePending(txx []*core.Transaction) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, tx := range txx {
+		p.removeLocked(tx)
+	}
+}
+
+// removeLocked removes tx from the pending or queued transactions. p.lock
+// must be held.
+func (p *TxPool) removeLocked(tx *core.Transaction) {
+	hash := tx.Hash(core.TxHasher{})
+	ptx, ok := p.byHash[hash]
+	if !ok {
+		return
+	}
+	delete(p.byHash, hash)
+	for _, txs := range []map[string]map[uint64]*poolTx{p.pending, p.queued} {
+		byNonce := txs[string(tx.From)]
+		if byNonce[tx.Nonce] == ptx {
+			delete(byNonce, tx.Nonce)
+		}
+		if len(byNonce) == 0 {
+			delete(txs, string(tx.From))
+		}
+	}
 }
 
 func (p *TxPool) ClearPending() {
-	p.pending.Clear()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending = make(map[string]map[uint64]*poolTx)
+	p.queued = make(map[string]map[uint64]*poolTx)
+	p.byHash = make(map[types.Hash]*poolTx)
 }
+
+// PendingCount returns the number of pending transactions.
 func (p *TxPool) PendingCount() int {
-	return p.pending.Count()
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	n := 0
+	for _, byNonce := range p.pending {
+		n += len(byNonce)
+	}
+	return n
+}
+
+// QueuedCount returns the number of queued transactions.
+func (p *TxPool) QueuedCount() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	n := 0
+	for _, byNonce := range p.queued {
+		n += len(byNonce)
+	}
+	return n
+}
+
+func (p *TxPool) nonce(from crypto.PublicKey) uint64 {
+	if p.chain == nil {
+		return 0
+	}
+	return p.chain.Nonce(from)
+}
+
+// sortedByNonce returns the transactions of byNonce by nonce.
+func sortedByNonce(byNonce map[uint64]*poolTx) []*poolTx {
+	txx := make([]*poolTx, 0, len(byNonce))
+	for _, ptx := range byNonce {
+		txx = append(txx, ptx)
+	}
+	sort.Slice(txx, func(i, j int) bool { return txx[i].tx.Nonce < txx[j].tx.Nonce })
+	return txx
+}
+
+// txCursor walks the transactions of a sender in nonce order.
+type txCursor struct {
+	txx  []*poolTx
+	next int
+}
+
+// txHeap orders the senders by the fee per gas of their next transaction.
+type txHeap []*txCursor
+
+func (h txHeap) Len() int { return len(h) }
+
+func (h txHeap) Less(i, j int) bool {
+	a, b := h[i].txx[h[i].next], h[j].txx[h[j].next]
+	if c := compareFeePerGas(a.tx, b.tx); c != 0 {
+		return c > 0
+	}
+	return a.seq < b.seq
+}
+
+func (h txHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *txHeap) Push(x any) { *h = append(*h, x.(*txCursor)) }
+
+func (h *txHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// byPriceAndNonce merges the transactions of the cursors, always taking
+// the next transaction with the highest fee per gas. take decides whether
+// a transaction goes in, if not the later ones of its sender do not
+// either, they need its nonce.
+func byPriceAndNonce(cursors []*txCursor, take func(*poolTx) bool) []*core.Transaction {
+	h := txHeap(cursors)
+	heap.Init(&h)
+
+	txx := []*core.Transaction{}
+	for h.Len() > 0 {
+		c := h[0]
+		ptx := c.txx[c.next]
+		if !take(ptx) {
+			heap.Pop(&h)
+			continue
+		}
+		txx = append(txx, ptx.tx)
+		c.next++
+		if c.next == len(c.txx) {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return txx
+}
+
+// compareFeePerGas returns 1 if a pays more fee per gas than b, -1 if it
+// pays less and 0 if they pay the same.
+func compareFeePerGas(a, b *core.Transaction) int {
+	// a.Fee / a.Gas() against b.Fee / b.Gas() without rounding.
+	ahi, alo := bits.Mul64(a.Fee, b.Gas())
+	bhi, blo := bits.Mul64(b.Fee, a.Gas())
+	switch {
+	case ahi != bhi:
+		if ahi > bhi {
+			return 1
+		}
+		return -1
+	case alo != blo:
+		if alo > blo {
+			return 1
+		}
+		return -1
+	}
+	return 0
 }
 
 
@@ -1,58 +1,69 @@
 package network
 
 import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/LeiZhou-97/blockchain/core"
+	"github.com/LeiZhou-97/blockchain/crypto"
 	"github.com/LeiZhou-97/blockchain/util"
 	"github.com/stretchr/testify/assert"
 )
 
 
 func TestTxMaxLength(t *testing.T) {
-	p := NewTxPool(1)
-	p.Add(util.NewRandomTransaction(10))
-	assert.Equal(t, 1, p.all.Count())
-	p.Add(util.NewRandomTransaction(10))
-	p.Add(util.NewRandomTransaction(10))
-	p.Add(util.NewRandomTransaction(10))
-	tx := util.NewRandomTransaction(100)
-	p.Add(tx)
-	assert.Equal(t, 1, p.all.Count())
+	p := NewTxPool(1, nil)
+	first := feeTx(t, crypto.GeneratePrivateKey(), 0, 10)
+	assert.Nil(t, p.Add(first))
+	assert.Equal(t, 1, p.PendingCount())
+
+	// a transaction that pays no more does not push it out.
+	assert.True(t, errors.Is(p.Add(feeTx(t, crypto.GeneratePrivateKey(), 0, 10)), ErrTxPoolFull))
+	tx := feeTx(t, crypto.GeneratePrivateKey(), 0, 11)
+	assert.Nil(t, p.Add(tx))
+	assert.Equal(t, 1, p.PendingCount())
 	assert.True(t, p.Contains(tx.Hash(core.TxHasher{})))
+	assert.False(t, p.Contains(first.Hash(core.TxHasher{})))
 }
 
 func TestTxPoolAdd(t *testing.T) {
-	p := NewTxPool(11)
+	p := NewTxPool(11, nil)
 	n := 10
 
 	for i := 1; i <= n; i++ {
 		tx := util.NewRandomTransaction(100)
-		p.Add(tx)
+		tx.Nonce = uint64(i - 1)
+		assert.Nil(t, p.Add(tx))
 		// cannot add twice
-		p.Add(tx)
+		assert.Nil(t, p.Add(tx))
 
 		assert.Equal(t, i, p.PendingCount())
-		assert.Equal(t, i, p.pending.Count())
-		assert.Equal(t, i, p.all.Count())
+		assert.Equal(t, i, len(p.byHash))
+		assert.Equal(t, i, len(p.All()))
 	}
 }
 
 func TestTxPoolMaxLength(t *testing.T) {
 	maxLen := 10
-	p := NewTxPool(maxLen)
+	p := NewTxPool(maxLen, nil)
 	n := 100
 	txx := []*core.Transaction{}
 
 	for i := 0; i < n; i++ {
 		tx := util.NewRandomTransaction(100)
+		tx.From = crypto.GeneratePrivateKey().PublicKey()
+		tx.Fee = uint64(i)
 		p.Add(tx)
 		if i > n-(maxLen+1) {
 			txx = append(txx, tx)
 		}
 	}
 
-	assert.Equal(t, p.all.Count(), maxLen)
+	// the ones that pay the most stay.
+	assert.Equal(t, p.PendingCount(), maxLen)
 	assert.Equal(t, len(txx), maxLen)
 
 	for _, tx := range txx {
@@ -96,3 +107,273 @@ func TestTxSortedMapRemove(t *testing.T) {
 	assert.Equal(t, m.Count(), 0)
 	assert.False(t, m.Contains(tx.Hash(core.TxHasher{})))
 }
+
+func TestTxPoolSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+
+	p := NewTxPool(10, nil)
+	tx := util.NewRandomTransactionWithSignature(t, crypto.GeneratePrivateKey(), 10)
+	p.Add(tx)
+	// transactions that do not verify are not loaded again.
+	p.Add(util.NewRandomTransaction(10))
+	assert.Nil(t, p.Save(path))
+
+	p = NewTxPool(10, nil)
+	n, err := p.Load(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, p.Contains(tx.Hash(core.TxHasher{})))
+
+	// a missing file is an empty pool.
+	n, err = NewTxPool(10, nil).Load(filepath.Join(t.TempDir(), "mempool.dat"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// a file of another codec version is refused, not misread.
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, core.CodecVersion, b[0])
+	b[0] = core.CodecVersion + 1
+	assert.Nil(t, os.WriteFile(path, b, 0o644))
+	_, err = NewTxPool(10, nil).Load(path)
+	assert.True(t, errors.Is(err, core.ErrUnknownCodecVersion))
+}
+
+func TestTxPoolBlockTransactions(t *testing.T) {
+	chain := nonceMap{}
+	p := NewTxPool(10, chain)
+	key := crypto.GeneratePrivateKey()
+	txx := []*core.Transaction{}
+	for i := 0; i < 4; i++ {
+		tx := util.NewRandomTransaction(100)
+		tx.Nonce = uint64(i)
+		assert.Nil(t, tx.Sign(key))
+		txx = append(txx, tx)
+		p.Add(tx)
+	}
+
+	defer func(n int) { core.MaxBlockTransactions = n }(core.MaxBlockTransactions)
+	core.MaxBlockTransactions = 3
+	assert.Equal(t, txx[:3], p.BlockTransactions())
+
+	// the block is full after two of them.
+	data, err := core.MarshalBinary(txx[0])
+	assert.Nil(t, err)
+	defer func(n int) { core.MaxBlockSize = n }(core.MaxBlockSize)
+	core.MaxBlockSize = blockSizeReserve + 2*len(data) + 1
+	assert.Equal(t, txx[:2], p.BlockTransactions())
+	core.MaxBlockSize = 1 << 20
+
+	defer func(n uint64) { core.MaxBlockGas = n }(core.MaxBlockGas)
+	core.MaxBlockGas = 3*txx[0].Gas() - 1
+	assert.Equal(t, txx[:2], p.BlockTransactions())
+
+	// a block included the first two.
+	p.RemovePending(txx[:2])
+	chain[string(key.PublicKey())] = 2
+	assert.Equal(t, txx[2:], p.BlockTransactions())
+	assert.False(t, p.Contains(txx[0].Hash(core.TxHasher{})))
+}
+
+// nonceMap is a chain that has the nonces of the map.
+type nonceMap map[string]uint64
+
+func (m nonceMap) Nonce(from crypto.PublicKey) uint64 {
+	return m[string(from)]
+}
+
+// feeTx returns a transaction of key with nonce that pays fee.
+func feeTx(t *testing.T, key crypto.PrivateKey, nonce, fee uint64) *core.Transaction {
+	tx := util.NewRandomTransaction(100)
+	tx.Nonce = nonce
+	tx.Fee = fee
+	assert.Nil(t, tx.Sign(key))
+	return tx
+}
+
+func TestTxPoolFeePriority(t *testing.T) {
+	a, b, c := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	chain := nonceMap{}
+	p := NewTxPool(10, chain)
+
+	a0, a1 := feeTx(t, a, 0, 10), feeTx(t, a, 1, 500)
+	b0, b1 := feeTx(t, b, 0, 100), feeTx(t, b, 1, 50)
+	c0 := feeTx(t, c, 0, 100)
+	for _, tx := range []*core.Transaction{a1, a0, b0, b1, c0} {
+		p.Add(tx)
+	}
+
+	// a1 pays the most but has to wait for a0. Of equal fees the first
+	// to arrive goes first.
+	assert.Equal(t, []*core.Transaction{b0, c0, b1, a0, a1}, p.Pending())
+	assert.Equal(t, p.Pending(), p.All())
+	assert.Equal(t, []*core.Transaction{b0, c0, b1, a0, a1}, p.BlockTransactions())
+
+	// only the transactions that follow the nonce of the chain.
+	chain[string(a.PublicKey())] = 1
+	chain[string(b.PublicKey())] = 2
+	c2 := feeTx(t, c, 2, 1000)
+	p.Add(c2)
+	assert.Equal(t, []*core.Transaction{a1, c0}, p.BlockTransactions())
+	assert.Equal(t, 2, p.PendingCount())
+	assert.Equal(t, 1, p.QueuedCount())
+	assert.Equal(t, []*core.Transaction{a1, c0, c2}, p.All())
+	assert.Nil(t, p.Get(a0.Hash(core.TxHasher{})))
+	assert.Equal(t, c2, p.Get(c2.Hash(core.TxHasher{})))
+
+	// an old nonce is not added.
+	assert.True(t, errors.Is(p.Add(feeTx(t, b, 1, 1000)), ErrNonceTooLow))
+	assert.Equal(t, 2, p.PendingCount())
+
+	// a big transaction pays per gas.
+	big := util.NewRandomTransaction(10000)
+	big.Fee = 1100
+	assert.Nil(t, big.Sign(crypto.GeneratePrivateKey()))
+	p.Add(big)
+	assert.Equal(t, []*core.Transaction{a1, c0, big}, p.BlockTransactions())
+}
+
+func TestTxPoolManyTransactions(t *testing.T) {
+	const (
+		senders = 2000
+		nonces  = 50
+	)
+	p := NewTxPool(senders*nonces, nil)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < senders; i++ {
+		// the pool does not check signatures.
+		from := crypto.GeneratePrivateKey().PublicKey()
+		for n := 0; n < nonces; n++ {
+			tx := core.NewTransaction([]byte{byte(i), byte(i >> 8), byte(n)})
+			tx.From = from
+			tx.Nonce = uint64(n)
+			tx.Fee = uint64(rng.Intn(10000))
+			p.Add(tx)
+		}
+	}
+	assert.Equal(t, senders*nonces, p.PendingCount())
+
+	// the gas limit fills the block first.
+	txx := p.BlockTransactions()
+	assert.Len(t, txx, int(core.MaxBlockGas/txx[0].Gas()))
+	next := make(map[string]uint64)
+	for _, tx := range txx {
+		assert.Equal(t, next[string(tx.From)], tx.Nonce)
+		next[string(tx.From)]++
+	}
+
+	p.RemovePending(txx)
+	assert.Equal(t, senders*nonces-len(txx), p.PendingCount())
+	assert.Len(t, p.Pending(), senders*nonces-len(txx))
+}
+
+func TestTxPoolReplaceByFee(t *testing.T) {
+	key := crypto.GeneratePrivateKey()
+	p := NewTxPool(10, nil)
+
+	tx0, tx1 := feeTx(t, key, 0, 100), feeTx(t, key, 1, 100)
+	assert.Nil(t, p.Add(tx0))
+	assert.Nil(t, p.Add(tx1))
+
+	// the same fee or a smaller bump does not replace.
+	assert.True(t, errors.Is(p.Add(feeTx(t, key, 0, 100)), ErrReplaceUnderpriced))
+	assert.True(t, errors.Is(p.Add(feeTx(t, key, 0, 109)), ErrReplaceUnderpriced))
+	assert.Equal(t, []*core.Transaction{tx0, tx1}, p.Pending())
+
+	bumped := feeTx(t, key, 0, 110)
+	assert.Nil(t, p.Add(bumped))
+	assert.Equal(t, []*core.Transaction{bumped, tx1}, p.BlockTransactions())
+	assert.Equal(t, bumped, p.Get(bumped.Hash(core.TxHasher{})))
+	assert.Equal(t, 2, p.PendingCount())
+
+	// the bump is per gas, more data needs more fee.
+	big := util.NewRandomTransaction(1000)
+	big.Nonce = 1
+	big.Fee = 110
+	assert.Nil(t, big.Sign(key))
+	assert.True(t, errors.Is(p.Add(big), ErrReplaceUnderpriced))
+
+	// queued transactions are replaced the same way.
+	tx3 := feeTx(t, key, 3, 0)
+	assert.Nil(t, p.Add(tx3))
+	assert.True(t, errors.Is(p.Add(feeTx(t, key, 3, 0)), ErrReplaceUnderpriced))
+	replaced := feeTx(t, key, 3, 1)
+	assert.Nil(t, p.Add(replaced))
+	assert.Equal(t, []*core.Transaction{replaced}, p.Queued())
+}
+
+func TestTxPoolQueued(t *testing.T) {
+	defer func(n int) { maxSenderPending = n }(maxSenderPending)
+	defer func(n int) { maxSenderQueued = n }(maxSenderQueued)
+	maxSenderPending = 3
+	maxSenderQueued = 2
+
+	key := crypto.GeneratePrivateKey()
+	chain := nonceMap{}
+	p := NewTxPool(20, chain)
+	txx := []*core.Transaction{}
+	for n := uint64(0); n < 6; n++ {
+		txx = append(txx, feeTx(t, key, n, 100))
+	}
+
+	// a gap at nonce 0 queues the others.
+	assert.Nil(t, p.Add(txx[1]))
+	assert.Nil(t, p.Add(txx[2]))
+	assert.True(t, errors.Is(p.Add(txx[4]), ErrSenderLimit))
+	assert.Empty(t, p.Pending())
+	assert.Empty(t, p.BlockTransactions())
+	assert.Equal(t, 2, p.QueuedCount())
+
+	// closing the gap promotes them.
+	assert.Nil(t, p.Add(txx[0]))
+	assert.Equal(t, txx[:3], p.Pending())
+	assert.Equal(t, 0, p.QueuedCount())
+	assert.True(t, errors.Is(p.Add(txx[3]), ErrSenderLimit))
+	assert.Nil(t, p.Add(txx[4]))
+	assert.Nil(t, p.Add(txx[5]))
+
+	// a block with the first two and a transaction at nonce 3 the pool
+	// never saw promotes the queued ones.
+	chain[string(key.PublicKey())] = 4
+	p.Update()
+	assert.Equal(t, txx[4:], p.Pending())
+	assert.Equal(t, 0, p.QueuedCount())
+	assert.Equal(t, 2, p.PendingCount())
+}
+
+func TestTxPoolEvictsQueuedFirst(t *testing.T) {
+	a, b, c, d := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+	p := NewTxPool(3, nil)
+	a0, a2 := feeTx(t, a, 0, 1), feeTx(t, a, 2, 100)
+	b0 := feeTx(t, b, 0, 50)
+	for _, tx := range []*core.Transaction{a0, a2, b0} {
+		assert.Nil(t, p.Add(tx))
+	}
+
+	// the queued transaction goes although it pays the most.
+	c0 := feeTx(t, c, 0, 60)
+	assert.Nil(t, p.Add(c0))
+	assert.Equal(t, []*core.Transaction{c0, b0, a0}, p.All())
+
+	// then the pending one that pays the least.
+	d0 := feeTx(t, d, 0, 70)
+	assert.Nil(t, p.Add(d0))
+	assert.Equal(t, []*core.Transaction{d0, c0, b0}, p.All())
+
+	// a replaced transaction is gone, re-adding it is refused.
+	b0r := feeTx(t, b, 0, 100)
+	assert.Nil(t, p.Add(b0r))
+	assert.False(t, p.Contains(b0.Hash(core.TxHasher{})))
+	assert.Nil(t, p.Get(b0.Hash(core.TxHasher{})))
+	assert.True(t, errors.Is(p.Add(b0), ErrReplaceUnderpriced))
+
+	// of a sender only the last pending transaction goes, no gap opens.
+	e := crypto.GeneratePrivateKey()
+	e0, e1, e2 := feeTx(t, e, 0, 80), feeTx(t, e, 1, 75), feeTx(t, e, 2, 1000)
+	for _, tx := range []*core.Transaction{e0, e1, e2} {
+		assert.Nil(t, p.Add(tx))
+	}
+	assert.Equal(t, []*core.Transaction{e0, e1, e2}, p.All())
+	assert.True(t, errors.Is(p.Add(feeTx(t, crypto.GeneratePrivateKey(), 0, 90)), ErrTxPoolFull))
+	assert.Equal(t, 3, p.PendingCount())
+}